@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-proxy/proxy"
+)
+
+// runReplay serves the exchanges of a record file as a stub of the servers:
+//
+//	go-proxy replay -p 8081 captures.jsonl
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: go-proxy replay [flags] <record file>")
+		flags.PrintDefaults()
+	}
+
+	port := flags.Int("p", 8080, "The TCP port to bind the server to")
+	matchBody := flags.Bool("match-body", false, "Also match the request bodies, not just the method, path and query")
+	logsDir := flags.String("logs-dir", "logs", "The directory to write the log files to")
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg := proxy.DefaultConfig()
+	cfg.Port = *port
+	cfg.Replay = flags.Arg(0)
+	cfg.ReplayMatchBody = *matchBody
+	cfg.Log.Dir = *logsDir
+
+	serve(cfg)
+}
+
+// runExport converts the exchanges of a record file, to open them in the
+// tools that read HAR files:
+//
+//	go-proxy export -record captures.jsonl -o captures.har
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+
+	recordFile := flags.String("record", "captures.jsonl", "The file recorded with -record, or a HAR file, to export")
+	var opts proxy.ExportOptions
+
+	flags.StringVar(&opts.Format, "format", "har", "The format to export to: har (HTTP Archive 1.2), raw (the HTTP messages as text), curl (the requests as curl commands), go (a Go file with an httptest server answering with the responses) or pcapng (TCP packets for Wireshark)")
+	flags.StringVar(&opts.BaseURL, "base-url", "http://localhost:8080", "The scheme and host the curl commands send the requests to, and the host and port of the pcapng packets")
+	flags.StringVar(&opts.Package, "package", "fixtures", "The package of the Go file")
+	redactHeaders := listFlag(proxy.DefaultRedactedHeaders)
+	flags.Var(&redactHeaders, "redact-headers", "The comma-separated headers whose values are replaced with [REDACTED] (empty exports them all)")
+	flags.Var((*listFlag)(&opts.RedactFields), "redact-fields", "The comma-separated JSON fields of the bodies, at any depth, whose values are replaced with [REDACTED]")
+	output := flags.String("o", "-", "The file to write to (- for stdout)")
+	query := captureQueryFlags(flags)
+
+	_ = flags.Parse(args)
+
+	opts.RedactHeaders = append([]string{}, redactHeaders...)
+
+	out := os.Stdout
+
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Can't create %s: %v", *output, err)
+		}
+		defer file.Close()
+
+		out = file
+	}
+
+	exported, err := proxy.ExportCaptures(*recordFile, query(), opts, out)
+	if err != nil {
+		log.Fatalf("Can't export %s: %v", *recordFile, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d exchanges exported\n", exported)
+}
+
+// runResend sends the requests of a record file to a server again,
+// reporting how the statuses and durations changed:
+//
+//	go-proxy resend -record captures.jsonl -target http://localhost:8000 -concurrency 4
+func runResend(args []string) {
+	flags := flag.NewFlagSet("resend", flag.ExitOnError)
+
+	recordFile := flags.String("record", "captures.jsonl", "The file recorded with -record, or a HAR file, to resend the requests of")
+
+	opts := proxy.ResendOptions{Concurrency: 1, Timeout: 30 * time.Second}
+
+	flags.StringVar(&opts.Target, "target", "", "The scheme and host to send the requests to, like http://localhost:8000")
+	flags.IntVar(&opts.Concurrency, "concurrency", opts.Concurrency, "How many requests are sent at a time")
+	flags.Float64Var(&opts.Rate, "rate", 0, "The most requests sent a second (0 for no limit)")
+	flags.DurationVar(&opts.Timeout, "timeout", opts.Timeout, "How long a request can take")
+	query := captureQueryFlags(flags)
+
+	_ = flags.Parse(args)
+
+	if _, err := proxy.ResendCaptures(*recordFile, query(), opts, os.Stdout); err != nil {
+		log.Fatalf("Can't resend %s: %v", *recordFile, err)
+	}
+}
+
+// runStats prints the latency percentiles, error rate and throughput of the
+// exchanges of a record file by route, upstream or path:
+//
+//	go-proxy stats -record captures.jsonl -by upstream
+func runStats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+
+	recordFile := flags.String("record", "captures.jsonl", "The file recorded with -record, or a HAR file")
+	by := flags.String("by", "route", "What the exchanges are grouped by: route, upstream or path")
+	format := flags.String("format", "table", "The output format: table or json")
+	query := captureQueryFlags(flags)
+
+	_ = flags.Parse(args)
+
+	if _, err := proxy.SummarizeCaptures(*recordFile, query(), *by, *format, os.Stdout); err != nil {
+		log.Fatalf("Can't summarize %s: %v", *recordFile, err)
+	}
+}
+
+// runTail follows the exchanges of a running proxy through its admin API,
+// printing those matching an expression:
+//
+//	go-proxy tail -admin http://localhost:8090 'status >= 500 && path ~ "/api"'
+func runTail(args []string) {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: go-proxy tail [flags] [filter expression]")
+		flags.PrintDefaults()
+	}
+
+	opts := proxy.TailOptions{Token: os.Getenv("GO_PROXY_ADMIN_TOKEN")}
+
+	flags.StringVar(&opts.Admin, "admin", "http://localhost:8090", "The URL of the admin API of the proxy, served with -admin-port")
+	flags.StringVar(&opts.Token, "token", opts.Token, "The -admin-token of the proxy (GO_PROXY_ADMIN_TOKEN by default)")
+	flags.IntVar(&opts.History, "n", 0, "Also print the latest matching exchanges kept by the proxy, up to this many")
+
+	_ = flags.Parse(args)
+
+	opts.Filter = strings.Join(flags.Args(), " ")
+
+	if err := proxy.Tail(opts, os.Stdout); err != nil {
+		log.Fatalf("Can't tail %s: %v", opts.Admin, err)
+	}
+}
+
+// runInspect shows an exchange of a record file, numbered as by query:
+//
+//	go-proxy inspect -record captures.jsonl 42
+func runInspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: go-proxy inspect [flags] <exchange number>")
+		flags.PrintDefaults()
+	}
+
+	recordFile := flags.String("record", "captures.jsonl", "The file recorded with -record, or a HAR file")
+
+	_ = flags.Parse(args)
+
+	n, err := strconv.Atoi(flags.Arg(0))
+	if flags.NArg() != 1 || err != nil || n < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := proxy.InspectCapture(*recordFile, n, os.Stdout); err != nil {
+		log.Fatalf("Can't inspect %s: %v", *recordFile, err)
+	}
+}
+
+// runCache lists, shows or removes the responses saved in the cache
+// directory of -cache-dir, while the proxy is stopped:
+//
+//	go-proxy cache -dir cache list 'api.local/users/*'
+//	go-proxy cache -dir cache inspect 3f2a
+//	go-proxy cache -dir cache purge 'api.local/users/*'
+func runCache(args []string) {
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: go-proxy cache [flags] list [URL pattern] | inspect <ID> | purge [URL pattern]")
+		fmt.Fprintln(flags.Output(), "The URLs are the host and the path with the query, the * of the patterns matching any characters.")
+		flags.PrintDefaults()
+	}
+
+	dir := flags.String("dir", "cache", "The cache directory of -cache-dir")
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	action, arg := flags.Arg(0), flags.Arg(1)
+
+	switch action {
+	case "list":
+		n, err := proxy.ListCache(*dir, arg, os.Stdout)
+		if err != nil {
+			log.Fatalf("Can't list the cache in %s: %v", *dir, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "%d cached responses\n", n)
+	case "inspect":
+		if arg == "" {
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		if err := proxy.InspectCache(*dir, arg, os.Stdout); err != nil {
+			log.Fatalf("Can't inspect the cache in %s: %v", *dir, err)
+		}
+	case "purge":
+		n, err := proxy.PurgeCache(*dir, arg)
+		if err != nil {
+			log.Fatalf("Can't purge the cache in %s: %v", *dir, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "%d cached responses purged\n", n)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// runGenCA creates the CA that signs the certificates of -mitm, unless it
+// already exists, optionally exporting its certificate for the clients.
+func runGenCA(args []string) {
+	flags := flag.NewFlagSet("gen-ca", flag.ExitOnError)
+
+	cfg := proxy.DefaultConfig().MITM
+
+	flags.StringVar(&cfg.CACert, "cert", cfg.CACert, "The CA certificate file to create")
+	flags.StringVar(&cfg.CAKey, "key", cfg.CAKey, "The CA private key file to create")
+	export := flags.String("export", "", "Also write the CA certificate to this file (- for stdout), to import it into the clients")
+
+	_ = flags.Parse(args)
+
+	if *export != "" {
+		exportCA(cfg, *export)
+
+		return
+	}
+
+	if err := proxy.ExportCA(cfg, io.Discard); err != nil {
+		log.Fatalf("Can't create the CA: %v", err)
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-proxy/proxy"
+)
+
+type addrListFlag []string
+
+func (f *addrListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *addrListFlag) Set(value string) error {
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSuffix(strings.TrimSpace(addr), "/")
+		if addr != "" {
+			*f = append(*f, addr)
+		}
+	}
+
+	return nil
+}
+
+type routeListFlag []proxy.RouteConfig
+
+func (f *routeListFlag) String() string {
+	routes := make([]string, len(*f))
+	for i, rc := range *f {
+		routes[i] = rc.Host + rc.Path + "=" + strings.Join(rc.Upstreams, ",")
+	}
+
+	return strings.Join(routes, " ")
+}
+
+func (f *routeListFlag) Set(value string) error {
+	pattern, addrs, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("the route must be of type [host]/path/*=scheme://host")
+	}
+
+	var upstreams addrListFlag
+	_ = upstreams.Set(addrs)
+
+	rc := proxy.RouteConfig{Path: pattern, Upstreams: upstreams}
+
+	// A route for a host starts with it, like api.local/*.
+	if !strings.HasPrefix(pattern, "/") {
+		rc.Host, rc.Path, _ = strings.Cut(pattern, "/")
+		rc.Path = "/" + rc.Path
+	}
+
+	*f = append(*f, rc)
+
+	return nil
+}
+
+type resolveListFlag []string
+
+func (f *resolveListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *resolveListFlag) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			*f = append(*f, entry)
+		}
+	}
+
+	return nil
+}
+
+type weightMapFlag map[string]int
+
+func (f *weightMapFlag) String() string {
+	weights := make([]string, 0, len(*f))
+	for addr, weight := range *f {
+		weights = append(weights, addr+"="+strconv.Itoa(weight))
+	}
+
+	sort.Strings(weights)
+
+	return strings.Join(weights, ",")
+}
+
+func (f *weightMapFlag) Set(value string) error {
+	weights := make(map[string]int)
+
+	for _, item := range strings.Split(value, ",") {
+		addr, weightStr, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return fmt.Errorf("the weight must be of type scheme://host=weight")
+		}
+
+		weight, err := strconv.Atoi(weightStr)
+		if err != nil {
+			return fmt.Errorf("invalid weight %q", weightStr)
+		}
+
+		weights[strings.TrimSuffix(addr, "/")] = weight
+	}
+
+	*f = weights
+
+	return nil
+}
+
+type userListFlag map[string]string
+
+func (f *userListFlag) String() string {
+	names := make([]string, 0, len(*f))
+	for name := range *f {
+		names = append(names, name+":***")
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func (f *userListFlag) Set(value string) error {
+	if *f == nil {
+		*f = make(map[string]string)
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		name, password, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			return fmt.Errorf("the user must be of type name:password")
+		}
+
+		(*f)[name] = password
+	}
+
+	return nil
+}
+
+type statusListFlag []int
+
+func (f *statusListFlag) String() string {
+	statuses := make([]string, len(*f))
+	for i, status := range *f {
+		statuses[i] = strconv.Itoa(status)
+	}
+
+	return strings.Join(statuses, ",")
+}
+
+func (f *statusListFlag) Set(value string) error {
+	var statuses []int
+
+	for _, s := range strings.Split(value, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid status code %q", s)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	*f = statuses
+
+	return nil
+}
+
+type logSinkListFlag []proxy.LogSinkConfig
+
+func (f *logSinkListFlag) String() string {
+	specs := make([]string, len(*f))
+	for i, sink := range *f {
+		switch {
+		case sink.Type == "http":
+			specs[i] = sink.Address
+		case sink.Address != "":
+			specs[i] = sink.Type + "+" + sink.Address
+		case sink.Format != "":
+			specs[i] = sink.Type + ":" + sink.Format
+		default:
+			specs[i] = sink.Type
+		}
+	}
+
+	return strings.Join(specs, ",")
+}
+
+func (f *logSinkListFlag) Set(value string) error {
+	var sinks []proxy.LogSinkConfig
+
+	for _, spec := range strings.Split(value, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		sink, err := proxy.ParseLogSink(spec)
+		if err != nil {
+			return err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	*f = sinks
+
+	return nil
+}
+
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	*f = items
+
+	return nil
+}
+
+type matchListFlag []proxy.RequestMatch
+
+func (f *matchListFlag) String() string {
+	rules := make([]string, len(*f))
+	for i, rule := range *f {
+		rules[i] = strings.TrimSpace(strings.Join(rule.Methods, ",") + " " + rule.Path)
+	}
+
+	return strings.Join(rules, " ")
+}
+
+func (f *matchListFlag) Set(value string) error {
+	rule := proxy.RequestMatch{Path: strings.TrimSpace(value)}
+
+	if method, path, ok := strings.Cut(rule.Path, " "); ok {
+		rule = proxy.RequestMatch{Path: strings.TrimSpace(path), Methods: []string{strings.ToUpper(method)}}
+	}
+
+	if !strings.HasPrefix(rule.Path, "/") {
+		return fmt.Errorf("the path must start with /")
+	}
+
+	*f = append(*f, rule)
+
+	return nil
+}
+
+// applyEnv sets the credentials given in the environment, which unlike the
+// flags don't show up in the process list.
+func applyEnv(cfg *proxy.Config) error {
+	if users := os.Getenv("GO_PROXY_AUTH_USERS"); users != "" {
+		var flagUsers userListFlag
+		if err := flagUsers.Set(users); err != nil {
+			return fmt.Errorf("invalid GO_PROXY_AUTH_USERS: %w", err)
+		}
+
+		cfg.Auth.Users = flagUsers
+	}
+
+	if tokens := os.Getenv("GO_PROXY_AUTH_TOKENS"); tokens != "" {
+		var flagTokens listFlag
+		_ = flagTokens.Set(tokens)
+
+		cfg.Auth.Tokens = flagTokens
+	}
+
+	if token := os.Getenv("GO_PROXY_ADMIN_TOKEN"); token != "" {
+		cfg.Admin.Token = token
+	}
+
+	return nil
+}
+
+func applyFlags(cfg *proxy.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			cfg.Port = *portFlag
+		case "listen":
+			cfg.Listen = listenFlag
+		case "addr":
+			cfg.Upstreams = forwardAddrsFlag
+		case "route":
+			cfg.Routes = routesFlag
+		case "stream":
+			cfg.Stream = *streamFlag
+		case "h2c":
+			cfg.H2C = *h2cFlag
+		case "forward-proxy":
+			cfg.ForwardProxy = *forwardProxyFlag
+		case "mitm":
+			cfg.MITM.Enabled = *mitmFlag
+		case "mitm-ca-cert":
+			cfg.MITM.CACert = *mitmCACertFlag
+		case "mitm-ca-key":
+			cfg.MITM.CAKey = *mitmCAKeyFlag
+		case "request-id":
+			cfg.RequestID = *requestIDFlag
+		case "forwarded":
+			cfg.Forwarded = *forwardedFlag
+		case "compress":
+			cfg.Compress.Enabled = *compressFlag
+		case "compress-types":
+			cfg.Compress.Types = compressTypesFlag
+		case "compress-min-size":
+			cfg.Compress.MinSize = compressMinSizeFlag
+		case "decompress-requests":
+			cfg.DecompressRequests = *decompressRequestsFlag
+		case "security-headers":
+			cfg.SecurityHeaders.Preset = *securityHeadersFlag
+		case "csp":
+			cfg.SecurityHeaders.CSP = *cspFlag
+		case "cache-stale-while-revalidate":
+			cfg.Cache.StaleWhileRevalidate = *cacheStaleWhileRevalidateFlag
+		case "cache-stale-if-error":
+			cfg.Cache.StaleIfError = *cacheStaleIfErrorFlag
+		case "cache-dir":
+			cfg.Cache.Dir = *cacheDirFlag
+		case "collapse":
+			cfg.Collapse.Enabled = *collapseFlag
+		case "cors":
+			cfg.CORS.Enabled = *corsFlag
+		case "cors-origins":
+			cfg.CORS.Origins = corsOriginsFlag
+		case "cors-credentials":
+			cfg.CORS.Credentials = *corsCredentialsFlag
+		case "graphql":
+			cfg.GraphQL.Paths = graphQLPathsFlag
+		case "graphql-block":
+			cfg.GraphQL.Block = graphQLBlockFlag
+		case "openapi":
+			cfg.OpenAPI.Spec = *openAPIFlag
+		case "openapi-enforce":
+			cfg.OpenAPI.Enforce = *openAPIEnforceFlag
+		case "tls-cert":
+			cfg.TLS.Cert = *tlsCertFlag
+		case "tls-key":
+			cfg.TLS.Key = *tlsKeyFlag
+		case "acme-host":
+			cfg.TLS.ACME.Hosts = acmeHostsFlag
+		case "acme-email":
+			cfg.TLS.ACME.Email = *acmeEmailFlag
+		case "acme-directory":
+			cfg.TLS.ACME.Directory = *acmeDirectoryFlag
+		case "acme-cache":
+			cfg.TLS.ACME.Cache = *acmeCacheFlag
+		case "acme-http-addr":
+			cfg.TLS.ACME.HTTPAddr = *acmeHTTPAddrFlag
+		case "upstream-proxy":
+			cfg.UpstreamProxy = *upstreamProxyFlag
+		case "resolve":
+			cfg.DNS.Resolve = resolveFlag
+		case "dns-server":
+			cfg.DNS.Server = *dnsServerFlag
+		case "insecure-skip-verify":
+			cfg.UpstreamTLS.InsecureSkipVerify = *insecureSkipVerifyFlag
+		case "upstream-ca":
+			cfg.UpstreamTLS.CA = *upstreamCAFlag
+		case "upstream-cert":
+			cfg.UpstreamTLS.Cert = *upstreamCertFlag
+		case "upstream-key":
+			cfg.UpstreamTLS.Key = *upstreamKeyFlag
+		case "logs-dir":
+			cfg.Log.Dir = *logsDirFlag
+		case "log-format":
+			cfg.Log.Format = *logFormatFlag
+		case "log-split":
+			cfg.Log.Split = *logSplitFlag
+		case "log-decode":
+			cfg.Log.Decode = *logDecodeFlag
+		case "log-binary":
+			cfg.Log.Binary = *logBinaryFlag
+		case "log-text-types":
+			cfg.Log.TextTypes = logTextTypesFlag
+		case "log-redact-headers":
+			cfg.Log.RedactHeaders = logRedactHeadersFlag
+		case "log-sink":
+			cfg.Log.Sinks = logSinksFlag
+		case "log-redact-fields":
+			cfg.Log.RedactFields = logRedactFieldsFlag
+		case "max-log-body":
+			cfg.Log.MaxBody = maxLogBodyFlag
+		case "mode":
+			cfg.Mode = *modeFlag
+		case "log-hex-dump":
+			cfg.Log.HexDump = *logHexDumpFlag
+		case "log-buffer":
+			cfg.Log.Buffer = *logBufferFlag
+		case "log-flush-interval":
+			cfg.Log.FlushInterval = *logFlushIntervalFlag
+		case "log-batch-size":
+			cfg.Log.BatchSize = *logBatchSizeFlag
+		case "log-overflow":
+			cfg.Log.Overflow = *logOverflowFlag
+		case "log-methods":
+			if cfg.Log.Filter.Match == nil {
+				cfg.Log.Filter.Match = &proxy.RequestMatch{}
+			}
+
+			cfg.Log.Filter.Match.Methods = logMethodsFlag
+		case "log-path":
+			if cfg.Log.Filter.Match == nil {
+				cfg.Log.Filter.Match = &proxy.RequestMatch{}
+			}
+
+			cfg.Log.Filter.Match.Path = *logPathFlag
+		case "log-status":
+			cfg.Log.Filter.Status = logStatusFlag
+		case "log-errors":
+			cfg.Log.Filter.Errors = *logErrorsFlag
+		case "log-slow":
+			cfg.Log.Filter.Slow = *logSlowFlag
+		case "log-sample":
+			cfg.Log.Filter.Sample = *logSampleFlag
+		case "log-time-format":
+			cfg.Log.TimeFormat = *logTimeFormatFlag
+		case "log-time-zone":
+			cfg.Log.TimeZone = *logTimeZoneFlag
+		case "verbose":
+			if *verboseFlag {
+				cfg.Log.Sinks = append(cfg.Log.Sinks, proxy.LogSinkConfig{Type: "console", Expand: verboseExpandFlag})
+			}
+		case "udp-idle-timeout":
+			cfg.Timeouts.UDPIdle = *udpIdleTimeoutFlag
+		case "listen-family":
+			cfg.ListenFamily = *listenFamilyFlag
+		case "proxy-protocol":
+			cfg.ProxyProtocol = *proxyProtocolFlag
+		case "proxy-protocol-from":
+			cfg.ProxyProtocolFrom = proxyProtocolFromFlag
+		case "upstream-proxy-protocol":
+			cfg.UpstreamProxyProtocol = *upstreamProxyProtocolFlag
+		case "max-in-flight":
+			cfg.Concurrency.Total = *maxInFlightFlag
+		case "max-in-flight-per-client":
+			cfg.Concurrency.PerClient = *maxInFlightPerClientFlag
+		case "in-flight-queue-timeout":
+			cfg.Concurrency.QueueTimeout = *inFlightQueueTimeoutFlag
+		case "maintenance":
+			cfg.Maintenance.Enabled = *maintenanceFlag
+		case "maintenance-routes":
+			cfg.Maintenance.Routes = maintenanceRoutesFlag
+		case "maintenance-retry-after":
+			cfg.Maintenance.RetryAfter = *maintenanceRetryAfterFlag
+		case "error-format":
+			cfg.ErrorPages.Format = *errorFormatFlag
+		case "error-template":
+			if cfg.ErrorPages.Templates == nil {
+				cfg.ErrorPages.Templates = make(map[string]string)
+			}
+
+			cfg.ErrorPages.Templates["default"] = *errorTemplateFlag
+		case "log-duplicates":
+			cfg.Log.DuplicateWindow = *logDuplicatesFlag
+		case "log-bodies":
+			cfg.Log.Bodies = *logBodiesFlag
+		case "throttle-down":
+			cfg.Throttle.Down = throttleDownFlag
+		case "throttle-up":
+			cfg.Throttle.Up = throttleUpFlag
+		case "max-request-body":
+			cfg.Limits.RequestBody = maxRequestBodyFlag
+		case "max-decoded-request-body":
+			cfg.Limits.DecodedRequestBody = maxDecodedRequestBodyFlag
+		case "max-header-size":
+			cfg.Limits.Header = maxHeaderSizeFlag
+		case "fault-delay":
+			cfg.Fault.Delay = *faultDelayFlag
+		case "fault-delay-jitter":
+			cfg.Fault.DelayJitter = *faultDelayJitterFlag
+		case "fault-abort":
+			cfg.Fault.Abort = *faultAbortFlag
+		case "fault-abort-status":
+			cfg.Fault.AbortStatus = *faultAbortStatusFlag
+		case "fault-drop":
+			cfg.Fault.Drop = *faultDropFlag
+		case "fault-corrupt":
+			cfg.Fault.Corrupt = *faultCorruptFlag
+		case "cache-size":
+			cfg.Cache.Size = cacheSizeFlag
+		case "cache-ttl":
+			cfg.Cache.TTL = *cacheTTLFlag
+		case "rate-limit":
+			cfg.RateLimit.Rate = *rateLimitFlag
+		case "rate-burst":
+			cfg.RateLimit.Burst = *rateBurstFlag
+		case "rate-limit-key":
+			cfg.RateLimit.Key = *rateLimitKeyFlag
+		case "compare":
+			cfg.Compare.Upstream = *compareFlag
+		case "compare-ignore-headers":
+			cfg.Compare.IgnoreHeaders = compareIgnoreHeadersFlag
+		case "mirror":
+			cfg.Mirror.Upstream = *mirrorFlag
+		case "mirror-percent":
+			cfg.Mirror.Percent = *mirrorPercentFlag
+		case "record":
+			cfg.Record = *recordFlag
+		case "replay":
+			cfg.Replay = *replayFlag
+		case "replay-match-body":
+			cfg.ReplayMatchBody = *replayMatchBodyFlag
+		case "retries":
+			cfg.Retry.Attempts = *retriesFlag
+		case "retry-statuses":
+			cfg.Retry.Statuses = retryStatusesFlag
+		case "retry-methods":
+			cfg.Retry.Methods = retryMethodsFlag
+		case "retry-backoff":
+			cfg.Retry.Backoff = *retryBackoffFlag
+		case "admin-port":
+			cfg.Admin.Port = *adminPortFlag
+		case "auth-user":
+			cfg.Auth.Users = authUsersFlag
+		case "auth-token":
+			cfg.Auth.Tokens = authTokensFlag
+		case "allow":
+			cfg.ACL.Allow = allowFlag
+		case "deny":
+			cfg.ACL.Deny = denyFlag
+		case "otlp-endpoint":
+			cfg.Tracing.Endpoint = *otlpEndpointFlag
+		case "trace-service":
+			cfg.Tracing.ServiceName = *traceServiceFlag
+		case "admin-token":
+			cfg.Admin.Token = *adminTokenFlag
+		case "admin-history":
+			cfg.Admin.History = *adminHistoryFlag
+		case "intercept":
+			cfg.Intercept = interceptFlag
+		case "intercept-timeout":
+			cfg.Timeouts.Intercept = *interceptTimeoutFlag
+		case "script":
+			cfg.Scripts = scriptsFlag
+		case "cookie-jar":
+			cfg.CookieJar = *cookieJarFlag
+		case "sticky":
+			cfg.Sticky = *stickyFlag
+		case "balance":
+			cfg.Balance = *balanceFlag
+		case "weights":
+			cfg.Weights = weightsFlag
+		case "health-check":
+			cfg.HealthCheck.Path = *healthCheckFlag
+		case "health-interval":
+			cfg.HealthCheck.Interval = *healthIntervalFlag
+		case "health-timeout":
+			cfg.HealthCheck.Timeout = *healthTimeoutFlag
+		case "health-threshold":
+			cfg.HealthCheck.Threshold = *healthThresholdFlag
+		case "timeout":
+			cfg.Timeouts.Request = *timeoutFlag
+		case "shutdown-timeout":
+			cfg.Timeouts.Shutdown = *shutdownTimeoutFlag
+		case "dial-timeout":
+			cfg.Timeouts.Dial = *dialTimeoutFlag
+		case "tls-handshake-timeout":
+			cfg.Timeouts.TLSHandshake = *tlsHandshakeTimeoutFlag
+		case "response-header-timeout":
+			cfg.Timeouts.ResponseHeader = *responseHeaderTimeoutFlag
+		case "client-read-header-timeout":
+			cfg.Timeouts.ClientReadHeader = *clientReadHeaderTimeoutFlag
+		case "client-read-timeout":
+			cfg.Timeouts.ClientRead = *clientReadTimeoutFlag
+		case "client-write-timeout":
+			cfg.Timeouts.ClientWrite = *clientWriteTimeoutFlag
+		case "client-idle-timeout":
+			cfg.Timeouts.ClientIdle = *clientIdleTimeoutFlag
+		case "max-client-conns":
+			cfg.Limits.ClientConns = *maxClientConnsFlag
+		case "max-udp-sessions":
+			cfg.Limits.UDPSessions = *maxUDPSessionsFlag
+		case "idle-conn-timeout":
+			cfg.Timeouts.IdleConn = *idleConnTimeoutFlag
+		case "max-idle-conns":
+			cfg.Connections.MaxIdle = *maxIdleConnsFlag
+		case "max-idle-conns-per-host":
+			cfg.Connections.MaxIdlePerHost = *maxIdleConnsPerHostFlag
+		case "max-conns-per-host":
+			cfg.Connections.MaxPerHost = *maxConnsPerHostFlag
+		case "keep-alive":
+			cfg.Connections.KeepAlive = *keepAliveFlag
+		}
+	})
+}
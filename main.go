@@ -1,268 +1,457 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"path"
-	"sort"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
-)
 
-var logsDir = path.Join(".", "logs")
+	"go-proxy/proxy"
+)
 
+var configFlag = flag.String("config", "", "A YAML file to load the settings from, or TOML if it ends in .toml. Flags given explicitly override its values")
 var portFlag = flag.Int("p", 8080, "The TCP port to bind the server to")
-var forwardAddrFlag = flag.String("addr", "", "The server address (scheme://host) to forward the request to")
-
-type logEntry struct {
-	timestamp time.Time
-	message   *rawHTTPMessage
+var compressFlag = flag.Bool("compress", false, "Compress the responses with gzip or deflate for the clients accepting it, when the server didn't")
+var corsFlag = flag.Bool("cors", false, "Answer the CORS preflight requests and add the CORS headers to the responses, for the browsers to call servers lacking CORS")
+var corsCredentialsFlag = flag.Bool("cors-credentials", false, "Allow the cross-origin requests of -cors to send cookies and authorization")
+var securityHeadersFlag = flag.String("security-headers", "", "Add the security headers of a preset to the responses lacking them: basic (nosniff, SAMEORIGIN frames and the referrer policy) or strict (also HSTS, a restrictive CSP, no frames and the opener and permissions policies)")
+var cspFlag = flag.String("csp", "", "The Content-Security-Policy set on the responses, replacing the server's")
+var cacheStaleWhileRevalidateFlag = flag.Duration("cache-stale-while-revalidate", 0, "Serve the expired cached responses for up to this long while refreshing them in the background, as far as their stale-while-revalidate allows (0 disables it)")
+var cacheStaleIfErrorFlag = flag.Duration("cache-stale-if-error", 0, "Serve the expired cached responses for up to this long when the server fails or answers with 500, 502, 503 or 504, as far as their stale-if-error allows (0 disables it)")
+var cacheDirFlag = flag.String("cache-dir", "", "Also save the cached responses of -cache-size to this directory, to keep them across restarts")
+var collapseFlag = flag.Bool("collapse", false, "Send the identical GET requests arriving while one of them is in flight to the server once, sharing its response")
+var openAPIFlag = flag.String("openapi", "", "The OpenAPI 3 spec, YAML or JSON, to validate the requests and responses against, logging the violations")
+var openAPIEnforceFlag = flag.Bool("openapi-enforce", false, "Reject the requests breaking the -openapi spec with 400, and replace the responses breaking it with 502")
+var decompressRequestsFlag = flag.Bool("decompress-requests", false, "Decode the request bodies compressed with gzip, deflate or br before forwarding them, for the servers that can't")
+var tlsCertFlag = flag.String("tls-cert", "", "The certificate file to serve TLS with (requires -tls-key)")
+var tlsKeyFlag = flag.String("tls-key", "", "The private key file to serve TLS with (requires -tls-cert)")
+var acmeEmailFlag = flag.String("acme-email", "", "The contact email of the ACME account, for the expiry notices of the CA")
+var acmeDirectoryFlag = flag.String("acme-directory", proxy.LetsEncryptDirectory, "The directory URL of the ACME CA the -acme-host certificates are obtained from")
+var acmeCacheFlag = flag.String("acme-cache", "acme", "The directory to keep the ACME account key and certificates in")
+var acmeHTTPAddrFlag = flag.String("acme-http-addr", ":80", "The address to answer the HTTP-01 challenges of the ACME CA on, redirecting the other requests to HTTPS")
+var insecureSkipVerifyFlag = flag.Bool("insecure-skip-verify", false, "Accept any certificate from the https:// servers, e.g. self-signed ones in development")
+var upstreamCAFlag = flag.String("upstream-ca", "", "A PEM bundle of CA certificates to trust for the https:// servers, on top of the system ones")
+var upstreamCertFlag = flag.String("upstream-cert", "", "The client certificate file for the servers requiring mutual TLS (requires -upstream-key)")
+var upstreamKeyFlag = flag.String("upstream-key", "", "The private key file of -upstream-cert")
+var upstreamProxyFlag = flag.String("upstream-proxy", "", "An HTTP or SOCKS5 proxy to reach the servers through, like http://proxy.corp:3128 or socks5://127.0.0.1:9050 (HTTP_PROXY and HTTPS_PROXY are used otherwise)")
+var dnsServerFlag = flag.String("dns-server", "", "A DNS server (host:port) to resolve the server hosts with, instead of the system resolver")
+var streamFlag = flag.Bool("stream", false, "Stream the bodies to and from the server instead of buffering them, logging only their first bytes")
+var h2cFlag = flag.Bool("h2c", false, "Speak HTTP/2 without TLS (h2c) to the http:// servers, e.g. for gRPC")
+var forwardProxyFlag = flag.Bool("forward-proxy", false, "Also act as a regular HTTP proxy that browsers can use, forwarding the requests with an absolute URL to their host and tunneling CONNECT")
+var mitmFlag = flag.Bool("mitm", false, "Decrypt the CONNECT tunnels with -forward-proxy to log the HTTPS traffic, using certificates signed by the CA in -mitm-ca-cert")
+var mitmCACertFlag = flag.String("mitm-ca-cert", "go-proxy-ca.pem", "The CA certificate file for -mitm, created with its key if it doesn't exist")
+var mitmCAKeyFlag = flag.String("mitm-ca-key", "go-proxy-ca-key.pem", "The CA private key file for -mitm")
+var exportCAFlag = flag.String("export-ca", "", "Write the -mitm CA certificate to this file (- for stdout), creating the CA if needed, and exit")
+var requestIDFlag = flag.String("request-id", "X-Request-ID", "The header carrying the ID of every request, kept if the client sent one and generated otherwise, which is forwarded to the server, returned to the client and logged (empty disables it)")
+var forwardedFlag = flag.String("forwarded", "x-forwarded", "How to tell the server about the client: x-forwarded (X-Forwarded-For/Proto/Host), forwarded (RFC 7239 Forwarded) or none")
+var logsDirFlag = flag.String("logs-dir", "logs", "The directory to write the log files to")
+var logFormatFlag = flag.String("log-format", "raw", "The format of the log files: raw (HTTP messages as text), har (HTTP Archive 1.2) or json (an object per exchange and line)")
+var logSplitFlag = flag.String("log-split", "route", "How to split the log files: route (a file per named route, per server otherwise), upstream (a file per server, even within the routes) or none (a single file, logs/all)")
+var logDecodeFlag = flag.Bool("log-decode", true, "Log the gzip, deflate and brotli bodies decoded. The client always gets them as sent by the server")
+var logBinaryFlag = flag.String("log-binary", "hex", "How to log the binary bodies: hex (a hex dump of their first bytes) or omit (just their size)")
+var modeFlag = flag.String("mode", "http", "What the proxy forwards: http, tcp for the raw TCP streams of the other protocols, like those of the databases, or udp for the UDP datagrams, to the host:port servers of -addr")
+var logHexDumpFlag = flag.Bool("log-hex-dump", false, "Log a hex dump of the data of the connections in the tcp mode and the datagrams in the udp mode")
+var udpIdleTimeoutFlag = flag.Duration("udp-idle-timeout", time.Minute, "How long a client's session in the udp mode lasts without datagrams either way (0 means forever)")
+var listenFamilyFlag = flag.String("listen-family", "dual", "What the proxy accepts on the wildcard addresses of -p and -listen, like :8080 or [::]:8080: dual (IPv4 and IPv6), ipv4 or ipv6")
+var proxyProtocolFlag = flag.Bool("proxy-protocol", false, "Require the PROXY protocol header (v1 or v2) of an L4 load balancer on every connection, logging and forwarding the real client addresses it gives")
+var upstreamProxyProtocolFlag = flag.String("upstream-proxy-protocol", "", "Send a PROXY protocol header of this version (v1 or v2) with the client address on the connections to the servers, which are then not reused")
+var maxInFlightFlag = flag.Int("max-in-flight", 0, "The requests in flight through the proxy at most, the next ones waiting up to -in-flight-queue-timeout before being rejected with 503 (0 means no limit)")
+var maxInFlightPerClientFlag = flag.Int("max-in-flight-per-client", 0, "The requests in flight from each client IP at most, like -max-in-flight (0 means no limit)")
+var inFlightQueueTimeoutFlag = flag.Duration("in-flight-queue-timeout", 0, "How long the requests over -max-in-flight or -max-in-flight-per-client wait for others to finish (0 rejects them right away)")
+var maintenanceFlag = flag.Bool("maintenance", false, "Start in maintenance, answering every request with 503 and Retry-After until it's turned off at the admin API or with SIGUSR1")
+var maintenanceRetryAfterFlag = flag.Duration("maintenance-retry-after", 5*time.Minute, "The Retry-After of the requests answered in maintenance (0 leaves it out)")
+var errorFormatFlag = flag.String("error-format", "text", "The body of the errors answered by the proxy itself, like 502 or 429: text (the status text), json or html, with the request ID")
+var errorTemplateFlag = flag.String("error-template", "", "A text/template file rendering the body of the errors answered by the proxy itself, given the .Status, .StatusText, .Error, .RequestID, .Method, .Path and .Time, its extension setting the Content-Type")
+var logBufferFlag = flag.Int("log-buffer", 4096, "The log entries kept in memory while waiting to be written")
+var logFlushIntervalFlag = flag.Duration("log-flush-interval", time.Second, "How often the buffered log entries are written out")
+var logBatchSizeFlag = flag.Int("log-batch-size", 100, "Write out the log entries every this many of them, besides every -log-flush-interval (0 means only on the interval)")
+var logOverflowFlag = flag.String("log-overflow", "drop", "What to do when the log buffer is full: drop (the new entries), drop-oldest, block (the requests wait for room) or sample (log one exchange in ten once the buffer is three quarters full)")
+var logPathFlag = flag.String("log-path", "", "Only log the requests with this path prefix, like /api, or glob, like /users/*/orders")
+var logErrorsFlag = flag.Bool("log-errors", false, "Only log the exchanges that failed, with an error or a 5xx response (or that were slow, with -log-slow)")
+var logSlowFlag = flag.Duration("log-slow", 0, "Only log the exchanges that took longer than this (or that failed, with -log-errors)")
+var logSampleFlag = flag.Float64("log-sample", 0, "The percentage of the exchanges logged, after the other log filters (0 means all of them)")
+var verboseFlag = flag.Bool("verbose", false, "Print a colored line per exchange with its method, path, status, latency and size on the standard output, besides the -log-sink destinations")
+var logTimeFormatFlag = flag.String("log-time-format", "rfc3339nano", "The format of the times in the logs: rfc3339, rfc3339ms, rfc3339nano or a Go layout like '2006-01-02 15:04:05.000'")
+var logTimeZoneFlag = flag.String("log-time-zone", "Local", "The time zone of the times in the logs: Local, UTC or a name like Europe/Paris")
+var logDuplicatesFlag = flag.Duration("log-duplicates", 0, "Flag the requests repeating an identical one (same route, method, path, query and body) made within this long, in the logs and the admin API's /stats (0 disables it)")
+var logBodiesFlag = flag.Bool("log-bodies", false, "Include the bodies in the json log format")
+var timeoutFlag = flag.Duration("timeout", 0, "The time limit for a request to the server, including reading its response (0 means no limit)")
+var shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests to finish when shutting down")
+var dialTimeoutFlag = flag.Duration("dial-timeout", 30*time.Second, "The time limit for connecting to a server (0 means no limit)")
+var tlsHandshakeTimeoutFlag = flag.Duration("tls-handshake-timeout", 10*time.Second, "The time limit for the TLS handshake with a server (0 means no limit)")
+var responseHeaderTimeoutFlag = flag.Duration("response-header-timeout", 0, "The time limit for a server to send the response headers after the request (0 means no limit)")
+var clientReadHeaderTimeoutFlag = flag.Duration("client-read-header-timeout", 10*time.Second, "The time limit for a client to send the request headers, against the slow clients holding connections (0 means no limit)")
+var clientReadTimeoutFlag = flag.Duration("client-read-timeout", 0, "The time limit for a client to send the whole request, including its body (0 means no limit)")
+var clientWriteTimeoutFlag = flag.Duration("client-write-timeout", 0, "The time limit for writing the response to a client, from the end of the request headers, which cuts the longer streams (0 means no limit)")
+var clientIdleTimeoutFlag = flag.Duration("client-idle-timeout", 2*time.Minute, "How long an idle client connection is kept open for the next request (0 means -client-read-timeout)")
+var maxUDPSessionsFlag = flag.Int("max-udp-sessions", proxy.DefaultUDPSessions, "The client sessions kept at most in the udp mode, the datagrams of the other clients being dropped (0 means no limit)")
+var maxClientConnsFlag = flag.Int("max-client-conns", 0, "The connections open from each client IP at most, the next ones being closed right away (0 means no limit)")
+var idleConnTimeoutFlag = flag.Duration("idle-conn-timeout", 90*time.Second, "How long an idle connection to a server is kept for reuse (0 means forever)")
+var maxIdleConnsFlag = flag.Int("max-idle-conns", 100, "The idle connections kept for reuse across all servers (0 means no limit)")
+var maxIdleConnsPerHostFlag = flag.Int("max-idle-conns-per-host", 32, "The idle connections kept for reuse to each server")
+var maxConnsPerHostFlag = flag.Int("max-conns-per-host", 0, "The connections open to each server at most, the requests beyond waiting for one (0 means no limit)")
+var keepAliveFlag = flag.Duration("keep-alive", 30*time.Second, "The interval of the TCP keep-alive probes to the servers (a negative value disables keep-alives and connection reuse)")
+var retriesFlag = flag.Int("retries", 0, "How many times to retry a request that failed to reach the server or got one of -retry-statuses back")
+var retryBackoffFlag = flag.Duration("retry-backoff", 100*time.Millisecond, "The wait before the first retry, doubled before each of the next ones")
+var adminPortFlag = flag.Int("admin-port", 0, "The TCP port to serve the admin API on, on localhost only (0 disables it)")
+var watchConfigFlag = flag.Bool("watch-config", false, "Reload the routes and upstreams of -config whenever the file changes")
+var adminTokenFlag = flag.String("admin-token", "", "A secret that every request to the admin API must carry, as a bearer token or the password of basic auth (a random one is generated and printed by default)")
+var adminHistoryFlag = flag.Int("admin-history", 500, "The latest exchanges kept in memory for the web UI on -admin-port")
+var interceptTimeoutFlag = flag.Duration("intercept-timeout", 0, "How long an intercepted request is held before being forwarded unchanged (0 means until it's released)")
+var healthCheckFlag = flag.String("health-check", "", "A path like /health to probe every server with, taking the failing ones out of rotation")
+var healthIntervalFlag = flag.Duration("health-interval", 10*time.Second, "How often to probe the servers with -health-check")
+var healthTimeoutFlag = flag.Duration("health-timeout", 2*time.Second, "The time limit for a -health-check probe")
+var healthThresholdFlag = flag.Int("health-threshold", 3, "The failed probes in a row that take a server out of rotation, and the successful ones that put it back")
+var cookieJarFlag = flag.String("cookie-jar", "", "Keep the cookies set by the servers and send them with the next requests, for the clients that don't handle cookies: client (a jar per client IP) or global")
+var stickyFlag = flag.String("sticky", "", "Keep each client on the same server when balancing: cookie (a cookie set by the proxy) or ip (a hash of the client IP)")
+var balanceFlag = flag.String("balance", "round-robin", "How to spread the requests over the servers: round-robin, weighted (by -weights), least-conn (the server with the fewest requests in flight) or p2c (the less busy of two random servers)")
+var faultDelayFlag = flag.Duration("fault-delay", 0, "Delay every request by this long, to test the clients")
+var faultDelayJitterFlag = flag.Duration("fault-delay-jitter", 0, "Delay every request by a random duration up to this long, on top of -fault-delay")
+var faultAbortFlag = flag.Float64("fault-abort", 0, "The percentage of requests answered with -fault-abort-status without reaching the server")
+var faultAbortStatusFlag = flag.Int("fault-abort-status", 503, "The status of the requests aborted by -fault-abort")
+var faultDropFlag = flag.Float64("fault-drop", 0, "The percentage of requests whose connection is closed halfway through the response body")
+var faultCorruptFlag = flag.Float64("fault-corrupt", 0, "The percentage of requests whose response body gets corrupted bytes")
+var otlpEndpointFlag = flag.String("otlp-endpoint", "", "An OpenTelemetry collector URL, like http://localhost:4318, to export a trace span of every request to with OTLP over HTTP")
+var traceServiceFlag = flag.String("trace-service", "go-proxy", "The service name of the trace spans exported to -otlp-endpoint")
+var cacheTTLFlag = flag.Duration("cache-ttl", 0, "Cache the responses for this long regardless of their caching headers (0 means follow the headers)")
+var rateLimitFlag = flag.Float64("rate-limit", 0, "The requests per second allowed for each client (0 means no limit)")
+var rateBurstFlag = flag.Int("rate-burst", 0, "The requests a client can make at once before -rate-limit applies (defaults to the rate)")
+var rateLimitKeyFlag = flag.String("rate-limit-key", "ip", "What identifies a client for -rate-limit: ip or header:<name>, like header:X-API-Key")
+var compareFlag = flag.String("compare", "", "Also send every request to this server (scheme://host), printing how its responses differ from those the clients get")
+var mirrorFlag = flag.String("mirror", "", "Also send a copy of the requests to this server (scheme://host) in the background, discarding its responses")
+var mirrorPercentFlag = flag.Float64("mirror-percent", 100, "The percentage of requests copied to -mirror")
+var recordFlag = flag.String("record", "", "A file to record the exchanges to, for replaying them later with -replay, as JSON lines or, if it ends in .db, .sqlite or .sqlite3, in an SQLite database")
+var replayFlag = flag.String("replay", "", "A file recorded with -record, or a HAR file, to answer the requests from, without contacting the servers")
+var replayMatchBodyFlag = flag.Bool("replay-match-body", false, "Also match the request bodies when replaying, not just the method, path and query")
+var forwardAddrsFlag addrListFlag
+var routesFlag routeListFlag
+var listenFlag addrListFlag
+var resolveFlag resolveListFlag
+var weightsFlag weightMapFlag
+var cacheSizeFlag proxy.ByteSize
+var logTextTypesFlag = listFlag(proxy.DefaultTextTypes)
+var logRedactHeadersFlag = listFlag(proxy.DefaultRedactedHeaders)
+var logRedactFieldsFlag listFlag
+var logSinksFlag = logSinkListFlag{{Type: "file"}}
+var logMethodsFlag listFlag
+var logStatusFlag listFlag
+var compressTypesFlag = listFlag(proxy.DefaultCompressTypes)
+var compressMinSizeFlag = proxy.ByteSize(1 << 10)
+var acmeHostsFlag listFlag
+var graphQLPathsFlag listFlag
+var corsOriginsFlag = listFlag{"*"}
+var graphQLBlockFlag listFlag
+var maintenanceRoutesFlag listFlag
+var compareIgnoreHeadersFlag = listFlag{"Date"}
+var interceptFlag matchListFlag
+var verboseExpandFlag matchListFlag
+var maxLogBodyFlag = proxy.ByteSize(64 << 10)
+var maxRequestBodyFlag proxy.ByteSize
+var maxDecodedRequestBodyFlag = proxy.DefaultDecodedRequestBody
+var throttleDownFlag proxy.Bandwidth
+var throttleUpFlag proxy.Bandwidth
+var maxHeaderSizeFlag = proxy.ByteSize(1 << 20)
+var retryStatusesFlag = statusListFlag{http.StatusBadGateway, http.StatusServiceUnavailable}
+var retryMethodsFlag = listFlag{http.MethodGet, http.MethodHead}
+var allowFlag listFlag
+var authUsersFlag userListFlag
+var authTokensFlag listFlag
+var denyFlag listFlag
+var proxyProtocolFromFlag listFlag
+var scriptsFlag listFlag
+
+func init() {
+	flag.Var(&authUsersFlag, "auth-user", "Require the clients to authenticate with basic auth as one of these comma-separated name:password users (or GO_PROXY_AUTH_USERS)")
+	flag.Var(&authTokensFlag, "auth-token", "Require the clients to authenticate with one of these comma-separated bearer tokens (or GO_PROXY_AUTH_TOKENS)")
+	flag.Var(&allowFlag, "allow", "The comma-separated client IPs or CIDR ranges, like 10.0.0.0/8, that are allowed to use the proxy (all by default)")
+	flag.Var(&denyFlag, "deny", "The comma-separated client IPs or CIDR ranges that are denied the proxy, even if allowed by -allow")
+	flag.Var(&proxyProtocolFromFlag, "proxy-protocol-from", "The comma-separated IPs or CIDR ranges of the load balancers trusted to send the -proxy-protocol header, the other peers keeping their own address (all by default)")
+	flag.Var(&corsOriginsFlag, "cors-origins", "The comma-separated origins allowed by -cors, like https://app.example.com or https://*.example.com (* allows any)")
+	flag.Var(&scriptsFlag, "script", "The Lua scripts that can change the requests and responses, reloaded when they change. May be repeated or comma-separated")
+	flag.Var(&graphQLPathsFlag, "graphql", "The comma-separated paths of the GraphQL endpoints, like /graphql, whose operations are parsed to be logged")
+	flag.Var(&maintenanceRoutesFlag, "maintenance-routes", "The comma-separated routes, by name or path, that start in maintenance like with -maintenance")
+	flag.Var(&graphQLBlockFlag, "graphql-block", "The comma-separated GraphQL operations rejected with 403 on -graphql, by name, type or both, like deleteUser, subscription or 'mutation delete*'")
+	flag.Var(&acmeHostsFlag, "acme-host", "Serve TLS with certificates obtained automatically from Let's Encrypt (or -acme-directory) for these comma-separated hostnames, which must point to the proxy")
+	flag.Var(&listenFlag, "listen", "The addresses to serve on instead of every interface on -p, like 127.0.0.1:8080 or unix:///run/go-proxy.sock. May be repeated or comma-separated")
+	flag.Var(&forwardAddrsFlag, "addr", "The server address (scheme://host, or unix:///path/to/socket) to forward the request to. May be repeated or comma-separated to balance between several servers")
+	flag.Var(&cacheSizeFlag, "cache-size", "The memory for caching GET responses, like 64MB (0 disables the cache)")
+	flag.Var(&interceptFlag, "intercept", "Hold the requests matching a path like /api/* (optionally preceded by a method, like 'POST /api/*') until they are forwarded, edited or dropped at the admin API. May be repeated")
+	flag.Var(&throttleDownFlag, "throttle-down", "Limit the download bandwidth of each response, like 512kbps or 2mbps, to simulate a slow network (0 means no limit)")
+	flag.Var(&throttleUpFlag, "throttle-up", "Limit the upload bandwidth of each request body, like 256kbps (0 means no limit)")
+	flag.Var(&maxRequestBodyFlag, "max-request-body", "The largest request body accepted, like 10MB, larger ones being rejected with 413 (0 means no limit)")
+	flag.Var(&maxDecodedRequestBodyFlag, "max-decoded-request-body", "The largest request body decoded by -decompress-requests, like 64MB, whatever its compressed size, larger ones being rejected with 413")
+	flag.Var(&maxHeaderSizeFlag, "max-header-size", "The largest request line and headers accepted, like 64KB, larger ones being rejected with 431")
+	flag.Var(&maxLogBodyFlag, "max-log-body", "The bytes of each body written to the log, like 64KB, the rest being omitted but still forwarded (0 means no limit)")
+	flag.Var(&logMethodsFlag, "log-methods", "Only log the requests with these comma-separated methods")
+	flag.Var(&logStatusFlag, "log-status", "Only log the responses with these comma-separated statuses, like 404, or classes, like 5xx")
+	flag.Var(&verboseExpandFlag, "verbose-expand", "Also print the headers and bodies of the requests matching a path like /api/* (optionally preceded by a method, like 'POST /api/*') with -verbose. May be repeated")
+	flag.Var(&logSinksFlag, "log-sink", "The comma-separated destinations of the logs: file (the files in -logs-dir), stdout or stdout:json, console (as with -verbose), syslog, syslog:raw, syslog://host:514 or syslog+tcp://host:514, an http:// or https:// URL receiving JSON lines, or loki+http://host:3100")
+	flag.Var(&logRedactHeadersFlag, "log-redact-headers", "The comma-separated headers whose values are replaced with [REDACTED] in the logs (empty logs them all)")
+	flag.Var(&logRedactFieldsFlag, "log-redact-fields", "The comma-separated JSON fields of the bodies, at any depth, whose values are replaced with [REDACTED] in the logs")
+	flag.Var(&compressTypesFlag, "compress-types", "The comma-separated Content-Types compressed with -compress, like text/* or application/*+json")
+	flag.Var(&compressMinSizeFlag, "compress-min-size", "The smallest response compressed with -compress, like 1KB")
+	flag.Var(&logTextTypesFlag, "log-text-types", "The comma-separated Content-Types whose bodies are logged as text, like text/* or application/*+json")
+	flag.Var(&compareIgnoreHeadersFlag, "compare-ignore-headers", "The comma-separated response headers left out of -compare")
+	flag.Var(&retryStatusesFlag, "retry-statuses", "The comma-separated response statuses that are retried with -retries")
+	flag.Var(&retryMethodsFlag, "retry-methods", "The comma-separated request methods that are retried with -retries")
+	flag.Var(&weightsFlag, "weights", "The comma-separated weights of the servers for -balance weighted, like http://a=3,http://b=1 (1 by default)")
+	flag.Var(&resolveFlag, "resolve", "Connect to host:port at this address instead of resolving the host, like curl's -resolve host:port:address. May be repeated")
+	flag.Var(&routesFlag, "route", "A route of type /path/*=scheme://host sending the paths with that prefix to other servers, or host/path/*=scheme://host for those of a host, like api.local/*. May be repeated")
 }
 
-func main() {
-	flag.Parse()
-
-	port := *portFlag
-	forwardAddr := strings.TrimSuffix(*forwardAddrFlag, "/")
-
-	ensurePortAvailable(port)
-	ensureForwardURLValid(forwardAddr)
-
-	logChan := make(chan logEntry, 2)
-
-	go startLoggerAgent(forwardAddr, logChan)
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		req := writeRequest(r, forwardAddr, logChan)
-
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		writeResponse(w, res, logChan)
-	})
-
-	log.Printf("Starting server on port %d\n\n", port)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(port), nil))
+const usage = `Usage: go-proxy [serve] [flags]
+       go-proxy <command> [flags]
+
+The commands are:
+  serve    run the proxy (the default)
+  replay   answer the requests from a record file, without the servers
+  query    search the exchanges of a record file
+  export   convert the exchanges of a record file to HAR, raw HTTP, curl, Go or pcapng
+  inspect  show an exchange of a record file in full
+  resend   send the requests of a record file to a server again
+  stats    show the latency percentiles of the exchanges of a record file
+  tail     follow the exchanges of a running proxy, filtered by an expression
+  cache    list, show or purge the responses saved by -cache-dir
+  gen-ca   create the CA for -mitm
+
+Run go-proxy <command> -h for the flags of a command. The flags of serve are:
+`
+
+// commands are the subcommands, serve being the one run when the first
+// argument is a flag.
+var commands = map[string]func(args []string){
+	"serve":   runServe,
+	"replay":  runReplay,
+	"query":   runQuery,
+	"export":  runExport,
+	"inspect": runInspect,
+	"resend":  runResend,
+	"stats":   runStats,
+	"tail":    runTail,
+	"cache":   runCache,
+	"gen-ca":  runGenCA,
 }
 
-func ensureForwardURLValid(forwardAddr string) {
-	forwardURL, err := url.Parse(forwardAddr)
-	if err != nil {
-		log.Fatal("The address must be a valid URL")
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
 	}
 
-	if forwardURL.Scheme != "http" && forwardURL.Scheme != "https" {
-		log.Fatal("The scheme must be http or https")
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	if forwardAddr != forwardURL.Scheme+"://"+forwardURL.Host {
-		log.Fatal("The address must be a valid HTTP URL of type scheme://host")
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
 	}
+
+	run(args)
 }
 
-func ensurePortAvailable(port int) {
-	probeTCPListener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+func runServe(args []string) {
+	_ = flag.CommandLine.Parse(args)
+
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Can't listen on port %d: %v", port, err)
+		log.Fatal(err)
 	}
 
-	_ = probeTCPListener.Close()
-}
-
-func startLoggerAgent(fileName string, logChan chan logEntry) {
-	logFile := openLogFile(fileName)
-	logger := log.New(logFile, "", 0)
-
-	var reqTimestamp time.Time
+	if *exportCAFlag != "" {
+		exportCA(cfg.MITM, *exportCAFlag)
 
-	for {
-		entry, ok := <-logChan
+		return
+	}
 
-		if !ok {
-			logFile.Close()
+	serve(cfg)
+}
 
-			break
+// serve runs the proxy until it's interrupted, then waits for the requests
+// in flight.
+func serve(cfg proxy.Config) {
+	switch cfg.Mode {
+	case "tcp":
+		p, err := proxy.NewTCP(cfg)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		logger.Println("==> " + entry.timestamp.Local().Format("02/01/2006 15:04:05"))
-		logger.Println(rawMessage(entry.message))
+		serveUntilInterrupted(p, cfg.Timeouts.Shutdown)
 
-		if entry.message.IsRequest {
-			reqTimestamp = entry.timestamp
-		} else {
-			logger.Printf("==> Elapsed: %s\n\n", entry.timestamp.Sub(reqTimestamp))
+		return
+	case "udp":
+		p, err := proxy.NewUDP(cfg)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}
-}
 
-func writeRequest(r *http.Request, forwardAddr string, logChan chan logEntry) *http.Request {
-	urlPath := strings.TrimPrefix(r.URL.EscapedPath(), "/")
+		serveUntilInterrupted(p, cfg.Timeouts.Shutdown)
 
-	reqURL, err := url.Parse(fmt.Sprintf("%s/%s?%s#%s", forwardAddr, urlPath, r.URL.RawQuery, r.URL.EscapedFragment()))
-	if err != nil {
-		log.Fatal(err)
+		return
 	}
 
-	reqBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Fatal(err)
+	if len(cfg.Listen) == 0 {
+		ensurePortAvailable(cfg.Port)
 	}
 
-	req, err := http.NewRequest(r.Method, reqURL.String(), bytes.NewReader(reqBody))
+	p, err := proxy.New(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for key, values := range r.Header {
-		for _, value := range values {
-			req.Header.Add(key, value)
-		}
+	go reloadOnSIGHUP(p, cfg)
+	go toggleMaintenanceOnSIGUSR1(p)
+
+	if *watchConfigFlag && *configFlag != "" {
+		go watchConfig(p)
 	}
 
-	logChan <- logEntry{timestamp: time.Now(), message: newRawHTTPRequest(req, reqBody)}
+	serveUntilInterrupted(p, cfg.Timeouts.Shutdown)
+}
 
-	return req
+// server is the HTTP proxy, the TCP one or the UDP one.
+type server interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
 }
 
-func writeResponse(w http.ResponseWriter, res *http.Response, logChan chan logEntry) {
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
+func serveUntilInterrupted(p server, shutdownTimeout time.Duration) {
+	serveErr := make(chan error, 1)
 
-	logChan <- logEntry{timestamp: time.Now(), message: newRawHTTPResponse(res, resBody)}
+	go func() {
+		serveErr <- p.ListenAndServe()
+	}()
 
-	for key, values := range res.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+		stop()
 	}
 
-	w.WriteHeader(res.StatusCode)
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", shutdownTimeout)
 
-	_, err = w.Write(resBody)
-	if err != nil {
-		log.Fatal(err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := p.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Some requests didn't finish in time: %v", err)
 	}
 }
 
-func openLogFile(fileName string) *os.File {
-	if _, err := os.Stat(logsDir); os.IsNotExist(err) {
-		err := os.Mkdir(logsDir, 0755)
-		if err != nil {
-			log.Fatal(err)
+// loadConfig reads the config file, if any, over the defaults and then
+// applies the environment and the flags.
+func loadConfig() (proxy.Config, error) {
+	cfg := proxy.DefaultConfig()
+
+	if *configFlag != "" {
+		if err := proxy.LoadConfigFile(&cfg, *configFlag); err != nil {
+			return cfg, fmt.Errorf("can't load the config file %s: %w", *configFlag, err)
 		}
 	}
 
-	logFile, err := os.OpenFile(logFilePath(fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
 	}
 
-	return logFile
-}
+	applyFlags(&cfg)
 
-func logFilePath(forwardAddr string) string {
-	forwardURL, err := url.Parse(forwardAddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return path.Join(logsDir, strings.ReplaceAll(forwardURL.Host, ":", "."))
+	return cfg, nil
 }
 
-type rawHTTPMessage struct {
-	IsRequest bool
-	Method    string
-	Path      string
-	Proto     string
-	Status    string
-	Header    http.Header
-	Body      []byte
-}
+func reloadOnSIGHUP(p *proxy.Proxy, cfg proxy.Config) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	for range sigChan {
+		if cfg.TLS.Cert != "" || len(cfg.TLS.Certs) > 0 {
+			if err := p.ReloadTLS(); err != nil {
+				log.Printf("Can't reload the TLS certificate, keeping the current one: %v", err)
+			} else {
+				log.Printf("Reloaded the TLS certificate")
+			}
+		}
 
-func newRawHTTPRequest(r *http.Request, rBody []byte) *rawHTTPMessage {
-	return &rawHTTPMessage{
-		IsRequest: true,
-		Method:    r.Method,
-		Path:      r.URL.Path,
-		Proto:     r.Proto,
-		Status:    "",
-		Header:    r.Header,
-		Body:      rBody,
+		if *configFlag != "" {
+			reloadConfig(p)
+		}
 	}
 }
 
-func newRawHTTPResponse(r *http.Response, rBody []byte) *rawHTTPMessage {
-	return &rawHTTPMessage{
-		IsRequest: false,
-		Method:    "",
-		Path:      "",
-		Proto:     r.Proto,
-		Status:    r.Status,
-		Header:    r.Header,
-		Body:      rBody,
-	}
-}
+// watchConfig reloads the config file whenever it's modified, checking it
+// every second.
+func watchConfig(p *proxy.Proxy) {
+	var lastMod time.Time
 
-func rawMessage(msg *rawHTTPMessage) string {
-	if msg.IsRequest {
-		return rawRequestMessage(msg)
+	if info, err := os.Stat(*configFlag); err == nil {
+		lastMod = info.ModTime()
 	}
 
-	return rawResponseMessage(msg)
-}
-
-func rawRequestMessage(req *rawHTTPMessage) string {
-	var sb strings.Builder
+	for range time.Tick(time.Second) {
+		info, err := os.Stat(*configFlag)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
 
-	sb.WriteString(fmt.Sprintf("%s %s %s\r\n", req.Method, req.Path, req.Proto))
-	sb.WriteString(rawHeadersAndBody(req))
+		lastMod = info.ModTime()
 
-	return sb.String()
+		reloadConfig(p)
+	}
 }
 
-func rawResponseMessage(res *rawHTTPMessage) string {
-	var sb strings.Builder
+func reloadConfig(p *proxy.Proxy) {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = p.Reload(cfg)
+	}
 
-	sb.WriteString(fmt.Sprintf("%s %s\r\n", res.Proto, res.Status))
-	sb.WriteString(rawHeadersAndBody(res))
+	if err != nil {
+		log.Printf("Can't reload the configuration, keeping the current routes and rewrite rules: %v", err)
+
+		return
+	}
 
-	return sb.String()
+	log.Printf("Reloaded the routes, upstreams and rewrite rules of %s", *configFlag)
 }
 
-func rawHeadersAndBody(msg *rawHTTPMessage) string {
-	var sb strings.Builder
+func exportCA(cfg proxy.MITMConfig, fileName string) {
+	out := os.Stdout
 
-	headerKeys := make([]string, len(msg.Header))
+	if fileName != "-" {
+		file, err := os.Create(fileName)
+		if err != nil {
+			log.Fatalf("Can't create %s: %v", fileName, err)
+		}
+		defer file.Close()
 
-	i := 0
-	for k := range msg.Header {
-		headerKeys[i] = k
-		i++
+		out = file
 	}
 
-	sort.Strings(headerKeys)
-
-	for _, key := range headerKeys {
-		values := msg.Header[key]
-
-		for _, value := range values {
-			sb.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
-		}
+	if err := proxy.ExportCA(cfg, out); err != nil {
+		log.Fatalf("Can't export the CA: %v", err)
 	}
+}
 
-	sb.WriteString(fmt.Sprintf("\r\n%s\r\n", msg.Body))
+func ensurePortAvailable(port int) {
+	probeTCPListener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("Can't listen on port %d: %v", port, err)
+	}
 
-	return sb.String()
+	_ = probeTCPListener.Close()
 }
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go-proxy/proxy"
+)
+
+// toggleMaintenanceOnSIGUSR1 puts the whole proxy in maintenance, or takes
+// it out of it, on every SIGUSR1, like `kill -USR1 <pid>`.
+func toggleMaintenanceOnSIGUSR1(p *proxy.Proxy) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+
+	for range sigChan {
+		m := p.Maintenance()
+		m.Enabled = !m.Enabled
+
+		if err := p.SetMaintenance(m); err != nil {
+			log.Printf("Can't change the maintenance: %v", err)
+
+			continue
+		}
+
+		if m.Enabled {
+			log.Printf("Put the proxy in maintenance on SIGUSR1")
+		} else {
+			log.Printf("Took the proxy out of maintenance on SIGUSR1")
+		}
+	}
+}
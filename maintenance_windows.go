@@ -0,0 +1,7 @@
+package main
+
+import "go-proxy/proxy"
+
+// toggleMaintenanceOnSIGUSR1 does nothing, Windows having no SIGUSR1; the
+// admin API's /maintenance changes the maintenance there.
+func toggleMaintenanceOnSIGUSR1(*proxy.Proxy) {}
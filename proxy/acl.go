@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ACLConfig restricts the clients by IP address or CIDR range, like
+// 10.0.0.0/8. A client in Deny is rejected, and so is one not in Allow
+// unless Allow is empty.
+type ACLConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newACL(cfg ACLConfig) (*acl, error) {
+	allow, err := parseIPNets(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("%w in the access list", err)
+	}
+
+	deny, err := parseIPNets(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("%w in the access list", err)
+	}
+
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	return &acl{allow: allow, deny: deny}, nil
+}
+
+func parseIPNets(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", value)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func (a *acl) allows(ip net.IP) bool {
+	if ip == nil {
+		return len(a.allow) == 0
+	}
+
+	for _, ipNet := range a.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	for _, ipNet := range a.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkACLs tells if the client of the exchange passes both the global
+// access list and that of its route, answering 403 if it doesn't.
+func (p *Proxy) checkACLs(w http.ResponseWriter, ex *exchange) bool {
+	ip := clientIP(ex.inbound)
+
+	for _, a := range []*acl{p.acl, ex.route.acl} {
+		if a == nil || a.allows(net.ParseIP(ip)) {
+			continue
+		}
+
+		log.Printf("Denied request #%d %s %s from %s by the access list", ex.id, ex.inbound.Method, ex.inbound.URL, ip)
+
+		p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Err: fmt.Errorf("403 Forbidden: the client %s is denied by the access list", ip), Status: http.StatusForbidden})
+
+		p.writeError(w, ex.inbound, http.StatusForbidden, fmt.Errorf("the client %s is denied by the access list", ip))
+
+		return false
+	}
+
+	return true
+}
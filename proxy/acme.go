@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncryptDirectory is the ACME directory of Let's Encrypt, which the
+// certificates are obtained from by default.
+const LetsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+// acmeRenewBefore is how long before they expire the certificates are
+// renewed.
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// ACMEConfig obtains the certificates of the listener for Hosts from an
+// ACME CA, Let's Encrypt by default, answering its HTTP-01 challenges on
+// HTTPAddr, which it must reach on port 80, and renewing them 30 days
+// before they expire. The account key and the certificates are kept in the
+// Cache directory.
+type ACMEConfig struct {
+	Hosts     []string `yaml:"hosts"`
+	Email     string   `yaml:"email"`
+	Directory string   `yaml:"directory"`
+	Cache     string   `yaml:"cache"`
+	HTTPAddr  string   `yaml:"http_addr"`
+}
+
+func (c *ACMEConfig) validate() error {
+	for i, host := range c.Hosts {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if host == "" || strings.ContainsAny(host, "*:/") {
+			return fmt.Errorf("invalid ACME host %q, which must be a plain hostname", c.Hosts[i])
+		}
+
+		c.Hosts[i] = host
+	}
+
+	u, err := url.Parse(c.Directory)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid ACME directory %q, which must be an http(s) URL", c.Directory)
+	}
+
+	if c.Cache == "" {
+		return errors.New("the ACME cache directory can't be empty")
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		return fmt.Errorf("invalid ACME challenge address %q, which must be like :80", c.HTTPAddr)
+	}
+
+	return nil
+}
+
+// acmeManager gets the certificates of the ACME hosts with autocert, from
+// the cache or else from the CA, during the TLS handshakes, and renews
+// them in the background.
+type acmeManager struct {
+	cfg     ACMEConfig
+	manager *autocert.Manager
+
+	// redirectPort is the port the plain HTTP requests are redirected to,
+	// "" for 443.
+	redirectPort string
+}
+
+func newACMEManager(cfg ACMEConfig) (*acmeManager, error) {
+	if err := os.MkdirAll(cfg.Cache, 0700); err != nil {
+		return nil, fmt.Errorf("can't create the ACME cache directory: %w", err)
+	}
+
+	return &acmeManager{
+		cfg: cfg,
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(cfg.Cache),
+			HostPolicy:  autocert.HostWhitelist(cfg.Hosts...),
+			RenewBefore: acmeRenewBefore,
+			Email:       cfg.Email,
+			Client:      &acme.Client{DirectoryURL: cfg.Directory},
+		},
+	}, nil
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// The clients connecting by IP send no server name.
+	if hello.ServerName == "" && len(m.cfg.Hosts) == 1 {
+		named := *hello
+		named.ServerName = m.cfg.Hosts[0]
+		hello = &named
+	}
+
+	return m.manager.GetCertificate(hello)
+}
+
+// start obtains the missing certificates in the background, autocert
+// renewing them from then on. Each attempt gives up after 5 minutes.
+func (m *acmeManager) start() {
+	for _, host := range m.cfg.Hosts {
+		go func(host string) {
+			// An ECDSA hello, for the certificate the clients mostly get.
+			hello := &tls.ClientHelloInfo{
+				ServerName:       host,
+				SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				SupportedCurves:  []tls.CurveID{tls.CurveP256},
+				CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			}
+
+			cert, err := m.manager.GetCertificate(hello)
+			if err != nil {
+				log.Printf("Can't obtain the certificate of %s, which the handshakes will try again: %v", host, err)
+
+				return
+			}
+
+			log.Printf("Got the certificate of %s, valid until %s", host, cert.Leaf.NotAfter.Format(time.RFC3339))
+		}(host)
+	}
+}
+
+// listenChallenges serves the HTTP-01 challenges on the HTTP address and
+// starts obtaining the certificates. The other plain HTTP requests are
+// redirected to the port of ln.
+func (p *Proxy) listenChallenges(ln net.Listener) error {
+	listener, err := net.Listen("tcp", p.cfg.TLS.ACME.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("can't listen on the ACME challenge address %s: %w", p.cfg.TLS.ACME.HTTPAddr, err)
+	}
+
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && addr.Port != 443 {
+		p.acme.redirectPort = strconv.Itoa(addr.Port)
+	}
+
+	p.challenges = &http.Server{Handler: p.acme.httpHandler()}
+
+	go func() {
+		if err := p.challenges.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("The ACME challenge server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Answering the ACME challenges on %s", p.cfg.TLS.ACME.HTTPAddr)
+
+	p.acme.start()
+
+	return nil
+}
+
+// httpHandler answers the HTTP-01 challenges, redirecting the other
+// requests to HTTPS.
+func (m *acmeManager) httpHandler() http.Handler {
+	return m.manager.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if m.redirectPort != "" {
+			host = net.JoinHostPort(host, m.redirectPort)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+}
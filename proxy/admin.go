@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+//go:embed ui/index.html
+var webUI []byte
+
+// AdminConfig enables the admin API and the web UI on Port, listening on
+// localhost only. The web UI keeps the last History exchanges. Every admin
+// request but /healthz must carry Token, which is generated if it's empty.
+type AdminConfig struct {
+	Port    int    `yaml:"port"`
+	History int    `yaml:"history"`
+	Token   string `yaml:"token"`
+}
+
+// errAdminAddr rejects the connections to the admin API made through the
+// proxy, which would let the clients of the forward proxy reach it on
+// localhost.
+var errAdminAddr = errors.New("the admin API can't be reached through the proxy")
+
+// newAdminToken returns a random token for the admin API, when none is
+// configured.
+func newAdminToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(token)
+}
+
+// refuseAdminAddr is the Control of the dialers to the upstreams, refusing
+// to connect to the admin port on a loopback address.
+func refuseAdminAddr(port int) func(network, address string, c syscall.RawConn) error {
+	return func(_, address string, _ syscall.RawConn) error {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil || portStr != strconv.Itoa(port) {
+			return nil
+		}
+
+		if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) {
+			return errAdminAddr
+		}
+
+		return nil
+	}
+}
+
+// AdminToken returns the token of the admin API, the one generated if none
+// was configured.
+func (p *Proxy) AdminToken() string {
+	return p.cfg.Admin.Token
+}
+
+// AdminHandler returns the admin API as an http.Handler, to be served by a
+// server other than the one started by ListenAndServe.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", p.serveHealthz)
+
+	for _, path := range []string{"/config", "/stats", "/upstreams", "/cache/flush", "/logging", "/maintenance"} {
+		mux.HandleFunc(path, p.serveControl)
+	}
+
+	mux.HandleFunc("/cache", p.serveCache)
+	mux.HandleFunc("/cache/", p.serveCache)
+
+	if p.interceptor != nil {
+		mux.HandleFunc("/intercepted", p.interceptor.serveIntercepted)
+		mux.HandleFunc("/intercepted/", p.interceptor.serveIntercepted)
+	}
+
+	if p.traffic != nil {
+		mux.HandleFunc("/exchanges", p.traffic.serveExchanges)
+		mux.HandleFunc("/exchanges/", p.traffic.serveExchanges)
+		mux.HandleFunc("/events", p.traffic.serveEvents)
+		mux.HandleFunc("/", serveWebUI)
+	}
+
+	return p.requireAdminToken(mux)
+}
+
+func (p *Proxy) listenAdmin() error {
+	listener, err := net.Listen("tcp", "localhost:"+strconv.Itoa(p.cfg.Admin.Port))
+	if err != nil {
+		return fmt.Errorf("can't listen on the admin port %d: %w", p.cfg.Admin.Port, err)
+	}
+
+	p.admin = &http.Server{Handler: p.AdminHandler()}
+
+	go func() {
+		if err := p.admin.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("The admin server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Serving the admin API on localhost:%d", p.cfg.Admin.Port)
+
+	return nil
+}
+
+func serveWebUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(webUI)
+}
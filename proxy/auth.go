@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AuthConfig requires the clients to authenticate before their requests
+// are forwarded, with basic auth as one of Users (names to passwords) or
+// with one of the bearer Tokens. The credentials are removed from the
+// forwarded requests. In forward proxy mode they are taken from
+// Proxy-Authorization instead.
+type AuthConfig struct {
+	Users  map[string]string `yaml:"users"`
+	Tokens []string          `yaml:"tokens"`
+	Realm  string            `yaml:"realm"`
+}
+
+func (ac AuthConfig) enabled() bool {
+	return len(ac.Users) > 0 || len(ac.Tokens) > 0
+}
+
+func (ac AuthConfig) validate() error {
+	for name := range ac.Users {
+		if name == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("invalid user name %q, which can't be empty or contain a colon", name)
+		}
+	}
+
+	for _, token := range ac.Tokens {
+		if token == "" {
+			return errors.New("the auth tokens can't be empty")
+		}
+	}
+
+	return nil
+}
+
+// authenticates tells if the credentials of an Authorization header are
+// valid.
+func (ac AuthConfig) authenticates(authorization string) bool {
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		for _, token := range ac.Tokens {
+			if subtle.ConstantTimeCompare([]byte(credentials), []byte(token)) == 1 {
+				return true
+			}
+		}
+	case strings.EqualFold(scheme, "Basic"):
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return false
+		}
+
+		name, password, _ := strings.Cut(string(decoded), ":")
+
+		if want, ok := ac.Users[name]; ok {
+			return subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+		}
+	}
+
+	return false
+}
+
+// authenticatedTunnelKey marks the requests decrypted from a CONNECT tunnel,
+// whose client authenticated once with the CONNECT request and doesn't send
+// Proxy-Authorization again inside the tunnel.
+type authenticatedTunnelKey struct{}
+
+// checkAuth tells if the client of the exchange is authenticated, asking
+// for credentials if it isn't.
+func (p *Proxy) checkAuth(w http.ResponseWriter, ex *exchange) bool {
+	auth := p.cfg.Auth
+	if !auth.enabled() || ex.inbound.Context().Value(authenticatedTunnelKey{}) != nil {
+		return true
+	}
+
+	header, challenge, status := "Authorization", "WWW-Authenticate", http.StatusUnauthorized
+	if ex.route == forwardProxyRoute {
+		header, challenge, status = "Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired
+	}
+
+	if auth.authenticates(ex.inbound.Header.Get(header)) {
+		ex.inbound.Header.Del(header)
+
+		return true
+	}
+
+	log.Printf("Rejected request #%d %s %s from %s without valid credentials", ex.id, ex.inbound.Method, ex.inbound.URL, clientIP(ex.inbound))
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Err: fmt.Errorf("%d %s: missing or invalid credentials", status, http.StatusText(status)), Status: status})
+
+	realm := auth.Realm
+	if realm == "" {
+		realm = "go-proxy"
+	}
+
+	if len(auth.Users) > 0 {
+		w.Header().Add(challenge, fmt.Sprintf("Basic realm=%q", realm))
+	}
+
+	if len(auth.Tokens) > 0 {
+		w.Header().Add(challenge, fmt.Sprintf("Bearer realm=%q", realm))
+	}
+
+	p.writeError(w, ex.inbound, status, errors.New("missing or invalid credentials"))
+
+	return false
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxHexDumpBytes = 256
+
+// isTextBody tells whether a body of the given Content-Type can be logged as
+// text. Without a Content-Type or an allowlist, it must be valid UTF-8.
+func isTextBody(contentType string, body []byte, textTypes []string) bool {
+	if contentType == "" || len(textTypes) == 0 {
+		return utf8.Valid(body)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return utf8.Valid(body)
+	}
+
+	for _, pattern := range textTypes {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renderedBinary returns a copy of msg whose binary body is replaced by a
+// hex dump of its first bytes, or just its size with mode omit.
+func renderedBinary(msg *Message, mode string, textTypes []string) *Message {
+	if len(msg.Body) == 0 || isTextBody(msg.Header.Get("Content-Type"), msg.Body, textTypes) {
+		return msg
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("[binary, %d bytes]", msg.BodySize()))
+
+	if mode == "hex" {
+		dump := msg.Body
+		if len(dump) > maxHexDumpBytes {
+			dump = dump[:maxHexDumpBytes]
+		}
+
+		sb.WriteString("\n")
+		sb.WriteString(strings.TrimSuffix(hex.Dump(dump), "\n"))
+
+		if msg.BodySize() > len(dump) {
+			sb.WriteString(fmt.Sprintf("\n[... %d more bytes]", msg.BodySize()-len(dump)))
+		}
+	}
+
+	rendered := *msg
+	rendered.Body = []byte(sb.String())
+	rendered.Omitted = 0
+
+	return &rendered
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"text/template"
+)
+
+const redacted = "[REDACTED]"
+
+// BodyRule transforms the bodies of the requests matching Match before they
+// are forwarded, and those of their responses before they reach the client.
+type BodyRule struct {
+	Match    RequestMatch  `yaml:"match"`
+	Request  BodyTransform `yaml:"request"`
+	Response BodyTransform `yaml:"response"`
+}
+
+// BodyTransform changes a body in three steps, each one being optional:
+//
+//   - Redact replaces the values of the JSON fields with these names, at
+//     any depth, with "[REDACTED]".
+//   - Replace substitutes the text found by Find, or by the regular
+//     expression Regex (where With can refer to its groups, like $1).
+//   - Template renders the new body with text/template, given the .Body as
+//     text, its .JSON when it's valid JSON, the .Method, .Path, .Query and
+//     .Header of the request and the .Status of the response.
+type BodyTransform struct {
+	Redact   []string          `yaml:"redact"`
+	Replace  []BodyReplacement `yaml:"replace"`
+	Template string            `yaml:"template"`
+
+	template *template.Template
+}
+
+type BodyReplacement struct {
+	Find  string `yaml:"find"`
+	Regex string `yaml:"regex"`
+	With  string `yaml:"with"`
+
+	regex *regexp.Regexp
+}
+
+type bodyTemplateData struct {
+	Body   string
+	JSON   interface{}
+	Method string
+	Path   string
+	Query  map[string][]string
+	Header http.Header
+	Status int
+}
+
+var bodyTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		content, err := json.Marshal(v)
+
+		return string(content), err
+	},
+}
+
+func (t *BodyTransform) compile() error {
+	for i := range t.Replace {
+		replacement := &t.Replace[i]
+
+		if (replacement.Find == "") == (replacement.Regex == "") {
+			return fmt.Errorf("a body replacement must have either find or regex")
+		}
+
+		if replacement.Regex == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(replacement.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid body regex %q: %w", replacement.Regex, err)
+		}
+
+		replacement.regex = re
+	}
+
+	if t.Template == "" {
+		return nil
+	}
+
+	tmpl, err := template.New("body").Funcs(bodyTemplateFuncs).Option("missingkey=zero").Parse(t.Template)
+	if err != nil {
+		return fmt.Errorf("invalid body template: %w", err)
+	}
+
+	t.template = tmpl
+
+	return nil
+}
+
+func (t *BodyTransform) isEmpty() bool {
+	return len(t.Redact) == 0 && len(t.Replace) == 0 && t.Template == ""
+}
+
+func (t *BodyTransform) apply(body []byte, r *http.Request, status int) ([]byte, error) {
+	if len(t.Redact) > 0 {
+		body = redactJSON(body, t.Redact)
+	}
+
+	for _, replacement := range t.Replace {
+		if replacement.regex != nil {
+			body = replacement.regex.ReplaceAll(body, []byte(replacement.With))
+		} else {
+			body = bytes.ReplaceAll(body, []byte(replacement.Find), []byte(replacement.With))
+		}
+	}
+
+	if t.template == nil {
+		return body, nil
+	}
+
+	data := bodyTemplateData{Body: string(body), Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header, Status: status}
+	_ = json.Unmarshal(body, &data.JSON)
+
+	var rendered bytes.Buffer
+
+	if err := t.template.Execute(&rendered, data); err != nil {
+		return nil, fmt.Errorf("can't render the body template: %w", err)
+	}
+
+	return rendered.Bytes(), nil
+}
+
+// redactJSON returns body with the values of the fields replaced, or body
+// itself if it isn't JSON. The fields of the objects end up sorted.
+func redactJSON(body []byte, fields []string) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+
+	if !redactValue(value, fields) {
+		return body
+	}
+
+	redactedBody, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+
+	return redactedBody
+}
+
+func redactValue(value interface{}, fields []string) bool {
+	changed := false
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if containsValue(fields, key) {
+				value[key] = redacted
+				changed = true
+			} else if redactValue(field, fields) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if redactValue(item, fields) {
+				changed = true
+			}
+		}
+	}
+
+	return changed
+}
+
+// transformRequestBody applies the request side of the body rules matching
+// r. Encoded request bodies are left alone.
+func (rw *rewriteRules) transformRequestBody(r *http.Request, body []byte) ([]byte, error) {
+	if r.Header.Get("Content-Encoding") != "" {
+		return body, nil
+	}
+
+	for i := range rw.body {
+		rule := &rw.body[i]
+		if rule.Request.isEmpty() || !rule.Match.matches(r) {
+			continue
+		}
+
+		var err error
+
+		if body, err = rule.Request.apply(body, r, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+// transformResponseBody applies the response side of the body rules
+// matching the request of res, decoding the body first if needed and
+// updating Content-Length.
+func (rw *rewriteRules) transformResponseBody(r *http.Request, res *http.Response, body []byte) ([]byte, error) {
+	transformed := false
+
+	for i := range rw.body {
+		rule := &rw.body[i]
+		if rule.Response.isEmpty() || !rule.Match.matches(r) {
+			continue
+		}
+
+		if !transformed {
+			msg := decodedMessage(&Message{Header: res.Header, Body: body})
+			if res.Header.Get("Content-Encoding") != "" && len(body) > 0 && bytes.Equal(msg.Body, body) {
+				return body, nil
+			}
+
+			body, transformed = msg.Body, true
+			res.Header.Del("Content-Encoding")
+		}
+
+		var err error
+
+		if body, err = rule.Response.apply(body, r, res.StatusCode); err != nil {
+			return nil, err
+		}
+	}
+
+	if transformed {
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	return body, nil
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RouteTimeouts override the timeouts of the config for the requests of a
+// route, those left at 0 being kept.
+type RouteTimeouts struct {
+	Dial           time.Duration `yaml:"dial"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	Request        time.Duration `yaml:"request"`
+}
+
+// timeoutBudgets are the time limits of an exchange with an upstream: to
+// connect and to get the response headers once the request is sent, for
+// every attempt, and for the whole exchange, retries included. They cancel
+// the upstream request, remembering which one fired to tell in the logs.
+type timeoutBudgets struct {
+	dial           time.Duration
+	responseHeader time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	fired    string
+	header   *time.Timer
+	attempts []context.CancelFunc
+}
+
+type timeoutBudgetsKey struct{}
+
+// exchangeTimeouts are the timeouts of the route of ex, or else those of
+// the config.
+func (p *Proxy) exchangeTimeouts(ex *exchange) RouteTimeouts {
+	t := p.cfg.Timeouts.upstream()
+
+	if rt := ex.route.timeouts; rt != nil {
+		if rt.Dial > 0 {
+			t.Dial = rt.Dial
+		}
+
+		if rt.ResponseHeader > 0 {
+			t.ResponseHeader = rt.ResponseHeader
+		}
+
+		if rt.Request > 0 {
+			t.Request = rt.Request
+		}
+	}
+
+	return t
+}
+
+// upstream are the timeouts of the requests to the upstreams.
+func (t TimeoutsConfig) upstream() RouteTimeouts {
+	return RouteTimeouts{Dial: t.Dial, ResponseHeader: t.ResponseHeader, Request: t.Request}
+}
+
+// newTimeoutBudgets starts the budgets of t for the requests made with
+// their context, or returns nil if there are none.
+func newTimeoutBudgets(parent context.Context, t RouteTimeouts) *timeoutBudgets {
+	if t.Dial == 0 && t.ResponseHeader == 0 && t.Request == 0 {
+		return nil
+	}
+
+	b := &timeoutBudgets{dial: t.Dial, responseHeader: t.ResponseHeader}
+
+	ctx := context.WithValue(parent, timeoutBudgetsKey{}, b)
+
+	if t.Request > 0 {
+		b.ctx, b.cancel = context.WithTimeout(ctx, t.Request)
+	} else {
+		b.ctx, b.cancel = context.WithCancel(ctx)
+	}
+
+	return b
+}
+
+// attempt gives req a context of its own for an attempt, which the
+// response header budget cancels without ending the exchange, so that it
+// can be retried.
+func (b *timeoutBudgets) attempt(req *http.Request) *http.Request {
+	if b == nil || b.responseHeader == 0 {
+		return req
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+
+	b.mu.Lock()
+	b.fired = ""
+	b.attempts = append(b.attempts, cancel)
+	b.mu.Unlock()
+
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest:         func(httptrace.WroteRequestInfo) { b.startHeaderTimer(cancel) },
+		GotFirstResponseByte: b.stopHeaderTimer,
+	})
+
+	return req.WithContext(ctx)
+}
+
+func requestTimeoutBudgets(ctx context.Context) *timeoutBudgets {
+	b, _ := ctx.Value(timeoutBudgetsKey{}).(*timeoutBudgets)
+
+	return b
+}
+
+func (b *timeoutBudgets) startHeaderTimer(cancel context.CancelFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.header != nil {
+		b.header.Stop()
+	}
+
+	b.header = time.AfterFunc(b.responseHeader, func() {
+		b.mu.Lock()
+		b.fired = "response_header"
+		b.mu.Unlock()
+
+		cancel()
+	})
+}
+
+func (b *timeoutBudgets) stopHeaderTimer() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.header != nil {
+		b.header.Stop()
+	}
+}
+
+// stop releases the timers once the exchange is over.
+func (b *timeoutBudgets) stop() {
+	if b == nil {
+		return
+	}
+
+	b.stopHeaderTimer()
+	b.cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, cancel := range b.attempts {
+		cancel()
+	}
+}
+
+// exceeded tells which budget err comes from: dial, response_header or
+// request, or "" if none.
+func (b *timeoutBudgets) exceeded(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return "dial"
+	}
+
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	fired := b.fired
+	b.mu.Unlock()
+
+	if fired == "" && errors.Is(b.ctx.Err(), context.DeadlineExceeded) {
+		fired = "request"
+	}
+
+	return fired
+}
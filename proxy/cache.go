@@ -0,0 +1,544 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// staleIfErrorStatuses are the upstream errors that the stale responses
+// replace (RFC 5861, section 4).
+var staleIfErrorStatuses = map[int]bool{
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// cacheWarnings are the Warning headers of the stale responses.
+var cacheWarnings = map[int]string{
+	110: "Response is Stale",
+	111: "Revalidation Failed",
+}
+
+type cachedResponse struct {
+	key      string
+	url      string
+	vary     []string
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+
+	// staleWhileRevalidate and staleIfError are how long past expires the
+	// response may be served stale (RFC 5861).
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+// cacheFreshness tells how a cached response can be used.
+type cacheFreshness int
+
+const (
+	cacheFresh cacheFreshness = iota
+
+	// cacheRevalidate responses are served stale while being refreshed in
+	// the background.
+	cacheRevalidate
+
+	// cacheStaleIfError responses are only served if the upstream fails.
+	cacheStaleIfError
+)
+
+func (c *cachedResponse) freshness(now time.Time) (cacheFreshness, bool) {
+	switch {
+	case !now.After(c.expires):
+		return cacheFresh, true
+	case !now.After(c.expires.Add(c.staleWhileRevalidate)):
+		return cacheRevalidate, true
+	case !now.After(c.expires.Add(c.staleIfError)):
+		return cacheStaleIfError, true
+	}
+
+	return 0, false
+}
+
+func (c *cachedResponse) size() int64 {
+	size := int64(len(c.key) + len(c.body))
+
+	for key, values := range c.header {
+		for _, value := range values {
+			size += int64(len(key) + len(value))
+		}
+	}
+
+	return size
+}
+
+type responseCache struct {
+	maxSize              int64
+	ttl                  time.Duration
+	dir                  string
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	mu           sync.Mutex
+	size         int64
+	lru          *list.List
+	entries      map[string]*list.Element
+	varies       map[string][]string
+	revalidating map[string]bool
+
+	// variants counts the entries of each URL, whose Vary is forgotten
+	// with the last one.
+	variants map[string]int
+
+	// saves are the cache files to write, or to remove when nil, by key,
+	// which writeFiles does out of the way of the responses.
+	saves    map[string]*cachedResponse
+	saveWake chan struct{}
+	saveStop chan struct{}
+	saveDone chan struct{}
+}
+
+// newResponseCache returns the cache of cfg, loading the responses saved in
+// its directory if it has one.
+func newResponseCache(cfg CacheConfig) (*responseCache, error) {
+	c := &responseCache{
+		maxSize:              int64(cfg.Size),
+		ttl:                  cfg.TTL,
+		dir:                  cfg.Dir,
+		staleWhileRevalidate: cfg.StaleWhileRevalidate,
+		staleIfError:         cfg.StaleIfError,
+		lru:                  list.New(),
+		entries:              make(map[string]*list.Element),
+		varies:               make(map[string][]string),
+		revalidating:         make(map[string]bool),
+		variants:             make(map[string]int),
+		saves:                make(map[string]*cachedResponse),
+	}
+
+	if c.dir != "" {
+		c.saveWake, c.saveStop, c.saveDone = make(chan struct{}, 1), make(chan struct{}), make(chan struct{})
+
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+
+		go c.writeFiles()
+	}
+
+	return c, nil
+}
+
+// close writes the last changes to the cache directory.
+func (c *responseCache) close() {
+	if c.dir == "" {
+		return
+	}
+
+	close(c.saveStop)
+	<-c.saveDone
+}
+
+// lookup returns the response cached for r, and how fresh it is.
+func (c *responseCache) lookup(r *http.Request) (*cachedResponse, cacheFreshness) {
+	if r.Method != http.MethodGet || !isCacheableRequest(r) {
+		return nil, 0
+	}
+
+	if _, ok := parseCacheControl(r.Header.Get("Cache-Control"))["no-cache"]; ok {
+		return nil, 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	primaryKey := cachePrimaryKey(r)
+
+	elem, ok := c.entries[cacheVariantKey(primaryKey, c.varies[primaryKey], r.Header)]
+	if !ok {
+		return nil, 0
+	}
+
+	cached := elem.Value.(*cachedResponse)
+
+	freshness, ok := cached.freshness(time.Now())
+	if !ok {
+		c.remove(elem)
+
+		return nil, 0
+	}
+
+	c.lru.MoveToFront(elem)
+
+	return cached, freshness
+}
+
+// startRevalidation tells if cached should be refreshed, false if it's
+// already being refreshed. finishRevalidation must be called then.
+func (c *responseCache) startRevalidation(cached *cachedResponse) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.revalidating[cached.key] {
+		return false
+	}
+
+	c.revalidating[cached.key] = true
+
+	return true
+}
+
+func (c *responseCache) finishRevalidation(cached *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.revalidating, cached.key)
+}
+
+// staleLifetime is how long past its expiry a response may be served stale
+// for a directive of its Cache-Control, up to limit, or limit with the TTL
+// of the config.
+func (c *responseCache) staleLifetime(cacheControl map[string]string, directive string, limit time.Duration) time.Duration {
+	if c.ttl > 0 {
+		return limit
+	}
+
+	seconds, err := strconv.Atoi(cacheControl[directive])
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+
+	if lifetime := time.Duration(seconds) * time.Second; lifetime < limit {
+		return lifetime
+	}
+
+	return limit
+}
+
+func (c *responseCache) store(r *http.Request, res *http.Response, body []byte) {
+	if r.Method != http.MethodGet || !isCacheableRequest(r) || !cacheableStatuses[res.StatusCode] {
+		return
+	}
+
+	resCacheControl := parseCacheControl(res.Header.Get("Cache-Control"))
+
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := resCacheControl[directive]; ok {
+			return
+		}
+	}
+
+	// The cookies are set for a client: the responses setting them are
+	// shared only when public, without them.
+	_, public := resCacheControl["public"]
+	if len(res.Header.Values("Set-Cookie")) > 0 && !public {
+		return
+	}
+
+	vary := varyHeaders(res.Header)
+	for _, name := range vary {
+		if name == "*" {
+			return
+		}
+	}
+
+	now := time.Now()
+
+	lifetime := c.ttl
+	if lifetime == 0 {
+		var ok bool
+		if lifetime, ok = freshnessLifetime(res.Header, resCacheControl, now); !ok {
+			return
+		}
+	}
+
+	if lifetime <= 0 {
+		return
+	}
+
+	primaryKey := cachePrimaryKey(r)
+
+	cached := &cachedResponse{
+		key:      cacheVariantKey(primaryKey, vary, r.Header),
+		url:      primaryKey,
+		vary:     vary,
+		status:   res.StatusCode,
+		header:   res.Header.Clone(),
+		body:     body,
+		storedAt: now,
+		expires:  now.Add(lifetime),
+
+		staleWhileRevalidate: c.staleLifetime(resCacheControl, "stale-while-revalidate", c.staleWhileRevalidate),
+		staleIfError:         c.staleLifetime(resCacheControl, "stale-if-error", c.staleIfError),
+	}
+
+	cached.header.Del("Set-Cookie")
+
+	if cached.size() > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.add(cached)
+	c.save(cached.key, cached)
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// add caches cached, replacing the response of the same key.
+func (c *responseCache) add(cached *cachedResponse) {
+	if elem, ok := c.entries[cached.key]; ok {
+		c.remove(elem)
+	}
+
+	c.varies[cached.url] = cached.vary
+	c.variants[cached.url]++
+	c.entries[cached.key] = c.lru.PushFront(cached)
+	c.size += cached.size()
+}
+
+// save has writeFiles write the file of cached, or remove the file of key
+// if it's nil. The caller must hold c.mu.
+func (c *responseCache) save(key string, cached *cachedResponse) {
+	if c.dir == "" {
+		return
+	}
+
+	c.saves[key] = cached
+
+	select {
+	case c.saveWake <- struct{}{}:
+	default:
+	}
+}
+
+// writeFiles applies the saves to the cache directory until the cache is
+// closed.
+func (c *responseCache) writeFiles() {
+	defer close(c.saveDone)
+
+	for {
+		select {
+		case <-c.saveWake:
+			c.applySaves()
+		case <-c.saveStop:
+			c.applySaves()
+
+			return
+		}
+	}
+}
+
+func (c *responseCache) applySaves() {
+	c.mu.Lock()
+	saves := c.saves
+	c.saves = make(map[string]*cachedResponse)
+	c.mu.Unlock()
+
+	for key, cached := range saves {
+		if cached == nil {
+			os.Remove(filepath.Join(c.dir, cacheEntryID(key)+cacheFileExt))
+
+			continue
+		}
+
+		if err := writeCacheFile(c.dir, cached); err != nil {
+			log.Printf("Can't save the cached response of %s: %v", cached.url, err)
+		}
+	}
+}
+
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		c.save(key, nil)
+	}
+
+	c.size = 0
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.varies = make(map[string][]string)
+	c.variants = make(map[string]int)
+}
+
+func (c *responseCache) remove(elem *list.Element) {
+	cached := c.lru.Remove(elem).(*cachedResponse)
+
+	delete(c.entries, cached.key)
+	c.size -= cached.size()
+
+	if c.variants[cached.url]--; c.variants[cached.url] <= 0 {
+		delete(c.variants, cached.url)
+		delete(c.varies, cached.url)
+	}
+
+	c.save(cached.key, nil)
+}
+
+// serve answers r with cached, marked as stale with the warning code of RFC
+// 7234 unless it's 0.
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, cached *cachedResponse, warning int) int {
+	copyHeader(w.Header(), cached.header)
+
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(cached.storedAt).Seconds())))
+	w.Header().Set("X-Cache", "HIT")
+
+	if warning != 0 {
+		w.Header().Set("X-Cache", "STALE")
+		w.Header().Add("Warning", fmt.Sprintf("%d - %q", warning, cacheWarnings[warning]))
+	}
+
+	if cached.status == http.StatusOK && isNotModified(r, cached.header) {
+		w.WriteHeader(http.StatusNotModified)
+
+		return http.StatusNotModified
+	}
+
+	w.WriteHeader(cached.status)
+
+	_, _ = w.Write(cached.body)
+
+	return cached.status
+}
+
+func isCacheableRequest(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	_, noStore := parseCacheControl(r.Header.Get("Cache-Control"))["no-store"]
+
+	return !noStore
+}
+
+func isNotModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ifModifiedSince)
+}
+
+func freshnessLifetime(header http.Header, cacheControl map[string]string, now time.Time) (time.Duration, bool) {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cacheControl[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, false
+			}
+
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	if expiresHeader := header.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			return 0, true
+		}
+
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+
+		return expires.Sub(date), true
+	}
+
+	return 0, false
+}
+
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		name, arg, _ := strings.Cut(directive, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+
+	return directives
+}
+
+func varyHeaders(header http.Header) []string {
+	var names []string
+
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func cachePrimaryKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+func cacheVariantKey(primaryKey string, vary []string, header http.Header) string {
+	var sb strings.Builder
+
+	sb.WriteString(primaryKey)
+
+	for _, name := range vary {
+		sb.WriteString("\n" + name + ": " + strings.Join(header.Values(name), ", "))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseCacheSetCookie(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		setCookie    bool
+		wantCached   bool
+	}{
+		{name: "no cookie", cacheControl: "max-age=60", wantCached: true},
+		{name: "cookie", cacheControl: "max-age=60", setCookie: true, wantCached: false},
+		{name: "public cookie", cacheControl: "public, max-age=60", setCookie: true, wantCached: true},
+		{name: "private cookie", cacheControl: "private, max-age=60", setCookie: true, wantCached: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := newResponseCache(CacheConfig{Size: 1 << 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "http://localhost/page", nil)
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {tt.cacheControl}}}
+
+			if tt.setCookie {
+				res.Header.Set("Set-Cookie", "session=alice")
+			}
+
+			cache.store(r, res, []byte("hello"))
+
+			cached, _ := cache.lookup(r)
+			if (cached != nil) != tt.wantCached {
+				t.Fatalf("cached = %v, want %v", cached != nil, tt.wantCached)
+			}
+
+			if cached != nil && cached.header.Get("Set-Cookie") != "" {
+				t.Errorf("the cached response sets the cookie %q", cached.header.Get("Set-Cookie"))
+			}
+
+			if tt.setCookie && res.Header.Get("Set-Cookie") == "" {
+				t.Errorf("the response lost its cookie")
+			}
+		})
+	}
+}
+
+func TestResponseCacheDir(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := newResponseCache(CacheConfig{Size: 1 << 20, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(path, vary string) *http.Request {
+		r := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		r.Header.Set("Accept-Language", "en")
+
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=60"}}}
+		if vary != "" {
+			res.Header.Set("Vary", vary)
+		}
+
+		cache.store(r, res, []byte("hello"))
+
+		return r
+	}
+
+	kept := store("/kept", "Accept-Language")
+	purged := store("/purged", "Accept-Language")
+
+	if n := cache.purge("localhost/purged"); n != 1 {
+		t.Fatalf("purge = %d, want 1", n)
+	}
+
+	cache.mu.Lock()
+	_, varied := cache.varies[cachePrimaryKey(purged)]
+	cache.mu.Unlock()
+
+	if varied {
+		t.Errorf("the Vary of the purged URL is kept")
+	}
+
+	cache.close()
+
+	reloaded, err := newResponseCache(CacheConfig{Size: 1 << 20, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.close()
+
+	if cached, _ := reloaded.lookup(kept); cached == nil {
+		t.Errorf("the saved response of /kept isn't loaded back")
+	}
+
+	if cached, _ := reloaded.lookup(purged); cached != nil {
+		t.Errorf("the purged response of /purged is loaded back")
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// The pure Go driver keeps the builds free of cgo.
+	_ "modernc.org/sqlite"
+)
+
+// isCaptureDB tells if a record file is an SQLite database rather than JSON
+// lines, by its extension.
+func isCaptureDB(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	}
+
+	return false
+}
+
+// captureSchema stores the exchanges as their record lines, with the
+// columns searched by CaptureQuery indexed next to them.
+var captureSchema = []string{
+	`CREATE TABLE IF NOT EXISTS exchanges (
+		id INTEGER PRIMARY KEY,
+		time INTEGER NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		duration_ms REAL NOT NULL,
+		size INTEGER NOT NULL,
+		route TEXT NOT NULL,
+		upstream TEXT NOT NULL,
+		exchange TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS exchanges_time ON exchanges (time)`,
+	`CREATE INDEX IF NOT EXISTS exchanges_method ON exchanges (method)`,
+	`CREATE INDEX IF NOT EXISTS exchanges_path ON exchanges (path)`,
+	`CREATE INDEX IF NOT EXISTS exchanges_status ON exchanges (status)`,
+	`CREATE INDEX IF NOT EXISTS exchanges_duration ON exchanges (duration_ms)`,
+	`CREATE INDEX IF NOT EXISTS exchanges_size ON exchanges (size)`,
+}
+
+// openCaptureDB opens the database of a record file, creating it for the
+// recorder. The write-ahead log lets the commands read it while the proxy
+// records to it.
+func openCaptureDB(fileName string, create bool) (*sql.DB, error) {
+	if !create {
+		if _, err := os.Stat(fileName); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite", fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []string{"PRAGMA busy_timeout = 5000"}
+	if create {
+		statements = append(append(statements, "PRAGMA journal_mode = WAL"), captureSchema...)
+	}
+
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// insertCaptures inserts the exchanges in a single transaction.
+func insertCaptures(db *sql.DB, exchanges []*recordedExchange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(`INSERT INTO exchanges (time, method, path, status, duration_ms, size, route, upstream, exchange) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, exchange := range exchanges {
+		content, err := json.Marshal(exchange)
+		if err != nil {
+			return err
+		}
+
+		if _, err := insert.Exec(exchange.Timestamp.UnixNano(), exchange.Request.Method, exchange.Request.Path, exchange.Response.Status, exchange.Duration,
+			len(exchange.Response.Body), exchange.Route, exchange.Upstream, string(content)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// escapeGlob escapes the wildcards of a GLOB pattern, each in brackets.
+func escapeGlob(s string) string {
+	return strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]").Replace(s)
+}
+
+// readCaptureDB is readCaptures for the databases, the conditions on the
+// indexed columns being left to SQLite. The others are checked on the
+// exchanges, along with those.
+func readCaptureDB(fileName string, q CaptureQuery, minStatus, maxStatus int, fn func(n int, exchange *recordedExchange, line []byte) error) (int, error) {
+	db, err := openCaptureDB(fileName, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	where, args := []string{"status BETWEEN ? AND ?"}, []interface{}{minStatus, maxStatus}
+
+	if q.id != 0 {
+		where, args = append(where, "id = ?"), append(args, q.id)
+	}
+
+	if !q.Since.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, q.Since.UnixNano())
+	}
+
+	if !q.Until.IsZero() {
+		where, args = append(where, "time <= ?"), append(args, q.Until.UnixNano())
+	}
+
+	if q.MinDuration > 0 {
+		where, args = append(where, "duration_ms >= ?"), append(args, durationMillis(q.MinDuration))
+	}
+
+	if q.MinSize > 0 {
+		where, args = append(where, "size >= ?"), append(args, int64(q.MinSize))
+	}
+
+	if len(q.Match.Methods) > 0 {
+		where = append(where, "method IN (?"+strings.Repeat(", ?", len(q.Match.Methods)-1)+")")
+
+		for _, method := range q.Match.Methods {
+			args = append(args, strings.ToUpper(method))
+		}
+	}
+
+	// The prefixes are GLOB patterns as well once escaped, which use the
+	// index.
+	if q.Match.Path != "" && !isPathGlob(q.Match.Path) {
+		where, args = append(where, "path GLOB ?"), append(args, escapeGlob(strings.TrimSuffix(q.Match.Path, "*"))+"*")
+	}
+
+	rows, err := db.Query("SELECT id, exchange FROM exchanges WHERE "+strings.Join(where, " AND ")+" ORDER BY id", args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	matched := 0
+
+	for rows.Next() && (q.Limit == 0 || matched < q.Limit) {
+		var id int
+		var line []byte
+
+		if err := rows.Scan(&id, &line); err != nil {
+			return matched, err
+		}
+
+		var exchange recordedExchange
+
+		if err := json.Unmarshal(line, &exchange); err != nil {
+			return matched, fmt.Errorf("exchange #%d: %w", id, err)
+		}
+
+		if !q.matches(&exchange) {
+			continue
+		}
+
+		matched++
+
+		if err := fn(id, &exchange, line); err != nil {
+			return matched, err
+		}
+	}
+
+	return matched, rows.Err()
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorderDB(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "captures.db")
+
+	rec, err := newRecorder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const recorded = 250
+
+	for i := 0; i < recorded; i++ {
+		path := fmt.Sprintf("/api/items/%d", i)
+		if i%2 == 0 {
+			path = fmt.Sprintf("/web/%d", i)
+		}
+
+		exchange := &recordedExchange{
+			Timestamp: time.Now(),
+			Request:   recordedRequest{Method: "GET", Path: path, Header: http.Header{}},
+			Response:  recordedResponse{Status: http.StatusOK, Header: http.Header{}, Body: []byte("hello")},
+		}
+
+		if err := rec.record(exchange); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rec.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{path: "", want: recorded},
+		{path: "/api", want: recorded / 2},
+		{path: "/api/*", want: recorded / 2},
+		{path: "/web/1*", want: 55},
+	} {
+		n, err := readCaptures(fileName, CaptureQuery{Match: RequestMatch{Path: tt.path}}, func(int, *recordedExchange, []byte) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != tt.want {
+			t.Errorf("readCaptures(path %q) = %d exchanges, want %d", tt.path, n, tt.want)
+		}
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	db, err := openCaptureDB(filepath.Join(t.TempDir(), "captures.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{prefix: "/api", path: "/api/users", want: true},
+		{prefix: "/a*", path: "/a*/b", want: true},
+		{prefix: "/a*", path: "/abc", want: false},
+		{prefix: "/a?", path: "/ab", want: false},
+		{prefix: "/a?", path: "/a?x", want: true},
+		{prefix: "/[ab]", path: "/a", want: false},
+		{prefix: "/[ab]", path: "/[ab]/c", want: true},
+	}
+
+	for _, tt := range tests {
+		var matched bool
+
+		if err := db.QueryRow("SELECT ? GLOB ?", tt.path, escapeGlob(tt.prefix)+"*").Scan(&matched); err != nil {
+			t.Fatal(err)
+		}
+
+		if matched != tt.want {
+			t.Errorf("%q GLOB the escaped prefix %q = %v, want %v", tt.path, tt.prefix, matched, tt.want)
+		}
+	}
+}
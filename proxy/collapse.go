@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxCollapsedBody is the largest response shared with the collapsed
+// requests, the larger ones being requested again.
+const maxCollapsedBody = 8 << 20
+
+// DefaultCollapseHeaders are the request headers that tell the collapsed
+// requests apart by default.
+var DefaultCollapseHeaders = []string{"Authorization", "Cookie", "Accept", "Accept-Encoding", "Accept-Language"}
+
+// CollapseConfig sends the identical GET requests arriving while one of
+// them is in flight to the upstream once, every client getting its
+// response. The requests are identical when their host, path, query and
+// Headers are, or their Key when it's set.
+type CollapseConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Headers []string `yaml:"headers"`
+
+	// Key identifies the requests that are collapsed together, replacing
+	// the default key.
+	Key func(r *http.Request) string `yaml:"-"`
+}
+
+func (c *CollapseConfig) key(r *http.Request) string {
+	if c.Key != nil {
+		return c.Key(r)
+	}
+
+	return cacheVariantKey(cachePrimaryKey(r), c.Headers, r.Header)
+}
+
+// collapser keeps the requests in flight by key.
+type collapser struct {
+	mu    sync.Mutex
+	calls map[string]*collapsedCall
+}
+
+// collapsedCall is a request in flight, whose response is shared once done
+// if it can be.
+type collapsedCall struct {
+	leader uint64
+	done   chan struct{}
+	res    *cachedResponse
+}
+
+func newCollapser() *collapser {
+	return &collapser{calls: make(map[string]*collapsedCall)}
+}
+
+// join returns the call in flight for key, and whether the request is its
+// leader, which must finish it.
+func (c *collapser) join(key string, id uint64) (*collapsedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+
+	call := &collapsedCall{leader: id, done: make(chan struct{})}
+	c.calls[key] = call
+
+	return call, true
+}
+
+func (c *collapser) finish(key string, call *collapsedCall, res *cachedResponse) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	call.res = res
+	close(call.done)
+}
+
+// collapseConfig is the collapsing of the route of ex, or of the config.
+func (p *Proxy) collapseConfig(ex *exchange) *CollapseConfig {
+	if ex.route.collapse != nil {
+		return ex.route.collapse
+	}
+
+	return &p.cfg.Collapse
+}
+
+// collapse makes the request of ex wait for an identical one in flight,
+// answering it with its response, or lead the others. It returns the
+// writer to use and the function finishing the call, or false if the
+// request was answered.
+func (p *Proxy) collapse(w http.ResponseWriter, ex *exchange) (http.ResponseWriter, func(), bool) {
+	cfg := p.collapseConfig(ex)
+	r := ex.inbound
+
+	if !cfg.Enabled || r.Method != http.MethodGet || r.ContentLength > 0 {
+		return w, func() {}, true
+	}
+
+	key := cfg.key(r)
+
+	call, leader := p.collapser.join(key, ex.id)
+	if leader {
+		recorder := &collapseRecorder{ResponseWriter: w}
+
+		return recorder, func() { p.collapser.finish(key, call, recorder.response()) }, true
+	}
+
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		p.logClientCanceled(ex, r.Context().Err())
+
+		return w, nil, false
+	}
+
+	if call.res == nil {
+		// The response couldn't be shared, so the request goes on its own.
+		return w, func() {}, true
+	}
+
+	p.serveCollapsed(w, ex, call)
+
+	return w, nil, false
+}
+
+func (p *Proxy) serveCollapsed(w http.ResponseWriter, ex *exchange, call *collapsedCall) {
+	p.stats.collapsed.Add(1)
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Upstream: ex.upstream, Route: ex.route.name, Message: ex.withGraphQL(newRawHTTPRequest(ex.inbound, nil))})
+
+	copyHeader(w.Header(), call.res.header)
+	w.WriteHeader(call.res.status)
+
+	if _, err := w.Write(call.res.body); err != nil {
+		log.Printf("Writing the response of #%d collapsed into #%d: %v", ex.id, call.leader, err)
+	}
+
+	res := &http.Response{
+		Proto:      ex.inbound.Proto,
+		Status:     fmt.Sprintf("%d %s", call.res.status, http.StatusText(call.res.status)),
+		StatusCode: call.res.status,
+		Header:     call.res.header,
+	}
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Message: newRawHTTPResponse(res, call.res.body)})
+}
+
+// collapseRecorder keeps a copy of the response of the leading request, for
+// the requests collapsed into it.
+type collapseRecorder struct {
+	http.ResponseWriter
+	status    int
+	header    http.Header
+	body      []byte
+	unshared  bool
+	hijacked  bool
+	writeFail bool
+}
+
+func (cr *collapseRecorder) WriteHeader(status int) {
+	if cr.status == 0 {
+		cr.status = status
+		cr.header = cr.Header().Clone()
+
+		// The cookies belong to the leading client, and the streams can't
+		// be kept.
+		mediaType, _, _ := mime.ParseMediaType(cr.header.Get("Content-Type"))
+		cr.unshared = cr.header.Get("Set-Cookie") != "" || mediaType == "text/event-stream"
+	}
+
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *collapseRecorder) Write(p []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+
+	if !cr.unshared {
+		if len(cr.body)+len(p) > maxCollapsedBody {
+			cr.unshared, cr.body = true, nil
+		} else {
+			cr.body = append(cr.body, p...)
+		}
+	}
+
+	n, err := cr.ResponseWriter.Write(p)
+	if err != nil {
+		cr.writeFail = true
+	}
+
+	return n, err
+}
+
+func (cr *collapseRecorder) Flush() {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+
+	_ = http.NewResponseController(cr.ResponseWriter).Flush()
+}
+
+func (cr *collapseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(cr.ResponseWriter).Hijack()
+	if err == nil {
+		cr.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+func (cr *collapseRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
+
+// response is the response to share, or nil if there is none.
+func (cr *collapseRecorder) response() *cachedResponse {
+	if cr.status == 0 || cr.unshared || cr.hijacked || cr.writeFail {
+		return nil
+	}
+
+	cr.header.Del("X-Cache")
+
+	return &cachedResponse{status: cr.status, header: cr.header, body: cr.body, storedAt: time.Now()}
+}
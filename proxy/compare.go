@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxComparedDiffs limits the differences printed for an exchange.
+const maxComparedDiffs = 20
+
+// CompareConfig sends every request to a second upstream as well, printing
+// how its response differs from the one of the primary upstream, which is
+// the one the client gets. The headers in IgnoreHeaders aren't compared.
+type CompareConfig struct {
+	Upstream      string   `yaml:"upstream"`
+	IgnoreHeaders []string `yaml:"ignore_headers"`
+}
+
+type comparedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// comparison is the request of an exchange to the compared upstream, which
+// waits for the primary response to diff them.
+type comparison struct {
+	primary chan *comparedResponse
+	once    sync.Once
+}
+
+// setPrimary hands the primary response over, or nil if there's none.
+func (c *comparison) setPrimary(res *comparedResponse) {
+	c.once.Do(func() {
+		c.primary <- res
+		close(c.primary)
+	})
+}
+
+// startComparison sends req to the compared upstream in the background,
+// with the body of ex.
+func (p *Proxy) startComparison(ex *exchange, req *http.Request) *comparison {
+	c := &comparison{primary: make(chan *comparedResponse, 1)}
+
+	secondary, budgets := p.shadowRequest(ex, req, p.cfg.Compare.Upstream)
+
+	go func() {
+		defer budgets.stop()
+
+		res, err := p.client.Do(budgets.attempt(secondary))
+		if err != nil {
+			log.Printf("Comparing #%d: the request to %s failed: %v", ex.id, p.cfg.Compare.Upstream, err)
+
+			return
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			log.Printf("Comparing #%d: can't read the response of %s: %v", ex.id, p.cfg.Compare.Upstream, err)
+
+			return
+		}
+
+		primary := <-c.primary
+		if primary == nil {
+			return
+		}
+
+		diffs := diffResponses(primary, &comparedResponse{status: res.StatusCode, header: res.Header, body: body}, p.cfg.Compare.IgnoreHeaders)
+		if len(diffs) == 0 {
+			return
+		}
+
+		if len(diffs) > maxComparedDiffs {
+			diffs = append(diffs[:maxComparedDiffs], fmt.Sprintf("... and %d more", len(diffs)-maxComparedDiffs))
+		}
+
+		log.Printf("Comparing #%d %s %s with %s:\n  %s", ex.id, secondary.Method, secondary.URL.Path, p.cfg.Compare.Upstream, strings.Join(diffs, "\n  "))
+	}()
+
+	return c
+}
+
+// diffResponses lists the differences between the primary response a and
+// the compared one b: their status, headers and bodies, compared field by
+// field when both are JSON.
+func diffResponses(a, b *comparedResponse, ignoreHeaders []string) []string {
+	var diffs []string
+
+	if a.status != b.status {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", a.status, b.status))
+	}
+
+	names := make(map[string]bool)
+	for name := range a.header {
+		names[name] = true
+	}
+
+	for name := range b.header {
+		names[name] = true
+	}
+
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		if !isIgnoredHeader(name, ignoreHeaders) {
+			sortedNames = append(sortedNames, name)
+		}
+	}
+
+	sort.Strings(sortedNames)
+
+	for _, name := range sortedNames {
+		if !reflect.DeepEqual(a.header[name], b.header[name]) {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", name, a.header[name], b.header[name]))
+		}
+	}
+
+	aBody := decodedMessage(&Message{Header: a.header, Body: a.body}).Body
+	bBody := decodedMessage(&Message{Header: b.header, Body: b.body}).Body
+
+	var aJSON, bJSON interface{}
+
+	if json.Unmarshal(aBody, &aJSON) == nil && json.Unmarshal(bBody, &bJSON) == nil {
+		return diffJSON("body $", aJSON, bJSON, diffs)
+	}
+
+	if !bytes.Equal(aBody, bBody) {
+		diffs = append(diffs, fmt.Sprintf("body: %d bytes != %d bytes, with other contents", len(aBody), len(bBody)))
+	}
+
+	return diffs
+}
+
+func diffJSON(path string, a, b interface{}, diffs []string) []string {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(a)+len(b))
+		for key := range a {
+			keys = append(keys, key)
+		}
+
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			aValue, aOK := a[key]
+			bValue, bOK := b[key]
+
+			switch {
+			case !bOK:
+				diffs = append(diffs, fmt.Sprintf("%s.%s: only in the primary", path, key))
+			case !aOK:
+				diffs = append(diffs, fmt.Sprintf("%s.%s: only in the compared", path, key))
+			default:
+				diffs = diffJSON(path+"."+key, aValue, bValue, diffs)
+			}
+		}
+
+		return diffs
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+
+		if len(a) != len(b) {
+			diffs = append(diffs, fmt.Sprintf("%s: %d items != %d items", path, len(a), len(b)))
+		}
+
+		for i := 0; i < len(a) && i < len(b); i++ {
+			diffs = diffJSON(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], diffs)
+		}
+
+		return diffs
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		aJSON, _ := json.Marshal(a)
+		bJSON, _ := json.Marshal(b)
+		diffs = append(diffs, fmt.Sprintf("%s: %s != %s", path, aJSON, bJSON))
+	}
+
+	return diffs
+}
+
+func isIgnoredHeader(name string, ignoreHeaders []string) bool {
+	for _, ignored := range ignoreHeaders {
+		if strings.EqualFold(ignored, name) {
+			return true
+		}
+	}
+
+	return false
+}
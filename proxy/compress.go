@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressTypes are the Content-Types compressed by default.
+var DefaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+// CompressConfig compresses the responses the upstreams left uncompressed
+// with gzip, or deflate, for the clients accepting it, when their
+// Content-Type matches one of Types and they're at least MinSize long.
+type CompressConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Types   []string `yaml:"types"`
+	MinSize ByteSize `yaml:"min_size"`
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// deflateWriters write the deflate encoding of HTTP, which is zlib.
+var deflateWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+
+// acceptedEncoding is the encoding the client of r prefers among gzip and
+// deflate, or "" if it accepts neither. "*" stands for those it doesn't
+// name, so that gzip;q=0 still refuses gzip.
+func acceptedEncoding(r *http.Request) string {
+	weights := make(map[string]float64)
+
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+
+			q := 1.0
+			if name, weight, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(weight), 64); err == nil {
+					q = parsed
+				}
+			}
+
+			weights[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+
+	// gzip wins the ties, being the most widely supported.
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, ok := weights[coding]
+		if !ok {
+			q = weights["*"]
+		}
+
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter compresses the response if it qualifies, which is decided
+// once its headers are written.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg         *CompressConfig
+	encoding    string
+	head        bool
+	wroteHeader bool
+	encoder     io.WriteCloser
+}
+
+// newCompressWriter wraps w if the client of r accepts compressed
+// responses, returning nil otherwise.
+func newCompressWriter(w http.ResponseWriter, r *http.Request, cfg *CompressConfig) *compressWriter {
+	encoding := acceptedEncoding(r)
+	if encoding == "" {
+		return nil
+	}
+
+	return &compressWriter{ResponseWriter: w, cfg: cfg, encoding: encoding, head: r.Method == http.MethodHead}
+}
+
+func (cw *compressWriter) compresses(status int) bool {
+	header := cw.Header()
+
+	// The ranges are of the uncompressed body.
+	if cw.head || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent || header.Get("Content-Range") != "" ||
+		header.Get("Content-Encoding") != "" || strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < int64(cw.cfg.MinSize) {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range cw.cfg.Types {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+
+		if cw.compresses(status) {
+			header := cw.Header()
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", cw.encoding)
+			if !strings.Contains(strings.ToLower(strings.Join(header.Values("Vary"), ",")), "accept-encoding") {
+				header.Add("Vary", "Accept-Encoding")
+			}
+
+			// A strong ETag would claim the compressed body is the same as
+			// the upstream's.
+			if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+				header.Set("ETag", "W/"+etag)
+			}
+
+			if cw.encoding == "gzip" {
+				gz := gzipWriters.Get().(*gzip.Writer)
+				gz.Reset(cw.ResponseWriter)
+				cw.encoder = gz
+			} else {
+				zw := deflateWriters.Get().(*zlib.Writer)
+				zw.Reset(cw.ResponseWriter)
+				cw.encoder = zw
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush writes what was compressed so far, for the streamed responses.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		_ = encoder.Flush()
+	case *zlib.Writer:
+		_ = encoder.Flush()
+	}
+
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close ends the compressed body, once the response is complete.
+func (cw *compressWriter) close() {
+	if cw.encoder == nil {
+		return
+	}
+
+	_ = cw.encoder.Close()
+
+	if cw.encoding == "gzip" {
+		gzipWriters.Put(cw.encoder)
+	} else {
+		deflateWriters.Put(cw.encoder)
+	}
+
+	cw.encoder = nil
+}
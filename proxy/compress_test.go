@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "deflate", want: "deflate"},
+		{acceptEncoding: "deflate, gzip", want: "gzip"},
+		{acceptEncoding: "gzip;q=0.5, deflate", want: "deflate"},
+		{acceptEncoding: "br", want: ""},
+		{acceptEncoding: "*", want: "gzip"},
+		{acceptEncoding: "gzip;q=0, *", want: "deflate"},
+		{acceptEncoding: "*, gzip;q=0, deflate;q=0", want: ""},
+		{acceptEncoding: "identity, *;q=0", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			if got := acceptedEncoding(r); got != tt.want {
+				t.Errorf("acceptedEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressWriterSkipsRanges(t *testing.T) {
+	cfg := DefaultConfig().Compress
+
+	tests := []struct {
+		name         string
+		status       int
+		contentRange string
+		want         bool
+	}{
+		{name: "full", status: http.StatusOK, want: true},
+		{name: "partial", status: http.StatusPartialContent, contentRange: "bytes 0-2047/4096", want: false},
+		{name: "range of a 200", status: http.StatusOK, contentRange: "bytes 0-2047/4096", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", "2048")
+
+			if tt.contentRange != "" {
+				w.Header().Set("Content-Range", tt.contentRange)
+			}
+
+			if got := newCompressWriter(w, r, &cfg).compresses(tt.status); got != tt.want {
+				t.Errorf("compresses(%d) = %v, want %v", tt.status, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConcurrencyConfig limits the requests in flight through the proxy, from
+// each client IP (PerClient) and in total (Total), 0 meaning no limit, to
+// keep the small upstreams from being swamped. The requests over the limits
+// wait for up to QueueTimeout for others to finish before being rejected
+// with 503, 0 rejecting them right away.
+type ConcurrencyConfig struct {
+	PerClient    int           `yaml:"per_client"`
+	Total        int           `yaml:"total"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+}
+
+func (c ConcurrencyConfig) validate() error {
+	if c.PerClient < 0 || c.Total < 0 || c.QueueTimeout < 0 {
+		return errors.New("the concurrency limits can't be negative")
+	}
+
+	return nil
+}
+
+// concurrencyLimiter hands out the slots of the requests in flight.
+type concurrencyLimiter struct {
+	cfg   ConcurrencyConfig
+	total chan struct{}
+
+	mu      sync.Mutex
+	clients map[string]*clientSlots
+}
+
+// clientSlots are the slots of a client, kept while it has requests in
+// flight or waiting.
+type clientSlots struct {
+	slots chan struct{}
+	users int
+}
+
+func newConcurrencyLimiter(cfg ConcurrencyConfig) *concurrencyLimiter {
+	l := &concurrencyLimiter{cfg: cfg, clients: make(map[string]*clientSlots)}
+
+	if cfg.Total > 0 {
+		l.total = make(chan struct{}, cfg.Total)
+	}
+
+	return l
+}
+
+// acquire takes a slot for a request of the client ip, waiting for up to
+// the queue timeout. It returns the function releasing it, or an error if
+// the request is over the limits.
+func (l *concurrencyLimiter) acquire(ctx context.Context, ip string) (func(), error) {
+	var timeout <-chan time.Time
+
+	if l.cfg.QueueTimeout > 0 {
+		timer := time.NewTimer(l.cfg.QueueTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	releaseClient := func() {}
+
+	if l.cfg.PerClient > 0 {
+		client := l.client(ip)
+
+		if err := waitForSlot(ctx, client.slots, timeout); err != nil {
+			l.leave(ip, client)
+
+			return nil, fmt.Errorf("over the limit of %d requests in flight from %s: %w", l.cfg.PerClient, ip, err)
+		}
+
+		releaseClient = func() {
+			<-client.slots
+			l.leave(ip, client)
+		}
+	}
+
+	if l.total == nil {
+		return releaseClient, nil
+	}
+
+	if err := waitForSlot(ctx, l.total, timeout); err != nil {
+		releaseClient()
+
+		return nil, fmt.Errorf("over the limit of %d requests in flight: %w", l.cfg.Total, err)
+	}
+
+	return func() {
+		<-l.total
+		releaseClient()
+	}, nil
+}
+
+func (l *concurrencyLimiter) client(ip string) *clientSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientSlots{slots: make(chan struct{}, l.cfg.PerClient)}
+		l.clients[ip] = client
+	}
+
+	client.users++
+
+	return client
+}
+
+func (l *concurrencyLimiter) leave(ip string, client *clientSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if client.users--; client.users == 0 {
+		delete(l.clients, ip)
+	}
+}
+
+var errQueueTimeout = errors.New("no slot was freed in time")
+
+func waitForSlot(ctx context.Context, slots chan struct{}, timeout <-chan time.Time) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if timeout == nil {
+		return errQueueTimeout
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return errQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
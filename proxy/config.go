@@ -0,0 +1,923 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the proxy settings. Its YAML form, or the same keys in TOML,
+// is what LoadConfigFile reads.
+type Config struct {
+	Port      int           `yaml:"port"`
+	Listen    []string      `yaml:"listen"`
+	Upstreams []string      `yaml:"upstreams"`
+	Routes    []RouteConfig `yaml:"routes"`
+	Stream    bool          `yaml:"stream"`
+	Forwarded string        `yaml:"forwarded"`
+
+	// Mode is what the proxy forwards: http, tcp for the raw TCP streams of
+	// the other protocols, which a TCPProxy forwards to the Upstreams, or udp
+	// for the datagrams, which a UDPProxy relays.
+	Mode string `yaml:"mode"`
+
+	// ListenFamily is what the TCP listeners accept: dual (IPv4 and IPv6
+	// on the wildcard addresses, like :8080 or [::]:8080), ipv4 or ipv6.
+	ListenFamily string `yaml:"listen_family"`
+
+	// ProxyProtocol requires the PROXY protocol header (v1 or v2) of the L4
+	// load balancers on the connections to the proxy, which then sees the
+	// real client addresses. ProxyProtocolFrom restricts it to the balancers
+	// at these IPs or CIDR ranges, the other peers keeping their own address,
+	// or to none. UpstreamProxyProtocol sends one of version v1 or v2 on the
+	// connections to the upstreams, which are then not reused.
+	ProxyProtocol         bool     `yaml:"proxy_protocol"`
+	ProxyProtocolFrom     []string `yaml:"proxy_protocol_from"`
+	UpstreamProxyProtocol string   `yaml:"upstream_proxy_protocol"`
+
+	// RequestID is the header carrying the ID of every request, reused if
+	// the client sent one and generated otherwise, which is forwarded to the
+	// upstream, returned to the client and logged. Empty disables it.
+	RequestID string `yaml:"request_id"`
+
+	H2C bool `yaml:"h2c"`
+
+	// UpstreamProxy is an HTTP or SOCKS5 proxy, like socks5://127.0.0.1:9050,
+	// to reach the upstreams through. The HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables are used otherwise.
+	UpstreamProxy string `yaml:"upstream_proxy"`
+
+	// ForwardProxy also serves as a regular HTTP proxy, forwarding the
+	// requests with an absolute URL to their host and tunneling CONNECT.
+	ForwardProxy bool       `yaml:"forward_proxy"`
+	MITM         MITMConfig `yaml:"mitm"`
+
+	// CookieJar keeps the cookies set by the upstreams and sends them with
+	// the next requests, in a jar per client IP (client) or a single one
+	// (global), for the clients that don't handle cookies.
+	CookieJar string `yaml:"cookie_jar"`
+
+	// Sticky keeps each client on the same upstream of a route, telling
+	// them apart by a cookie or their IP address.
+	Sticky string `yaml:"sticky"`
+
+	// Balance is how the requests are spread over the upstreams of a route:
+	// round-robin, weighted (by Weights, keyed by upstream address),
+	// least-conn or p2c (the less busy of two random upstreams).
+	Balance string         `yaml:"balance"`
+	Weights map[string]int `yaml:"weights"`
+
+	Record          string `yaml:"record"`
+	Replay          string `yaml:"replay"`
+	ReplayMatchBody bool   `yaml:"replay_match_body"`
+
+	TLS         TLSConfig         `yaml:"tls"`
+	UpstreamTLS UpstreamTLSConfig `yaml:"upstream_tls"`
+	DNS         DNSConfig         `yaml:"dns"`
+	Log         LogConfig         `yaml:"log"`
+	Timeouts    TimeoutsConfig    `yaml:"timeouts"`
+	Connections ConnectionsConfig `yaml:"connections"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	Retry       RetryConfig       `yaml:"retry"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Cache       CacheConfig       `yaml:"cache"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+	Fault       FaultConfig       `yaml:"fault"`
+	Throttle    ThrottleConfig    `yaml:"throttle"`
+	ACL         ACLConfig         `yaml:"acl"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Headers     HeaderRewrites    `yaml:"headers"`
+	Query       QueryRewrites     `yaml:"query"`
+	BodyRules   []BodyRule        `yaml:"body_rules"`
+	Mocks       []MockResponse    `yaml:"mocks"`
+	Compare     CompareConfig     `yaml:"compare"`
+	Mirror      MirrorConfig      `yaml:"mirror"`
+	Admin       AdminConfig       `yaml:"admin"`
+	Intercept   []RequestMatch    `yaml:"intercept"`
+	Processors  []ProcessorConfig `yaml:"processors"`
+	Scripts     []string          `yaml:"scripts"`
+	Compress    CompressConfig    `yaml:"compress"`
+	OpenAPI     OpenAPIConfig     `yaml:"openapi"`
+	GraphQL     GraphQLConfig     `yaml:"graphql"`
+	CORS        CORSConfig        `yaml:"cors"`
+	Collapse    CollapseConfig    `yaml:"collapse"`
+	ErrorPages  ErrorPagesConfig  `yaml:"error_pages"`
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+
+	SecurityHeaders SecurityHeadersConfig `yaml:"security_headers"`
+
+	// DecompressRequests decodes the compressed request bodies before
+	// forwarding them.
+	DecompressRequests bool `yaml:"decompress_requests"`
+
+	// Logger receives the log entries instead of the log files in Log.Dir.
+	Logger Logger `yaml:"-"`
+
+	// Middleware wraps the proxy handler, the first one being the outermost.
+	Middleware []Middleware `yaml:"-"`
+
+	// UpstreamMiddleware wraps the transport to the upstreams, the first one
+	// being the outermost.
+	UpstreamMiddleware []UpstreamMiddleware `yaml:"-"`
+
+	// Hooks are called at the stages of the exchanges.
+	Hooks Hooks `yaml:"-"`
+
+	scripts scripts
+}
+
+// TLSConfig serves TLS with the certificate in Cert and Key and those of
+// Certs, picked by the server name the clients ask for (SNI), the first
+// one being served to the others, or with those obtained for the hosts of
+// ACME.
+type TLSConfig struct {
+	Cert  string           `yaml:"cert"`
+	Key   string           `yaml:"key"`
+	Certs []TLSCertificate `yaml:"certs"`
+	ACME  ACMEConfig       `yaml:"acme"`
+}
+
+type TLSCertificate struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// certificates are all the certificates to serve, Cert first.
+func (c TLSConfig) certificates() []TLSCertificate {
+	var certs []TLSCertificate
+
+	if c.Cert != "" {
+		certs = append(certs, TLSCertificate{Cert: c.Cert, Key: c.Key})
+	}
+
+	return append(certs, c.Certs...)
+}
+
+// UpstreamTLSConfig is how the proxy connects to the https:// upstreams.
+// CA is a PEM bundle trusted on top of the system roots, and Cert and Key
+// are a client certificate for the upstreams requiring mutual TLS.
+type UpstreamTLSConfig struct {
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+}
+
+// LogConfig tells where and how to log the exchanges. Bodies only applies
+// to the json format, where the bodies are left out unless it's set. Decode
+// logs the bodies decoded from their Content-Encoding. MaxBody limits the
+// logged bytes of each body, 0 meaning no limit. In the raw format,
+// bodies whose Content-Type doesn't match TextTypes (like text/* or
+// application/*+json) are logged as a hex dump, or omitted if Binary is omit.
+type LogConfig struct {
+	Dir       string   `yaml:"dir"`
+	Format    string   `yaml:"format"`
+	Split     string   `yaml:"split"`
+	Bodies    bool     `yaml:"bodies"`
+	Decode    bool     `yaml:"decode"`
+	Binary    string   `yaml:"binary"`
+	TextTypes []string `yaml:"text_types"`
+	MaxBody   ByteSize `yaml:"max_body"`
+
+	// RedactHeaders and RedactFields are the headers and JSON body fields
+	// whose values are replaced with [REDACTED] in the logs.
+	RedactHeaders []string `yaml:"redact_headers"`
+	RedactFields  []string `yaml:"redact_fields"`
+
+	// DuplicateWindow flags the requests repeating an identical one made
+	// within it, to find the redundant calls of the clients.
+	DuplicateWindow time.Duration `yaml:"duplicate_window"`
+
+	// Sinks are where the entries are written, the files in Dir by
+	// default.
+	Sinks []LogSinkConfig `yaml:"sinks"`
+
+	// HexDump logs a hex dump of the data of the connections in the tcp
+	// mode and of the datagrams in the udp one.
+	HexDump bool `yaml:"hex_dump"`
+
+	// Buffer is the entries waiting to be written, which are flushed every
+	// BatchSize entries, 0 meaning only every FlushInterval. Overflow tells
+	// what to do when the buffer is full: drop the new entries (drop), the
+	// oldest ones (drop-oldest), wait for room (block), which holds the
+	// requests, or log one exchange in ten once it's three quarters full
+	// (sample).
+	Buffer        int           `yaml:"buffer"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	BatchSize     int           `yaml:"batch_size"`
+	Overflow      string        `yaml:"overflow"`
+
+	// Filter leaves some exchanges out of the logs.
+	Filter LogFilterConfig `yaml:"filter"`
+
+	// TimeFormat is the layout of the times in the logs: rfc3339,
+	// rfc3339ms, rfc3339nano or a Go layout like 2006-01-02 15:04:05.000.
+	// TimeZone is the zone they're given in: Local, UTC or a name like
+	// Europe/Paris.
+	TimeFormat string `yaml:"time_format"`
+	TimeZone   string `yaml:"time_zone"`
+
+	timeLayout   string
+	timeLocation *time.Location
+}
+
+type TimeoutsConfig struct {
+	Request        time.Duration `yaml:"request"`
+	Shutdown       time.Duration `yaml:"shutdown"`
+	Dial           time.Duration `yaml:"dial"`
+	TLSHandshake   time.Duration `yaml:"tls_handshake"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	IdleConn       time.Duration `yaml:"idle_conn"`
+	Intercept      time.Duration `yaml:"intercept"`
+
+	// ClientReadHeader, ClientRead, ClientWrite and ClientIdle are the time
+	// limits of the client connections for reading the request headers,
+	// reading the whole request, writing the response and waiting for the
+	// next request, 0 meaning none.
+	ClientReadHeader time.Duration `yaml:"client_read_header"`
+	ClientRead       time.Duration `yaml:"client_read"`
+	ClientWrite      time.Duration `yaml:"client_write"`
+	ClientIdle       time.Duration `yaml:"client_idle"`
+
+	// UDPIdle ends the sessions of the udp mode without datagrams for that
+	// long, 0 meaning never.
+	UDPIdle time.Duration `yaml:"udp_idle"`
+}
+
+// ConnectionsConfig tunes the pool of connections to the upstreams. A
+// negative KeepAlive disables both TCP keep-alives and connection reuse.
+// MaxPerHost limits the connections to each upstream, the requests beyond
+// it waiting for one to be free, 0 meaning no limit.
+type ConnectionsConfig struct {
+	MaxIdle        int           `yaml:"max_idle"`
+	MaxIdlePerHost int           `yaml:"max_idle_per_host"`
+	MaxPerHost     int           `yaml:"max_per_host"`
+	KeepAlive      time.Duration `yaml:"keep_alive"`
+}
+
+// CacheConfig caches the responses to GET requests in Size of memory. With
+// Dir they're also saved there, to survive the restarts.
+//
+// The expired responses are served for up to StaleWhileRevalidate while
+// being refreshed in the background, and up to StaleIfError when the
+// upstream fails, as far as their stale-while-revalidate and
+// stale-if-error directives allow, or regardless of them with TTL.
+type CacheConfig struct {
+	Size ByteSize      `yaml:"size"`
+	TTL  time.Duration `yaml:"ttl"`
+	Dir  string        `yaml:"dir"`
+
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	StaleIfError         time.Duration `yaml:"stale_if_error"`
+}
+
+// DefaultTextTypes are the Content-Types logged as text by default.
+var DefaultTextTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/javascript",
+	"application/x-www-form-urlencoded",
+}
+
+// DefaultConfig returns the settings used when nothing else is given; at
+// least the upstreams have to be added to it.
+func DefaultConfig() Config {
+	return Config{
+		Port:         8080,
+		Mode:         "http",
+		ListenFamily: "dual",
+		Forwarded:    "x-forwarded",
+		RequestID:    "X-Request-ID",
+		Balance:      "round-robin",
+		Log: LogConfig{
+			Dir:       "logs",
+			Format:    "raw",
+			Split:     "route",
+			Decode:    true,
+			Binary:    "hex",
+			TextTypes: append([]string(nil), DefaultTextTypes...),
+			MaxBody:   64 << 10,
+			Sinks:     []LogSinkConfig{{Type: "file"}},
+
+			Buffer:        4096,
+			FlushInterval: time.Second,
+			BatchSize:     100,
+			Overflow:      "drop",
+
+			TimeFormat: "rfc3339nano",
+			TimeZone:   "Local",
+
+			RedactHeaders: append([]string(nil), DefaultRedactedHeaders...),
+		},
+		Timeouts: TimeoutsConfig{
+			Shutdown:     10 * time.Second,
+			Dial:         30 * time.Second,
+			TLSHandshake: 10 * time.Second,
+			IdleConn:     90 * time.Second,
+
+			ClientReadHeader: 10 * time.Second,
+			ClientIdle:       2 * time.Minute,
+
+			UDPIdle: time.Minute,
+		},
+		Connections: ConnectionsConfig{MaxIdle: 100, MaxIdlePerHost: 32, KeepAlive: 30 * time.Second},
+		Limits:      LimitsConfig{DecodedRequestBody: DefaultDecodedRequestBody, Header: 1 << 20, UDPSessions: DefaultUDPSessions},
+		Admin:       AdminConfig{History: 500},
+		Tracing:     TracingConfig{ServiceName: "go-proxy"},
+		Compare:     CompareConfig{IgnoreHeaders: []string{"Date"}},
+		Mirror:      MirrorConfig{Percent: 100},
+		Compress:    CompressConfig{Types: append([]string(nil), DefaultCompressTypes...), MinSize: 1 << 10},
+		Collapse:    CollapseConfig{Headers: append([]string(nil), DefaultCollapseHeaders...)},
+		ErrorPages:  ErrorPagesConfig{Format: "text"},
+		Maintenance: MaintenanceConfig{RetryAfter: 5 * time.Minute},
+		CORS:        CORSConfig{Origins: []string{"*"}, Methods: append([]string(nil), DefaultCORSMethods...)},
+		HealthCheck: HealthCheckConfig{Interval: 10 * time.Second, Timeout: 2 * time.Second, Threshold: 3},
+		MITM:        MITMConfig{CACert: "go-proxy-ca.pem", CAKey: "go-proxy-ca-key.pem"},
+		TLS:         TLSConfig{ACME: ACMEConfig{Directory: LetsEncryptDirectory, Cache: "acme", HTTPAddr: ":80"}},
+		Retry: RetryConfig{
+			Statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+			Methods:  []string{http.MethodGet, http.MethodHead},
+			Backoff:  100 * time.Millisecond,
+		},
+	}
+}
+
+// LoadConfigFile overrides the settings in cfg with the ones in a YAML file,
+// or a TOML one if its extension is .toml, failing on unknown keys.
+func LoadConfigFile(cfg *Config, fileName string) error {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	isTOML := strings.EqualFold(filepath.Ext(fileName), ".toml")
+
+	if isTOML {
+		if content, err = tomlToYAML(content); err != nil {
+			return err
+		}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(cfg)
+
+	// The lines of the errors are those of the YAML converted from TOML.
+	var typeErr *yaml.TypeError
+	if isTOML && errors.As(err, &typeErr) {
+		for i, msg := range typeErr.Errors {
+			typeErr.Errors[i] = yamlErrorLine.ReplaceAllString(msg, "")
+		}
+	}
+
+	return err
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line \d+: `)
+
+// tomlToYAML converts a TOML config to YAML, for the TOML keys to be those
+// of the YAML form and decoded the same way.
+func tomlToYAML(content []byte) ([]byte, error) {
+	var settings map[string]interface{}
+
+	if _, err := toml.Decode(string(content), &settings); err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(settings)
+}
+
+func (c *Config) validate() error {
+	if err := validateMode(c.Mode); err != nil {
+		return err
+	}
+
+	if c.Mode == "tcp" || c.Mode == "udp" {
+		return fmt.Errorf("the %s mode isn't served by the HTTP proxy", c.Mode)
+	}
+
+	if c.Record != "" && c.Replay != "" {
+		return errors.New("recording and replaying can't be done at the same time")
+	}
+
+	if c.Record != "" && c.Stream {
+		return errors.New("exchanges can't be recorded in streaming mode")
+	}
+
+	if isCaptureHAR(c.Record) {
+		return errors.New("exchanges can't be recorded to a HAR file, which is only read")
+	}
+
+	if len(c.Upstreams) == 0 && len(c.Routes) == 0 && len(c.Mocks) == 0 && c.Replay == "" && !c.ForwardProxy {
+		return errors.New("at least one server address must be given")
+	}
+
+	for _, addr := range c.Listen {
+		if err := validateListenAddr(addr); err != nil {
+			return err
+		}
+	}
+
+	if err := validateListenFamily(c.ListenFamily); err != nil {
+		return err
+	}
+
+	for i := range c.Upstreams {
+		c.Upstreams[i] = strings.TrimSuffix(c.Upstreams[i], "/")
+
+		if err := validateForwardURL(c.Upstreams[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, rc := range c.Routes {
+		if err := rc.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+
+	if err := c.GraphQL.validate(); err != nil {
+		return err
+	}
+
+	if err := c.CORS.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Maintenance.validate(); err != nil {
+		return err
+	}
+
+	if err := c.ErrorPages.validate(); err != nil {
+		return err
+	}
+
+	if err := c.SecurityHeaders.validate(); err != nil {
+		return err
+	}
+
+	if c.MITM.Enabled && !c.ForwardProxy {
+		return errors.New("decrypting tunnels requires the forward proxy mode")
+	}
+
+	if c.MITM.Enabled && (c.MITM.CACert == "" || c.MITM.CAKey == "") {
+		return errors.New("both the CA certificate and key files must be given to decrypt tunnels")
+	}
+
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+		return errors.New("the admin port must be between 1 and 65535, or 0 to disable the admin API")
+	}
+
+	if c.Admin.History < 0 {
+		return errors.New("the admin history can't be negative")
+	}
+
+	if len(c.Intercept) > 0 && c.Admin.Port == 0 {
+		return errors.New("intercepting requests requires the admin API port")
+	}
+
+	if len(c.Intercept) > 0 && c.Stream {
+		return errors.New("requests can't be intercepted in streaming mode")
+	}
+
+	for i := range c.Intercept {
+		if err := c.Intercept[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Query.validate(); err != nil {
+		return err
+	}
+
+	for i := range c.Headers.Rules {
+		if err := c.Headers.Rules[i].Match.compile(); err != nil {
+			return err
+		}
+	}
+
+	if c.Compare.Upstream != "" {
+		c.Compare.Upstream = strings.TrimSuffix(c.Compare.Upstream, "/")
+
+		if err := validateForwardURL(c.Compare.Upstream); err != nil {
+			return err
+		}
+
+		if c.Stream {
+			return errors.New("exchanges can't be compared in streaming mode")
+		}
+	}
+
+	if err := c.Mirror.validate(); err != nil {
+		return err
+	}
+
+	if c.Mirror.Upstream != "" && c.Stream {
+		return errors.New("requests can't be mirrored in streaming mode")
+	}
+
+	for i := range c.Mocks {
+		if err := c.Mocks[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Processors {
+		if err := c.Processors[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	if c.Stream && (c.Collapse.Enabled || c.routesCollapse()) {
+		return errors.New("requests can't be collapsed in streaming mode")
+	}
+
+	if len(c.Processors) > 0 && c.Stream {
+		return errors.New("external processors can't be used in streaming mode")
+	}
+
+	if len(c.Scripts) > 0 && c.Stream {
+		return errors.New("scripts can't be used in streaming mode")
+	}
+
+	scripts, err := loadScripts(c.Scripts)
+	if err != nil {
+		return err
+	}
+
+	c.scripts = scripts
+
+	if c.OpenAPI.Spec != "" && c.Stream {
+		return errors.New("exchanges can't be validated against an OpenAPI spec in streaming mode")
+	}
+
+	for i := range c.BodyRules {
+		rule := &c.BodyRules[i]
+
+		if err := rule.Match.compile(); err != nil {
+			return err
+		}
+
+		if err := rule.Request.compile(); err != nil {
+			return err
+		}
+
+		if err := rule.Response.compile(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.HealthCheck.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Timeouts.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Auth.validate(); err != nil {
+		return err
+	}
+
+	if _, err := newACL(c.ACL); err != nil {
+		return err
+	}
+
+	if c.RequestID != "" && !httpguts.ValidHeaderFieldName(c.RequestID) {
+		return fmt.Errorf("invalid request ID header %q", c.RequestID)
+	}
+
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Fault.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Concurrency.validate(); err != nil {
+		return err
+	}
+
+	if c.Connections.MaxIdle < 0 || c.Connections.MaxIdlePerHost < 0 || c.Connections.MaxPerHost < 0 {
+		return errors.New("the connection limits can't be negative")
+	}
+
+	if c.Log.Format != "raw" && c.Log.Format != "har" && c.Log.Format != "json" {
+		return errors.New("the log format must be raw, har or json")
+	}
+
+	if c.Log.Split != "route" && c.Log.Split != "upstream" && c.Log.Split != "none" {
+		return errors.New("the log files must be split by route, upstream or none")
+	}
+
+	for _, sink := range c.Log.Sinks {
+		if err := sink.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Log.Buffer <= 0 || c.Log.FlushInterval <= 0 || c.Log.BatchSize < 0 {
+		return errors.New("the log buffer and flush interval must be positive, and the batch size can't be negative")
+	}
+
+	if _, err := c.Log.Filter.compile(); err != nil {
+		return err
+	}
+
+	if err := c.Log.compileTime(); err != nil {
+		return err
+	}
+
+	switch c.Log.Overflow {
+	case "drop", "drop-oldest", "block", "sample":
+	default:
+		return fmt.Errorf("invalid log overflow policy %q, which must be drop, drop-oldest, block or sample", c.Log.Overflow)
+	}
+
+	if c.CookieJar != "" && c.CookieJar != "client" && c.CookieJar != "global" {
+		return errors.New("the cookie jar must be per client or global")
+	}
+
+	if c.Sticky != "" && c.Sticky != "cookie" && c.Sticky != "ip" {
+		return errors.New("the sticky sessions must be based on cookie or ip")
+	}
+
+	if err := validateBalance(c.Balance); err != nil {
+		return err
+	}
+
+	for addr, weight := range c.Weights {
+		if weight <= 0 {
+			return fmt.Errorf("the weight of %s must be positive", addr)
+		}
+	}
+
+	if c.Log.Binary != "hex" && c.Log.Binary != "omit" {
+		return errors.New("the binary log mode must be hex or omit")
+	}
+
+	if c.Forwarded != "x-forwarded" && c.Forwarded != "forwarded" && c.Forwarded != "none" {
+		return errors.New("the forwarded mode must be x-forwarded, forwarded or none")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("both the TLS certificate and key must be given to serve TLS")
+	}
+
+	for _, cert := range c.TLS.Certs {
+		if cert.Cert == "" || cert.Key == "" {
+			return errors.New("both the certificate and key must be given for each of the TLS certs")
+		}
+	}
+
+	if len(c.TLS.ACME.Hosts) > 0 {
+		if len(c.TLS.certificates()) > 0 {
+			return errors.New("the TLS certificate can't be given with the ACME hosts")
+		}
+
+		if err := c.TLS.ACME.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := validateProxyProtocolVersion(c.UpstreamProxyProtocol); err != nil {
+		return err
+	}
+
+	if _, err := c.proxyProtocolSources(); err != nil {
+		return err
+	}
+
+	if c.UpstreamProxyProtocol != "" && c.H2C {
+		return errors.New("the PROXY protocol can't be sent to the upstreams with h2c, whose connections are shared")
+	}
+
+	if c.UpstreamProxy != "" {
+		if c.UpstreamProxyProtocol != "" {
+			return errors.New("the PROXY protocol can't be sent to the upstreams through an upstream proxy")
+		}
+
+		if err := validateUpstreamProxy(c.UpstreamProxy); err != nil {
+			return err
+		}
+
+		if c.H2C {
+			return errors.New("h2c can't be spoken through an upstream proxy")
+		}
+	}
+
+	if err := c.DNS.compile(); err != nil {
+		return err
+	}
+
+	if (c.UpstreamTLS.Cert == "") != (c.UpstreamTLS.Key == "") {
+		return errors.New("both the client certificate and key must be given for the upstream TLS")
+	}
+
+	return nil
+}
+
+func (rc RouteConfig) validate() error {
+	if rc.Host != "" {
+		if err := validateRouteHost(rc.Host); err != nil {
+			return err
+		}
+
+		if rc.Path == "" {
+			rc.Path = "/"
+		}
+	}
+
+	if !strings.HasPrefix(rc.Path, "/") {
+		return fmt.Errorf("the route path %q must start with /", rc.Path)
+	}
+
+	if len(rc.Upstreams) == 0 {
+		return fmt.Errorf("the route %s needs at least one server address", rc.Path)
+	}
+
+	for i := range rc.Upstreams {
+		rc.Upstreams[i] = strings.TrimSuffix(rc.Upstreams[i], "/")
+
+		if err := validateForwardURL(rc.Upstreams[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := validateBalance(rc.Balance); err != nil {
+		return err
+	}
+
+	if rc.ACL != nil {
+		if _, err := newACL(*rc.ACL); err != nil {
+			return err
+		}
+	}
+
+	if rc.Rewrite != nil {
+		if err := rc.Rewrite.compile(); err != nil {
+			return err
+		}
+	}
+
+	if rc.Match != nil {
+		if err := rc.Match.compile(); err != nil {
+			return err
+		}
+	}
+
+	if rc.Fault != nil {
+		if err := rc.Fault.validate(); err != nil {
+			return err
+		}
+	}
+
+	if rc.SecurityHeaders != nil {
+		if err := rc.SecurityHeaders.validate(); err != nil {
+			return err
+		}
+	}
+
+	if rc.Timeouts != nil && (rc.Timeouts.Dial < 0 || rc.Timeouts.ResponseHeader < 0 || rc.Timeouts.Request < 0) {
+		return fmt.Errorf("the timeouts of the route %s can't be negative", rc.Path)
+	}
+
+	if rc.RateLimit != nil {
+		return rc.RateLimit.validate()
+	}
+
+	return nil
+}
+
+// validateRouteHost checks the host of a route: a hostname, without a port,
+// or a wildcard like *.example.com.
+func validateRouteHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/ ") {
+		return fmt.Errorf("invalid route host %q, which must be like example.com or *.example.com", host)
+	}
+
+	return nil
+}
+
+func (rlc RateLimitConfig) validate() error {
+	if rlc.Rate < 0 || rlc.Burst < 0 {
+		return errors.New("the rate limit and burst can't be negative")
+	}
+
+	if rlc.Key != "" && rlc.Key != "ip" && (!strings.HasPrefix(rlc.Key, "header:") || rlc.Key == "header:") {
+		return errors.New("the rate limit key must be ip or header:<name>")
+	}
+
+	return nil
+}
+
+func validateForwardURL(forwardAddr string) error {
+	forwardURL, err := url.Parse(forwardAddr)
+	if err != nil {
+		return fmt.Errorf("the address %s must be a valid URL", forwardAddr)
+	}
+
+	if forwardURL.Scheme == "unix" {
+		if forwardURL.Host != "" || forwardURL.Path == "" || forwardAddr != "unix://"+forwardURL.Path {
+			return fmt.Errorf("the address %s must be of type unix:///path/to/socket", forwardAddr)
+		}
+
+		return nil
+	}
+
+	if forwardURL.Scheme == "h3" && !http3Supported {
+		return fmt.Errorf("the address %s can't be reached, HTTP/3 requiring a build with the http3 tag", forwardAddr)
+	}
+
+	if forwardURL.Scheme != "http" && forwardURL.Scheme != "https" && forwardURL.Scheme != "h3" {
+		return fmt.Errorf("the scheme of %s must be http, https, h3 or unix", forwardAddr)
+	}
+
+	if forwardAddr != forwardURL.Scheme+"://"+forwardURL.Host {
+		return fmt.Errorf("the address %s must be a valid HTTP URL of type scheme://host", forwardAddr)
+	}
+
+	return nil
+}
+
+func validateBalance(balance string) error {
+	if balance == "" {
+		return nil
+	}
+
+	for _, strategy := range balanceStrategies {
+		if balance == strategy {
+			return nil
+		}
+	}
+
+	return errors.New("the balancing must be round-robin, weighted, least-conn or p2c")
+}
+
+// routesCollapse tells if a route collapses the requests.
+func (c *Config) routesCollapse() bool {
+	for _, rc := range c.Routes {
+		if rc.Collapse != nil && rc.Collapse.Enabled {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Config) routeConfigs() []RouteConfig {
+	routes := append([]RouteConfig(nil), c.Routes...)
+
+	if len(c.Upstreams) > 0 {
+		routes = append(routes, RouteConfig{Path: "/", Upstreams: c.Upstreams})
+	}
+
+	for i := range routes {
+		if routes[i].Balance == "" {
+			routes[i].Balance = c.Balance
+		}
+	}
+
+	return routes
+}
+
+func (t TimeoutsConfig) validate() error {
+	for _, d := range []time.Duration{t.Request, t.Shutdown, t.Dial, t.TLSHandshake, t.ResponseHeader, t.IdleConn, t.Intercept, t.ClientReadHeader, t.ClientRead, t.ClientWrite, t.ClientIdle, t.UDPIdle} {
+		if d < 0 {
+			return errors.New("the timeouts can't be negative")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connStats counts the connections to the upstreams, to tell how well the
+// pool reuses them: those open, those dialed, and the requests sent on a
+// connection taken from the pool, with how long it had been idle.
+type connStats struct {
+	open       atomic.Int64
+	dialed     atomic.Uint64
+	dialErrors atomic.Uint64
+	reused     atomic.Uint64
+	idleNanos  atomic.Int64
+}
+
+type connStatsView struct {
+	Open       int64   `json:"open"`
+	New        uint64  `json:"new"`
+	DialErrors uint64  `json:"dial_errors"`
+	Reused     uint64  `json:"reused"`
+	ReuseRate  float64 `json:"reuse_rate"`
+	AvgIdle    string  `json:"avg_idle"`
+}
+
+func (s *connStats) view() connStatsView {
+	view := connStatsView{
+		Open:       s.open.Load(),
+		New:        s.dialed.Load(),
+		DialErrors: s.dialErrors.Load(),
+		Reused:     s.reused.Load(),
+		AvgIdle:    "0s",
+	}
+
+	if total := view.New + view.Reused; total > 0 {
+		view.ReuseRate = float64(view.Reused) / float64(total)
+	}
+
+	if view.Reused > 0 {
+		view.AvgIdle = (time.Duration(s.idleNanos.Load()) / time.Duration(view.Reused)).Round(time.Millisecond).String()
+	}
+
+	return view
+}
+
+// conn counts a connection dialed, which is no longer open once closed.
+func (s *connStats) conn(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		s.dialErrors.Add(1)
+
+		return nil, err
+	}
+
+	s.dialed.Add(1)
+	s.open.Add(1)
+
+	return &countedConn{Conn: conn, stats: s}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	stats *connStats
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.stats.open.Add(-1) })
+
+	return c.Conn.Close()
+}
+
+// connStatsTransport counts the requests sent on reused connections.
+type connStatsTransport struct {
+	next  http.RoundTripper
+	stats *connStats
+}
+
+func (t *connStatsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.stats.reused.Add(1)
+				t.stats.idleNanos.Add(int64(info.IdleTime))
+			}
+		},
+	})
+
+	return t.next.RoundTrip(req.WithContext(ctx))
+}
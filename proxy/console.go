@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// consoleLogSink prints a line per exchange with its method, path, status,
+// latency and response size, for watching the traffic while debugging. The
+// lines are colored by status when the output is a terminal, unless
+// NO_COLOR is set. The exchanges whose request matches a rule of expand
+// also get their messages printed in full.
+type consoleLogSink struct {
+	out    io.Writer
+	cfg    LogConfig
+	expand []RequestMatch
+	color  bool
+}
+
+func newConsoleLogSink(c LogSinkConfig, cfg LogConfig) *consoleLogSink {
+	s := &consoleLogSink{out: os.Stdout, cfg: cfg, color: isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""}
+
+	for _, rule := range c.Expand {
+		if err := rule.compile(); err == nil {
+			s.expand = append(s.expand, rule)
+		}
+	}
+
+	return s
+}
+
+// isTerminal tells if file is a terminal rather than a file or a pipe.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (s *consoleLogSink) write(entry LogEntry, req *LogEntry) {
+	if req == nil || (entry.Err == nil && entry.Message.IsRequest) {
+		return
+	}
+
+	var line strings.Builder
+
+	fmt.Fprintf(&line, "%s %s %s %s ",
+		s.paint(colorDim, s.cfg.inTimeZone(req.Timestamp).Format("15:04:05")),
+		s.paint(colorDim, fmt.Sprintf("#%d", entry.ID)),
+		s.paint(colorBold, fmt.Sprintf("%-7s", req.Message.Method)),
+		req.Message.Path)
+
+	elapsed := formatElapsed(entry.elapsed(*req))
+
+	if entry.Err != nil {
+		fmt.Fprintf(&line, "%s %s %s", s.paint(colorRed, "ERR"), elapsed, s.paint(colorRed, entry.Err.Error()))
+	} else {
+		fmt.Fprintf(&line, "%s %s %s", s.paint(statusColor(entry.Message.StatusCode), fmt.Sprint(entry.Message.StatusCode)),
+			elapsed, formatSize(entry.Message.BodySize()))
+	}
+
+	fmt.Fprintln(s.out, line.String())
+
+	if s.expands(req.Message) {
+		s.printMessage(req.Message)
+
+		if entry.Err == nil {
+			s.printMessage(entry.Message)
+		}
+	}
+}
+
+func (s *consoleLogSink) expands(msg *Message) bool {
+	if len(s.expand) == 0 {
+		return false
+	}
+
+	r := messageRequest(msg)
+
+	for _, rule := range s.expand {
+		if rule.matches(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// printMessage prints msg like the raw logs, indented under its line.
+func (s *consoleLogSink) printMessage(msg *Message) {
+	text := strings.TrimRight(rawMessage(renderedBinary(msg, s.cfg.Binary, s.cfg.TextTypes)), "\r\n")
+
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintln(s.out, "    "+s.paint(colorDim, strings.TrimRight(line, "\r")))
+	}
+
+	fmt.Fprintln(s.out)
+}
+
+func (s *consoleLogSink) paint(color, text string) string {
+	if !s.color {
+		return text
+	}
+
+	return color + text + colorReset
+}
+
+func (s *consoleLogSink) flush() {}
+
+func (s *consoleLogSink) close() {}
+
+func statusColor(status int) string {
+	switch {
+	case status >= 500:
+		return colorRed
+	case status >= 400:
+		return colorYellow
+	case status >= 300:
+		return colorCyan
+	default:
+		return colorGreen
+	}
+}
+
+func formatElapsed(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+
+	return d.Round(time.Millisecond).String()
+}
+
+// formatSize is a human-friendly size, like 512B or 1.5KB.
+func formatSize(n int) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	size, suffix := float64(n)/unit, "KB"
+
+	for _, next := range []string{"MB", "GB"} {
+		if size < unit {
+			break
+		}
+
+		size, suffix = size/unit, next
+	}
+
+	return fmt.Sprintf("%.1f%s", size, suffix)
+}
@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// proxyStats counts the exchanges for the admin API.
+type proxyStats struct {
+	requests   atomic.Uint64
+	active     atomic.Int64
+	errors     atomic.Uint64
+	cacheHits  atomic.Uint64
+	collapsed  atomic.Uint64
+	duplicates atomic.Uint64
+	statuses   [6]atomic.Uint64
+
+	started time.Time
+}
+
+type statsView struct {
+	Uptime      string            `json:"uptime"`
+	Requests    uint64            `json:"requests"`
+	Active      int64             `json:"active"`
+	Errors      uint64            `json:"errors"`
+	CacheHits   uint64            `json:"cache_hits"`
+	Collapsed   uint64            `json:"collapsed"`
+	Duplicates  uint64            `json:"duplicates"`
+	Statuses    map[string]uint64 `json:"statuses"`
+	Connections connStatsView     `json:"connections"`
+	Logging     bool              `json:"logging"`
+	Logger      *LoggerStats      `json:"logger,omitempty"`
+}
+
+// count records a response or error entry.
+func (s *proxyStats) count(entry LogEntry) {
+	switch {
+	case entry.Err != nil:
+		s.errors.Add(1)
+	case entry.Message.Duplicate != nil:
+		s.duplicates.Add(1)
+	case !entry.Message.IsRequest && entry.Message.StatusCode >= 100 && entry.Message.StatusCode < 600:
+		s.statuses[entry.Message.StatusCode/100].Add(1)
+	}
+}
+
+func (p *Proxy) statsView() statsView {
+	view := statsView{
+		Uptime:      time.Since(p.stats.started).Round(time.Second).String(),
+		Requests:    p.stats.requests.Load(),
+		Active:      p.stats.active.Load(),
+		Errors:      p.stats.errors.Load(),
+		CacheHits:   p.stats.cacheHits.Load(),
+		Collapsed:   p.stats.collapsed.Load(),
+		Duplicates:  p.stats.duplicates.Load(),
+		Statuses:    make(map[string]uint64),
+		Connections: p.conns.view(),
+		Logging:     p.loggingEnabled(),
+	}
+
+	if logger, ok := p.logger.(interface{ Stats() LoggerStats }); ok {
+		stats := logger.Stats()
+		view.Logger = &stats
+	}
+
+	for class := 1; class < len(p.stats.statuses); class++ {
+		view.Statuses[fmt.Sprintf("%dxx", class)] = p.stats.statuses[class].Load()
+	}
+
+	return view
+}
+
+func (p *Proxy) loggingEnabled() bool {
+	return p.loggingPaused.Load() == 0
+}
+
+// requireAdminToken lets through the requests carrying the admin token,
+// either as a bearer token or as the password of basic auth, which the
+// browsers prompt for when opening the web UI.
+//
+// Since the browsers send that password along with the requests of any web
+// page, the requests changing the proxy are rejected if they come from
+// another origin, and their bodies must be JSON, which the browsers don't
+// send to another origin without its consent.
+func (p *Proxy) requireAdminToken(next http.Handler) http.Handler {
+	token := []byte(p.cfg.Admin.Token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			given = password
+		}
+
+		if subtle.ConstantTimeCompare([]byte(given), token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-proxy admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r.Host) {
+				http.Error(w, "the admin API can't be changed from another origin", http.StatusForbidden)
+
+				return
+			}
+
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.ContentLength != 0 && mediaType != "application/json" {
+				http.Error(w, "the body must be JSON, with Content-Type: application/json", http.StatusUnsupportedMediaType)
+
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin tells if the Origin of a request is the host it's sent to.
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+
+	return err == nil && strings.EqualFold(u.Host, host)
+}
+
+type upstreamChange struct {
+	Route string `json:"route"`
+	Addr  string `json:"addr"`
+}
+
+// serveControl handles the admin API for changing the proxy at runtime:
+//
+//	GET    /config       shows the configuration, with the reloaded settings, as YAML
+//	GET    /stats        shows the counters of the exchanges
+//	POST   /upstreams    adds the upstream {"route": "api", "addr": "http://host"}
+//	DELETE /upstreams    removes the upstream {"route": "api", "addr": "http://host"}
+//	POST   /cache/flush  empties the response cache
+//	GET    /logging      tells if the exchanges are being logged
+//	PUT    /logging      pauses or resumes the logging with {"enabled": false}
+//	GET    /maintenance  tells if the proxy or some routes are in maintenance
+//	PUT    /maintenance  sets the maintenance with {"enabled": true, "routes": [], "retry_after": "5m"}
+//
+// The routes of the upstreams and of the maintenance are given by name or
+// path, the -addr servers being the / route.
+func (p *Proxy) serveControl(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/config" && r.Method == http.MethodGet:
+		p.serveConfig(w)
+	case r.URL.Path == "/stats" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, p.statsView())
+	case r.URL.Path == "/upstreams" && r.Method == http.MethodGet:
+		p.serveUpstreams(w, r)
+	case r.URL.Path == "/upstreams" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		p.changeUpstreams(w, r)
+	case r.URL.Path == "/cache/flush" && r.Method == http.MethodPost:
+		if p.cache != nil {
+			p.cache.flush()
+		}
+
+		log.Printf("Flushed the cache at the admin API")
+
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/logging" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": p.loggingEnabled()})
+	case r.URL.Path == "/logging" && r.Method == http.MethodPut:
+		p.setLogging(w, r)
+	case r.URL.Path == "/maintenance" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, newMaintenanceView(p.Maintenance()))
+	case r.URL.Path == "/maintenance" && r.Method == http.MethodPut:
+		p.setMaintenance(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) serveConfig(w http.ResponseWriter) {
+	cfg := redactedConfig(*p.currentConfig())
+
+	content, err := yaml.Marshal(&cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(content)
+}
+
+// redactedConfig returns cfg without its secrets: the tokens, passwords and
+// the credentials in the URLs.
+func redactedConfig(cfg Config) Config {
+	if cfg.Admin.Token != "" {
+		cfg.Admin.Token = "[redacted]"
+	}
+
+	if len(cfg.Auth.Users) > 0 {
+		users := make(map[string]string, len(cfg.Auth.Users))
+		for name := range cfg.Auth.Users {
+			users[name] = "[redacted]"
+		}
+
+		cfg.Auth.Users = users
+	}
+
+	if len(cfg.Auth.Tokens) > 0 {
+		cfg.Auth.Tokens = []string{"[redacted]"}
+	}
+
+	cfg.UpstreamProxy = redactedURL(cfg.UpstreamProxy)
+	cfg.Tracing.Endpoint = redactedURL(cfg.Tracing.Endpoint)
+	cfg.Upstreams = redactedURLs(cfg.Upstreams)
+
+	cfg.Routes = append([]RouteConfig(nil), cfg.Routes...)
+	for i := range cfg.Routes {
+		cfg.Routes[i].Upstreams = redactedURLs(cfg.Routes[i].Upstreams)
+	}
+
+	cfg.Log.Sinks = append([]LogSinkConfig(nil), cfg.Log.Sinks...)
+	for i := range cfg.Log.Sinks {
+		cfg.Log.Sinks[i].Address = redactedURL(cfg.Log.Sinks[i].Address)
+	}
+
+	cfg.Processors = append([]ProcessorConfig(nil), cfg.Processors...)
+	for i := range cfg.Processors {
+		cfg.Processors[i].URL = redactedURL(cfg.Processors[i].URL)
+	}
+
+	return cfg
+}
+
+// redactedURL hides the password of a URL, or its user name if it has no
+// password, since it's then usually a token.
+func redactedURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+
+	if _, ok := u.User.Password(); ok {
+		return u.Redacted()
+	}
+
+	u.User = url.User("xxxxx")
+
+	return u.String()
+}
+
+func redactedURLs(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+
+	redacted := make([]string, len(urls))
+	for i, rawURL := range urls {
+		redacted[i] = redactedURL(rawURL)
+	}
+
+	return redacted
+}
+
+func (p *Proxy) changeUpstreams(w http.ResponseWriter, r *http.Request) {
+	var change upstreamChange
+
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, "invalid upstream: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if change.Route == "" {
+		change.Route = "/"
+	}
+
+	rt := p.routeTable().byName(change.Route)
+	if rt == nil {
+		http.Error(w, fmt.Sprintf("no route %s", change.Route), http.StatusNotFound)
+
+		return
+	}
+
+	addr := strings.TrimSuffix(change.Addr, "/")
+
+	if r.Method == http.MethodPost {
+		if err := validateForwardURL(addr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if !rt.upstreams.add(addr, p.health) {
+			http.Error(w, fmt.Sprintf("the route %s already has the upstream %s", rt.displayName(), addr), http.StatusConflict)
+
+			return
+		}
+
+		log.Printf("Added the upstream %s to the route %s at the admin API", addr, rt.displayName())
+
+		writeJSON(w, http.StatusOK, rt.upstreams.stats())
+
+		return
+	}
+
+	removed, err := rt.upstreams.remove(addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+
+		return
+	}
+
+	if !removed {
+		http.Error(w, fmt.Sprintf("the route %s has no upstream %s", rt.displayName(), addr), http.StatusNotFound)
+
+		return
+	}
+
+	if p.health != nil && !p.routeTable().hasUpstream(addr) {
+		p.health.unwatch(addr)
+	}
+
+	log.Printf("Removed the upstream %s from the route %s at the admin API", addr, rt.displayName())
+
+	writeJSON(w, http.StatusOK, rt.upstreams.stats())
+}
+
+// serveCache handles the admin API for the cached responses:
+//
+//	GET    /cache?url=pattern  lists the responses cached for the URLs matching pattern
+//	GET    /cache/<id>         shows a cached response as HTTP
+//	DELETE /cache?url=pattern  removes the responses cached for the URLs matching pattern
+//
+// The URLs are the host and the path with the query, like
+// api.local/users?page=2, the * of the patterns matching any characters.
+func (p *Proxy) serveCache(w http.ResponseWriter, r *http.Request) {
+	if p.cache == nil {
+		http.Error(w, "the cache is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/cache"), "/")
+	pattern := r.URL.Query().Get("url")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, p.cache.list(pattern))
+	case id == "" && r.Method == http.MethodDelete:
+		purged := p.cache.purge(pattern)
+
+		log.Printf("Purged %d cached responses matching %q at the admin API", purged, pattern)
+
+		writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	case r.Method == http.MethodGet:
+		cached := p.cache.get(id)
+		if cached == nil {
+			http.Error(w, fmt.Sprintf("no cached response %s", id), http.StatusNotFound)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeCachedResponse(w, cached)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) setLogging(w http.ResponseWriter, r *http.Request) {
+	var logging struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&logging); err != nil {
+		http.Error(w, "invalid logging: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	paused := uint32(1)
+	if logging.Enabled {
+		paused = 0
+	}
+
+	p.loggingPaused.Store(paused)
+
+	log.Printf("Set the logging of the exchanges to %t at the admin API", logging.Enabled)
+
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": logging.Enabled})
+}
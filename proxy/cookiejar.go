@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+	"time"
+)
+
+const (
+	cookieJarSweepInterval = time.Minute
+
+	// cookieJarIdleTimeout is how long the jar of a client is kept after its
+	// last request.
+	cookieJarIdleTimeout = time.Hour
+)
+
+type clientCookieJar struct {
+	jar      *cookiejar.Jar
+	lastUsed time.Time
+}
+
+// cookieJarTransport keeps the cookies set by the upstreams, in a jar per
+// client IP or in a single one, and sends them along with the next requests
+// to the same upstream, for the clients that don't handle cookies. The
+// cookies sent by the client take precedence.
+type cookieJarTransport struct {
+	next  http.RoundTripper
+	perIP bool
+
+	mu        sync.Mutex
+	jars      map[string]*clientCookieJar
+	lastSweep time.Time
+}
+
+func newCookieJarTransport(next http.RoundTripper, mode string) *cookieJarTransport {
+	return &cookieJarTransport{
+		next:      next,
+		perIP:     mode == "client",
+		jars:      make(map[string]*clientCookieJar),
+		lastSweep: time.Now(),
+	}
+}
+
+func (t *cookieJarTransport) jar(req *http.Request) *cookiejar.Jar {
+	key := ""
+	if r := InboundRequest(req.Context()); t.perIP && r != nil {
+		key = clientIP(r)
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastSweep) > cookieJarSweepInterval {
+		for key, jar := range t.jars {
+			if now.Sub(jar.lastUsed) > cookieJarIdleTimeout {
+				delete(t.jars, key)
+			}
+		}
+
+		t.lastSweep = now
+	}
+
+	jar, ok := t.jars[key]
+	if !ok {
+		cookies, _ := cookiejar.New(nil)
+		jar = &clientCookieJar{jar: cookies}
+		t.jars[key] = jar
+	}
+
+	jar.lastUsed = now
+
+	return jar.jar
+}
+
+func (t *cookieJarTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	jar := t.jar(req)
+
+	if cookies := jar.Cookies(req.URL); len(cookies) > 0 {
+		req = req.Clone(req.Context())
+
+		for _, cookie := range cookies {
+			if _, err := req.Cookie(cookie.Name); err == http.ErrNoCookie {
+				req.AddCookie(cookie)
+			}
+		}
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if cookies := res.Cookies(); len(cookies) > 0 {
+		jar.SetCookies(req.URL, cookies)
+	}
+
+	return res, nil
+}
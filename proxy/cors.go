@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCORSMethods are the methods allowed to the cross-origin requests
+// by default.
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// CORSConfig answers the CORS preflight requests from the browsers, and adds
+// the CORS headers to the responses, in place of those of the upstreams:
+//
+//   - Origins, the origins allowed, like https://app.example.com, or globs
+//     like https://*.example.com, * allowing any of them.
+//   - Methods, the methods allowed.
+//   - Headers, the request headers allowed, those the browser asks for
+//     being allowed if empty.
+//   - ExposeHeaders, the response headers the scripts can read.
+//   - Credentials, whether the cookies and the authorization are sent.
+//   - MaxAge, how long the browsers can cache the preflight answers.
+type CORSConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Origins       []string      `yaml:"origins"`
+	Methods       []string      `yaml:"methods"`
+	Headers       []string      `yaml:"headers"`
+	ExposeHeaders []string      `yaml:"expose_headers"`
+	Credentials   bool          `yaml:"credentials"`
+	MaxAge        time.Duration `yaml:"max_age"`
+}
+
+func (c CORSConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if len(c.Origins) == 0 {
+		return errors.New("CORS requires the allowed origins")
+	}
+
+	for _, origin := range c.Origins {
+		if _, err := path.Match(origin, ""); err != nil {
+			return fmt.Errorf("invalid CORS origin %q: %w", origin, err)
+		}
+	}
+
+	if c.MaxAge < 0 {
+		return errors.New("the CORS max age can't be negative")
+	}
+
+	return nil
+}
+
+func (c *CORSConfig) allows(origin string) bool {
+	for _, pattern := range c.Origins {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedOrigin is the value of Access-Control-Allow-Origin for origin,
+// which can't be * when the credentials are allowed.
+func (c *CORSConfig) allowedOrigin(origin string) string {
+	if len(c.Origins) == 1 && c.Origins[0] == "*" && !c.Credentials {
+		return "*"
+	}
+
+	return origin
+}
+
+func isCORSPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// serveCORSPreflight answers the preflight request r, without the upstream.
+func (p *Proxy) serveCORSPreflight(w http.ResponseWriter, r *http.Request) {
+	cfg := &p.cfg.CORS
+	origin := r.Header.Get("Origin")
+
+	header := w.Header()
+	header.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	if !cfg.allows(origin) {
+		log.Printf("Denied the CORS preflight of %s %s from the origin %s", r.Header.Get("Access-Control-Request-Method"), r.URL.Path, origin)
+
+		p.writeError(w, r, http.StatusForbidden, fmt.Errorf("the origin %s isn't allowed", origin))
+
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", cfg.allowedOrigin(origin))
+	header.Set("Access-Control-Allow-Methods", strings.Join(cfg.Methods, ", "))
+
+	if len(cfg.Headers) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(cfg.Headers, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+
+	if cfg.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if cfg.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// corsWriter adds the CORS headers to the response to an allowed origin,
+// replacing those of the upstream.
+type corsWriter struct {
+	http.ResponseWriter
+	cfg         *CORSConfig
+	origin      string
+	wroteHeader bool
+}
+
+func (cw *corsWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+
+		header := cw.Header()
+		for name := range header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				header.Del(name)
+			}
+		}
+
+		header.Set("Access-Control-Allow-Origin", cw.cfg.allowedOrigin(cw.origin))
+		if header.Get("Access-Control-Allow-Origin") != "*" {
+			header.Add("Vary", "Origin")
+		}
+
+		if cw.cfg.Credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if len(cw.cfg.ExposeHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(cw.cfg.ExposeHeaders, ", "))
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *corsWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *corsWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *corsWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
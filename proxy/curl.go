@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// curlCommand writes a recorded request as a curl command line sending it
+// to baseURL again. Content-Length is left to curl.
+func curlCommand(e *recordedExchange, n int, baseURL string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# #%d %s %s -> %d\n", n, e.Request.Method, e.Request.Path, e.Response.Status)
+
+	target := strings.TrimSuffix(baseURL, "/") + e.Request.Path
+	if e.Request.Query != "" {
+		target += "?" + e.Request.Query
+	}
+
+	b.WriteString("curl")
+
+	switch {
+	case e.Request.Method == http.MethodHead:
+		b.WriteString(" --head")
+	case e.Request.Method == http.MethodPost && len(e.Request.Body) > 0:
+	case e.Request.Method != http.MethodGet:
+		b.WriteString(" -X " + shellQuote(e.Request.Method))
+	}
+
+	b.WriteString(" " + shellQuote(target))
+
+	names := make([]string, 0, len(e.Request.Header))
+	for name := range e.Request.Header {
+		if name != "Content-Length" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range e.Request.Header[name] {
+			b.WriteString(" \\\n  -H " + shellQuote(name+": "+value))
+		}
+	}
+
+	if len(e.Request.Body) > 0 {
+		b.WriteString(" \\\n  --data-binary " + shellQuote(string(e.Request.Body)))
+	}
+
+	b.WriteString("\n")
+
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell, or for bash with $'...' if it has
+// control characters or isn't valid UTF-8.
+func shellQuote(s string) string {
+	printable := utf8.ValidString(s)
+
+	for _, r := range s {
+		if r < ' ' && r != '\n' && r != '\t' || r == 0x7f {
+			printable = false
+
+			break
+		}
+	}
+
+	if printable {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+
+	var b strings.Builder
+
+	b.WriteString("$'")
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= ' ' && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+
+	b.WriteString("'")
+
+	return b.String()
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// maxDecodedBody is where the decoding of the bodies stops, for the small
+// bodies that decode into gigabytes.
+const maxDecodedBody = 16 << 20
+
+// decodedMessage returns a copy of msg with its body decoded from the
+// Content-Encoding, or msg itself if the body isn't encoded or can't be
+// decoded. Truncated bodies, like the ones logged while streaming, are
+// decoded as far as they go, and the decoded bodies are cut off past
+// maxDecodedBody.
+func decodedMessage(msg *Message) *Message {
+	if msg == nil || len(msg.Body) == 0 {
+		return msg
+	}
+
+	encodings := strings.Split(msg.Header.Get("Content-Encoding"), ",")
+
+	body, truncated := msg.Body, false
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoded, cut, ok := decodeBody(strings.TrimSpace(encodings[i]), body)
+		if !ok {
+			return msg
+		}
+
+		body, truncated = decoded, truncated || cut
+	}
+
+	if bytes.Equal(body, msg.Body) {
+		return msg
+	}
+
+	decoded := *msg
+	decoded.Body = body
+
+	if truncated {
+		log.Printf("Cut off a %s body decoded past %d bytes", msg.Header.Get("Content-Encoding"), maxDecodedBody)
+
+		decoded.Truncated = true
+	}
+
+	return &decoded
+}
+
+// decodeBody decodes body from encoding, telling if it was cut off past
+// maxDecodedBody.
+func decodeBody(encoding string, body []byte) (decoded []byte, truncated, ok bool) {
+	var reader io.Reader
+
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return body, false, true
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, false, false
+		}
+
+		reader = gzipReader
+	case "deflate":
+		// Most servers send zlib-wrapped data as deflate, a few raw deflate.
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		} else {
+			reader = zlibReader
+		}
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, false, false
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxDecodedBody+1))
+	if err != nil && len(decoded) == 0 {
+		return nil, false, false
+	}
+
+	if len(decoded) > maxDecodedBody {
+		return decoded[:maxDecodedBody], true, true
+	}
+
+	return decoded, false, true
+}
+
+// decodeRequestBody decodes the body of r from its Content-Encoding, if
+// it's gzip, deflate or br, for the upstreams that can't, dropping the
+// header. The decoded body is cut off past limit bytes, or
+// DefaultDecodedRequestBody if it's 0, so that a small compressed body
+// can't expand unbounded.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, limit ByteSize) error {
+	var decoded io.Reader
+
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return fmt.Errorf("invalid gzip request body: %w", err)
+		}
+
+		decoded = gzipReader
+	case "deflate":
+		buffered := bufio.NewReader(r.Body)
+
+		// Like the responses, the bodies are zlib-wrapped or, for a few
+		// clients, raw deflate.
+		if header, err := buffered.Peek(2); err == nil && header[0]&0x0f == 8 && (int(header[0])<<8|int(header[1]))%31 == 0 {
+			zlibReader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return fmt.Errorf("invalid deflate request body: %w", err)
+			}
+
+			decoded = zlibReader
+		} else {
+			decoded = flate.NewReader(buffered)
+		}
+	case "br":
+		decoded = brotli.NewReader(r.Body)
+	default:
+		return nil
+	}
+
+	if limit <= 0 {
+		limit = DefaultDecodedRequestBody
+	}
+
+	r.Body = http.MaxBytesReader(w, decodedBody{Reader: decoded, Closer: r.Body}, int64(limit))
+
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+
+	return nil
+}
+
+// decodedBody reads the decoded body, closing the original one.
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const cacheFileExt = ".cache"
+
+// cacheFileMeta is the first line of a cache file, the body following it.
+type cacheFileMeta struct {
+	Key      string      `json:"key"`
+	URL      string      `json:"url"`
+	Vary     []string    `json:"vary,omitempty"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	StoredAt time.Time   `json:"stored_at"`
+	Expires  time.Time   `json:"expires"`
+
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`
+}
+
+// cacheEntryView is a cached response as listed by the admin API and the
+// cache command.
+type cacheEntryView struct {
+	ID       string   `json:"id"`
+	URL      string   `json:"url"`
+	Vary     []string `json:"vary,omitempty"`
+	Status   int      `json:"status"`
+	Size     int      `json:"size"`
+	StoredAt string   `json:"stored_at"`
+	Expires  string   `json:"expires"`
+}
+
+// cacheEntryID identifies a cached response, being also the name of its
+// file.
+func cacheEntryID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *cachedResponse) view() cacheEntryView {
+	return cacheEntryView{
+		ID:       cacheEntryID(c.key),
+		URL:      c.url,
+		Vary:     c.vary,
+		Status:   c.status,
+		Size:     len(c.body),
+		StoredAt: c.storedAt.UTC().Format(time.RFC3339),
+		Expires:  c.expires.UTC().Format(time.RFC3339),
+	}
+}
+
+// writeCacheFile saves cached to dir, replacing the file atomically.
+func writeCacheFile(dir string, cached *cachedResponse) error {
+	meta, err := json.Marshal(cacheFileMeta{
+		Key:      cached.key,
+		URL:      cached.url,
+		Vary:     cached.vary,
+		Status:   cached.status,
+		Header:   cached.header,
+		StoredAt: cached.storedAt,
+		Expires:  cached.expires,
+
+		StaleWhileRevalidate: cached.staleWhileRevalidate,
+		StaleIfError:         cached.staleIfError,
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(append(meta, '\n'), cached.body...))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(dir, cacheEntryID(cached.key)+cacheFileExt))
+}
+
+func readCacheFile(fileName string) (*cachedResponse, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	line, body, ok := bytes.Cut(content, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a cache file", fileName)
+	}
+
+	var meta cacheFileMeta
+
+	if err := json.Unmarshal(line, &meta); err != nil {
+		return nil, fmt.Errorf("%s isn't a cache file: %w", fileName, err)
+	}
+
+	return &cachedResponse{
+		key:      meta.Key,
+		url:      meta.URL,
+		vary:     meta.Vary,
+		status:   meta.Status,
+		header:   meta.Header,
+		body:     body,
+		storedAt: meta.StoredAt,
+		expires:  meta.Expires,
+
+		staleWhileRevalidate: meta.StaleWhileRevalidate,
+		staleIfError:         meta.StaleIfError,
+	}, nil
+}
+
+// readCacheDir reads the cached responses of dir, oldest first, removing
+// those expired and past their stale lifetimes.
+func readCacheDir(dir string) ([]*cachedResponse, error) {
+	fileNames, err := filepath.Glob(filepath.Join(dir, "*"+cacheFileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*cachedResponse
+
+	now := time.Now()
+
+	for _, fileName := range fileNames {
+		cached, err := readCacheFile(fileName)
+		if err != nil {
+			log.Printf("Skipping the cache file %s: %v", fileName, err)
+
+			continue
+		}
+
+		if _, ok := cached.freshness(now); !ok {
+			os.Remove(fileName)
+
+			continue
+		}
+
+		entries = append(entries, cached)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].storedAt.Before(entries[j].storedAt)
+	})
+
+	return entries, nil
+}
+
+// load fills the cache with the responses saved in its directory.
+func (c *responseCache) load() error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+
+	entries, err := readCacheDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, cached := range entries {
+		c.add(cached)
+	}
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+
+	return nil
+}
+
+// cacheURLPattern compiles a pattern of the cached URLs, like
+// api.local/users/*, whose * match any characters. An empty pattern
+// matches every URL.
+func cacheURLPattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+// list returns the responses cached for the URLs matching pattern, the
+// most recently used first.
+func (c *responseCache) list(pattern string) []cacheEntryView {
+	re := cacheURLPattern(pattern)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	views := []cacheEntryView{}
+
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		if cached := elem.Value.(*cachedResponse); re.MatchString(cached.url) {
+			views = append(views, cached.view())
+		}
+	}
+
+	return views
+}
+
+func (c *responseCache) get(id string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		if cached := elem.Value.(*cachedResponse); cacheEntryID(cached.key) == id {
+			return cached
+		}
+	}
+
+	return nil
+}
+
+// purge removes the responses cached for the URLs matching pattern,
+// returning how many.
+func (c *responseCache) purge(pattern string) int {
+	re := cacheURLPattern(pattern)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var purged []*list.Element
+
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		if re.MatchString(elem.Value.(*cachedResponse).url) {
+			purged = append(purged, elem)
+		}
+	}
+
+	for _, elem := range purged {
+		c.remove(elem)
+	}
+
+	return len(purged)
+}
+
+// writeCachedResponse writes cached to w as an HTTP response, with the URL
+// and the expiry before it.
+func writeCachedResponse(w io.Writer, cached *cachedResponse) {
+	res := &http.Response{
+		Proto:      "HTTP/1.1",
+		Status:     fmt.Sprintf("%d %s", cached.status, http.StatusText(cached.status)),
+		StatusCode: cached.status,
+		Header:     cached.header,
+	}
+
+	msg := decodedMessage(newRawHTTPResponse(res, cached.body))
+
+	fmt.Fprintf(w, "==> %s (%s)\n", cached.url, cacheEntryID(cached.key))
+	fmt.Fprintf(w, "==> Stored %s, expires %s\n", cached.storedAt.Local().Format(time.RFC3339), cached.expires.Local().Format(time.RFC3339))
+	fmt.Fprintln(w, rawMessage(renderedBinary(msg, "hex", DefaultTextTypes)))
+}
+
+// ListCache writes the responses saved in the cache directory dir for the
+// URLs matching pattern to w, one per line, returning how many there are.
+func ListCache(dir, pattern string, w io.Writer) (int, error) {
+	entries, err := readCacheDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	re := cacheURLPattern(pattern)
+	out := bufio.NewWriter(w)
+	n := 0
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if view := entries[i].view(); re.MatchString(view.URL) {
+			fmt.Fprintf(out, "%s  %d  %8d  %s  %s\n", view.ID, view.Status, view.Size, entries[i].storedAt.Local().Format("02/01/2006 15:04:05"), view.URL)
+			n++
+		}
+	}
+
+	return n, out.Flush()
+}
+
+// InspectCache writes the response saved in the cache directory dir with
+// the ID id, or a prefix of it, to w.
+func InspectCache(dir, id string, w io.Writer) error {
+	fileNames, err := filepath.Glob(filepath.Join(dir, filepath.Base(id)+"*"+cacheFileExt))
+	if err != nil {
+		return err
+	}
+
+	switch len(fileNames) {
+	case 0:
+		return fmt.Errorf("no cached response %s in %s", id, dir)
+	case 1:
+	default:
+		return fmt.Errorf("%d cached responses start with %s", len(fileNames), id)
+	}
+
+	cached, err := readCacheFile(fileNames[0])
+	if err != nil {
+		return err
+	}
+
+	writeCachedResponse(w, cached)
+
+	return nil
+}
+
+// PurgeCache removes the responses saved in the cache directory dir for
+// the URLs matching pattern, returning how many. A running proxy keeps
+// them in memory until it restarts.
+func PurgeCache(dir, pattern string) (int, error) {
+	entries, err := readCacheDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	re := cacheURLPattern(pattern)
+	n := 0
+
+	for _, cached := range entries {
+		if !re.MatchString(cached.url) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, cacheEntryID(cached.key)+cacheFileExt)); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNSConfig changes how the upstream hosts are resolved. Resolve pins
+// host:port pairs to an address, like curl's --resolve host:port:address,
+// and Server is a DNS server (host:port) to ask instead of the system
+// resolver.
+type DNSConfig struct {
+	Resolve []string `yaml:"resolve"`
+	Server  string   `yaml:"server"`
+
+	overrides map[string]string
+}
+
+func (c *DNSConfig) compile() error {
+	c.overrides = make(map[string]string, len(c.Resolve))
+
+	for _, entry := range c.Resolve {
+		host, port, address, err := parseResolve(entry)
+		if err != nil {
+			return err
+		}
+
+		c.overrides[net.JoinHostPort(host, port)] = address
+	}
+
+	if c.Server == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return fmt.Errorf("the DNS server %q must be of type host:port", c.Server)
+	}
+
+	return nil
+}
+
+// parseResolve splits an entry of type host:port:address, where the
+// address can be an IPv6 one in brackets.
+func parseResolve(entry string) (host, port, address string, err error) {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("the resolve entry %q must be of type host:port:address", entry)
+	}
+
+	address = strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+	if net.ParseIP(address) == nil {
+		return "", "", "", fmt.Errorf("invalid address %q in the resolve entry %q", address, entry)
+	}
+
+	return strings.ToLower(parts[0]), parts[1], address, nil
+}
+
+// upstreamDialer connects to the upstreams, applying the DNS overrides and
+// connecting to the Unix sockets of the unix:// upstreams. The connections
+// of the pool are counted in stats. The PROXY protocol header of version
+// proxyProtocol is sent first on the connections if it's set.
+type upstreamDialer struct {
+	dialer        *net.Dialer
+	overrides     map[string]string
+	stats         *connStats
+	proxyProtocol string
+}
+
+func newDialer(cfg *Config) *upstreamDialer {
+	d := &upstreamDialer{
+		dialer:    &net.Dialer{Timeout: cfg.Timeouts.Dial, KeepAlive: cfg.Connections.KeepAlive},
+		overrides: cfg.DNS.overrides,
+	}
+
+	if cfg.Admin.Port > 0 {
+		d.dialer.Control = refuseAdminAddr(cfg.Admin.Port)
+	}
+
+	if cfg.DNS.Server != "" {
+		server := cfg.DNS.Server
+		dnsDialer := &net.Dialer{Timeout: cfg.Timeouts.Dial}
+
+		d.dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dnsDialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return d
+}
+
+func (d *upstreamDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects within the dial timeout of the route of the request
+// that ctx belongs to, if it has one.
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.stats != nil {
+		return d.stats.conn(d.dial(ctx, network, addr))
+	}
+
+	return d.dial(ctx, network, addr)
+}
+
+func (d *upstreamDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialUpstream(ctx, network, addr)
+	if err != nil || d.proxyProtocol == "" {
+		return conn, err
+	}
+
+	if err := sendProxyProtocolHeader(ctx, conn, d.proxyProtocol); err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *upstreamDialer) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := d.dialer
+	if b := requestTimeoutBudgets(ctx); b != nil && b.dial > 0 {
+		copied := *dialer
+		copied.Timeout = b.dial
+		dialer = &copied
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		if socket, ok := unixSocketPath(host); ok {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+
+		if address, ok := d.overrides[net.JoinHostPort(strings.ToLower(host), port)]; ok {
+			addr = net.JoinHostPort(address, port)
+		}
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
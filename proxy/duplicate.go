@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Duplicate tells that a request repeats an identical one, with the same
+// route, method, path, query and body, made shortly before it.
+type Duplicate struct {
+	// Of is the ID of the previous identical request.
+	Of uint64
+
+	// Count is the number of identical requests in a row, each following
+	// the previous one within the window, this one included.
+	Count int
+
+	// After is the time since the previous identical request.
+	After time.Duration
+}
+
+func (d Duplicate) String() string {
+	return fmt.Sprintf("Duplicate of #%d, %s after it (%d identical requests in a row)", d.Of, d.After.Round(time.Millisecond), d.Count)
+}
+
+func (d Duplicate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Of          uint64  `json:"of"`
+		Count       int     `json:"count"`
+		AfterMillis float64 `json:"after_ms"`
+	}{d.Of, d.Count, durationMillis(d.After)})
+}
+
+// duplicateTracker finds the requests repeating an identical one made
+// within window.
+type duplicateTracker struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[[sha256.Size]byte]*seenRequest
+	lastSweep time.Time
+}
+
+type seenRequest struct {
+	id    uint64
+	at    time.Time
+	count int
+}
+
+func newDuplicateTracker(window time.Duration) *duplicateTracker {
+	return &duplicateTracker{window: window, seen: make(map[[sha256.Size]byte]*seenRequest), lastSweep: time.Now()}
+}
+
+// requestFingerprint hashes what makes the request of entry identical to
+// another.
+func requestFingerprint(entry LogEntry) [sha256.Size]byte {
+	msg := entry.Message
+
+	uri := msg.URL
+	if u, err := url.Parse(msg.URL); err == nil {
+		uri = u.RequestURI()
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s %s\n%d\n", entry.Route, msg.Method, uri, msg.Omitted)
+	h.Write(msg.Body)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+
+	return sum
+}
+
+// check records the request of entry, returning the duplicate it is or nil.
+func (t *duplicateTracker) check(entry LogEntry) *Duplicate {
+	fingerprint := requestFingerprint(entry)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := entry.Timestamp
+
+	if now.Sub(t.lastSweep) > t.window {
+		for key, seen := range t.seen {
+			if now.Sub(seen.at) > t.window {
+				delete(t.seen, key)
+			}
+		}
+
+		t.lastSweep = now
+	}
+
+	seen, ok := t.seen[fingerprint]
+	if !ok || now.Sub(seen.at) > t.window {
+		t.seen[fingerprint] = &seenRequest{id: entry.ID, at: now, count: 1}
+
+		return nil
+	}
+
+	dup := &Duplicate{Of: seen.id, Count: seen.count + 1, After: now.Sub(seen.at)}
+
+	seen.id, seen.at, seen.count = entry.ID, now, dup.Count
+
+	return dup
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// ErrorPagesConfig renders the bodies of the errors answered by the proxy
+// itself, like 502 when an upstream can't be reached or 429 when a client
+// is rate limited. Format picks the built-in pages: text (the status text),
+// json or html. Templates replace them with text/template files by status,
+// like 502, status class, like 5xx, or default for the others, given the
+// .Status, .StatusText, .Error, .RequestID, .Method, .Path and .Time. Their
+// Content-Type comes from their extension.
+type ErrorPagesConfig struct {
+	Format    string            `yaml:"format"`
+	Templates map[string]string `yaml:"templates"`
+}
+
+var errorPageKeyRegexp = regexp.MustCompile(`^([1-5][0-9][0-9]|[1-5]xx|default)$`)
+
+func (c ErrorPagesConfig) validate() error {
+	if _, ok := errorPageFormats[c.Format]; !ok && c.Format != "" {
+		return fmt.Errorf("invalid error page format %q, which must be text, json or html", c.Format)
+	}
+
+	for key := range c.Templates {
+		if !errorPageKeyRegexp.MatchString(key) {
+			return fmt.Errorf("invalid error page %q, which must be a status like 502, a class like 5xx or default", key)
+		}
+	}
+
+	return nil
+}
+
+type errorPage struct {
+	contentType string
+	template    *template.Template
+}
+
+// errorPageFormats are the built-in error pages.
+var errorPageFormats = map[string]errorPage{
+	"text": newBuiltinErrorPage("text/plain; charset=utf-8", "{{.StatusText}}\n"),
+	"json": newBuiltinErrorPage("application/json",
+		`{"status":{{.Status}},"error":{{json .StatusText}}{{if .RequestID}},"request_id":{{json .RequestID}}{{end}}}`+"\n"),
+	"html": newBuiltinErrorPage("text/html; charset=utf-8", `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+{{- if .RequestID}}
+<p>Request ID: <code>{{html .RequestID}}</code></p>
+{{- end}}
+</body>
+</html>
+`),
+}
+
+func newBuiltinErrorPage(contentType, text string) errorPage {
+	return errorPage{contentType: contentType, template: template.Must(template.New("error").Funcs(bodyTemplateFuncs).Parse(text))}
+}
+
+// errorPageData is given to the error page templates.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Error      string
+	RequestID  string
+	Method     string
+	Path       string
+	Time       time.Time
+}
+
+// errorPages are the error pages of an ErrorPagesConfig, by status, class
+// or default.
+type errorPages struct {
+	pages map[string]errorPage
+}
+
+func loadErrorPages(cfg ErrorPagesConfig) (*errorPages, error) {
+	format := cfg.Format
+	if format == "" {
+		format = "text"
+	}
+
+	e := &errorPages{pages: map[string]errorPage{"default": errorPageFormats[format]}}
+
+	for key, fileName := range cfg.Templates {
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		tmpl, err := template.New(filepath.Base(fileName)).Funcs(bodyTemplateFuncs).Option("missingkey=zero").Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page template %s: %w", fileName, err)
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(fileName))
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+
+		e.pages[key] = errorPage{contentType: contentType, template: tmpl}
+	}
+
+	return e, nil
+}
+
+func (e *errorPages) page(status int) errorPage {
+	for _, key := range []string{strconv.Itoa(status), fmt.Sprintf("%dxx", status/100)} {
+		if page, ok := e.pages[key]; ok {
+			return page
+		}
+	}
+
+	return e.pages["default"]
+}
+
+// writeError answers r with the error page of status, err being the reason
+// if there is one.
+func (p *Proxy) writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestID:  p.inboundRequestID(r),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Time:       time.Now(),
+	}
+
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	page := p.errorPages.page(status)
+
+	var body bytes.Buffer
+
+	if err := page.template.Execute(&body, data); err != nil {
+		log.Printf("Can't render the error page of %d: %v", status, err)
+
+		http.Error(w, http.StatusText(status), status)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	_, _ = w.Write(body.Bytes())
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// ExportOptions are the format the exchanges are exported to and its
+// settings:
+//   - har, HTTP Archive 1.2, for the browser devtools and other HAR viewers.
+//   - raw, the HTTP messages as text, like the raw logs.
+//   - curl, the requests as curl commands sending them to BaseURL.
+//   - go, a Go source file of package Package with the exchanges and an
+//     httptest server answering with them, for test stubs.
+//   - pcapng, the exchanges as HTTP/1.1 over made up TCP connections to
+//     the host of BaseURL, for Wireshark.
+//
+// The values of the headers in RedactHeaders, DefaultRedactedHeaders if
+// it's nil, and of the JSON fields in RedactFields are replaced with
+// "[REDACTED]", like in the logs.
+type ExportOptions struct {
+	Format  string
+	BaseURL string
+	Package string
+
+	RedactHeaders []string
+	RedactFields  []string
+}
+
+// ExportCaptures writes the exchanges of the record file that match q to w
+// in the format of opts. It returns how many exchanges were exported.
+func ExportCaptures(fileName string, q CaptureQuery, opts ExportOptions, w io.Writer) (int, error) {
+	redact := LogConfig{RedactHeaders: opts.RedactHeaders, RedactFields: opts.RedactFields}
+	if redact.RedactHeaders == nil {
+		redact.RedactHeaders = DefaultRedactedHeaders
+	}
+
+	// readRedacted reads the exchanges of the file with redact applied.
+	readRedacted := func(fn func(n int, exchange *recordedExchange) error) (int, error) {
+		return readCaptures(fileName, q, func(n int, exchange *recordedExchange, _ []byte) error {
+			return fn(n, exchange.redacted(redact))
+		})
+	}
+
+	switch opts.Format {
+	case "har":
+		har := harFile{Log: harLog{Version: "1.2", Creator: harCreator{Name: "go-proxy", Version: "1.0"}, Entries: []harEntry{}}}
+
+		exported, err := readRedacted(func(n int, exchange *recordedExchange) error {
+			req, res := exchange.logEntries(n)
+			har.Log.Entries = append(har.Log.Entries, newHAREntry(req, res))
+
+			return nil
+		})
+		if err != nil {
+			return exported, err
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return exported, encoder.Encode(har)
+	case "raw":
+		sink := &rawLogSink{logger: log.New(w, "", 0), cfg: LogConfig{Binary: "hex", TextTypes: DefaultTextTypes}}
+
+		return readRedacted(func(n int, exchange *recordedExchange) error {
+			req, res := exchange.logEntries(n)
+			req.Message, res.Message = decodedMessage(req.Message), decodedMessage(res.Message)
+
+			sink.write(req, nil)
+			sink.write(res, &req)
+
+			return nil
+		})
+	case "curl":
+		return readRedacted(func(n int, exchange *recordedExchange) error {
+			_, err := io.WriteString(w, curlCommand(exchange, n, opts.BaseURL)+"\n")
+
+			return err
+		})
+	case "go":
+		var exchanges []*recordedExchange
+
+		exported, err := readRedacted(func(_ int, exchange *recordedExchange) error {
+			exchanges = append(exchanges, exchange)
+
+			return nil
+		})
+		if err != nil {
+			return exported, err
+		}
+
+		return exported, writeGoFixture(w, opts.Package, exchanges)
+	case "pcapng":
+		host := "localhost"
+		if u, err := url.Parse(opts.BaseURL); err == nil && u.Host != "" {
+			host = u.Host
+		}
+
+		pcap := newPCAPNGWriter(w, opts.BaseURL)
+
+		return readRedacted(func(n int, exchange *recordedExchange) error {
+			req, res := exchange.logEntries(n)
+
+			return pcap.writeExchange(n, host, req, res)
+		})
+	}
+
+	return 0, fmt.Errorf("invalid format %q, which must be har, raw, curl, go or pcapng", opts.Format)
+}
+
+var errCaptureFound = errors.New("found the capture")
+
+// InspectCapture writes the exchange at position n of the record file, as
+// numbered by QueryCaptures, to w as HTTP messages with their bodies
+// decoded.
+func InspectCapture(fileName string, n int, w io.Writer) error {
+	sink := &rawLogSink{logger: log.New(w, "", 0), cfg: LogConfig{Binary: "hex", TextTypes: DefaultTextTypes}}
+
+	_, err := readCaptures(fileName, CaptureQuery{id: n}, func(_ int, exchange *recordedExchange, _ []byte) error {
+		req, res := exchange.logEntries(n)
+		req.Message, res.Message = decodedMessage(req.Message), decodedMessage(res.Message)
+
+		sink.write(req, nil)
+		sink.write(res, &req)
+
+		return errCaptureFound
+	})
+
+	switch {
+	case errors.Is(err, errCaptureFound):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	return fmt.Errorf("no exchange #%d in %s", n, fileName)
+}
+
+// logEntries turns a recorded exchange back into the log entries of its
+// request and response. The protocol and the host aren't recorded.
+func (e *recordedExchange) logEntries(id int) (req, res LogEntry) {
+	target := e.Request.Path
+	if e.Request.Query != "" {
+		target += "?" + e.Request.Query
+	}
+
+	req = LogEntry{
+		ID:        uint64(id),
+		Timestamp: e.Timestamp.Add(-e.duration()),
+		Message: &Message{
+			IsRequest: true,
+			Method:    e.Request.Method,
+			Path:      e.Request.Path,
+			URL:       target,
+			Proto:     "HTTP/1.1",
+			Header:    e.Request.Header,
+			Body:      e.Request.Body,
+		},
+	}
+
+	res = LogEntry{
+		ID:        uint64(id),
+		Timestamp: e.Timestamp,
+		Message: &Message{
+			Proto:      "HTTP/1.1",
+			Status:     fmt.Sprintf("%d %s", e.Response.Status, http.StatusText(e.Response.Status)),
+			StatusCode: e.Response.Status,
+			Header:     e.Response.Header,
+			Body:       e.Response.Body,
+		},
+	}
+
+	return req, res
+}
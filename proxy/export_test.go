@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportCapturesRedacted(t *testing.T) {
+	exchange := recordedExchange{
+		Timestamp: time.Now(),
+		Request: recordedRequest{
+			Method: "POST",
+			Path:   "/login",
+			Header: http.Header{"Authorization": {"Bearer s3cret-token"}, "Cookie": {"session=s3cret-cookie"}, "Content-Type": {"application/json"}},
+			Body:   []byte(`{"user": "alice", "password": "s3cret-password"}`),
+		},
+		Response: recordedResponse{
+			Status: http.StatusOK,
+			Header: http.Header{"Set-Cookie": {"session=s3cret-session"}, "Content-Type": {"application/json"}},
+			Body:   []byte(`{"ok": true}`),
+		},
+	}
+
+	fileName := filepath.Join(t.TempDir(), "captures.jsonl")
+
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fileName, append(line, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"har", "raw", "curl", "go", "pcapng"} {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+
+			opts := ExportOptions{Format: format, BaseURL: "http://localhost:8080", Package: "fixtures", RedactFields: []string{"password"}}
+
+			if _, err := ExportCaptures(fileName, CaptureQuery{}, opts, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(out.String(), "s3cret") {
+				t.Errorf("the %s export has a secret:\n%s", format, out.String())
+			}
+
+			// The Go fixtures keep only the responses.
+			if format != "go" && !strings.Contains(out.String(), "alice") {
+				t.Errorf("the %s export lost the request body:\n%s", format, out.String())
+			}
+		})
+	}
+
+	t.Run("kept", func(t *testing.T) {
+		var out bytes.Buffer
+
+		if _, err := ExportCaptures(fileName, CaptureQuery{}, ExportOptions{Format: "curl", RedactHeaders: []string{}}, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(out.String(), "s3cret-token") {
+			t.Errorf("the export without redacted headers lost the Authorization:\n%s", out.String())
+		}
+	})
+}
+
+// TestRecordKeepsSecrets checks that the recordings keep the values the
+// logs redact, for the replay and resend, and that the export redacts them.
+func TestRecordKeepsSecrets(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=s3cret-session")
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.Upstreams = []string{upstream.URL}
+	cfg.Log.Dir = t.TempDir()
+	cfg.Record = filepath.Join(t.TempDir(), "captures.jsonl")
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Set("Authorization", "Bearer s3cret-token")
+	p.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	p.Close()
+
+	recorded, err := os.ReadFile(cfg.Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"s3cret-token", "s3cret-session"} {
+		if !strings.Contains(string(recorded), secret) {
+			t.Errorf("the recording lacks %q:\n%s", secret, recorded)
+		}
+	}
+
+	var out bytes.Buffer
+
+	if _, err := ExportCaptures(cfg.Record, CaptureQuery{}, ExportOptions{Format: "har"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "s3cret") {
+		t.Errorf("the export has a secret:\n%s", out.String())
+	}
+}
+
+// TestReadCapturesHAR reads back the HAR export of a record file.
+func TestReadCapturesHAR(t *testing.T) {
+	exchange := recordedExchange{
+		Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Duration:  12.5,
+		Request: recordedRequest{
+			Method: "POST",
+			Path:   "/login",
+			Query:  "next=%2Fhome",
+			Header: http.Header{"Content-Type": {"application/json"}},
+			Body:   []byte(`{"user": "alice"}`),
+		},
+		Response: recordedResponse{
+			Status: http.StatusCreated,
+			Header: http.Header{"Content-Type": {"application/octet-stream"}},
+			Body:   []byte{0xff, 0x00, 0x01},
+		},
+	}
+	exchange.Request.BodyHash = bodyHash(exchange.Request.Body)
+
+	dir := t.TempDir()
+	fileName, harName := filepath.Join(dir, "captures.jsonl"), filepath.Join(dir, "captures.har")
+
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fileName, append(line, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var har bytes.Buffer
+
+	if _, err := ExportCaptures(fileName, CaptureQuery{}, ExportOptions{Format: "har", BaseURL: "http://localhost:8080", RedactHeaders: []string{}}, &har); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(harName, har.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*recordedExchange
+
+	matched, err := readCaptures(harName, CaptureQuery{Status: "2xx"}, func(_ int, exchange *recordedExchange, _ []byte) error {
+		got = append(got, exchange)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if matched != 1 || len(got) != 1 {
+		t.Fatalf("got %d exchanges, want 1", matched)
+	}
+
+	req, res := got[0].Request, got[0].Response
+
+	if !got[0].Timestamp.Equal(exchange.Timestamp) || got[0].Duration != exchange.Duration {
+		t.Errorf("got the time %s and duration %v, want %s and %v", got[0].Timestamp, got[0].Duration, exchange.Timestamp, exchange.Duration)
+	}
+
+	if req.Method != "POST" || req.Path != "/login" || req.Query != "next=%2Fhome" || req.BodyHash != exchange.Request.BodyHash {
+		t.Errorf("got the request %+v", req)
+	}
+
+	if res.Status != http.StatusCreated || !bytes.Equal(res.Body, exchange.Response.Body) || res.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("got the response %+v", res)
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var errInjectedFault = errors.New("injected fault")
+
+// FaultConfig injects faults into the exchanges, to test how the clients
+// cope with them. Every request is delayed by Delay plus up to DelayJitter.
+// Abort, Drop and Corrupt are the percentages of requests that are answered
+// with AbortStatus (503 by default) without reaching the upstream, that
+// have their connection closed halfway through the response body, and that
+// get a response body with flipped bytes.
+type FaultConfig struct {
+	Delay       time.Duration `yaml:"delay"`
+	DelayJitter time.Duration `yaml:"delay_jitter"`
+	Abort       float64       `yaml:"abort"`
+	AbortStatus int           `yaml:"abort_status"`
+	Drop        float64       `yaml:"drop"`
+	Corrupt     float64       `yaml:"corrupt"`
+
+	// Match restricts the faults to the requests it matches.
+	Match *RequestMatch `yaml:"match"`
+}
+
+func (fc FaultConfig) validate() error {
+	if fc.Delay < 0 || fc.DelayJitter < 0 {
+		return errors.New("the fault delays can't be negative")
+	}
+
+	for _, percent := range []float64{fc.Abort, fc.Drop, fc.Corrupt} {
+		if percent < 0 || percent > 100 {
+			return errors.New("the fault percentages must be between 0 and 100")
+		}
+	}
+
+	if fc.AbortStatus != 0 && (fc.AbortStatus < 100 || fc.AbortStatus > 599) {
+		return errors.New("the fault abort status must be a valid HTTP status")
+	}
+
+	if fc.Match != nil {
+		return fc.Match.compile()
+	}
+
+	return nil
+}
+
+// injectFault applies the faults of fc to the exchange, returning the
+// writer for the response, or false if the exchange was already answered.
+func (p *Proxy) injectFault(w http.ResponseWriter, ex *exchange, fc FaultConfig) (http.ResponseWriter, bool) {
+	if fc.Match != nil && !fc.Match.matches(ex.inbound) {
+		return w, true
+	}
+
+	delay := fc.Delay
+	if fc.DelayJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(fc.DelayJitter)))
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ex.inbound.Context().Done():
+			return w, false
+		}
+	}
+
+	if chance(fc.Abort) {
+		status := fc.AbortStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+
+		p.writeProxyError(w, ex, status, errInjectedFault)
+
+		return w, false
+	}
+
+	fw := &faultWriter{ResponseWriter: w, drop: chance(fc.Drop), corrupt: chance(fc.Corrupt)}
+
+	switch {
+	case fw.drop:
+		log.Printf("Injecting a dropped connection into #%d", ex.id)
+	case fw.corrupt:
+		log.Printf("Injecting a corrupted body into #%d", ex.id)
+	default:
+		return w, true
+	}
+
+	return fw, true
+}
+
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// faultWriter flips a byte of every write if corrupt is set, and aborts
+// the connection halfway through the first write if drop is set.
+type faultWriter struct {
+	http.ResponseWriter
+	drop    bool
+	corrupt bool
+}
+
+func (fw *faultWriter) Write(p []byte) (int, error) {
+	if fw.corrupt && len(p) > 0 {
+		p = append([]byte(nil), p...)
+		p[rand.Intn(len(p))] ^= 0xff
+	}
+
+	if !fw.drop || len(p) == 0 {
+		return fw.ResponseWriter.Write(p)
+	}
+
+	_, _ = fw.ResponseWriter.Write(p[:len(p)/2])
+	fw.Flush()
+
+	panic(http.ErrAbortHandler)
+}
+
+func (fw *faultWriter) Flush() {
+	_ = http.NewResponseController(fw.ResponseWriter).Flush()
+}
+
+func (fw *faultWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
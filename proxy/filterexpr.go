@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exchangeFilter tells if an exchange of the web UI and tail is shown.
+type exchangeFilter func(*exchangeSummary) bool
+
+// compileFilter parses an expression selecting the exchanges, like
+//
+//	status >= 500 && path ~ "/api" && duration > 200ms
+//
+// The comparisons are of a field with a value, quoted or not:
+//
+//   - status, like 404 or a class like 5xx, and id, numbers.
+//   - duration, like 200ms or 1.5s, a bare number being milliseconds.
+//   - size, the response body, like 512 or 10KB.
+//   - method, path, route, upstream and error, strings, compared with ==
+//     and != or matched against a regular expression with ~ and !~.
+//
+// error and pending alone select the failed and unanswered exchanges.
+// The comparisons combine with && (and), || (or), ! (not) and parentheses.
+// An empty expression selects everything.
+func compileFilter(expr string) (exchangeFilter, error) {
+	tokens, err := filterTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return func(*exchangeSummary) bool { return true }, nil
+	}
+
+	p := &filterParser{tokens: tokens}
+
+	filter, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in the filter", p.tokens[p.pos].text)
+	}
+
+	return filter, nil
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// filterOperators are the operators of the filters, the longer first.
+var filterOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "!~", "(", ")", "!", "<", ">", "~", "="}
+
+func filterTokens(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string in the filter")
+			}
+
+			tokens = append(tokens, filterToken{text: expr[i+1 : i+1+end], quoted: true})
+			i += end + 2
+
+			continue
+		}
+
+		operator := ""
+
+		for _, op := range filterOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				operator = op
+
+				break
+			}
+		}
+
+		if operator != "" {
+			tokens = append(tokens, filterToken{text: operator})
+			i += len(operator)
+
+			continue
+		}
+
+		end := i
+		for end < len(expr) && !strings.ContainsRune(" \t\n\r\"'()&|!=<>~", rune(expr[end])) {
+			end++
+		}
+
+		if end == i {
+			return nil, fmt.Errorf("unexpected %q in the filter", expr[i])
+		}
+
+		tokens = append(tokens, filterToken{text: expr[i:end]})
+		i = end
+	}
+
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// accept consumes the next token if it's one of words, the keywords being
+// case insensitive.
+func (p *filterParser) accept(words ...string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return false
+	}
+
+	for _, word := range words {
+		if strings.EqualFold(p.tokens[p.pos].text, word) {
+			p.pos++
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *filterParser) or() (exchangeFilter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("||", "or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(ex *exchangeSummary) bool { return l(ex) || right(ex) }
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) and() (exchangeFilter, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("&&", "and") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(ex *exchangeSummary) bool { return l(ex) && right(ex) }
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) unary() (exchangeFilter, error) {
+	if p.accept("!", "not") {
+		filter, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ex *exchangeSummary) bool { return !filter(ex) }, nil
+	}
+
+	if p.accept("(") {
+		filter, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.accept(")") {
+			return nil, errors.New("missing ) in the filter")
+		}
+
+		return filter, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (exchangeFilter, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("the filter ends too early")
+	}
+
+	field := p.tokens[p.pos]
+	if field.quoted || strings.ContainsAny(field.text, "&|!=<>~()") {
+		return nil, fmt.Errorf("unexpected %q in the filter, where a field was expected", field.text)
+	}
+
+	p.pos++
+
+	op := ""
+	for _, candidate := range []string{"==", "=", "!=", "<=", ">=", "<", ">", "~", "!~"} {
+		if p.accept(candidate) {
+			op = candidate
+
+			break
+		}
+	}
+
+	name := strings.ToLower(field.text)
+
+	if op == "" {
+		switch name {
+		case "error":
+			return func(ex *exchangeSummary) bool { return ex.Error != "" }, nil
+		case "pending":
+			return func(ex *exchangeSummary) bool { return ex.Pending }, nil
+		}
+
+		return nil, fmt.Errorf("the field %q of the filter must be compared with a value", field.text)
+	}
+
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("missing value after %s %s in the filter", field.text, op)
+	}
+
+	value := p.tokens[p.pos]
+	p.pos++
+
+	if op == "=" {
+		op = "=="
+	}
+
+	return compileFilterComparison(name, op, value.text)
+}
+
+func compileFilterComparison(field, op, value string) (exchangeFilter, error) {
+	switch field {
+	case "method":
+		return compileStringComparison(op, value, true, func(ex *exchangeSummary) string { return ex.Method })
+	case "path":
+		return compileStringComparison(op, value, false, func(ex *exchangeSummary) string { return ex.Path })
+	case "route":
+		return compileStringComparison(op, value, false, func(ex *exchangeSummary) string { return ex.Route })
+	case "upstream":
+		return compileStringComparison(op, value, false, func(ex *exchangeSummary) string { return ex.Upstream })
+	case "error":
+		return compileStringComparison(op, value, false, func(ex *exchangeSummary) string { return ex.Error })
+	}
+
+	switch {
+	case field != "status" && field != "duration" && field != "size" && field != "id":
+		return nil, fmt.Errorf("unknown field %q in the filter, which must be status, method, path, route, upstream, duration, size, error, id or pending", field)
+	case op == "~" || op == "!~":
+		return nil, fmt.Errorf("the %s operator doesn't apply to the %s field", op, field)
+	}
+
+	var lo, hi float64
+	var get func(*exchangeSummary) float64
+
+	switch field {
+	case "status":
+		minStatus, maxStatus, err := parseStatusRange(value)
+		if err != nil {
+			return nil, err
+		}
+
+		lo, hi = float64(minStatus), float64(maxStatus)
+		get = func(ex *exchangeSummary) float64 { return float64(ex.Status) }
+	case "duration":
+		ms, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration %q in the filter", value)
+			}
+
+			ms = durationMillis(d)
+		}
+
+		lo, hi = ms, ms
+		get = func(ex *exchangeSummary) float64 { return ex.Duration }
+	case "size":
+		size, err := ParseByteSize(value)
+		if err != nil {
+			return nil, err
+		}
+
+		lo, hi = float64(size), float64(size)
+		get = func(ex *exchangeSummary) float64 { return float64(ex.Size) }
+	case "id":
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q in the filter", value)
+		}
+
+		lo, hi = float64(id), float64(id)
+		get = func(ex *exchangeSummary) float64 { return float64(ex.ID) }
+	}
+
+	// The values are ranges, for the status classes.
+	switch op {
+	case "==":
+		return func(ex *exchangeSummary) bool { return get(ex) >= lo && get(ex) <= hi }, nil
+	case "!=":
+		return func(ex *exchangeSummary) bool { return get(ex) < lo || get(ex) > hi }, nil
+	case "<":
+		return func(ex *exchangeSummary) bool { return get(ex) < lo }, nil
+	case "<=":
+		return func(ex *exchangeSummary) bool { return get(ex) <= hi }, nil
+	case ">":
+		return func(ex *exchangeSummary) bool { return get(ex) > hi }, nil
+	case ">=":
+		return func(ex *exchangeSummary) bool { return get(ex) >= lo }, nil
+	}
+
+	return nil, fmt.Errorf("the %s operator doesn't apply to the %s field", op, field)
+}
+
+func compileStringComparison(op, value string, foldCase bool, get func(*exchangeSummary) string) (exchangeFilter, error) {
+	switch op {
+	case "==", "!=":
+		want := op == "=="
+
+		return func(ex *exchangeSummary) bool {
+			if foldCase {
+				return strings.EqualFold(get(ex), value) == want
+			}
+
+			return (get(ex) == value) == want
+		}, nil
+	case "~", "!~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q in the filter: %w", value, err)
+		}
+
+		want := op == "~"
+
+		return func(ex *exchangeSummary) bool { return re.MatchString(get(ex)) == want }, nil
+	}
+
+	return nil, fmt.Errorf("the %s operator doesn't apply to strings, which are compared with ==, !=, ~ or !~", op)
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileFilter(t *testing.T) {
+	ex := &exchangeSummary{ID: 7, Method: "POST", Path: "/api/users", Route: "api", Status: 502, Duration: 250, Size: 2048}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "", want: true},
+		{expr: "status >= 500", want: true},
+		{expr: "status == 5xx", want: true},
+		{expr: "status = 4xx", want: false},
+		{expr: `status >= 500 && path ~ "/api"`, want: true},
+		{expr: `status >= 500 and path !~ '^/api'`, want: false},
+		{expr: "method == post || status < 300", want: true},
+		{expr: "!(duration > 200ms)", want: false},
+		{expr: "not duration > 1s", want: true},
+		{expr: "size >= 2KB && id == 7", want: true},
+		{expr: "route != api", want: false},
+		{expr: "error || pending", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			filter, err := compileFilter(tt.expr)
+			if err != nil {
+				t.Fatalf("compileFilter(%q): %v", tt.expr, err)
+			}
+
+			if got := filter(ex); got != tt.want {
+				t.Errorf("filter %q = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		`status >= 500 & path ~ "/api"`,
+		`status >= 500 | path ~ "/api"`,
+		"&",
+		"|",
+		"status >= 500 &",
+		`path ~ "/api`,
+		"status >=",
+		"status",
+		"(status >= 500",
+		"status >= 500)",
+		"== 500",
+		"color == red",
+		"status ~ 5",
+		"method > GET",
+		"duration > soon",
+		`path ~ "("`,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				_, err := compileFilter(expr)
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Errorf("compileFilter(%q) succeeded, want an error", expr)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("compileFilter(%q) didn't return", expr)
+			}
+		})
+	}
+}
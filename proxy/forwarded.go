@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+func setForwardedHeaders(mode string, r *http.Request, req *http.Request) {
+	forwardedFor := clientIP(r)
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	switch mode {
+	case "x-forwarded":
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
+		}
+
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", r.Host)
+	case "forwarded":
+		forwarded := "for=" + forwardedNode(forwardedFor) + ";host=" + quoteForwarded(r.Host) + ";proto=" + proto
+
+		if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+			forwarded = strings.Join(prior, ", ") + ", " + forwarded
+		}
+
+		req.Header.Set("Forwarded", forwarded)
+	}
+}
+
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return `"` + value + `"`
+	}
+
+	return value
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveConnect tunnels the connection to the host requested with CONNECT,
+// usually for TLS, which is then passed through without being logged unless
+// it's decrypted with MITM.
+func (p *Proxy) serveConnect(w http.ResponseWriter, ex *exchange) {
+	r := ex.inbound
+
+	reqMsg := newRawHTTPRequest(r, nil)
+	reqMsg.Path = r.Host
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Upstream: ex.upstream, Route: ex.route.name, Message: reqMsg})
+
+	if r.ProtoMajor != 1 {
+		p.writeProxyError(w, ex, http.StatusHTTPVersionNotSupported, errors.New("CONNECT is only supported over HTTP/1.1"))
+
+		return
+	}
+
+	var upstreamConn net.Conn
+
+	if p.mitm == nil {
+		var err error
+
+		upstreamConn, err = p.dialTunnel(r.Context(), r.Host)
+		if err != nil {
+			p.writeUpstreamError(w, ex, err)
+
+			return
+		}
+	}
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		if upstreamConn != nil {
+			upstreamConn.Close()
+		}
+
+		log.Printf("Can't take over the connection of #%d: %v", ex.id, err)
+
+		return
+	}
+
+	res := &http.Response{
+		Proto:      "HTTP/1.1",
+		Status:     "200 Connection established",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+	}
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		clientConn.Close()
+
+		if upstreamConn != nil {
+			upstreamConn.Close()
+		}
+
+		return
+	}
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Message: newRawHTTPResponse(res, nil)})
+
+	if p.mitm != nil {
+		p.mitm.serve(&bufferedConn{Conn: clientConn, reader: clientBuf.Reader}, r.Host, p.handler)
+
+		return
+	}
+
+	tunnel(clientConn, clientBuf.Reader, upstreamConn)
+}
+
+// tunnel copies the bytes both ways until both sides are done, clientReader
+// holding what the client sent after the CONNECT request.
+func tunnel(clientConn net.Conn, clientReader *bufio.Reader, upstreamConn net.Conn) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(upstreamConn, clientReader)
+		closeWrite(upstreamConn)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, _ = io.Copy(clientConn, upstreamConn)
+		closeWrite(clientConn)
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+
+	clientConn.Close()
+	upstreamConn.Close()
+}
+
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = halfCloser.CloseWrite()
+
+		return
+	}
+
+	_ = conn.Close()
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const goFixtureHeader = `// Code generated by go-proxy export -format go. DO NOT EDIT.
+
+package %s
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Exchange is a recorded request, by its method, path and query, and the
+// response to it.
+type Exchange struct {
+	Method string
+	Path   string
+	Query  string
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Handler answers the requests with the recorded responses of the same
+// method, path and query, in the recorded order for the requests made more
+// than once, the last one being repeated. Other requests get a 404.
+func Handler() http.Handler {
+	var mu sync.Mutex
+
+	served := make([]bool, len(Exchanges))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Encode()
+
+		mu.Lock()
+
+		found := -1
+
+		for i, e := range Exchanges {
+			if e.Method != r.Method || e.Path != r.URL.Path || e.Query != query {
+				continue
+			}
+
+			found = i
+
+			if !served[i] {
+				served[i] = true
+
+				break
+			}
+		}
+
+		mu.Unlock()
+
+		if found < 0 {
+			http.Error(w, "no recorded exchange for "+r.Method+" "+r.URL.RequestURI(), http.StatusNotFound)
+
+			return
+		}
+
+		e := Exchanges[found]
+
+		for name, values := range e.Header {
+			w.Header()[name] = values
+		}
+
+		w.WriteHeader(e.Status)
+		_, _ = w.Write(e.Body)
+	})
+}
+
+// NewServer starts a test server answering with the recorded responses.
+// The caller closes it.
+func NewServer() *httptest.Server {
+	return httptest.NewServer(Handler())
+}
+
+// Exchanges are the recorded exchanges, in their order.
+var Exchanges = []Exchange{
+`
+
+// writeGoFixture writes the recorded exchanges as a Go source file of
+// package pkg, with an httptest server answering with them, to turn real
+// traffic into test stubs.
+func writeGoFixture(w io.Writer, pkg string, exchanges []*recordedExchange) error {
+	if !token.IsIdentifier(pkg) {
+		return fmt.Errorf("invalid package name %q", pkg)
+	}
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, goFixtureHeader, pkg)
+
+	for _, e := range exchanges {
+		fmt.Fprintf(&b, "\t{\n\t\tMethod: %s,\n\t\tPath: %s,\n\t\tQuery: %s,\n\t\tStatus: %d,\n",
+			strconv.Quote(e.Request.Method), strconv.Quote(e.Request.Path), strconv.Quote(e.Request.Query), e.Response.Status)
+
+		b.WriteString("\t\tHeader: http.Header{\n")
+
+		names := make([]string, 0, len(e.Response.Header))
+		for name := range e.Response.Header {
+			if name != "Content-Length" {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			values := make([]string, len(e.Response.Header[name]))
+			for i, value := range e.Response.Header[name] {
+				values[i] = strconv.Quote(value)
+			}
+
+			fmt.Fprintf(&b, "\t\t\t%s: {%s},\n", strconv.Quote(name), strings.Join(values, ", "))
+		}
+
+		b.WriteString("\t\t},\n")
+
+		if len(e.Response.Body) > 0 {
+			fmt.Fprintf(&b, "\t\tBody: []byte(%s),\n", strconv.Quote(string(e.Response.Body)))
+		}
+
+		b.WriteString("\t},\n")
+	}
+
+	b.WriteString("}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("can't format the Go fixture: %w", err)
+	}
+
+	_, err = w.Write(src)
+
+	return err
+}
@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// GraphQLConfig parses the requests to the GraphQL endpoints at Paths, to
+// log their operations, block those matching Block and rate limit them by
+// RateLimits. The operations are matched by name, type or both, like
+// deleteUser, mutation or "mutation delete*".
+type GraphQLConfig struct {
+	Paths      []string           `yaml:"paths"`
+	Block      []string           `yaml:"block"`
+	RateLimits []GraphQLRateLimit `yaml:"rate_limits"`
+}
+
+// GraphQLRateLimit limits the operations matching Operation for each
+// client, the first matching limit applying.
+type GraphQLRateLimit struct {
+	Operation       string `yaml:"operation"`
+	RateLimitConfig `yaml:",inline"`
+}
+
+// GraphQLOperation is an operation of a GraphQL request, Name being empty
+// for the anonymous ones.
+type GraphQLOperation struct {
+	Type      string          `json:"type"`
+	Name      string          `json:"name,omitempty"`
+	Variables json.RawMessage `json:"variables,omitempty"`
+}
+
+func (op GraphQLOperation) String() string {
+	if op.Name == "" {
+		return op.Type
+	}
+
+	return op.Type + " " + op.Name
+}
+
+// graphQLRequest is a request of the GraphQL over HTTP protocol, several of
+// them being sent at once in a JSON array by the batching clients.
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+}
+
+type graphQL struct {
+	paths      []RequestMatch
+	block      []string
+	rateLimits []graphQLRateLimiter
+}
+
+type graphQLRateLimiter struct {
+	operation string
+	limiter   *rateLimiter
+}
+
+func (c GraphQLConfig) validate() error {
+	for _, p := range c.Paths {
+		match := RequestMatch{Path: p}
+		if err := match.compile(); err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range c.Block {
+		if err := validateGraphQLPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	for _, limit := range c.RateLimits {
+		if err := validateGraphQLPattern(limit.Operation); err != nil {
+			return err
+		}
+
+		if limit.Rate <= 0 {
+			return fmt.Errorf("the rate limit of the GraphQL operation %q must be positive", limit.Operation)
+		}
+
+		if err := limit.RateLimitConfig.validate(); err != nil {
+			return err
+		}
+	}
+
+	if (len(c.Block) > 0 || len(c.RateLimits) > 0) && len(c.Paths) == 0 {
+		return errors.New("the GraphQL operations can't be blocked or rate limited without the paths of the endpoints")
+	}
+
+	return nil
+}
+
+func validateGraphQLPattern(pattern string) error {
+	fields := strings.Fields(pattern)
+	if len(fields) == 0 || len(fields) > 2 || (len(fields) == 2 && !isGraphQLOperationType(fields[0])) {
+		return fmt.Errorf("invalid GraphQL operation %q, which must be like deleteUser, mutation or \"mutation delete*\"", pattern)
+	}
+
+	if _, err := path.Match(fields[len(fields)-1], ""); err != nil {
+		return fmt.Errorf("invalid GraphQL operation %q: %w", pattern, err)
+	}
+
+	return nil
+}
+
+func isGraphQLOperationType(name string) bool {
+	return name == "query" || name == "mutation" || name == "subscription"
+}
+
+func newGraphQL(cfg GraphQLConfig) *graphQL {
+	g := &graphQL{block: cfg.Block}
+
+	for _, p := range cfg.Paths {
+		g.paths = append(g.paths, RequestMatch{Path: p})
+	}
+
+	for _, limit := range cfg.RateLimits {
+		g.rateLimits = append(g.rateLimits, graphQLRateLimiter{operation: limit.Operation, limiter: newRateLimiter(limit.RateLimitConfig)})
+	}
+
+	return g
+}
+
+// matchesGraphQLOperation tells if op matches pattern: a name, a type, or
+// a type and a name, the names being globs.
+func matchesGraphQLOperation(pattern string, op GraphQLOperation) bool {
+	fields := strings.Fields(pattern)
+
+	if len(fields) == 2 {
+		if fields[0] != op.Type {
+			return false
+		}
+	} else if isGraphQLOperationType(fields[0]) {
+		return fields[0] == op.Type
+	}
+
+	ok, _ := path.Match(fields[len(fields)-1], op.Name)
+
+	return ok
+}
+
+func (g *graphQL) matches(r *http.Request) bool {
+	for _, match := range g.paths {
+		if match.matchesPath(r.URL.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// operations parses the GraphQL requests of r, whose body is read and
+// replaced. The bodies that aren't GraphQL requests have no operations.
+func (g *graphQL) operations(r *http.Request) ([]GraphQLOperation, error) {
+	var requests []graphQLRequest
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		requests = []graphQLRequest{{Query: query.Get("query"), OperationName: query.Get("operationName"), Variables: json.RawMessage(query.Get("variables"))}}
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/graphql" {
+			requests = []graphQLRequest{{Query: string(body), OperationName: r.URL.Query().Get("operationName")}}
+		} else if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("[")) {
+			_ = json.Unmarshal(trimmed, &requests)
+		} else {
+			requests = make([]graphQLRequest, 1)
+			_ = json.Unmarshal(trimmed, &requests[0])
+		}
+	}
+
+	var ops []GraphQLOperation
+
+	for _, request := range requests {
+		if request.Query == "" {
+			continue
+		}
+
+		op := selectGraphQLOperation(parseGraphQLOperations(request.Query), request.OperationName)
+		if op == nil {
+			continue
+		}
+
+		if variables := bytes.TrimSpace(request.Variables); len(variables) > 0 && !bytes.Equal(variables, []byte("null")) && json.Valid(variables) {
+			op.Variables = variables
+		}
+
+		ops = append(ops, *op)
+	}
+
+	return ops, nil
+}
+
+// selectGraphQLOperation picks the operation executed among those of a
+// document: the one named, or the first one.
+func selectGraphQLOperation(ops []GraphQLOperation, name string) *GraphQLOperation {
+	for i := range ops {
+		if name == "" || ops[i].Name == name {
+			return &ops[i]
+		}
+	}
+
+	return nil
+}
+
+// parseGraphQLOperations finds the type and name of the operations of a
+// GraphQL document, skipping its fragments. Only the top level of the
+// document is read, the selection sets being skipped over.
+func parseGraphQLOperations(document string) []GraphQLOperation {
+	var ops []GraphQLOperation
+
+	var current *GraphQLOperation
+
+	depth, parens := 0, 0
+	expectDefinition, expectName := true, false
+
+	for i := 0; i < len(document); {
+		c := document[i]
+
+		switch {
+		case c == '#':
+			for i < len(document) && document[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			i = skipGraphQLString(document, i)
+		case isGraphQLNameStart(c):
+			start := i
+			for i < len(document) && (isGraphQLNameStart(document[i]) || (document[i] >= '0' && document[i] <= '9')) {
+				i++
+			}
+
+			name := document[start:i]
+
+			if depth > 0 || parens > 0 {
+				continue
+			}
+
+			if expectDefinition {
+				expectDefinition = false
+
+				if isGraphQLOperationType(name) {
+					current, expectName = &GraphQLOperation{Type: name}, true
+				}
+			} else if expectName {
+				current.Name, expectName = name, false
+			}
+
+			continue
+		case c == '(':
+			parens++
+			expectName = false
+		case c == ')':
+			parens--
+		case c == '@':
+			expectName = false
+		case c == '{':
+			if depth == 0 && parens == 0 && expectDefinition {
+				current, expectDefinition = &GraphQLOperation{Type: "query"}, false
+			}
+
+			depth++
+			expectName = false
+		case c == '}':
+			depth--
+
+			if depth == 0 && parens == 0 {
+				if current != nil {
+					ops = append(ops, *current)
+				}
+
+				current, expectDefinition = nil, true
+			}
+		}
+
+		i++
+	}
+
+	return ops
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// skipGraphQLString returns the index of the closing quote of the string,
+// or block string, starting at i.
+func skipGraphQLString(document string, i int) int {
+	if strings.HasPrefix(document[i:], `"""`) {
+		end := strings.Index(document[i+3:], `"""`)
+		if end < 0 {
+			return len(document)
+		}
+
+		return i + 3 + end + 2
+	}
+
+	for i++; i < len(document) && document[i] != '"' && document[i] != '\n'; i++ {
+		if document[i] == '\\' {
+			i++
+		}
+	}
+
+	return i
+}
+
+// checkGraphQL parses the GraphQL operations of ex, blocking or rate
+// limiting them if configured. It returns false if the request was
+// answered already.
+func (p *Proxy) checkGraphQL(w http.ResponseWriter, ex *exchange) bool {
+	ops, err := p.graphQL.operations(ex.inbound)
+	if err != nil {
+		status := http.StatusBadRequest
+		if isBodyTooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		p.writeProxyError(w, ex, status, err)
+
+		return false
+	}
+
+	ex.graphQL = ops
+
+	for _, op := range ops {
+		for _, pattern := range p.graphQL.block {
+			if !matchesGraphQLOperation(pattern, op) {
+				continue
+			}
+
+			log.Printf("Blocked the GraphQL %s of request #%d from %s", op, ex.id, clientIP(ex.inbound))
+
+			p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Err: fmt.Errorf("403 Forbidden: the GraphQL %s is blocked", op), Status: http.StatusForbidden})
+
+			p.writeError(w, ex.inbound, http.StatusForbidden, fmt.Errorf("the GraphQL %s is blocked", op))
+
+			return false
+		}
+
+		for _, limit := range p.graphQL.rateLimits {
+			if !matchesGraphQLOperation(limit.operation, op) {
+				continue
+			}
+
+			if ok, retryAfter := limit.limiter.allow(ex.inbound); !ok {
+				p.writeRateLimited(w, ex, fmt.Sprintf("%s for the GraphQL %s", limit.limiter.key(ex.inbound), op), retryAfter)
+
+				return false
+			}
+
+			break
+		}
+	}
+
+	return true
+}
+
+// withGraphQL returns msg with the GraphQL operations of ex, if any.
+func (ex *exchange) withGraphQL(msg *Message) *Message {
+	msg.GraphQL = ex.graphQL
+
+	return msg
+}
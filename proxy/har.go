@@ -0,0 +1,428 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string             `json:"startedDateTime"`
+	Time            float64            `json:"time"`
+	Request         harRequest         `json:"request"`
+	Response        harResponse        `json:"response"`
+	Cache           struct{}           `json:"cache"`
+	Timings         harTimings         `json:"timings"`
+	RequestID       string             `json:"_requestId,omitempty"`
+	GraphQL         []GraphQLOperation `json:"_graphql,omitempty"`
+	Duplicate       *Duplicate         `json:"_duplicate,omitempty"`
+	Error           string             `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings are -1 for the phases that didn't happen or weren't traced,
+// blocked being the time spent by the proxy besides the phases.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHARTimings(elapsed time.Duration, t *Timings) harTimings {
+	if t == nil {
+		return harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: durationMillis(elapsed)}
+	}
+
+	timings := harTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+		Send:    durationMillis(t.Send),
+		Wait:    durationMillis(t.Wait),
+		Receive: durationMillis(t.Receive),
+	}
+
+	if t.DNS > 0 {
+		timings.DNS = durationMillis(t.DNS)
+	}
+
+	// The connection time includes the TLS handshake in HAR.
+	if t.Connect > 0 || t.TLS > 0 {
+		timings.Connect = durationMillis(t.Connect + t.TLS)
+	}
+
+	if t.TLS > 0 {
+		timings.SSL = durationMillis(t.TLS)
+	}
+
+	if blocked := elapsed - t.DNS - t.Connect - t.TLS - t.Send - t.Wait - t.Receive; blocked > 0 {
+		timings.Blocked = durationMillis(blocked)
+	}
+
+	return timings
+}
+
+// harLogSink appends the entries to the HAR file in place, writing the new
+// ones over its closing brackets on every flush, so neither the file nor
+// the entries logged so far are held in memory.
+type harLogSink struct {
+	fileName string
+	cfg      LogConfig
+	file     *os.File
+	entries  []harEntry
+
+	// end is the offset after the last entry, or after the [ of the entries
+	// while there are none.
+	end   int64
+	empty bool
+}
+
+// harFileEnd closes the entries and the file, as indented by MarshalIndent.
+const harFileEnd = "\n    ]\n  }\n}\n"
+
+func newHARLogSink(fileName string, cfg LogConfig) (*harLogSink, error) {
+	if err := os.MkdirAll(path.Dir(fileName), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &harLogSink{fileName: fileName, cfg: cfg, file: file}
+
+	if err := s.findEnd(); err != nil {
+		file.Close()
+
+		return nil, fmt.Errorf("can't append to the HAR file: %w", err)
+	}
+
+	return s, nil
+}
+
+// findEnd finds where the entries end in an existing file, or starts a new
+// one.
+func (s *harLogSink) findEnd() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		har := harFile{Log: harLog{Version: "1.2", Creator: harCreator{Name: "go-proxy", Version: "1.0"}, Entries: []harEntry{}}}
+
+		content, err := json.MarshalIndent(har, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		// The entries are the last field, so their [] is the last one.
+		start := bytes.LastIndex(content, []byte("[]")) + 1
+		s.end, s.empty = int64(start), true
+
+		_, err = s.file.WriteAt(append(content[:start:start], harFileEnd...), 0)
+
+		return err
+	}
+
+	// The entries are followed by the closing brackets of the log and the
+	// file only, so the end of the file tells where they end.
+	tail := make([]byte, 4096)
+	if int64(len(tail)) > info.Size() {
+		tail = tail[:info.Size()]
+	}
+
+	offset := info.Size() - int64(len(tail))
+
+	if _, err := s.file.ReadAt(tail, offset); err != nil {
+		return err
+	}
+
+	i := len(tail)
+
+	for _, closing := range []byte("}}]") {
+		i = lastNonSpace(tail[:i])
+		if i < 0 || tail[i] != closing {
+			return errors.New("it doesn't end with its entries")
+		}
+	}
+
+	i = lastNonSpace(tail[:i])
+	if i < 0 {
+		return errors.New("it doesn't end with its entries")
+	}
+
+	s.end, s.empty = offset+int64(i)+1, tail[i] == '['
+
+	return nil
+}
+
+func lastNonSpace(b []byte) int {
+	return bytes.LastIndexFunc(b, func(r rune) bool { return !unicode.IsSpace(r) })
+}
+
+func (s *harLogSink) write(entry LogEntry, req *LogEntry) {
+	if req == nil || (entry.Err == nil && entry.Message.IsRequest) {
+		return
+	}
+
+	// The HAR times are in ISO 8601 whatever the time format of the logs.
+	started := *req
+	started.Timestamp = s.cfg.inTimeZone(req.Timestamp)
+
+	s.entries = append(s.entries, newHAREntry(started, entry))
+}
+
+func (s *harLogSink) flush() {
+	if len(s.entries) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	for _, entry := range s.entries {
+		content, err := json.MarshalIndent(entry, "      ", "  ")
+		if err != nil {
+			log.Printf("Can't encode a HAR entry of %s: %v", s.fileName, err)
+
+			continue
+		}
+
+		if !s.empty || buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteString("\n      ")
+		buf.Write(content)
+	}
+
+	s.entries = s.entries[:0]
+
+	if buf.Len() == 0 {
+		return
+	}
+
+	written := buf.Len()
+	buf.WriteString(harFileEnd)
+
+	if _, err := s.file.WriteAt(buf.Bytes(), s.end); err != nil {
+		log.Printf("Can't write the HAR file %s: %v", s.fileName, err)
+
+		return
+	}
+
+	if err := s.file.Truncate(s.end + int64(buf.Len())); err != nil {
+		log.Printf("Can't write the HAR file %s: %v", s.fileName, err)
+	}
+
+	s.end += int64(written)
+	s.empty = false
+}
+
+func (s *harLogSink) close() {
+	s.flush()
+	s.file.Close()
+}
+
+func newHAREntry(req, res LogEntry) harEntry {
+	elapsed := res.elapsed(req)
+
+	entry := harEntry{
+		StartedDateTime: req.Timestamp.Format(time.RFC3339Nano),
+		Time:            durationMillis(elapsed),
+		Request:         newHARRequest(req.Message),
+		Timings:         newHARTimings(elapsed, res.Timings),
+		RequestID:       req.RequestID,
+		GraphQL:         req.Message.GraphQL,
+		Duplicate:       req.Message.Duplicate,
+	}
+
+	if res.Err != nil {
+		entry.Error = res.Err.Error()
+		entry.Response = harResponse{Status: res.Status, Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+
+		return entry
+	}
+
+	entry.Response = newHARResponse(res.Message)
+
+	return entry
+}
+
+func newHARRequest(msg *Message) harRequest {
+	harReq := harRequest{
+		Method:      msg.Method,
+		URL:         msg.URL,
+		HTTPVersion: msg.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(msg.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    msg.BodySize(),
+	}
+
+	for _, cookie := range (&http.Request{Header: msg.Header}).Cookies() {
+		harReq.Cookies = append(harReq.Cookies, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	if reqURL, err := url.Parse(msg.URL); err == nil {
+		harReq.QueryString = harValues(reqURL.Query())
+	}
+
+	if len(msg.Body) > 0 {
+		text, encoding := harBody(msg.Body)
+		harReq.PostData = &harPostData{MimeType: msg.Header.Get("Content-Type"), Text: text, Encoding: encoding, Comment: omittedComment(msg)}
+	}
+
+	return harReq
+}
+
+func newHARResponse(msg *Message) harResponse {
+	statusText := http.StatusText(msg.StatusCode)
+	if _, text, ok := strings.Cut(msg.Status, " "); ok {
+		statusText = text
+	}
+
+	harRes := harResponse{
+		Status:      msg.StatusCode,
+		StatusText:  statusText,
+		HTTPVersion: msg.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(msg.Header),
+		RedirectURL: msg.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    msg.BodySize(),
+	}
+
+	for _, cookie := range (&http.Response{Header: msg.Header}).Cookies() {
+		harRes.Cookies = append(harRes.Cookies, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	text, encoding := harBody(msg.Body)
+	harRes.Content = harContent{Size: msg.BodySize(), MimeType: msg.Header.Get("Content-Type"), Text: text, Encoding: encoding, Comment: omittedComment(msg)}
+
+	return harRes
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	return harValues(url.Values(header))
+}
+
+func harValues(values url.Values) []harNameValue {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	pairs := []harNameValue{}
+
+	for _, key := range keys {
+		for _, value := range values[key] {
+			pairs = append(pairs, harNameValue{Name: key, Value: value})
+		}
+	}
+
+	return pairs
+}
+
+func harBody(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func omittedComment(msg *Message) string {
+	if msg.Omitted == 0 {
+		if msg.Truncated {
+			return "truncated"
+		}
+
+		return ""
+	}
+
+	return fmt.Sprintf("%d bytes omitted", msg.Omitted)
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isCaptureHAR tells if a record file is a HAR file, like the HAR logs or
+// those saved from the browser devtools, by its extension. They're only
+// read.
+func isCaptureHAR(fileName string) bool {
+	return strings.EqualFold(filepath.Ext(fileName), ".har")
+}
+
+// readCaptureHAR is readCaptures for the HAR files, their entries being
+// numbered in order. The line of each one is its record line, so that the
+// queries turn them into a record file.
+func readCaptureHAR(fileName string, q CaptureQuery, minStatus, maxStatus int, fn func(n int, exchange *recordedExchange, line []byte) error) (int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var har harFile
+
+	if err := json.NewDecoder(file).Decode(&har); err != nil {
+		return 0, err
+	}
+
+	matched := 0
+
+	for i, entry := range har.Log.Entries {
+		if q.Limit > 0 && matched >= q.Limit {
+			break
+		}
+
+		n := i + 1
+		if q.id != 0 && n != q.id {
+			continue
+		}
+
+		exchange, err := entry.recordedExchange()
+		if err != nil {
+			return matched, fmt.Errorf("entry %d: %w", n, err)
+		}
+
+		status := exchange.Response.Status
+		if status < minStatus || status > maxStatus || !q.matches(exchange) {
+			continue
+		}
+
+		line, err := json.Marshal(exchange)
+		if err != nil {
+			return matched, err
+		}
+
+		matched++
+
+		if err := fn(n, exchange, line); err != nil {
+			return matched, err
+		}
+	}
+
+	return matched, nil
+}
+
+// recordedExchange maps the entry to an exchange of the record files, which
+// are timed by the end of the exchange, the scheme and host of an absolute
+// URL being the upstream.
+func (e harEntry) recordedExchange() (*recordedExchange, error) {
+	started, err := time.Parse(time.RFC3339Nano, e.StartedDateTime)
+	if err != nil {
+		return nil, err
+	}
+
+	reqURL, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	exchange := &recordedExchange{
+		Timestamp: started.Add(time.Duration(e.Time * float64(time.Millisecond))),
+		Duration:  e.Time,
+		Request: recordedRequest{
+			Method: e.Request.Method,
+			Path:   reqURL.Path,
+			Query:  reqURL.Query().Encode(),
+			Header: harHeader(e.Request.Headers),
+		},
+		Response: recordedResponse{
+			Status: e.Response.Status,
+			Header: harHeader(e.Response.Headers),
+		},
+	}
+
+	if reqURL.Host != "" {
+		exchange.Upstream = reqURL.Scheme + "://" + reqURL.Host
+	}
+
+	if e.Request.PostData != nil {
+		if exchange.Request.Body, err = harBodyBytes(e.Request.PostData.Text, e.Request.PostData.Encoding); err != nil {
+			return nil, err
+		}
+	}
+
+	exchange.Request.BodyHash = bodyHash(exchange.Request.Body)
+
+	if exchange.Response.Body, err = harBodyBytes(e.Response.Content.Text, e.Response.Content.Encoding); err != nil {
+		return nil, err
+	}
+
+	return exchange, nil
+}
+
+// harHeader is the header of the HAR pairs, without the HTTP/2 pseudo
+// headers the browsers list along with the others.
+func harHeader(pairs []harNameValue) http.Header {
+	header := make(http.Header, len(pairs))
+
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Name, ":") {
+			header.Add(pair.Name, pair.Value)
+		}
+	}
+
+	return header
+}
+
+// harBodyBytes is the reverse of harBody.
+func harBodyBytes(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+
+	if text == "" {
+		return nil, nil
+	}
+
+	return []byte(text), nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderRewrites change the headers of the forwarded requests and of the
+// responses, those of the Rules applying to the matching requests only.
+type HeaderRewrites struct {
+	Request  HeaderRules  `yaml:"request"`
+	Response HeaderRules  `yaml:"response"`
+	Rules    []HeaderRule `yaml:"rules"`
+}
+
+// HeaderRule changes the headers of the requests that match Match, and of
+// their responses.
+type HeaderRule struct {
+	Match    RequestMatch `yaml:"match"`
+	Request  HeaderRules  `yaml:"request"`
+	Response HeaderRules  `yaml:"response"`
+}
+
+// HeaderRules remove the Remove headers, replace the values of the Replace
+// ones that are present, then set the Set ones and add the Add ones. The
+// values can have the variables {client_ip}, {host}, {method} and {path}.
+type HeaderRules struct {
+	Set     map[string]string `yaml:"set"`
+	Add     map[string]string `yaml:"add"`
+	Replace map[string]string `yaml:"replace"`
+	Remove  []string          `yaml:"remove"`
+}
+
+func (h HeaderRules) apply(header http.Header, vars *strings.Replacer) {
+	for _, key := range h.Remove {
+		header.Del(key)
+	}
+
+	for key, value := range h.Replace {
+		if header.Get(key) != "" {
+			header.Set(key, vars.Replace(value))
+		}
+	}
+
+	for key, value := range h.Set {
+		header.Set(key, vars.Replace(value))
+	}
+
+	for key, value := range h.Add {
+		header.Add(key, vars.Replace(value))
+	}
+}
+
+func (h HeaderRewrites) applyRequest(r *http.Request, req *http.Request) {
+	vars := headerVars(r)
+
+	h.Request.apply(req.Header, vars)
+
+	for _, rule := range h.Rules {
+		if rule.Match.matches(r) {
+			rule.Request.apply(req.Header, vars)
+		}
+	}
+
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+}
+
+func (h HeaderRewrites) applyResponse(r *http.Request, header http.Header) {
+	vars := headerVars(r)
+
+	h.Response.apply(header, vars)
+
+	for _, rule := range h.Rules {
+		if rule.Match.matches(r) {
+			rule.Response.apply(header, vars)
+		}
+	}
+}
+
+func headerVars(r *http.Request) *strings.Replacer {
+	return strings.NewReplacer(
+		"{client_ip}", clientIP(r),
+		"{host}", r.Host,
+		"{method}", r.Method,
+		"{path}", r.URL.Path,
+	)
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig probes every upstream with a GET to Path each Interval.
+// An upstream is taken out of rotation after Threshold failed probes in a
+// row, and put back after as many successful ones.
+type HealthCheckConfig struct {
+	Path      string        `yaml:"path"`
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Threshold int           `yaml:"threshold"`
+}
+
+func (hc HealthCheckConfig) validate() error {
+	if hc.Path == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(hc.Path, "/") {
+		return errors.New("the health check path must start with /")
+	}
+
+	if hc.Interval <= 0 || hc.Timeout <= 0 || hc.Threshold <= 0 {
+		return errors.New("the health check interval, timeout and threshold must be positive")
+	}
+
+	return nil
+}
+
+type upstreamHealth struct {
+	addr string
+
+	mu        sync.RWMutex
+	healthy   bool
+	failures  int
+	successes int
+	lastCheck time.Time
+	lastErr   string
+
+	stop chan struct{}
+}
+
+type upstreamHealthView struct {
+	Addr      string `json:"addr"`
+	Healthy   bool   `json:"healthy"`
+	LastCheck string `json:"last_check,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (h *upstreamHealth) isHealthy() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.healthy
+}
+
+func (h *upstreamHealth) record(err error, threshold int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastCheck = time.Now()
+
+	if err != nil {
+		h.lastErr = err.Error()
+		h.successes = 0
+		h.failures++
+
+		if h.healthy && h.failures >= threshold {
+			h.healthy = false
+
+			log.Printf("Upstream %s is down, taking it out of rotation: %v", h.addr, err)
+		}
+
+		return
+	}
+
+	h.lastErr = ""
+	h.failures = 0
+	h.successes++
+
+	if !h.healthy && h.successes >= threshold {
+		h.healthy = true
+
+		log.Printf("Upstream %s is back up", h.addr)
+	}
+}
+
+func (h *upstreamHealth) view() upstreamHealthView {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	view := upstreamHealthView{Addr: h.addr, Healthy: h.healthy, LastError: h.lastErr}
+	if !h.lastCheck.IsZero() {
+		view.LastCheck = h.lastCheck.UTC().Format(time.RFC3339)
+	}
+
+	return view
+}
+
+type healthChecker struct {
+	cfg    HealthCheckConfig
+	client *http.Client
+	stop   chan struct{}
+
+	mu        sync.Mutex
+	upstreams map[string]*upstreamHealth
+	started   bool
+}
+
+func newHealthChecker(cfg HealthCheckConfig, transport http.RoundTripper) *healthChecker {
+	return &healthChecker{
+		cfg:       cfg,
+		client:    &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		upstreams: make(map[string]*upstreamHealth),
+		stop:      make(chan struct{}),
+	}
+}
+
+// watch returns the health of addr, shared by the pools with the same
+// upstream, probing it from now on if the checker was started.
+func (c *healthChecker) watch(addr string) *upstreamHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.upstreams[addr]
+	if !ok {
+		h = &upstreamHealth{addr: addr, healthy: true, stop: make(chan struct{})}
+		c.upstreams[addr] = h
+
+		if c.started {
+			go c.run(h)
+		}
+	}
+
+	return h
+}
+
+// unwatch stops probing addr, once no pool has it.
+func (c *healthChecker) unwatch(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h, ok := c.upstreams[addr]; ok {
+		delete(c.upstreams, addr)
+		close(h.stop)
+	}
+}
+
+func (c *healthChecker) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.started = true
+
+	for _, h := range c.upstreams {
+		go c.run(h)
+	}
+}
+
+func (c *healthChecker) views() []upstreamHealthView {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	views := make([]upstreamHealthView, 0, len(c.upstreams))
+	for _, h := range c.upstreams {
+		views = append(views, h.view())
+	}
+
+	return views
+}
+
+func (c *healthChecker) close() {
+	close(c.stop)
+}
+
+func (c *healthChecker) run(h *upstreamHealth) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.record(c.probe(h.addr), c.cfg.Threshold)
+
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *healthChecker) probe(addr string) error {
+	res, err := c.client.Get(forwardBaseURL(addr) + c.cfg.Path)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("the health check got %s", res.Status)
+	}
+
+	return nil
+}
+
+// serveHealthz reports the health of every upstream, answering 503 if a
+// route has none left in rotation.
+func (p *Proxy) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+
+	for _, rt := range p.routeTable().routes {
+		if !rt.upstreams.hasHealthy() {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	views := []upstreamHealthView{}
+
+	if p.health != nil {
+		views = p.health.views()
+	}
+
+	sort.Slice(views, func(i, j int) bool { return views[i].Addr < views[j].Addr })
+
+	summary := "ok"
+	if status != http.StatusOK {
+		summary = "unavailable"
+	}
+
+	writeJSON(w, status, struct {
+		Status    string               `json:"status"`
+		Upstreams []upstreamHealthView `json:"upstreams"`
+	}{summary, views})
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ExchangeInfo identifies the exchange a hook is called for: its ID, as in
+// the logs, the request ID, the route and upstream it was sent to and the
+// client request.
+type ExchangeInfo struct {
+	ID        uint64
+	RequestID string
+	Route     string
+	Upstream  string
+	Request   *http.Request
+}
+
+// Hooks are called at the stages of the exchanges, for custom logging,
+// metrics or changes to the requests and responses, which they may modify
+// in place. They run on the goroutine of the exchange, so they should be
+// quick, and are all optional.
+type Hooks struct {
+	// OnRequest is called once a client request was routed, before the
+	// limits are checked.
+	OnRequest func(ex ExchangeInfo)
+
+	// BeforeForward is called with the request to the upstream, after the
+	// rewrites, before it's logged and sent.
+	BeforeForward func(ex ExchangeInfo, req *http.Request)
+
+	// OnResponse is called with the response of the upstream, before its
+	// body is read.
+	OnResponse func(ex ExchangeInfo, res *http.Response)
+
+	// BeforeWrite is called with the response of the upstream and its body,
+	// after the rewrites, before they are logged and written to the client.
+	// It returns the body to write, body itself to keep it. Streamed
+	// responses don't go through it.
+	BeforeWrite func(ex ExchangeInfo, res *http.Response, body []byte) []byte
+
+	// OnError is called when an exchange fails, with the status the client
+	// gets, 499 if it went away.
+	OnError func(ex ExchangeInfo, status int, err error)
+}
+
+func (ex *exchange) info() ExchangeInfo {
+	return ExchangeInfo{ID: ex.id, RequestID: ex.requestID, Route: ex.route.displayName(), Upstream: ex.upstream, Request: ex.inbound}
+}
+
+func (h *Hooks) request(ex *exchange) {
+	if h.OnRequest != nil {
+		h.OnRequest(ex.info())
+	}
+}
+
+func (h *Hooks) beforeForward(ex *exchange, req *http.Request) {
+	if h.BeforeForward != nil {
+		h.BeforeForward(ex.info(), req)
+	}
+}
+
+func (h *Hooks) response(ex *exchange, res *http.Response) {
+	if h.OnResponse != nil {
+		h.OnResponse(ex.info(), res)
+	}
+}
+
+// beforeWrite updates Content-Length if the hook changed the length of the
+// body.
+func (h *Hooks) beforeWrite(ex *exchange, res *http.Response, body []byte) []byte {
+	if h.BeforeWrite == nil {
+		return body
+	}
+
+	written := h.BeforeWrite(ex.info(), res, body)
+	if len(written) != len(body) {
+		res.ContentLength = int64(len(written))
+		res.Header.Set("Content-Length", strconv.Itoa(len(written)))
+	}
+
+	return written
+}
+
+func (h *Hooks) error(ex *exchange, status int, err error) {
+	if h.OnError != nil {
+		h.OnError(ex.info(), status, err)
+	}
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import "net/http"
+
+// http3Transport sends the requests to the h3:// upstreams over HTTP/3, as
+// requests to their https:// URL, and the others over next. The scheme
+// tells them apart, so that the https:// requests to the same host, like
+// those of the forward proxy, aren't sent over HTTP/3.
+type http3Transport struct {
+	next  http.RoundTripper
+	http3 http.RoundTripper
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "h3" {
+		return t.next.RoundTrip(req)
+	}
+
+	h3Req := req.Clone(req.Context())
+	h3Req.URL.Scheme = "https"
+
+	return t.http3.RoundTrip(h3Req)
+}
@@ -0,0 +1,16 @@
+//go:build !http3
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// http3Supported tells if the h3:// upstreams can be reached, which
+// requires building with the http3 tag.
+const http3Supported = false
+
+func newHTTP3RoundTripper(*tls.Config) http.RoundTripper {
+	return nil
+}
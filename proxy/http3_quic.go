@@ -0,0 +1,18 @@
+//go:build http3
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Supported tells if the h3:// upstreams can be reached, which
+// requires building with the http3 tag.
+const http3Supported = true
+
+func newHTTP3RoundTripper(tlsConfig *tls.Config) http.RoundTripper {
+	return &http3.Transport{TLSClientConfig: tlsConfig.Clone()}
+}
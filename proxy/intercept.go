@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInterceptDropped = errors.New("the request was dropped at the admin API")
+
+// interceptor holds the requests matching its rules until they are
+// forwarded, edited or dropped through the admin API.
+type interceptor struct {
+	rules   []RequestMatch
+	timeout time.Duration
+
+	mu   sync.Mutex
+	held map[uint64]*heldRequest
+}
+
+type heldRequest struct {
+	id        uint64
+	req       *http.Request
+	body      []byte
+	since     time.Time
+	decisions chan interceptDecision
+}
+
+type interceptDecision struct {
+	edit *interceptEdit
+	drop bool
+}
+
+// interceptEdit replaces the parts of a held request that are set.
+type interceptEdit struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"headers"`
+	Body   *string     `json:"body"`
+}
+
+type heldRequestView struct {
+	ID           uint64      `json:"id"`
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Header       http.Header `json:"headers"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	HeldFor      string      `json:"held_for"`
+}
+
+func newInterceptor(rules []RequestMatch, timeout time.Duration) *interceptor {
+	return &interceptor{rules: rules, timeout: timeout, held: make(map[uint64]*heldRequest)}
+}
+
+func (i *interceptor) matches(r *http.Request) bool {
+	for _, rule := range i.rules {
+		if rule.matches(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hold blocks until the request is released, returning it as it must be
+// forwarded. Requests not released within the timeout, or when the proxy
+// shuts down, are forwarded unchanged.
+func (i *interceptor) hold(ex *exchange, req *http.Request, body []byte) (*http.Request, []byte, error) {
+	held := &heldRequest{id: ex.id, req: req, body: body, since: time.Now(), decisions: make(chan interceptDecision, 1)}
+
+	i.mu.Lock()
+	i.held[ex.id] = held
+	i.mu.Unlock()
+
+	defer func() {
+		i.mu.Lock()
+		delete(i.held, ex.id)
+		i.mu.Unlock()
+	}()
+
+	log.Printf("Holding request #%d %s %s until it's released at the admin API", ex.id, req.Method, req.URL)
+
+	var timeout <-chan time.Time
+	if i.timeout > 0 {
+		timer := time.NewTimer(i.timeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case decision := <-held.decisions:
+		if decision.drop {
+			return nil, nil, errInterceptDropped
+		}
+
+		if decision.edit != nil {
+			return decision.edit.apply(req, body)
+		}
+	case <-timeout:
+		log.Printf("Request #%d was held for %s, forwarding it unchanged", ex.id, i.timeout)
+	case <-ex.inbound.Context().Done():
+		return nil, nil, ex.inbound.Context().Err()
+	}
+
+	return req, body, nil
+}
+
+func (i *interceptor) release(id uint64, decision interceptDecision) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	held, ok := i.held[id]
+	if !ok {
+		return false
+	}
+
+	delete(i.held, id)
+
+	held.decisions <- decision
+
+	return true
+}
+
+func (i *interceptor) releaseAll() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for id, held := range i.held {
+		delete(i.held, id)
+
+		held.decisions <- interceptDecision{}
+	}
+}
+
+func (i *interceptor) list() []heldRequestView {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	views := make([]heldRequestView, 0, len(i.held))
+	for _, held := range i.held {
+		views = append(views, held.view())
+	}
+
+	sort.Slice(views, func(a, b int) bool { return views[a].ID < views[b].ID })
+
+	return views
+}
+
+func (i *interceptor) get(id uint64) (heldRequestView, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	held, ok := i.held[id]
+	if !ok {
+		return heldRequestView{}, false
+	}
+
+	return held.view(), true
+}
+
+func (h *heldRequest) view() heldRequestView {
+	body, encoding := harBody(h.body)
+
+	return heldRequestView{
+		ID:           h.id,
+		Method:       h.req.Method,
+		URL:          h.req.URL.String(),
+		Header:       h.req.Header,
+		Body:         body,
+		BodyEncoding: encoding,
+		HeldFor:      time.Since(h.since).Round(time.Second).String(),
+	}
+}
+
+func (e *interceptEdit) apply(req *http.Request, body []byte) (*http.Request, []byte, error) {
+	method, reqURL := req.Method, req.URL.String()
+
+	if e.Method != "" {
+		method = e.Method
+	}
+
+	if e.URL != "" {
+		reqURL = e.URL
+	}
+
+	if e.Body != nil {
+		body = []byte(*e.Body)
+	}
+
+	edited, err := http.NewRequestWithContext(req.Context(), method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	edited.Header = req.Header.Clone()
+	if e.Header != nil {
+		edited.Header = e.Header
+	}
+
+	edited.Header.Del("Content-Length")
+
+	if host := edited.Header.Get("Host"); host != "" {
+		edited.Host = host
+	} else if e.URL == "" {
+		edited.Host = req.Host
+	}
+
+	return edited, body, nil
+}
+
+// serveIntercepted handles the admin API for the held requests:
+//
+//	GET  /intercepted               lists them
+//	GET  /intercepted/{id}          shows one
+//	POST /intercepted/{id}/forward  forwards it, edited by the JSON body if any
+//	POST /intercepted/{id}/drop     drops it
+func (i *interceptor) serveIntercepted(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/intercepted"), "/")
+
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, i.list())
+
+		return
+	}
+
+	idStr, action, _ := strings.Cut(rest, "/")
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		view, ok := i.get(id)
+		if !ok {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, view)
+	case action == "forward" && r.Method == http.MethodPost:
+		var decision interceptDecision
+
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if len(bytes.TrimSpace(content)) > 0 {
+			decision.edit = &interceptEdit{}
+
+			if err := json.Unmarshal(content, decision.edit); err != nil {
+				http.Error(w, "invalid edit: "+err.Error(), http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		i.writeReleased(w, r, id, decision)
+	case action == "drop" && r.Method == http.MethodPost:
+		i.writeReleased(w, r, id, interceptDecision{drop: true})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (i *interceptor) writeReleased(w http.ResponseWriter, r *http.Request, id uint64, decision interceptDecision) {
+	if !i.release(id, decision) {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("Can't write the admin response: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+type jsonLogRecord struct {
+	Time              string             `json:"time"`
+	ID                uint64             `json:"id"`
+	RequestID         string             `json:"request_id,omitempty"`
+	Route             string             `json:"route,omitempty"`
+	Upstream          string             `json:"upstream,omitempty"`
+	Method            string             `json:"method"`
+	URL               string             `json:"url"`
+	Path              string             `json:"path"`
+	Proto             string             `json:"proto"`
+	Status            int                `json:"status,omitempty"`
+	DurationMillis    float64            `json:"duration_ms"`
+	Timings           *jsonTimings       `json:"timings,omitempty"`
+	RequestSize       int                `json:"request_size"`
+	ResponseSize      int                `json:"response_size"`
+	RequestHeaders    http.Header        `json:"request_headers"`
+	ResponseHeaders   http.Header        `json:"response_headers,omitempty"`
+	RequestBody       string             `json:"request_body,omitempty"`
+	RequestEncoding   string             `json:"request_body_encoding,omitempty"`
+	ResponseBody      string             `json:"response_body,omitempty"`
+	ResponseEncoding  string             `json:"response_body_encoding,omitempty"`
+	RequestOmitted    int                `json:"request_body_omitted,omitempty"`
+	ResponseOmitted   int                `json:"response_body_omitted,omitempty"`
+	RequestTruncated  bool               `json:"request_body_truncated,omitempty"`
+	ResponseTruncated bool               `json:"response_body_truncated,omitempty"`
+	GraphQL           []GraphQLOperation `json:"graphql,omitempty"`
+	Duplicate         *Duplicate         `json:"duplicate,omitempty"`
+	Error             string             `json:"error,omitempty"`
+}
+
+// jsonTimings are the Timings in milliseconds.
+type jsonTimings struct {
+	DNS     float64 `json:"dns_ms"`
+	Connect float64 `json:"connect_ms"`
+	TLS     float64 `json:"tls_ms"`
+	Send    float64 `json:"send_ms"`
+	Wait    float64 `json:"wait_ms"`
+	Receive float64 `json:"receive_ms"`
+}
+
+// jsonLogSink writes every exchange as a single JSON object per line, once
+// its response or error arrives. The lines are buffered until flush.
+type jsonLogSink struct {
+	file    io.WriteCloser
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	cfg     LogConfig
+}
+
+func newJSONLogSink(file io.WriteCloser, cfg LogConfig) *jsonLogSink {
+	writer := bufio.NewWriter(file)
+
+	return &jsonLogSink{file: file, writer: writer, encoder: json.NewEncoder(writer), cfg: cfg}
+}
+
+func (s *jsonLogSink) write(entry LogEntry, req *LogEntry) {
+	if req == nil || (entry.Err == nil && entry.Message.IsRequest) {
+		return
+	}
+
+	if err := s.encoder.Encode(s.newRecord(*req, entry)); err != nil {
+		log.Printf("Can't write the JSON log entry #%d: %v", entry.ID, err)
+	}
+}
+
+func (s *jsonLogSink) newRecord(req, res LogEntry) jsonLogRecord {
+	record := jsonLogRecord{
+		Time:           s.cfg.formatTime(req.Timestamp),
+		ID:             req.ID,
+		RequestID:      req.RequestID,
+		Route:          req.Route,
+		Upstream:       req.Upstream,
+		Method:         req.Message.Method,
+		URL:            req.Message.URL,
+		Path:           req.Message.Path,
+		Proto:          req.Message.Proto,
+		DurationMillis: durationMillis(res.elapsed(req)),
+		RequestSize:    req.Message.BodySize(),
+		RequestHeaders: req.Message.Header,
+		GraphQL:        req.Message.GraphQL,
+		Duplicate:      req.Message.Duplicate,
+	}
+
+	if s.cfg.Bodies {
+		record.RequestBody, record.RequestEncoding = harBody(req.Message.Body)
+		record.RequestOmitted, record.RequestTruncated = req.Message.Omitted, req.Message.Truncated
+	}
+
+	if t := res.Timings; t != nil {
+		record.Timings = &jsonTimings{
+			DNS:     durationMillis(t.DNS),
+			Connect: durationMillis(t.Connect),
+			TLS:     durationMillis(t.TLS),
+			Send:    durationMillis(t.Send),
+			Wait:    durationMillis(t.Wait),
+			Receive: durationMillis(t.Receive),
+		}
+	}
+
+	if res.Err != nil {
+		record.Status = res.Status
+		record.Error = res.Err.Error()
+
+		return record
+	}
+
+	record.Status = res.Message.StatusCode
+	record.ResponseSize = res.Message.BodySize()
+	record.ResponseHeaders = res.Message.Header
+
+	if s.cfg.Bodies {
+		record.ResponseBody, record.ResponseEncoding = harBody(res.Message.Body)
+		record.ResponseOmitted, record.ResponseTruncated = res.Message.Omitted, res.Message.Truncated
+	}
+
+	return record
+}
+
+func (s *jsonLogSink) flush() {
+	if err := s.writer.Flush(); err != nil {
+		log.Printf("Can't write the JSON log entries: %v", err)
+	}
+}
+
+func (s *jsonLogSink) close() {
+	s.flush()
+	s.file.Close()
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// LimitsConfig rejects the requests whose body is larger than RequestBody
+// with 413, and those whose request line and headers are larger than Header
+// with 431. A RequestBody of 0 means no limit, and a Header of 0 means
+// http.DefaultMaxHeaderBytes. The connections of a client IP that already
+// has ClientConns open are closed right away, 0 meaning no limit. The udp
+// mode keeps UDPSessions sessions at most, dropping the datagrams of the
+// other clients, 0 meaning no limit.
+//
+// The request bodies decoded with DecompressRequests are cut off past
+// DecodedRequestBody, whatever their size on the wire, 0 meaning
+// DefaultDecodedRequestBody.
+type LimitsConfig struct {
+	RequestBody        ByteSize `yaml:"request_body"`
+	DecodedRequestBody ByteSize `yaml:"decoded_request_body"`
+	Header             ByteSize `yaml:"header"`
+	ClientConns        int      `yaml:"client_conns"`
+	UDPSessions        int      `yaml:"udp_sessions"`
+}
+
+// DefaultDecodedRequestBody is the size the decoded request bodies are
+// limited to by default.
+const DefaultDecodedRequestBody = ByteSize(64 << 20)
+
+// DefaultUDPSessions is the number of sessions the udp mode keeps at most
+// by default.
+const DefaultUDPSessions = 10000
+
+func (lc LimitsConfig) validate() error {
+	if lc.RequestBody < 0 || lc.DecodedRequestBody < 0 || lc.Header < 0 {
+		return errors.New("the request size limits can't be negative")
+	}
+
+	if lc.ClientConns < 0 {
+		return errors.New("the connections per client can't be negative")
+	}
+
+	if lc.UDPSessions < 0 {
+		return errors.New("the UDP sessions limit can't be negative")
+	}
+
+	return nil
+}
+
+// checkLimits returns the status to reject r with, if it's over the limits.
+// A body without a Content-Length is cut off as soon as it goes over.
+func (p *Proxy) checkLimits(w http.ResponseWriter, r *http.Request) (int, error) {
+	limits := p.cfg.Limits
+
+	if size := headerSize(r); limits.Header > 0 && size > int(limits.Header) {
+		return http.StatusRequestHeaderFieldsTooLarge, fmt.Errorf("the request headers are %d bytes, over the limit of %d", size, limits.Header)
+	}
+
+	if limits.RequestBody <= 0 {
+		return 0, nil
+	}
+
+	if r.ContentLength > int64(limits.RequestBody) {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("the request body is %d bytes, over the limit of %d", r.ContentLength, limits.RequestBody)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limits.RequestBody))
+
+	return 0, nil
+}
+
+func headerSize(r *http.Request) int {
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(value) + 4
+		}
+	}
+
+	return size
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+
+	return errors.As(err, &maxBytesErr)
+}
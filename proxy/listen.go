@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func validateListenAddr(addr string) error {
+	if isUnixUpstream(addr) {
+		if strings.TrimPrefix(addr, "unix://") == "" {
+			return fmt.Errorf("the listen address %s must be of type unix:///path/to/socket", addr)
+		}
+
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("the listen address %s must be of type host:port or unix:///path/to/socket", addr)
+	}
+
+	return nil
+}
+
+// listenFamilies are the TCP networks of the ListenFamily values.
+var listenFamilies = map[string]string{
+	"":     "tcp",
+	"dual": "tcp",
+	"ipv4": "tcp4",
+	"ipv6": "tcp6",
+}
+
+func validateListenFamily(family string) error {
+	if _, ok := listenFamilies[family]; !ok {
+		return fmt.Errorf("invalid listen family %q, which must be dual, ipv4 or ipv6", family)
+	}
+
+	return nil
+}
+
+// listenAddrs are the addresses the proxy is served on: those of Listen,
+// or every interface on Port.
+func (c *Config) listenAddrs() []string {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+
+	return []string{":" + strconv.Itoa(c.Port)}
+}
+
+// listen opens a listener for every address, on the TCP network of
+// family, closing them all if one can't be opened.
+func listen(addrs []string, family string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+
+	for _, addr := range addrs {
+		ln, err := listenAddr(addr, listenFamilies[family])
+		if err != nil {
+			closeListeners(listeners)
+
+			return nil, err
+		}
+
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// listen opens the listeners of the proxy, reading the PROXY protocol
+// headers and limiting the connections of each client if enabled.
+func (c *Config) listen() ([]net.Listener, error) {
+	listeners, err := listen(c.listenAddrs(), c.ListenFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	// The PROXY protocol headers are read first, for the connection limits
+	// to apply to the real clients.
+	if c.ProxyProtocol {
+		sources, err := c.proxyProtocolSources()
+		if err != nil {
+			closeListeners(listeners)
+
+			return nil, err
+		}
+
+		for i, ln := range listeners {
+			listeners[i] = newProxyProtocolListener(ln, c.Timeouts.ClientReadHeader, sources)
+		}
+	}
+
+	if c.Limits.ClientConns > 0 {
+		for i, ln := range listeners {
+			listeners[i] = newClientConnsListener(ln, c.Limits.ClientConns)
+		}
+	}
+
+	return listeners, nil
+}
+
+func listenAddr(addr, network string) (net.Listener, error) {
+	if !isUnixUpstream(addr) {
+		return net.Listen(network, addr)
+	}
+
+	socket := strings.TrimPrefix(addr, "unix://")
+
+	// A socket left behind by a proxy that didn't shut down cleanly would
+	// make the listen fail.
+	if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(socket)
+	}
+
+	return net.Listen("unix", socket)
+}
+
+// serveListeners serves every listener until one of them fails, which
+// closes the others, returning the first error.
+func serveListeners(listeners []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(listeners))
+
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- serve(ln)
+		}(ln)
+	}
+
+	err := <-errs
+
+	closeListeners(listeners)
+
+	return err
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+}
+
+// clientConnsListener closes the connections of the clients that already
+// have limit open, so that a single client can't hold them all.
+type clientConnsListener struct {
+	net.Listener
+	limit int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newClientConnsListener(ln net.Listener, limit int) *clientConnsListener {
+	return &clientConnsListener{Listener: ln, limit: limit, conns: make(map[string]int)}
+}
+
+func (l *clientConnsListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			// The unix sockets have no client IP to limit.
+			return conn, nil
+		}
+
+		if l.open(ip) {
+			return &clientConn{Conn: conn, close: func() { l.closed(ip) }}, nil
+		}
+
+		log.Printf("Closed a connection from %s, which already has %d open", ip, l.limit)
+
+		_ = conn.Close()
+	}
+}
+
+func (l *clientConnsListener) open(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip] >= l.limit {
+		return false
+	}
+
+	l.conns[ip]++
+
+	return true
+}
+
+func (l *clientConnsListener) closed(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// clientConn calls close once when the connection is closed.
+type clientConn struct {
+	net.Conn
+	once  sync.Once
+	close func()
+}
+
+func (c *clientConn) Close() error {
+	c.once.Do(c.close)
+
+	return c.Conn.Close()
+}
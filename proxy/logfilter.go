@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// LogFilterConfig keeps only some of the exchanges in the logs, to keep
+// them manageable under high volume. All the conditions that are set must
+// hold:
+//
+//   - Match, the request, like the rules of the other features.
+//   - Status, any of the statuses like 404 or classes like 5xx of the
+//     response.
+//   - Errors and Slow, the exchanges that failed, with an error or a 5xx
+//     response, or that took longer than Slow; either one with both.
+//   - Sample, the percentage of the exchanges kept by the others, 0
+//     meaning all of them.
+//
+// The errors the proxy answers before logging the request, like the
+// access list denials, are filtered on the status it answered with, and
+// left out by Match.
+type LogFilterConfig struct {
+	Match  *RequestMatch `yaml:"match"`
+	Status []string      `yaml:"status"`
+	Errors bool          `yaml:"errors"`
+	Slow   time.Duration `yaml:"slow"`
+	Sample float64       `yaml:"sample"`
+}
+
+// logFilter is a compiled LogFilterConfig.
+type logFilter struct {
+	cfg      LogFilterConfig
+	statuses [][2]int
+}
+
+func (fc LogFilterConfig) compile() (*logFilter, error) {
+	if fc.Slow < 0 {
+		return nil, errors.New("the slow exchanges threshold of the log filter can't be negative")
+	}
+
+	if fc.Sample < 0 || fc.Sample > 100 {
+		return nil, errors.New("the log sample percentage must be between 0 and 100")
+	}
+
+	if fc.Match != nil {
+		if err := fc.Match.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &logFilter{cfg: fc}
+
+	for _, status := range fc.Status {
+		minStatus, maxStatus, err := parseStatusRange(status)
+		if err != nil {
+			return nil, err
+		}
+
+		f.statuses = append(f.statuses, [2]int{minStatus, maxStatus})
+	}
+
+	return f, nil
+}
+
+// active tells if the filter leaves out any exchange.
+func (f *logFilter) active() bool {
+	return f.cfg.Match != nil || len(f.statuses) > 0 || f.cfg.Errors || f.cfg.Slow > 0 || (f.cfg.Sample > 0 && f.cfg.Sample < 100)
+}
+
+// keeps tells if the exchange of req ending with res, a response or an
+// error, is logged. req is nil for the errors whose request wasn't logged.
+func (f *logFilter) keeps(req *LogEntry, res LogEntry) bool {
+	if f.cfg.Match != nil && (req == nil || !f.cfg.Match.matches(messageRequest(req.Message))) {
+		return false
+	}
+
+	status := res.Status
+	if res.Err == nil {
+		status = res.Message.StatusCode
+	}
+
+	if len(f.statuses) > 0 && !f.matchesStatus(status) {
+		return false
+	}
+
+	failed := res.Err != nil || status >= 500
+	elapsed := res.Elapsed
+	if req != nil {
+		elapsed = res.elapsed(*req)
+	}
+
+	slow := f.cfg.Slow > 0 && elapsed > f.cfg.Slow
+
+	if (f.cfg.Errors || f.cfg.Slow > 0) && !(f.cfg.Errors && failed) && !slow {
+		return false
+	}
+
+	return f.cfg.Sample == 0 || f.cfg.Sample >= 100 || chance(f.cfg.Sample)
+}
+
+func (f *logFilter) matchesStatus(status int) bool {
+	for _, r := range f.statuses {
+		if status >= r[0] && status <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// messageRequest rebuilds the request of a logged message, for matching it.
+func messageRequest(msg *Message) *http.Request {
+	u, err := url.Parse(msg.URL)
+	if err != nil {
+		u = &url.URL{}
+	}
+
+	if msg.Path != "" {
+		u.Path = msg.Path
+	}
+
+	return &http.Request{Method: msg.Method, URL: u, Header: msg.Header}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFilterProxyErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name   string
+		filter LogFilterConfig
+		want   []string
+		unwant []string
+	}{
+		{
+			name:   "errors",
+			filter: LogFilterConfig{Errors: true},
+			want:   []string{"502 Bad Gateway", "denied by the access list"},
+			unwant: []string{"200 OK"},
+		},
+		{
+			name:   "status 502",
+			filter: LogFilterConfig{Status: []string{"502"}},
+			want:   []string{"502 Bad Gateway"},
+			unwant: []string{"200 OK", "denied by the access list"},
+		},
+		{
+			name:   "status 4xx",
+			filter: LogFilterConfig{Status: []string{"4xx"}},
+			want:   []string{"denied by the access list"},
+			unwant: []string{"200 OK", "502 Bad Gateway"},
+		},
+		{
+			name:   "matched path",
+			filter: LogFilterConfig{Errors: true, Match: &RequestMatch{Path: "/down/*"}},
+			want:   []string{"502 Bad Gateway"},
+			unwant: []string{"200 OK", "denied by the access list"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Upstreams = []string{upstream.URL}
+			cfg.Routes = []RouteConfig{
+				{Path: "/down/*", Upstreams: []string{down.URL}},
+				{Path: "/denied/*", Upstreams: []string{upstream.URL}, ACL: &ACLConfig{Deny: []string{"192.0.2.0/24"}}},
+			}
+			cfg.Log.Dir = t.TempDir()
+			cfg.Log.Split = "none"
+			cfg.Log.Filter = tt.filter
+
+			p, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range []string{"/ok", "/down/a", "/denied/a"} {
+				p.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+
+			p.Close()
+
+			logged, err := os.ReadFile(filepath.Join(cfg.Log.Dir, "all"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tt.want {
+				if !strings.Contains(string(logged), want) {
+					t.Errorf("the log lacks %q:\n%s", want, logged)
+				}
+			}
+
+			for _, unwant := range tt.unwant {
+				if strings.Contains(string(logged), unwant) {
+					t.Errorf("the log has %q:\n%s", unwant, logged)
+				}
+			}
+		})
+	}
+}
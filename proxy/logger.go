@@ -0,0 +1,582 @@
+package proxy
+
+import (
+	"bufio"
+	"container/list"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logSampleRate is the share of the exchanges, one in that many, logged
+// with the sample overflow policy while the buffer is filling up.
+const logSampleRate = 10
+
+// maxOpenLogFiles is how many log files are kept open, the least recently
+// written being closed beyond, since in forward proxy mode every host gets
+// its own.
+const maxOpenLogFiles = 64
+
+// pendingMaxAge is how long a request entry waits for its response, which
+// may never come while the logging is paused.
+const pendingMaxAge = time.Hour
+
+// LogEntry is a request or response going through the proxy, or the error
+// that ended an exchange (Message is nil then).
+type LogEntry struct {
+	ID        uint64
+	RequestID string
+	Timestamp time.Time
+	Upstream  string
+	Route     string
+	Message   *Message
+	Err       error
+
+	// Status is, for the errors, the status the proxy answered with, 499
+	// when the client went away first.
+	Status int
+
+	// Elapsed is, for the responses and errors, the time since the proxy
+	// got the request.
+	Elapsed time.Duration
+
+	// Timings are, for the responses from the upstreams, the phases of the
+	// request to them.
+	Timings *Timings
+}
+
+// elapsed is the duration of the exchange of req ended by e, a response or
+// an error, measured by the proxy or else between their timestamps.
+func (e LogEntry) elapsed(req LogEntry) time.Duration {
+	if e.Elapsed > 0 {
+		return e.Elapsed
+	}
+
+	return e.Timestamp.Sub(req.Timestamp)
+}
+
+type logSink interface {
+	// write receives every entry in order; for responses and errors, req is
+	// the matching request entry, or nil if it was dropped. The errors the
+	// proxy answered before logging the request get a stand-in without a
+	// message.
+	write(entry LogEntry, req *LogEntry)
+	flush()
+	close()
+}
+
+// Logger receives the entries of every exchange: the request, then either
+// the response or an error with the same ID. Log is called from the request
+// goroutines and must not block.
+type Logger interface {
+	Log(entry LogEntry)
+	Close()
+}
+
+// FileLogger writes the entries to the sinks of cfg.Sinks from a background
+// goroutine: one file per upstream host or named route in a directory, by
+// cfg.Split, which are opened on their first entry (and closed when more
+// than maxOpenLogFiles are open), the standard output, syslog or HTTP
+// endpoints. Without sinks, the entries go to the files.
+//
+// The entries wait in a buffer of cfg.Buffer entries, and are written to
+// the sinks in batches, flushed every cfg.BatchSize entries and every
+// cfg.FlushInterval. When the buffer is full, cfg.Overflow drops the new
+// entries (drop), the oldest ones (drop-oldest), or holds the requests
+// until there's room (block). With sample, only one exchange in ten is
+// logged once the buffer is three quarters full.
+type FileLogger struct {
+	dropped      atomic.Uint64
+	totalDropped atomic.Uint64
+	sampledOut   atomic.Uint64
+
+	cfg     LogConfig
+	filter  *logFilter
+	entries chan LogEntry
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	// orphans are the IDs of the responses and errors dropped, whose
+	// request entries run stops waiting for.
+	orphansMu sync.Mutex
+	orphans   []uint64
+}
+
+// LoggerStats are the figures of the buffer of a FileLogger.
+type LoggerStats struct {
+	Buffered   int    `json:"buffered"`
+	Dropped    uint64 `json:"dropped"`
+	SampledOut uint64 `json:"sampled_out"`
+}
+
+func NewFileLogger(cfg LogConfig) *FileLogger {
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = DefaultConfig().Log.Buffer
+	}
+
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultConfig().Log.FlushInterval
+	}
+
+	filter, err := cfg.Filter.compile()
+	if err != nil {
+		log.Printf("Can't filter the log entries, all of them are logged: %v", err)
+
+		filter = &logFilter{}
+	}
+
+	l := &FileLogger{
+		cfg:     cfg,
+		filter:  filter,
+		entries: make(chan LogEntry, cfg.Buffer),
+		done:    make(chan struct{}),
+	}
+
+	go l.run()
+
+	return l
+}
+
+func (l *FileLogger) Log(entry LogEntry) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return
+	}
+
+	switch l.cfg.Overflow {
+	case "block":
+		l.entries <- entry
+	case "drop-oldest":
+		for {
+			select {
+			case l.entries <- entry:
+				return
+			default:
+			}
+
+			select {
+			case old := <-l.entries:
+				l.drop(old)
+			default:
+			}
+		}
+	case "sample":
+		if len(l.entries) >= cap(l.entries)*3/4 && entry.ID%logSampleRate != 0 {
+			l.sampledOut.Add(1)
+			l.orphan(entry)
+
+			return
+		}
+
+		fallthrough
+	default:
+		select {
+		case l.entries <- entry:
+		default:
+			l.drop(entry)
+		}
+	}
+}
+
+func (l *FileLogger) drop(entry LogEntry) {
+	l.dropped.Add(1)
+	l.totalDropped.Add(1)
+	l.orphan(entry)
+}
+
+// orphan has run forget the request of entry, left out, if it's a response
+// or an error.
+func (l *FileLogger) orphan(entry LogEntry) {
+	if entry.Err == nil && entry.Message.IsRequest {
+		return
+	}
+
+	l.orphansMu.Lock()
+	l.orphans = append(l.orphans, entry.ID)
+	l.orphansMu.Unlock()
+}
+
+// forgetOrphans removes from pending the requests whose response or error
+// was left out, and those waiting for longer than pendingMaxAge.
+func (l *FileLogger) forgetOrphans(pending map[uint64]LogEntry) {
+	l.orphansMu.Lock()
+	orphans := l.orphans
+	l.orphans = nil
+	l.orphansMu.Unlock()
+
+	for _, id := range orphans {
+		delete(pending, id)
+	}
+
+	for id, req := range pending {
+		if time.Since(req.Timestamp) > pendingMaxAge {
+			delete(pending, id)
+		}
+	}
+}
+
+// Stats returns the entries waiting to be written and those left out
+// since the start.
+func (l *FileLogger) Stats() LoggerStats {
+	return LoggerStats{
+		Buffered:   len(l.entries),
+		Dropped:    l.totalDropped.Load(),
+		SampledOut: l.sampledOut.Load(),
+	}
+}
+
+func (l *FileLogger) Close() {
+	l.mu.Lock()
+	l.closed = true
+	close(l.entries)
+	l.mu.Unlock()
+
+	<-l.done
+}
+
+func (l *FileLogger) run() {
+	files := newLogFiles(maxOpenLogFiles)
+	sinks, toFiles := l.openSinks()
+	pending := make(map[uint64]LogEntry)
+	filtered := l.filter.active()
+
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	unflushed := 0
+
+	flush := func() {
+		files.flush()
+
+		for _, sink := range sinks {
+			sink.flush()
+		}
+
+		unflushed = 0
+	}
+
+	defer func() {
+		ticker.Stop()
+		files.close()
+
+		for _, sink := range sinks {
+			sink.close()
+		}
+
+		close(l.done)
+	}()
+
+	for {
+		select {
+		case entry, ok := <-l.entries:
+			if !ok {
+				return
+			}
+
+			if dropped := l.dropped.Swap(0); dropped > 0 {
+				log.Printf("Dropped %d log entries because the logger fell behind", dropped)
+			}
+
+			if l.cfg.Decode {
+				entry.Message = decodedMessage(entry.Message)
+			}
+
+			var req *LogEntry
+
+			if entry.Err == nil && entry.Message.IsRequest {
+				pending[entry.ID] = entry
+			} else if r, ok := pending[entry.ID]; ok {
+				delete(pending, entry.ID)
+
+				req = &r
+			}
+
+			if filtered {
+				// The requests wait for their response to be filtered,
+				// those whose request was dropped being left out. The
+				// errors without a request are filtered on their own.
+				if entry.Err == nil && (entry.Message.IsRequest || req == nil) || !l.filter.keeps(req, entry) {
+					continue
+				}
+
+				if req != nil {
+					l.write(files, sinks, toFiles, *req, nil)
+				}
+			}
+
+			l.write(files, sinks, toFiles, entry, req)
+
+			if unflushed++; l.cfg.BatchSize > 0 && unflushed >= l.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			l.forgetOrphans(pending)
+		}
+	}
+}
+
+func (l *FileLogger) write(files *logFiles, sinks []logSink, toFiles bool, entry LogEntry, req *LogEntry) {
+	if toFiles {
+		writeLogEntry(l.fileSink(files, entry), entry, req)
+	}
+
+	for _, sink := range sinks {
+		writeLogEntry(sink, entry, req)
+	}
+}
+
+// openSinks opens the sinks other than the files, telling if the entries
+// go to the files too.
+func (l *FileLogger) openSinks() (sinks []logSink, toFiles bool) {
+	if len(l.cfg.Sinks) == 0 {
+		return nil, true
+	}
+
+	for _, c := range l.cfg.Sinks {
+		if c.Type == "file" {
+			toFiles = true
+
+			continue
+		}
+
+		sink, err := openLogSink(c, l.cfg)
+		if err != nil {
+			log.Printf("Can't open the %s log sink, its entries are dropped: %v", c.Type, err)
+
+			continue
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, toFiles
+}
+
+// fileSink returns the sink of the file of entry, opening it if needed.
+func (l *FileLogger) fileSink(files *logFiles, entry LogEntry) logSink {
+	fileName := logFileName(entry, l.cfg.Split)
+
+	sink := files.get(fileName)
+	if sink == nil {
+		var err error
+
+		if sink, err = l.openSink(fileName); err != nil {
+			log.Printf("Can't open the log file %s, its entries are dropped: %v", fileName, err)
+
+			sink = discardLogSink{}
+		}
+
+		files.add(fileName, sink)
+	}
+
+	return sink
+}
+
+// logFiles are the sinks of the open log files, the least recently written
+// one being closed when there are more than max.
+type logFiles struct {
+	max   int
+	order *list.List
+	files map[string]*list.Element
+}
+
+type logFile struct {
+	name string
+	sink logSink
+}
+
+func newLogFiles(max int) *logFiles {
+	return &logFiles{max: max, order: list.New(), files: make(map[string]*list.Element)}
+}
+
+// get returns the sink of the file, or nil if it isn't open.
+func (f *logFiles) get(name string) logSink {
+	elem, ok := f.files[name]
+	if !ok {
+		return nil
+	}
+
+	f.order.MoveToFront(elem)
+
+	return elem.Value.(*logFile).sink
+}
+
+func (f *logFiles) add(name string, sink logSink) {
+	f.files[name] = f.order.PushFront(&logFile{name: name, sink: sink})
+
+	for f.order.Len() > f.max {
+		oldest := f.order.Remove(f.order.Back()).(*logFile)
+		delete(f.files, oldest.name)
+
+		oldest.sink.close()
+	}
+}
+
+func (f *logFiles) flush() {
+	for elem := f.order.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*logFile).sink.flush()
+	}
+}
+
+func (f *logFiles) close() {
+	for elem := f.order.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*logFile).sink.close()
+	}
+}
+
+func (l *FileLogger) openSink(fileName string) (logSink, error) {
+	switch l.cfg.Format {
+	case "har":
+		return newHARLogSink(path.Join(l.cfg.Dir, fileName+".har"), l.cfg)
+	case "json":
+		file, err := openLogFile(l.cfg.Dir, fileName+".jsonl")
+		if err != nil {
+			return nil, err
+		}
+
+		return newJSONLogSink(file, l.cfg), nil
+	}
+
+	file, err := openLogFile(l.cfg.Dir, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRawLogSink(file, l.cfg), nil
+}
+
+// writeLogEntry keeps a failing sink from taking down the logger, and the
+// proxy with it.
+func writeLogEntry(sink logSink, entry LogEntry, req *LogEntry) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Can't log entry #%d: %v", entry.ID, err)
+		}
+	}()
+
+	if req == nil && entry.Err != nil {
+		standIn := entry.requestStandIn()
+		req = &standIn
+	}
+
+	sink.write(entry, req)
+}
+
+// requestStandIn is the request of the errors the proxy answers before
+// logging it, like the access list denials: the exchange without the
+// message.
+func (e LogEntry) requestStandIn() LogEntry {
+	return LogEntry{
+		ID:        e.ID,
+		RequestID: e.RequestID,
+		Timestamp: e.Timestamp.Add(-e.Elapsed),
+		Upstream:  e.Upstream,
+		Route:     e.Route,
+		Message:   &Message{IsRequest: true},
+	}
+}
+
+// discardLogSink stands in for the files that can't be opened.
+type discardLogSink struct{}
+
+func (discardLogSink) write(LogEntry, *LogEntry) {}
+func (discardLogSink) flush()                    {}
+func (discardLogSink) close()                    {}
+
+// rawLogSink writes the messages as they went through the proxy, buffered
+// until flush.
+type rawLogSink struct {
+	file   io.WriteCloser
+	writer *bufio.Writer
+	logger *log.Logger
+	cfg    LogConfig
+}
+
+func newRawLogSink(file io.WriteCloser, cfg LogConfig) *rawLogSink {
+	writer := bufio.NewWriter(file)
+
+	return &rawLogSink{file: file, writer: writer, logger: log.New(writer, "", 0), cfg: cfg}
+}
+
+func (s *rawLogSink) write(entry LogEntry, req *LogEntry) {
+	if entry.RequestID != "" {
+		s.logger.Printf("==> #%d %s (%s)\n", entry.ID, s.cfg.formatTime(entry.Timestamp), entry.RequestID)
+	} else {
+		s.logger.Printf("==> #%d %s\n", entry.ID, s.cfg.formatTime(entry.Timestamp))
+	}
+
+	if entry.Err != nil {
+		s.logger.Printf("==> Error: %v\n\n", entry.Err)
+
+		return
+	}
+
+	if entry.Message.Duplicate != nil {
+		s.logger.Printf("==> %s\n", entry.Message.Duplicate)
+	}
+
+	for _, op := range entry.Message.GraphQL {
+		if len(op.Variables) > 0 {
+			s.logger.Printf("==> GraphQL: %s %s\n", op, op.Variables)
+		} else {
+			s.logger.Printf("==> GraphQL: %s\n", op)
+		}
+	}
+
+	s.logger.Println(rawMessage(renderedBinary(entry.Message, s.cfg.Binary, s.cfg.TextTypes)))
+
+	if !entry.Message.IsRequest && req != nil {
+		s.logger.Printf("==> Elapsed: %s\n\n", entry.elapsed(*req))
+	} else if !entry.Message.IsRequest && entry.Elapsed > 0 {
+		s.logger.Printf("==> Elapsed: %s\n\n", entry.Elapsed)
+	}
+}
+
+func (s *rawLogSink) flush() {
+	if err := s.writer.Flush(); err != nil {
+		log.Printf("Can't write the log entries: %v", err)
+	}
+}
+
+func (s *rawLogSink) close() {
+	s.flush()
+	s.file.Close()
+}
+
+func openLogFile(logsDir, fileName string) (*os.File, error) {
+	if err := os.MkdirAll(logsDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path.Join(logsDir, fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// logFileName is the file an entry is logged to, by the split mode: route
+// for a file per named route and per upstream host otherwise, upstream for
+// a file per upstream host, or none for a single file.
+func logFileName(entry LogEntry, split string) string {
+	switch {
+	case split == "none":
+		return "all"
+	case entry.Route != "" && (split != "upstream" || entry.Upstream == ""):
+		return strings.ReplaceAll(entry.Route, "/", "_")
+	}
+
+	host := entry.Upstream
+	if upstreamURL, err := url.Parse(entry.Upstream); err == nil && upstreamURL.Host != "" {
+		host = upstreamURL.Host
+	} else if err == nil && upstreamURL.Scheme == "unix" {
+		host = strings.TrimPrefix(upstreamURL.Path, "/")
+	}
+
+	return strings.NewReplacer(":", ".", "/", "_").Replace(host)
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSinkConfig is a destination of the log entries: the files in the log
+// directory (file), the standard output (stdout), a line per exchange on
+// the standard output (console), syslog, an HTTP endpoint receiving them as
+// JSON lines (http) or a Loki server (loki).
+type LogSinkConfig struct {
+	Type string `yaml:"type"`
+
+	// Format is raw or json for stdout, raw by default, and syslog, json by
+	// default. The files have the format of the log, and the HTTP endpoints
+	// always get JSON.
+	Format string `yaml:"format"`
+
+	// Address is the syslog server, like udp://10.0.0.5:514, the local one
+	// being used if it's empty, or the URL of the HTTP endpoint or Loki
+	// server.
+	Address string `yaml:"address"`
+
+	// Labels are the labels of the Loki stream, job=go-proxy by default.
+	Labels map[string]string `yaml:"labels"`
+
+	// Expand prints the headers and bodies of the exchanges it matches on
+	// the console.
+	Expand []RequestMatch `yaml:"expand"`
+}
+
+// ParseLogSink reads the log sink of a spec like file, stdout, stdout:json,
+// console, syslog, syslog://10.0.0.5:514, syslog+tcp://10.0.0.5:514, an
+// http:// or https:// URL or loki+http://loki:3100.
+func ParseLogSink(spec string) (LogSinkConfig, error) {
+	switch spec {
+	case "file", "stdout", "console", "syslog":
+		return LogSinkConfig{Type: spec}, nil
+	case "stdout:json", "stdout:raw", "syslog:json", "syslog:raw":
+		sinkType, format, _ := strings.Cut(spec, ":")
+
+		return LogSinkConfig{Type: sinkType, Format: format}, nil
+	}
+
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		return LogSinkConfig{}, fmt.Errorf("invalid log sink %q", spec)
+	}
+
+	switch scheme {
+	case "syslog", "syslog+udp":
+		return LogSinkConfig{Type: "syslog", Address: "udp://" + rest}, nil
+	case "syslog+tcp":
+		return LogSinkConfig{Type: "syslog", Address: "tcp://" + rest}, nil
+	case "http", "https":
+		return LogSinkConfig{Type: "http", Address: spec}, nil
+	case "loki+http", "loki+https":
+		return LogSinkConfig{Type: "loki", Address: strings.TrimPrefix(spec, "loki+")}, nil
+	}
+
+	return LogSinkConfig{}, fmt.Errorf("invalid log sink %q", spec)
+}
+
+func (c LogSinkConfig) validate() error {
+	switch c.Type {
+	case "file":
+	case "console":
+		for i := range c.Expand {
+			if err := c.Expand[i].compile(); err != nil {
+				return err
+			}
+		}
+	case "stdout", "syslog":
+		if c.Format != "" && c.Format != "raw" && c.Format != "json" {
+			return fmt.Errorf("the format of the %s log sink must be raw or json", c.Type)
+		}
+
+		if c.Type == "syslog" && c.Address != "" {
+			u, err := url.Parse(c.Address)
+			if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+				return fmt.Errorf("the syslog server %q must be of type udp://host:port or tcp://host:port", c.Address)
+			}
+		}
+	case "http", "loki":
+		u, err := url.Parse(c.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("the address of the %s log sink must be an http:// or https:// URL", c.Type)
+		}
+	default:
+		return fmt.Errorf("invalid log sink type %q, which must be file, stdout, console, syslog, http or loki", c.Type)
+	}
+
+	return nil
+}
+
+// openLogSink opens a sink other than the files.
+func openLogSink(c LogSinkConfig, cfg LogConfig) (logSink, error) {
+	switch c.Type {
+	case "stdout":
+		if c.Format == "json" {
+			return newJSONLogSink(nopWriteCloser{os.Stdout}, cfg), nil
+		}
+
+		return newRawLogSink(nopWriteCloser{os.Stdout}, cfg), nil
+	case "console":
+		return newConsoleLogSink(c, cfg), nil
+	case "syslog":
+		return newSyslogLogSink(c, cfg)
+	case "http", "loki":
+		return newHTTPLogSink(c, cfg), nil
+	}
+
+	return nil, fmt.Errorf("invalid log sink type %q", c.Type)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// httpLogBatchSize is the most entries sent to the HTTP log sinks at once.
+const httpLogBatchSize = 500
+
+// httpLogSink sends the exchanges, as JSON records, to an HTTP endpoint,
+// as JSON lines, or to Loki, in batches from a goroutine of its own so
+// that a slow endpoint doesn't hold the others. The batches that can't be
+// queued are dropped.
+type httpLogSink struct {
+	cfg     LogSinkConfig
+	url     string
+	json    *jsonLogSink
+	records []jsonLogRecord
+	times   []time.Time
+	batches chan []byte
+	client  *http.Client
+	done    sync.WaitGroup
+}
+
+func newHTTPLogSink(c LogSinkConfig, cfg LogConfig) *httpLogSink {
+	s := &httpLogSink{
+		cfg:     c,
+		url:     c.Address,
+		json:    &jsonLogSink{cfg: cfg},
+		batches: make(chan []byte, 16),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	// Loki is given by its base URL, or that of its push API.
+	if u, _ := url.Parse(c.Address); c.Type == "loki" && strings.Trim(u.Path, "/") == "" {
+		s.url = strings.TrimSuffix(c.Address, "/") + "/loki/api/v1/push"
+	}
+
+	s.done.Add(1)
+
+	go s.send()
+
+	return s
+}
+
+func (s *httpLogSink) write(entry LogEntry, req *LogEntry) {
+	if req == nil || (entry.Err == nil && entry.Message.IsRequest) {
+		return
+	}
+
+	s.records = append(s.records, s.json.newRecord(*req, entry))
+	s.times = append(s.times, req.Timestamp)
+
+	if len(s.records) >= httpLogBatchSize {
+		s.flush()
+	}
+}
+
+func (s *httpLogSink) flush() {
+	if len(s.records) == 0 {
+		return
+	}
+
+	batch, err := s.encode()
+	if err != nil {
+		log.Printf("Can't encode the log entries for %s: %v", s.url, err)
+	}
+
+	s.records, s.times = s.records[:0], s.times[:0]
+
+	if err != nil {
+		return
+	}
+
+	select {
+	case s.batches <- batch:
+	default:
+		log.Printf("Dropped a batch of log entries because %s fell behind", s.url)
+	}
+}
+
+// encode returns the body of the pending records: JSON lines, or a Loki
+// push request.
+func (s *httpLogSink) encode() ([]byte, error) {
+	var body bytes.Buffer
+
+	if s.cfg.Type != "loki" {
+		encoder := json.NewEncoder(&body)
+
+		for _, record := range s.records {
+			if err := encoder.Encode(record); err != nil {
+				return nil, err
+			}
+		}
+
+		return body.Bytes(), nil
+	}
+
+	labels := s.cfg.Labels
+	if len(labels) == 0 {
+		labels = map[string]string{"job": "go-proxy"}
+	}
+
+	values := make([][2]string, len(s.records))
+
+	for i, record := range s.records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = [2]string{strconv.FormatInt(s.times[i].UnixNano(), 10), string(line)}
+	}
+
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	err := json.NewEncoder(&body).Encode(struct {
+		Streams []lokiStream `json:"streams"`
+	}{[]lokiStream{{Stream: labels, Values: values}}})
+
+	return body.Bytes(), err
+}
+
+func (s *httpLogSink) send() {
+	defer s.done.Done()
+
+	contentType := "application/x-ndjson"
+	if s.cfg.Type == "loki" {
+		contentType = "application/json"
+	}
+
+	for batch := range s.batches {
+		res, err := s.client.Post(s.url, contentType, bytes.NewReader(batch))
+		if err != nil {
+			log.Printf("Can't send the log entries to %s: %v", s.url, err)
+
+			continue
+		}
+
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+
+		if res.StatusCode >= 300 {
+			log.Printf("Can't send the log entries to %s: %s", s.url, res.Status)
+		}
+	}
+}
+
+func (s *httpLogSink) close() {
+	s.flush()
+	close(s.batches)
+	s.done.Wait()
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSinksErrorsWithoutRequest(t *testing.T) {
+	denied := LogEntry{
+		ID:        7,
+		Timestamp: time.Now(),
+		Elapsed:   time.Millisecond,
+		Upstream:  "http://some-server",
+		Err:       errors.New("403 Forbidden: the client 192.0.2.1 is denied by the access list"),
+		Status:    http.StatusForbidden,
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		sink := newJSONLogSink(nopWriteCloser{&buf}, LogConfig{})
+		writeLogEntry(sink, denied, nil)
+		sink.flush()
+
+		for _, want := range []string{`"id":7`, `"status":403`, `"error":"403 Forbidden`} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("the JSON log lacks %s: %s", want, buf.String())
+			}
+		}
+	})
+
+	t.Run("console", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		sink := newConsoleLogSink(LogSinkConfig{}, LogConfig{})
+		sink.out, sink.color = &buf, false
+		writeLogEntry(sink, denied, nil)
+
+		if !strings.Contains(buf.String(), "#7") || !strings.Contains(buf.String(), "ERR") {
+			t.Errorf("the console lacks the error: %q", buf.String())
+		}
+	})
+
+	t.Run("har", func(t *testing.T) {
+		sink, err := newHARLogSink(filepath.Join(t.TempDir(), "log.har"), LogConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sink.close()
+
+		writeLogEntry(sink, denied, nil)
+
+		if len(sink.entries) != 1 {
+			t.Fatalf("got %d HAR entries, want 1", len(sink.entries))
+		}
+
+		if got := sink.entries[0].Response.Status; got != http.StatusForbidden {
+			t.Errorf("got the status %d, want %d", got, http.StatusForbidden)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// logTimeLayouts are the names of the common layouts of TimeFormat.
+var logTimeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339ms":   "2006-01-02T15:04:05.000Z07:00",
+	"rfc3339nano": time.RFC3339Nano,
+}
+
+// compileTime checks the time format and zone of the logs, loading the
+// latter.
+func (c *LogConfig) compileTime() error {
+	c.timeLayout = c.TimeFormat
+	if layout, ok := logTimeLayouts[c.TimeFormat]; ok {
+		c.timeLayout = layout
+	}
+
+	if c.timeLayout == "" {
+		return errors.New("the time format of the logs can't be empty")
+	}
+
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return fmt.Errorf("invalid log time zone %q: %w", c.TimeZone, err)
+	}
+
+	c.timeLocation = location
+
+	return nil
+}
+
+// inTimeZone returns t in the time zone of the logs, the local one if it
+// wasn't compiled.
+func (c LogConfig) inTimeZone(t time.Time) time.Time {
+	if c.timeLocation == nil {
+		return t.Local()
+	}
+
+	return t.In(c.timeLocation)
+}
+
+// formatTime formats t with the time format of the logs, in their zone.
+func (c LogConfig) formatTime(t time.Time) string {
+	layout := c.timeLayout
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+
+	return c.inTimeZone(t).Format(layout)
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errMaintenance = errors.New("the proxy is in maintenance")
+
+// MaintenanceConfig answers the requests with 503 instead of forwarding
+// them, those of the whole proxy when Enabled or those of the Routes given
+// by name or path. The responses have the 503 error page and tell the
+// clients to retry after RetryAfter.
+type MaintenanceConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Routes     []string      `yaml:"routes"`
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+func (c MaintenanceConfig) validate() error {
+	if c.RetryAfter < 0 {
+		return errors.New("the maintenance retry after can't be negative")
+	}
+
+	return nil
+}
+
+// covers tells if the maintenance applies to rt.
+func (c *MaintenanceConfig) covers(rt *route) bool {
+	if c.Enabled {
+		return true
+	}
+
+	for _, name := range c.Routes {
+		if rt.hasName(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Maintenance returns the current maintenance mode.
+func (p *Proxy) Maintenance() MaintenanceConfig {
+	p.maintenanceMu.RLock()
+	defer p.maintenanceMu.RUnlock()
+
+	return p.maintenance
+}
+
+// SetMaintenance puts the proxy or some of its routes in maintenance, or
+// takes them out of it, for the requests arriving next.
+func (p *Proxy) SetMaintenance(m MaintenanceConfig) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	p.maintenanceMu.Lock()
+	defer p.maintenanceMu.Unlock()
+
+	p.maintenance = m
+
+	return nil
+}
+
+// checkMaintenance tells if the route of the exchange is available,
+// answering 503 if it's in maintenance.
+func (p *Proxy) checkMaintenance(w http.ResponseWriter, ex *exchange) bool {
+	p.maintenanceMu.RLock()
+	covered, retryAfter := p.maintenance.covers(ex.route), p.maintenance.RetryAfter
+	p.maintenanceMu.RUnlock()
+
+	if !covered {
+		return true
+	}
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Err: fmt.Errorf("503 Service Unavailable: %w", errMaintenance), Status: http.StatusServiceUnavailable})
+	p.cfg.Hooks.error(ex, http.StatusServiceUnavailable, errMaintenance)
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+
+	p.writeError(w, ex.inbound, http.StatusServiceUnavailable, errMaintenance)
+
+	return false
+}
+
+type maintenanceView struct {
+	Enabled    bool     `json:"enabled"`
+	Routes     []string `json:"routes"`
+	RetryAfter string   `json:"retry_after"`
+}
+
+func newMaintenanceView(m MaintenanceConfig) maintenanceView {
+	view := maintenanceView{Enabled: m.Enabled, Routes: m.Routes, RetryAfter: m.RetryAfter.String()}
+	if view.Routes == nil {
+		view.Routes = []string{}
+	}
+
+	return view
+}
+
+func (p *Proxy) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	change := newMaintenanceView(p.Maintenance())
+
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, "invalid maintenance: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	m := MaintenanceConfig{Enabled: change.Enabled, Routes: change.Routes}
+
+	retryAfter, err := time.ParseDuration(change.RetryAfter)
+	if err != nil {
+		http.Error(w, "invalid maintenance: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	m.RetryAfter = retryAfter
+
+	for _, name := range m.Routes {
+		if p.routeTable().byName(name) == nil {
+			http.Error(w, fmt.Sprintf("no route %s", name), http.StatusNotFound)
+
+			return
+		}
+	}
+
+	if err := p.SetMaintenance(m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	switch {
+	case m.Enabled:
+		log.Printf("Put the proxy in maintenance at the admin API")
+	case len(m.Routes) > 0:
+		log.Printf("Put the routes %s in maintenance at the admin API", strings.Join(m.Routes, ", "))
+	default:
+		log.Printf("Took the proxy out of maintenance at the admin API")
+	}
+
+	writeJSON(w, http.StatusOK, newMaintenanceView(m))
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RequestMatch selects requests for the rules of the other features. All
+// the conditions that are set must match, while each one matches any of
+// its values:
+//
+//   - Methods, any of the methods.
+//   - Path, a prefix like /api or /api/*, or a glob like /users/*/orders
+//     when it has wildcards before the end.
+//   - PathRegex, a regular expression matched against the path.
+//   - Headers and Query, a map of names to values, where an empty value
+//     only requires the header or parameter to be present.
+type RequestMatch struct {
+	Methods   []string          `yaml:"methods"`
+	Path      string            `yaml:"path"`
+	PathRegex string            `yaml:"path_regex"`
+	Headers   map[string]string `yaml:"headers"`
+	Query     map[string]string `yaml:"query"`
+
+	pathRegex *regexp.Regexp
+}
+
+// compile checks the match, compiling its regular expression.
+func (m *RequestMatch) compile() error {
+	if m.Path != "" && !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("the matched path %q must start with /", m.Path)
+	}
+
+	if isPathGlob(m.Path) {
+		if _, err := path.Match(m.Path, "/"); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", m.Path, err)
+		}
+	}
+
+	if m.PathRegex == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(m.PathRegex)
+	if err != nil {
+		return fmt.Errorf("invalid path regex %q: %w", m.PathRegex, err)
+	}
+
+	m.pathRegex = re
+
+	return nil
+}
+
+func (m RequestMatch) matches(r *http.Request) bool {
+	if !m.matchesMethod(r.Method) || !m.matchesPath(r.URL.Path) || !matchesValues(m.Headers, r.Header.Values) {
+		return false
+	}
+
+	query := r.URL.Query()
+
+	return matchesValues(m.Query, func(name string) []string { return query[name] })
+}
+
+func (m RequestMatch) matchesMethod(method string) bool {
+	if len(m.Methods) == 0 {
+		return true
+	}
+
+	for _, candidate := range m.Methods {
+		if strings.EqualFold(candidate, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m RequestMatch) matchesPath(urlPath string) bool {
+	if m.pathRegex != nil && !m.pathRegex.MatchString(urlPath) {
+		return false
+	}
+
+	if isPathGlob(m.Path) {
+		ok, _ := path.Match(m.Path, urlPath)
+
+		return ok
+	}
+
+	return strings.HasPrefix(urlPath, strings.TrimSuffix(m.Path, "*"))
+}
+
+// isPathGlob tells if pattern has wildcards other than a trailing *, which
+// only marks a prefix.
+func isPathGlob(pattern string) bool {
+	return strings.ContainsAny(strings.TrimSuffix(pattern, "*"), "*?[")
+}
+
+// matchesValues works for both the headers and the query parameters, with
+// get returning the values of a name.
+func matchesValues(want map[string]string, get func(string) []string) bool {
+	for name, value := range want {
+		if !containsValue(get(name), value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsValue(values []string, want string) bool {
+	for _, value := range values {
+		if want == "" || value == want {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Message is an HTTP request or response as it is logged.
+type Message struct {
+	IsRequest  bool
+	Method     string
+	Path       string
+	URL        string
+	Proto      string
+	Status     string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Trailer    http.Header
+
+	// Omitted is the number of bytes left out at the end of Body.
+	Omitted int
+
+	// Truncated tells if the end of Body was left out without knowing its
+	// size, like the decoded bodies cut off past 16MB.
+	Truncated bool
+
+	// GraphQL are the operations of a request to a GraphQL endpoint.
+	GraphQL []GraphQLOperation
+
+	// Duplicate tells if the request repeats an identical one.
+	Duplicate *Duplicate
+}
+
+// BodySize returns the size of the whole body, including the omitted bytes.
+func (m *Message) BodySize() int {
+	return len(m.Body) + m.Omitted
+}
+
+// truncatedMessage returns a copy of msg whose body is cut to maxBody
+// bytes, or msg itself if it fits. A maxBody of 0 means no limit.
+func truncatedMessage(msg *Message, maxBody int) *Message {
+	if msg == nil || maxBody <= 0 || len(msg.Body) <= maxBody {
+		return msg
+	}
+
+	truncated := *msg
+	truncated.Body = msg.Body[:maxBody]
+	truncated.Omitted += len(msg.Body) - maxBody
+
+	return &truncated
+}
+
+func newRawHTTPRequest(r *http.Request, rBody []byte) *Message {
+	return &Message{
+		IsRequest: true,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		URL:       r.URL.String(),
+		Proto:     r.Proto,
+		Status:    "",
+		Header:    r.Header,
+		Body:      rBody,
+	}
+}
+
+func newRawHTTPResponse(r *http.Response, rBody []byte) *Message {
+	return &Message{
+		IsRequest:  false,
+		Method:     "",
+		Path:       "",
+		URL:        "",
+		Proto:      r.Proto,
+		Status:     r.Status,
+		StatusCode: r.StatusCode,
+		Header:     r.Header,
+		Body:       rBody,
+		Trailer:    r.Trailer,
+	}
+}
+
+func rawMessage(msg *Message) string {
+	if msg.IsRequest {
+		return rawRequestMessage(msg)
+	}
+
+	return rawResponseMessage(msg)
+}
+
+func rawRequestMessage(req *Message) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("%s %s %s\r\n", req.Method, req.Path, req.Proto))
+	sb.WriteString(rawHeadersAndBody(req))
+
+	return sb.String()
+}
+
+func rawResponseMessage(res *Message) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("%s %s\r\n", res.Proto, res.Status))
+	sb.WriteString(rawHeadersAndBody(res))
+
+	return sb.String()
+}
+
+func rawHeadersAndBody(msg *Message) string {
+	var sb strings.Builder
+
+	sb.WriteString(rawHeaders(msg.Header))
+	sb.WriteString(fmt.Sprintf("\r\n%s\r\n", msg.Body))
+
+	if msg.Omitted > 0 {
+		sb.WriteString(fmt.Sprintf("[... %d bytes omitted]\r\n", msg.Omitted))
+	} else if msg.Truncated {
+		sb.WriteString("[... truncated]\r\n")
+	}
+
+	if len(msg.Trailer) > 0 {
+		sb.WriteString(rawHeaders(msg.Trailer))
+	}
+
+	return sb.String()
+}
+
+func rawHeaders(header http.Header) string {
+	var sb strings.Builder
+
+	headerKeys := make([]string, len(header))
+
+	i := 0
+	for k := range header {
+		headerKeys[i] = k
+		i++
+	}
+
+	sort.Strings(headerKeys)
+
+	for _, key := range headerKeys {
+		values := header[key]
+
+		for _, value := range values {
+			sb.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+		}
+	}
+
+	return sb.String()
+}
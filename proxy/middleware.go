@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// Middleware wraps the handler of the proxy, seeing the requests as they
+// arrive from the clients and the responses as they are sent back.
+type Middleware func(next http.Handler) http.Handler
+
+// UpstreamMiddleware wraps the transport used to reach the upstream servers,
+// seeing the requests after they were rewritten for the upstream and the
+// responses before they are logged. InboundRequest returns the client request
+// an upstream request was made for.
+type UpstreamMiddleware func(next http.RoundTripper) http.RoundTripper
+
+type inboundRequestKey struct{}
+
+// InboundRequest returns the client request that an upstream request was
+// created for, or nil if ctx doesn't belong to an upstream request.
+func InboundRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(inboundRequestKey{}).(*http.Request)
+
+	return r
+}
+
+func chainMiddleware(handler http.Handler, middlewares []Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+func chainUpstreamMiddleware(transport http.RoundTripper, middlewares []UpstreamMiddleware) http.RoundTripper {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		transport = middlewares[i](transport)
+	}
+
+	return transport
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxMirroredRequests limits the mirrored requests in flight, the next ones
+// being skipped, so that a slow shadow upstream can't pile them up.
+const maxMirroredRequests = 128
+
+// MirrorConfig sends a copy of Percent of the requests (all of them by
+// default) to a shadow upstream, in the background. Its responses are
+// discarded.
+type MirrorConfig struct {
+	Upstream string  `yaml:"upstream"`
+	Percent  float64 `yaml:"percent"`
+}
+
+func (c *MirrorConfig) validate() error {
+	if c.Upstream == "" {
+		return nil
+	}
+
+	c.Upstream = strings.TrimSuffix(c.Upstream, "/")
+
+	if err := validateForwardURL(c.Upstream); err != nil {
+		return err
+	}
+
+	if c.Percent < 0 || c.Percent > 100 {
+		return errors.New("the mirrored percentage must be between 0 and 100")
+	}
+
+	return nil
+}
+
+// shadowRequest copies req, with the body of ex, for another upstream,
+// within the timeouts of the config. It isn't tied to the client, so that
+// it goes on after the exchange; the budgets are stopped once it's done.
+func (p *Proxy) shadowRequest(ex *exchange, req *http.Request, upstream string) (*http.Request, *timeoutBudgets) {
+	base, _ := url.Parse(forwardBaseURL(upstream))
+
+	ctx := context.Background()
+
+	budgets := newTimeoutBudgets(ctx, p.cfg.Timeouts.upstream())
+	if budgets != nil {
+		ctx = budgets.ctx
+	}
+
+	shadow := req.Clone(context.WithValue(ctx, inboundRequestKey{}, ex.inbound))
+	shadow.URL.Scheme, shadow.URL.Host, shadow.Host = base.Scheme, base.Host, base.Host
+	shadow.Body = io.NopCloser(bytes.NewReader(ex.reqBody))
+	shadow.ContentLength = int64(len(ex.reqBody))
+
+	if isUnixUpstream(upstream) {
+		shadow.Host = "localhost"
+	}
+
+	return shadow, budgets
+}
+
+// mirror sends req to the shadow upstream, for the share of the requests
+// being mirrored.
+func (p *Proxy) mirror(ex *exchange, req *http.Request) {
+	if !chance(p.cfg.Mirror.Percent) {
+		return
+	}
+
+	select {
+	case p.mirrors <- struct{}{}:
+	default:
+		return
+	}
+
+	shadow, budgets := p.shadowRequest(ex, req, p.cfg.Mirror.Upstream)
+
+	go func() {
+		defer func() { <-p.mirrors }()
+		defer budgets.stop()
+
+		res, err := p.client.Do(budgets.attempt(shadow))
+		if err != nil {
+			log.Printf("Mirroring #%d to %s failed: %v", ex.id, p.cfg.Mirror.Upstream, err)
+
+			return
+		}
+
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// MITMConfig decrypts the CONNECT tunnels in forward proxy mode, with
+// certificates minted on the fly by the CA in CACert and CAKey, which are
+// created if they don't exist. The clients must trust that CA.
+type MITMConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	CACert  string `yaml:"ca_cert"`
+	CAKey   string `yaml:"ca_key"`
+}
+
+type mitm struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// ExportCA writes the certificate of the MITM CA in PEM to w, creating the
+// CA first if needed, so it can be trusted by the clients.
+func ExportCA(cfg MITMConfig, w io.Writer) error {
+	m, err := loadMITM(cfg)
+	if err != nil {
+		return err
+	}
+
+	return pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: m.ca.Raw})
+}
+
+func loadMITM(cfg MITMConfig) (*mitm, error) {
+	if _, err := os.Stat(cfg.CACert); errors.Is(err, os.ErrNotExist) {
+		if err := createCA(cfg.CACert, cfg.CAKey); err != nil {
+			return nil, fmt.Errorf("can't create the CA: %w", err)
+		}
+
+		log.Printf("Created the CA %s, which the clients must trust", cfg.CACert)
+	}
+
+	pair, err := tls.LoadX509KeyPair(cfg.CACert, cfg.CAKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't load the CA: %w", err)
+	}
+
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("can't parse the CA: %w", err)
+	}
+
+	caKey, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the CA key must be an ECDSA key")
+	}
+
+	return &mitm{ca: ca, caKey: caKey, leaves: make(map[string]*tls.Certificate)}, nil
+}
+
+func createCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "go-proxy CA", Organization: []string{"go-proxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(fileName, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+
+	return serial
+}
+
+// leaf returns a certificate for host signed by the CA, minting it the
+// first time.
+func (m *mitm) leaf(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cert, ok := m.leaves[host]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, 397),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca, &key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{Certificate: [][]byte{der, m.ca.Raw}, PrivateKey: key, Leaf: leaf}
+	m.leaves[host] = cert
+
+	return cert, nil
+}
+
+// serve decrypts the tunnel to target and serves the requests inside it
+// with handler, as requests to https://target.
+func (m *mitm) serve(conn net.Conn, target string, handler http.Handler) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, "443"
+	}
+
+	if port == "443" {
+		target = host
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.leaf(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	listener := newSingleConnListener(tlsConn)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = target
+
+			handler.ServeHTTP(w, r)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), authenticatedTunnelKey{}, true)
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+
+	_ = server.Serve(listener)
+}
+
+// singleConnListener hands one connection to an http.Server and then blocks
+// until it's closed.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	mu     sync.Mutex
+	taken  bool
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.taken {
+		l.taken = true
+		l.mu.Unlock()
+
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+
+	<-l.closed
+
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// bufferedConn reads what was buffered from the connection before reading
+// from the connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
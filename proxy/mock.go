@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// MockResponse answers the requests matching Match without reaching an
+// upstream, e.g. to stub the endpoints a server doesn't have yet. Body is
+// rendered with text/template, like the body templates, given the request
+// .Body, its .JSON, .Method, .Path, .Query and .Header. Status defaults to
+// 200, and the exchanges are logged under Name, or mock.
+type MockResponse struct {
+	Name    string            `yaml:"name"`
+	Match   RequestMatch      `yaml:"match"`
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	route    *route
+	template *template.Template
+}
+
+func (m *MockResponse) compile() error {
+	if err := m.Match.compile(); err != nil {
+		return err
+	}
+
+	if m.Status == 0 {
+		m.Status = http.StatusOK
+	}
+
+	if m.Status < 100 || m.Status > 999 {
+		return fmt.Errorf("invalid mock status %d", m.Status)
+	}
+
+	name := m.Name
+	if name == "" {
+		name = "mock"
+	}
+
+	m.route = &route{name: name}
+
+	tmpl, err := template.New("mock").Funcs(bodyTemplateFuncs).Option("missingkey=zero").Parse(m.Body)
+	if err != nil {
+		return fmt.Errorf("invalid mock body template: %w", err)
+	}
+
+	m.template = tmpl
+
+	return nil
+}
+
+// findMock returns the first mock matching r, or nil.
+func (p *Proxy) findMock(r *http.Request) *MockResponse {
+	for i := range p.cfg.Mocks {
+		if p.cfg.Mocks[i].Match.matches(r) {
+			return &p.cfg.Mocks[i]
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxy) serveMock(w http.ResponseWriter, ex *exchange, m *MockResponse) {
+	r := ex.inbound
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		p.writeProxyError(w, ex, http.StatusBadRequest, err)
+
+		return
+	}
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Route: ex.route.name, Message: ex.withGraphQL(newRawHTTPRequest(r, reqBody))})
+
+	data := bodyTemplateData{Body: string(reqBody), Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header}
+	_ = json.Unmarshal(reqBody, &data.JSON)
+
+	var body bytes.Buffer
+
+	if err := m.template.Execute(&body, data); err != nil {
+		p.writeProxyError(w, ex, http.StatusInternalServerError, fmt.Errorf("can't render the mock body: %w", err))
+
+		return
+	}
+
+	res := &http.Response{
+		Proto:      r.Proto,
+		Status:     fmt.Sprintf("%d %s", m.Status, http.StatusText(m.Status)),
+		StatusCode: m.Status,
+		Header:     http.Header{},
+	}
+
+	for name, value := range m.Headers {
+		res.Header.Set(name, value)
+	}
+
+	if res.Header.Get("Content-Type") == "" && body.Len() > 0 {
+		res.Header.Set("Content-Type", http.DetectContentType(body.Bytes()))
+	}
+
+	res.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Route: ex.route.name, Message: newRawHTTPResponse(res, body.Bytes())})
+
+	copyHeader(w.Header(), res.Header)
+	ex.rewrites.headers.applyResponse(r, w.Header())
+
+	w.WriteHeader(res.StatusCode)
+
+	_, _ = w.Write(body.Bytes())
+}
@@ -0,0 +1,856 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+var errOpenAPIViolation = errors.New("the OpenAPI spec is violated")
+
+// OpenAPIConfig validates the requests and their responses against the
+// OpenAPI 3 document in Spec, YAML or JSON: their path, method and
+// parameters, and their JSON bodies against the schemas. The violations are
+// logged, and with Enforce the invalid requests are rejected with 400 and
+// the invalid responses replaced with 502.
+type OpenAPIConfig struct {
+	Spec    string `yaml:"spec"`
+	Enforce bool   `yaml:"enforce"`
+}
+
+// openAPISpec is the part of an OpenAPI document that the exchanges are
+// validated against.
+type openAPISpec struct {
+	Servers []struct {
+		URL string `yaml:"url"`
+	} `yaml:"servers"`
+	Paths      map[string]*openAPIPathItem `yaml:"paths"`
+	Components struct {
+		Schemas       map[string]*jsonSchema         `yaml:"schemas"`
+		Parameters    map[string]*openAPIParameter   `yaml:"parameters"`
+		RequestBodies map[string]*openAPIRequestBody `yaml:"requestBodies"`
+		Responses     map[string]*openAPIResponse    `yaml:"responses"`
+	} `yaml:"components"`
+
+	basePath string
+	routes   []openAPIRoute
+}
+
+type openAPIPathItem struct {
+	Parameters []*openAPIParameter `yaml:"parameters"`
+	Get        *openAPIOperation   `yaml:"get"`
+	Put        *openAPIOperation   `yaml:"put"`
+	Post       *openAPIOperation   `yaml:"post"`
+	Delete     *openAPIOperation   `yaml:"delete"`
+	Options    *openAPIOperation   `yaml:"options"`
+	Head       *openAPIOperation   `yaml:"head"`
+	Patch      *openAPIOperation   `yaml:"patch"`
+	Trace      *openAPIOperation   `yaml:"trace"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter         `yaml:"parameters"`
+	RequestBody *openAPIRequestBody         `yaml:"requestBody"`
+	Responses   map[string]*openAPIResponse `yaml:"responses"`
+}
+
+type openAPIParameter struct {
+	Ref      string      `yaml:"$ref"`
+	Name     string      `yaml:"name"`
+	In       string      `yaml:"in"`
+	Required bool        `yaml:"required"`
+	Schema   *jsonSchema `yaml:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Ref      string                       `yaml:"$ref"`
+	Required bool                         `yaml:"required"`
+	Content  map[string]*openAPIMediaType `yaml:"content"`
+}
+
+type openAPIResponse struct {
+	Ref     string                       `yaml:"$ref"`
+	Content map[string]*openAPIMediaType `yaml:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `yaml:"schema"`
+}
+
+// openAPIRoute is a path of the spec, like /users/{id}, split on the
+// slashes.
+type openAPIRoute struct {
+	segments []string
+	item     *openAPIPathItem
+}
+
+// jsonSchema is the subset of JSON Schema the bodies and parameters are
+// validated against.
+type jsonSchema struct {
+	Ref                  string                 `yaml:"$ref"`
+	Type                 schemaTypes            `yaml:"type"`
+	Nullable             bool                   `yaml:"nullable"`
+	Enum                 []interface{}          `yaml:"enum"`
+	Format               string                 `yaml:"format"`
+	Properties           map[string]*jsonSchema `yaml:"properties"`
+	Required             []string               `yaml:"required"`
+	AdditionalProperties *additionalProperties  `yaml:"additionalProperties"`
+	Items                *jsonSchema            `yaml:"items"`
+	MinItems             *int                   `yaml:"minItems"`
+	MaxItems             *int                   `yaml:"maxItems"`
+	MinLength            *int                   `yaml:"minLength"`
+	MaxLength            *int                   `yaml:"maxLength"`
+	Pattern              string                 `yaml:"pattern"`
+	Minimum              *float64               `yaml:"minimum"`
+	Maximum              *float64               `yaml:"maximum"`
+	AllOf                []*jsonSchema          `yaml:"allOf"`
+	AnyOf                []*jsonSchema          `yaml:"anyOf"`
+	OneOf                []*jsonSchema          `yaml:"oneOf"`
+	ReadOnly             bool                   `yaml:"readOnly"`
+	WriteOnly            bool                   `yaml:"writeOnly"`
+
+	pattern *regexp.Regexp
+}
+
+func (s *jsonSchema) UnmarshalYAML(node *yaml.Node) error {
+	type plain jsonSchema
+
+	if err := node.Decode((*plain)(s)); err != nil {
+		return err
+	}
+
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+
+		s.pattern = pattern
+	}
+
+	return nil
+}
+
+// schemaTypes is the type of a schema, a list of them in OpenAPI 3.1.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = schemaTypes{node.Value}
+
+		return nil
+	}
+
+	return node.Decode((*[]string)(t))
+}
+
+// additionalProperties either allows the properties not listed or not, or
+// gives their schema.
+type additionalProperties struct {
+	allowed bool
+	schema  *jsonSchema
+}
+
+func (a *additionalProperties) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&a.allowed)
+	}
+
+	a.allowed = true
+
+	return node.Decode(&a.schema)
+}
+
+func loadOpenAPISpec(fileName string) (*openAPISpec, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &openAPISpec{}
+
+	if err := yaml.Unmarshal(content, spec); err != nil {
+		return nil, err
+	}
+
+	if len(spec.Paths) == 0 {
+		return nil, fmt.Errorf("no paths in %s", fileName)
+	}
+
+	// The paths are relative to the server URL, like https://host/v1.
+	if len(spec.Servers) > 0 {
+		if u, err := url.Parse(spec.Servers[0].URL); err == nil {
+			spec.basePath = strings.TrimSuffix(u.Path, "/")
+		}
+	}
+
+	for template, item := range spec.Paths {
+		spec.routes = append(spec.routes, openAPIRoute{segments: strings.Split(strings.Trim(template, "/"), "/"), item: item})
+	}
+
+	// The paths without parameters win over the templated ones.
+	sort.Slice(spec.routes, func(i, j int) bool {
+		return spec.routes[i].templated() < spec.routes[j].templated()
+	})
+
+	return spec, nil
+}
+
+func (r openAPIRoute) templated() int {
+	n := 0
+
+	for _, segment := range r.segments {
+		if strings.HasPrefix(segment, "{") {
+			n++
+		}
+	}
+
+	return n
+}
+
+// match finds the path of the spec for urlPath, with the values of its
+// parameters.
+func (s *openAPISpec) match(urlPath string) (*openAPIPathItem, map[string]string) {
+	urlPath = strings.TrimPrefix(urlPath, s.basePath)
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+
+	for _, route := range s.routes {
+		if len(route.segments) != len(segments) {
+			continue
+		}
+
+		params := make(map[string]string)
+		matched := true
+
+		for i, segment := range route.segments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				value, err := url.PathUnescape(segments[i])
+				if err != nil || value == "" {
+					matched = false
+
+					break
+				}
+
+				params[strings.Trim(segment, "{}")] = value
+			} else if segment != segments[i] {
+				matched = false
+
+				break
+			}
+		}
+
+		if matched {
+			return route.item, params
+		}
+	}
+
+	return nil, nil
+}
+
+func (item *openAPIPathItem) operation(method string) *openAPIOperation {
+	switch method {
+	case http.MethodGet:
+		return item.Get
+	case http.MethodPut:
+		return item.Put
+	case http.MethodPost:
+		return item.Post
+	case http.MethodDelete:
+		return item.Delete
+	case http.MethodOptions:
+		return item.Options
+	case http.MethodHead:
+		// A HEAD request is a GET without the body.
+		if item.Head == nil {
+			return item.Get
+		}
+
+		return item.Head
+	case http.MethodPatch:
+		return item.Patch
+	case http.MethodTrace:
+		return item.Trace
+	}
+
+	return nil
+}
+
+func (s *openAPISpec) componentName(ref, kind string) string {
+	return strings.TrimPrefix(ref, "#/components/"+kind+"/")
+}
+
+func (s *openAPISpec) schema(schema *jsonSchema) *jsonSchema {
+	// A chain of references can't be longer than the schemas, unless it
+	// loops.
+	for i := 0; schema != nil && schema.Ref != "" && i <= len(s.Components.Schemas); i++ {
+		schema = s.Components.Schemas[s.componentName(schema.Ref, "schemas")]
+	}
+
+	return schema
+}
+
+func (s *openAPISpec) parameter(param *openAPIParameter) *openAPIParameter {
+	if param.Ref != "" {
+		if resolved := s.Components.Parameters[s.componentName(param.Ref, "parameters")]; resolved != nil {
+			return resolved
+		}
+	}
+
+	return param
+}
+
+// validateRequest returns how the request breaks the spec, and the
+// operation it's for, if it's in the spec.
+func (s *openAPISpec) validateRequest(r *http.Request, body []byte) ([]string, *openAPIOperation) {
+	item, pathParams := s.match(r.URL.Path)
+	if item == nil {
+		return []string{fmt.Sprintf("the path %s isn't in the spec", r.URL.Path)}, nil
+	}
+
+	operation := item.operation(r.Method)
+	if operation == nil {
+		return []string{fmt.Sprintf("the method %s isn't allowed on %s", r.Method, r.URL.Path)}, nil
+	}
+
+	var violations []string
+
+	query := r.URL.Query()
+
+	for _, param := range s.parameters(item, operation) {
+		var values []string
+
+		switch param.In {
+		case "path":
+			if value, ok := pathParams[param.Name]; ok {
+				values = []string{value}
+			}
+		case "query":
+			values = query[param.Name]
+		case "header":
+			values = r.Header.Values(param.Name)
+		default:
+			continue
+		}
+
+		if len(values) == 0 {
+			if param.Required || param.In == "path" {
+				violations = append(violations, fmt.Sprintf("the %s parameter %s is missing", param.In, param.Name))
+			}
+
+			continue
+		}
+
+		violations = append(violations, s.validateParameter(param, values)...)
+	}
+
+	if requestBody := operation.RequestBody; requestBody != nil {
+		if requestBody.Ref != "" {
+			if resolved := s.Components.RequestBodies[s.componentName(requestBody.Ref, "requestBodies")]; resolved != nil {
+				requestBody = resolved
+			}
+		}
+
+		if len(body) == 0 {
+			if requestBody.Required {
+				violations = append(violations, "the request body is missing")
+			}
+		} else {
+			violations = append(violations, s.validateBody("request", r.Header.Get("Content-Type"), body, requestBody.Content)...)
+		}
+	}
+
+	return violations, operation
+}
+
+// parameters are those of the operation and those of its path that it
+// doesn't override.
+func (s *openAPISpec) parameters(item *openAPIPathItem, operation *openAPIOperation) []*openAPIParameter {
+	var params []*openAPIParameter
+
+	seen := make(map[string]bool)
+
+	for _, param := range operation.Parameters {
+		param = s.parameter(param)
+		seen[param.In+" "+param.Name] = true
+		params = append(params, param)
+	}
+
+	for _, param := range item.Parameters {
+		if param = s.parameter(param); !seen[param.In+" "+param.Name] {
+			params = append(params, param)
+		}
+	}
+
+	return params
+}
+
+// validateParameter checks the values of a parameter against its schema,
+// after converting them to its type.
+func (s *openAPISpec) validateParameter(param *openAPIParameter, values []string) []string {
+	schema := s.schema(param.Schema)
+	if schema == nil {
+		return nil
+	}
+
+	where := fmt.Sprintf("the %s parameter %s", param.In, param.Name)
+
+	var value interface{}
+
+	if schema.Type.has("array") {
+		// The path and header arrays are comma-separated, the query ones
+		// repeated.
+		if param.In != "query" {
+			values = strings.Split(values[0], ",")
+		}
+
+		items := make([]interface{}, len(values))
+
+		for i, raw := range values {
+			converted, ok := parameterValue(s.schema(schema.Items), raw)
+			if !ok {
+				return []string{fmt.Sprintf("%s has the invalid item %q", where, raw)}
+			}
+
+			items[i] = converted
+		}
+
+		value = items
+	} else {
+		converted, ok := parameterValue(schema, values[0])
+		if !ok {
+			return []string{fmt.Sprintf("%s must be %s, not %q", where, schema.Type, values[0])}
+		}
+
+		value = converted
+	}
+
+	var violations []string
+
+	s.validateValue(schema, value, where, "request", &violations)
+
+	return violations
+}
+
+// parameterValue converts a parameter to the type of its schema.
+func parameterValue(schema *jsonSchema, raw string) (interface{}, bool) {
+	switch {
+	case schema == nil:
+		return raw, true
+	case schema.Type.has("integer"):
+		_, err := strconv.ParseInt(raw, 10, 64)
+
+		return json.Number(raw), err == nil
+	case schema.Type.has("number"):
+		_, err := strconv.ParseFloat(raw, 64)
+
+		return json.Number(raw), err == nil
+	case schema.Type.has("boolean"):
+		b, err := strconv.ParseBool(raw)
+
+		return b, err == nil && (raw == "true" || raw == "false")
+	}
+
+	return raw, true
+}
+
+// validateResponse returns how the response of the operation breaks the
+// spec.
+func (s *openAPISpec) validateResponse(operation *openAPIOperation, method string, status int, header http.Header, body []byte) []string {
+	code := strconv.Itoa(status)
+
+	response := operation.Responses[code]
+	if response == nil {
+		response = operation.Responses[code[:1]+"XX"]
+	}
+
+	if response == nil {
+		response = operation.Responses[code[:1]+"xx"]
+	}
+
+	if response == nil {
+		response = operation.Responses["default"]
+	}
+
+	if response == nil {
+		return []string{fmt.Sprintf("the status %d isn't documented", status)}
+	}
+
+	if response.Ref != "" {
+		if resolved := s.Components.Responses[s.componentName(response.Ref, "responses")]; resolved != nil {
+			response = resolved
+		}
+	}
+
+	if len(response.Content) == 0 || method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified {
+		return nil
+	}
+
+	if len(body) == 0 {
+		return []string{"the response body is missing"}
+	}
+
+	if decoded, _, ok := decodeBody(header.Get("Content-Encoding"), body); ok {
+		body = decoded
+	}
+
+	return s.validateBody("response", header.Get("Content-Type"), body, response.Content)
+}
+
+// validateBody checks that the body has one of the content types, and its
+// schema if it's JSON.
+func (s *openAPISpec) validateBody(direction, contentType string, body []byte, content map[string]*openAPIMediaType) []string {
+	if len(content) == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return []string{fmt.Sprintf("the %s Content-Type %q is invalid", direction, contentType)}
+	}
+
+	media, ok := content[mediaType]
+	if !ok {
+		media, ok = content[strings.SplitN(mediaType, "/", 2)[0]+"/*"]
+	}
+
+	if !ok {
+		media, ok = content["*/*"]
+	}
+
+	if !ok {
+		return []string{fmt.Sprintf("the %s Content-Type %s isn't allowed", direction, mediaType)}
+	}
+
+	schema := s.schema(media.Schema)
+	if schema == nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	var value interface{}
+
+	// The numbers are kept as they are, those too big for a float64 being
+	// valid JSON too.
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&value); err != nil {
+		return []string{fmt.Sprintf("the %s body isn't valid JSON: %v", direction, err)}
+	}
+
+	var violations []string
+
+	s.validateValue(schema, value, direction+" body", direction, &violations)
+
+	return violations
+}
+
+// validateValue appends to violations how value, decoded from JSON, breaks
+// schema, at is telling where it is. The read-only properties aren't
+// required in the requests, nor the write-only ones in the responses.
+func (s *openAPISpec) validateValue(schema *jsonSchema, value interface{}, at, direction string, violations *[]string) {
+	schema = s.schema(schema)
+	if schema == nil {
+		return
+	}
+
+	if value == nil && (schema.Nullable || schema.Type.has("null")) {
+		return
+	}
+
+	if len(schema.Type) > 0 && !schema.Type.matches(value) {
+		*violations = append(*violations, fmt.Sprintf("%s must be %s, not %s", at, schema.Type, jsonType(value)))
+
+		return
+	}
+
+	if len(schema.Enum) > 0 && !enumContains(schema.Enum, value) {
+		*violations = append(*violations, fmt.Sprintf("%s must be one of %s", at, jsonText(schema.Enum)))
+	}
+
+	for _, sub := range schema.AllOf {
+		s.validateValue(sub, value, at, direction, violations)
+	}
+
+	if len(schema.AnyOf) > 0 && s.matching(schema.AnyOf, value, direction) == 0 {
+		*violations = append(*violations, fmt.Sprintf("%s matches none of the anyOf schemas", at))
+	}
+
+	if len(schema.OneOf) > 0 {
+		if n := s.matching(schema.OneOf, value, direction); n != 1 {
+			*violations = append(*violations, fmt.Sprintf("%s matches %d of the oneOf schemas instead of 1", at, n))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		s.validateString(schema, v, at, violations)
+	case json.Number:
+		n, _ := v.Float64()
+
+		if schema.Minimum != nil && n < *schema.Minimum {
+			*violations = append(*violations, fmt.Sprintf("%s must be at least %v", at, *schema.Minimum))
+		}
+
+		if schema.Maximum != nil && n > *schema.Maximum {
+			*violations = append(*violations, fmt.Sprintf("%s must be at most %v", at, *schema.Maximum))
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(v) < *schema.MinItems {
+			*violations = append(*violations, fmt.Sprintf("%s must have at least %d items", at, *schema.MinItems))
+		}
+
+		if schema.MaxItems != nil && len(v) > *schema.MaxItems {
+			*violations = append(*violations, fmt.Sprintf("%s must have at most %d items", at, *schema.MaxItems))
+		}
+
+		if schema.Items != nil {
+			for i, item := range v {
+				s.validateValue(schema.Items, item, jsonPath(at, fmt.Sprintf("[%d]", i)), direction, violations)
+			}
+		}
+	case map[string]interface{}:
+		s.validateObject(schema, v, at, direction, violations)
+	}
+}
+
+func (s *openAPISpec) validateString(schema *jsonSchema, value, at string, violations *[]string) {
+	length := utf8.RuneCountInString(value)
+
+	if schema.MinLength != nil && length < *schema.MinLength {
+		*violations = append(*violations, fmt.Sprintf("%s must be at least %d characters long", at, *schema.MinLength))
+	}
+
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		*violations = append(*violations, fmt.Sprintf("%s must be at most %d characters long", at, *schema.MaxLength))
+	}
+
+	if schema.pattern != nil && !schema.pattern.MatchString(value) {
+		*violations = append(*violations, fmt.Sprintf("%s must match %s", at, schema.Pattern))
+	}
+
+	if !matchesFormat(schema.Format, value) {
+		*violations = append(*violations, fmt.Sprintf("%s must be a valid %s, not %q", at, schema.Format, value))
+	}
+}
+
+func (s *openAPISpec) validateObject(schema *jsonSchema, value map[string]interface{}, at, direction string, violations *[]string) {
+	for _, name := range schema.Required {
+		if _, ok := value[name]; ok {
+			continue
+		}
+
+		if property := s.schema(schema.Properties[name]); property != nil &&
+			((direction == "request" && property.ReadOnly) || (direction == "response" && property.WriteOnly)) {
+			continue
+		}
+
+		*violations = append(*violations, fmt.Sprintf("%s lacks the required property %s", at, name))
+	}
+
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		where := jsonPath(at, "."+name)
+
+		if property, ok := schema.Properties[name]; ok {
+			s.validateValue(property, value[name], where, direction, violations)
+
+			continue
+		}
+
+		if extra := schema.AdditionalProperties; extra != nil {
+			if !extra.allowed {
+				*violations = append(*violations, fmt.Sprintf("%s isn't allowed", where))
+			} else if extra.schema != nil {
+				s.validateValue(extra.schema, value[name], where, direction, violations)
+			}
+		}
+	}
+}
+
+// matching counts the schemas that value matches.
+func (s *openAPISpec) matching(schemas []*jsonSchema, value interface{}, direction string) int {
+	n := 0
+
+	for _, schema := range schemas {
+		var violations []string
+
+		if s.validateValue(schema, value, "", direction, &violations); len(violations) == 0 {
+			n++
+		}
+	}
+
+	return n
+}
+
+// jsonPath is the path of a value within the body at, like body $.items[2],
+// as printed by the comparisons.
+func jsonPath(at, suffix string) string {
+	if !strings.Contains(at, "$") {
+		at += " $"
+	}
+
+	return at + suffix
+}
+
+func (t schemaTypes) has(name string) bool {
+	for _, candidate := range t {
+		if candidate == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t schemaTypes) matches(value interface{}) bool {
+	actual := jsonType(value)
+
+	for _, candidate := range t {
+		if candidate == actual || (candidate == "number" && actual == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t schemaTypes) String() string {
+	return strings.Join(t, " or ")
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if !strings.ContainsAny(string(v), ".eE") {
+			return "integer"
+		}
+
+		if n, err := v.Float64(); err == nil && n == math.Trunc(n) {
+			return "integer"
+		}
+
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func enumContains(enum []interface{}, value interface{}) bool {
+	text := jsonText(value)
+
+	for _, candidate := range enum {
+		if jsonText(candidate) == text {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonText is value as JSON, to compare the values decoded from YAML with
+// those from JSON.
+func jsonText(value interface{}) string {
+	text, _ := json.Marshal(value)
+
+	return string(text)
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// matchesFormat checks the common string formats, the others being
+// accepted.
+func matchesFormat(format, value string) bool {
+	var err error
+
+	switch format {
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, value)
+	case "date":
+		_, err = time.Parse("2006-01-02", value)
+	case "email":
+		_, err = mail.ParseAddress(value)
+	case "uuid":
+		return uuidPattern.MatchString(value)
+	case "ipv4":
+		return net.ParseIP(value) != nil && strings.Contains(value, ".")
+	case "ipv6":
+		return net.ParseIP(value) != nil && strings.Contains(value, ":")
+	case "uri":
+		var u *url.URL
+		u, err = url.Parse(value)
+
+		return err == nil && u.Scheme != ""
+	}
+
+	return err == nil
+}
+
+// checkOpenAPIRequest validates the request of ex, logging the violations,
+// which fail it if the spec is enforced.
+func (p *Proxy) checkOpenAPIRequest(ex *exchange, r *http.Request, body []byte) error {
+	violations, operation := p.openAPI.validateRequest(r, body)
+	ex.operation = operation
+
+	return p.openAPIViolations(fmt.Sprintf("Exchange #%d %s %s", ex.id, r.Method, r.URL.Path), violations)
+}
+
+// checkOpenAPIResponse validates the response of ex, if its request is in
+// the spec.
+func (p *Proxy) checkOpenAPIResponse(ex *exchange, res *http.Response, body []byte) error {
+	if ex.operation == nil {
+		return nil
+	}
+
+	violations := p.openAPI.validateResponse(ex.operation, ex.inbound.Method, res.StatusCode, res.Header, body)
+
+	return p.openAPIViolations(fmt.Sprintf("The response %d to exchange #%d %s %s", res.StatusCode, ex.id, ex.inbound.Method, ex.inbound.URL.Path), violations)
+}
+
+func (p *Proxy) openAPIViolations(what string, violations []string) error {
+	if len(violations) == 0 {
+		return nil
+	}
+
+	log.Printf("%s breaks the OpenAPI spec:\n  %s", what, strings.Join(violations, "\n  "))
+
+	if !p.cfg.OpenAPI.Enforce {
+		return nil
+	}
+
+	if len(violations) > 1 {
+		return fmt.Errorf("%w: %s (and %d more)", errOpenAPIViolation, violations[0], len(violations)-1)
+	}
+
+	return fmt.Errorf("%w: %s", errOpenAPIViolation, violations[0])
+}
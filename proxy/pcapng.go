@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// pcapLinkTypeRaw is the link type of packets starting with their IP
+	// header, without an Ethernet one.
+	pcapLinkTypeRaw = 101
+
+	pcapMaxSegment = 1460
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+var (
+	pcapClientIP = net.IPv4(10, 0, 0, 1).To4()
+	pcapServerIP = net.IPv4(10, 0, 0, 2).To4()
+)
+
+// pcapngWriter writes exchanges as a pcapng file, each one over a TCP
+// connection of its own made up from the HTTP/1.1 messages, so that
+// Wireshark and the other packet analyzers can dissect the captures.
+type pcapngWriter struct {
+	w          io.Writer
+	serverPort uint16
+	err        error
+}
+
+func newPCAPNGWriter(w io.Writer, baseURL string) *pcapngWriter {
+	p := &pcapngWriter{w: w, serverPort: 80}
+
+	if u, err := url.Parse(baseURL); err == nil {
+		if port, err := strconv.ParseUint(u.Port(), 10, 16); err == nil {
+			p.serverPort = uint16(port)
+		}
+	}
+
+	// The section header block, then the description of the interface.
+	p.block(0x0a0d0d0a, func(b *bytes.Buffer) {
+		_ = binary.Write(b, binary.LittleEndian, uint32(0x1a2b3c4d))
+		_ = binary.Write(b, binary.LittleEndian, uint16(1))
+		_ = binary.Write(b, binary.LittleEndian, uint16(0))
+		_ = binary.Write(b, binary.LittleEndian, int64(-1))
+	})
+
+	p.block(0x00000001, func(b *bytes.Buffer) {
+		_ = binary.Write(b, binary.LittleEndian, uint16(pcapLinkTypeRaw))
+		_ = binary.Write(b, binary.LittleEndian, uint16(0))
+		_ = binary.Write(b, binary.LittleEndian, uint32(0))
+	})
+
+	return p
+}
+
+func (p *pcapngWriter) block(blockType uint32, body func(b *bytes.Buffer)) {
+	if p.err != nil {
+		return
+	}
+
+	var b bytes.Buffer
+
+	body(&b)
+
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+
+	length := uint32(b.Len() + 12)
+
+	var block bytes.Buffer
+
+	_ = binary.Write(&block, binary.LittleEndian, blockType)
+	_ = binary.Write(&block, binary.LittleEndian, length)
+	block.Write(b.Bytes())
+	_ = binary.Write(&block, binary.LittleEndian, length)
+
+	_, p.err = p.w.Write(block.Bytes())
+}
+
+// writeExchange writes the exchange #n, from the client port 10000+n, the
+// request being sent at the start of the exchange and the response at its
+// end.
+func (p *pcapngWriter) writeExchange(n int, host string, req, res LogEntry) error {
+	conn := &pcapTCPConn{
+		w:          p,
+		clientPort: uint16(10000 + n%50000),
+		serverPort: p.serverPort,
+		clientSeq:  1000,
+		serverSeq:  5000,
+	}
+
+	start, end := req.Timestamp, res.Timestamp
+
+	conn.packet(start, true, tcpSYN, nil)
+	conn.packet(start, false, tcpSYN|tcpACK, nil)
+	conn.packet(start, true, tcpACK, nil)
+	conn.send(start, true, wireRequest(req.Message, host))
+	conn.send(end, false, wireResponse(res.Message, req.Message.Method))
+	conn.packet(end, false, tcpFIN|tcpACK, nil)
+	conn.packet(end, true, tcpFIN|tcpACK, nil)
+	conn.packet(end, false, tcpACK, nil)
+
+	return p.err
+}
+
+type pcapTCPConn struct {
+	w                      *pcapngWriter
+	clientPort, serverPort uint16
+	clientSeq, serverSeq   uint32
+}
+
+func (c *pcapTCPConn) send(t time.Time, fromClient bool, data []byte) {
+	for len(data) > 0 {
+		size := len(data)
+		if size > pcapMaxSegment {
+			size = pcapMaxSegment
+		}
+
+		c.packet(t, fromClient, tcpPSH|tcpACK, data[:size])
+		data = data[size:]
+	}
+
+	c.packet(t, !fromClient, tcpACK, nil)
+}
+
+// packet writes a TCP segment in an enhanced packet block, advancing the
+// sequence number of its sender.
+func (c *pcapTCPConn) packet(t time.Time, fromClient bool, flags byte, payload []byte) {
+	srcIP, dstIP := pcapClientIP, pcapServerIP
+	srcPort, dstPort := c.clientPort, c.serverPort
+	seq, ack := &c.clientSeq, c.serverSeq
+
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &c.serverSeq, c.clientSeq
+	}
+
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+
+	pseudo := make([]byte, 12, 12+len(tcp))
+	copy(pseudo[0:], srcIP)
+	copy(pseudo[4:], dstIP)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(append(pseudo, tcp...)))
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], srcIP)
+	copy(ip[16:], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip))
+	ip = append(ip, tcp...)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		*seq++
+	}
+
+	micros := uint64(t.UnixMicro())
+
+	c.w.block(0x00000006, func(b *bytes.Buffer) {
+		_ = binary.Write(b, binary.LittleEndian, uint32(0))
+		_ = binary.Write(b, binary.LittleEndian, uint32(micros>>32))
+		_ = binary.Write(b, binary.LittleEndian, uint32(micros))
+		_ = binary.Write(b, binary.LittleEndian, uint32(len(ip)))
+		_ = binary.Write(b, binary.LittleEndian, uint32(len(ip)))
+		b.Write(ip)
+	})
+}
+
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// wireRequest writes a recorded request as HTTP/1.1, with the Host header
+// that isn't recorded.
+func wireRequest(msg *Message, host string) []byte {
+	header := msg.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+
+	header.Set("Host", host)
+	header.Del("Transfer-Encoding")
+
+	if len(msg.Body) > 0 {
+		header.Set("Content-Length", strconv.Itoa(len(msg.Body)))
+	}
+
+	return []byte(msg.Method + " " + msg.URL + " HTTP/1.1\r\n" + rawHeaders(header) + "\r\n" + string(msg.Body))
+}
+
+// wireResponse writes a recorded response as HTTP/1.1, with the length of
+// its body, which may have been chunked.
+func wireResponse(msg *Message, method string) []byte {
+	header := msg.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+
+	header.Del("Transfer-Encoding")
+
+	if method != http.MethodHead {
+		header.Set("Content-Length", strconv.Itoa(len(msg.Body)))
+	}
+
+	return []byte("HTTP/1.1 " + msg.Status + "\r\n" + rawHeaders(header) + "\r\n" + string(msg.Body))
+}
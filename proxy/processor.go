@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var errProcessorFailed = errors.New("external processor failed")
+
+// maxProcessorReply limits the replies of the external processors.
+const maxProcessorReply = 64 << 20
+
+// ProcessorConfig sends the exchanges matching Match to an external
+// processor, a server of its own that filters them: the proxy posts it
+// every request, and its response too with Response, as JSON, and the
+// processor answers with the changes to make, or with the response to give
+// the client instead of forwarding the request. A processor that fails, or
+// doesn't answer within Timeout, fails the exchange with a 502, unless
+// FailOpen lets it go on unchanged.
+type ProcessorConfig struct {
+	URL      string        `yaml:"url"`
+	Match    RequestMatch  `yaml:"match"`
+	Response bool          `yaml:"response"`
+	Timeout  time.Duration `yaml:"timeout"`
+	FailOpen bool          `yaml:"fail_open"`
+
+	client *http.Client
+}
+
+func (c *ProcessorConfig) compile() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid processor URL %q, which must be like http://host:port/path", c.URL)
+	}
+
+	if err := c.Match.compile(); err != nil {
+		return err
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+
+	c.client = &http.Client{Timeout: c.Timeout}
+
+	return nil
+}
+
+// processorMessage is a request or a response as the processors see them,
+// the body being base64 if body_encoding says so. In the replies, the
+// fields left out are kept.
+type processorMessage struct {
+	Method       string      `json:"method,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	Header       http.Header `json:"headers,omitempty"`
+	Body         *string     `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+// processorCall is what the processors are posted, with the response in
+// the response phase.
+type processorCall struct {
+	Phase     string            `json:"phase"`
+	ID        uint64            `json:"id"`
+	RequestID string            `json:"request_id,omitempty"`
+	Route     string            `json:"route"`
+	Upstream  string            `json:"upstream"`
+	Request   processorMessage  `json:"request"`
+	Response  *processorMessage `json:"response,omitempty"`
+}
+
+// processorReply is the answer of a processor. In the request phase,
+// Request edits the forwarded request and Response answers the client
+// without forwarding it; in the response phase, Response edits the
+// response. An empty reply changes nothing.
+type processorReply struct {
+	Request  *processorMessage `json:"request"`
+	Response *processorMessage `json:"response"`
+}
+
+// processorAnswer is the response a processor gave instead of forwarding
+// the request.
+type processorAnswer struct {
+	res  *http.Response
+	body []byte
+}
+
+func newProcessorMessage(body []byte) processorMessage {
+	text, encoding := harBody(body)
+
+	return processorMessage{Body: &text, BodyEncoding: encoding}
+}
+
+func (m *processorMessage) body() ([]byte, error) {
+	if m.BodyEncoding == "base64" {
+		return base64.StdEncoding.DecodeString(*m.Body)
+	}
+
+	return []byte(*m.Body), nil
+}
+
+// call posts the exchange to the processor.
+func (c *ProcessorConfig) call(call *processorCall) (*processorReply, error) {
+	payload, err := json.Marshal(call)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.client.Post(c.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxProcessorReply))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("%s answered %s", c.URL, res.Status)
+	}
+
+	var reply processorReply
+
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &reply); err != nil {
+			return nil, fmt.Errorf("invalid reply from %s: %w", c.URL, err)
+		}
+	}
+
+	return &reply, nil
+}
+
+func newProcessorCall(ex *exchange, phase string) *processorCall {
+	return &processorCall{Phase: phase, ID: ex.id, RequestID: ex.requestID, Route: ex.route.displayName(), Upstream: ex.upstream}
+}
+
+// processRequest runs the request through the processors matching it,
+// returning it as it must be forwarded, or the answer of a processor.
+func (p *Proxy) processRequest(ex *exchange, req *http.Request, body []byte) (*http.Request, []byte, *processorAnswer, error) {
+	for i := range p.cfg.Processors {
+		c := &p.cfg.Processors[i]
+		if !c.Match.matches(ex.inbound) {
+			continue
+		}
+
+		call := newProcessorCall(ex, "request")
+		call.Request = newProcessorMessage(body)
+		call.Request.Method, call.Request.URL, call.Request.Header = req.Method, req.URL.String(), req.Header
+
+		reply, err := c.call(call)
+		if err != nil {
+			if c.FailOpen {
+				continue
+			}
+
+			return nil, nil, nil, fmt.Errorf("%w: %v", errProcessorFailed, err)
+		}
+
+		if reply.Response != nil {
+			answer, err := newProcessorAnswer(ex.inbound, reply.Response)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%w: %s: %v", errProcessorFailed, c.URL, err)
+			}
+
+			return req, body, answer, nil
+		}
+
+		if reply.Request != nil {
+			edit := interceptEdit{Method: reply.Request.Method, URL: reply.Request.URL, Header: reply.Request.Header}
+
+			if reply.Request.Body != nil {
+				edited, err := reply.Request.body()
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("%w: %s: invalid body: %v", errProcessorFailed, c.URL, err)
+				}
+
+				text := string(edited)
+				edit.Body = &text
+			}
+
+			if req, body, err = edit.apply(req, body); err != nil {
+				return nil, nil, nil, fmt.Errorf("%w: %s: %v", errProcessorFailed, c.URL, err)
+			}
+		}
+	}
+
+	return req, body, nil, nil
+}
+
+func newProcessorAnswer(r *http.Request, m *processorMessage) (*processorAnswer, error) {
+	status := m.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if status < 100 || status > 999 {
+		return nil, fmt.Errorf("invalid status %d", status)
+	}
+
+	var body []byte
+
+	if m.Body != nil {
+		var err error
+
+		if body, err = m.body(); err != nil {
+			return nil, fmt.Errorf("invalid body: %w", err)
+		}
+	}
+
+	res := &http.Response{
+		Proto:      r.Proto,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Header:     m.Header,
+	}
+
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &processorAnswer{res: res, body: body}, nil
+}
+
+// processResponse runs the response through the processors matching its
+// request that see the responses, returning its body as it must be
+// written.
+func (p *Proxy) processResponse(ex *exchange, res *http.Response, body []byte) ([]byte, error) {
+	req := res.Request
+	if req == nil {
+		req = ex.inbound
+	}
+
+	for i := range p.cfg.Processors {
+		c := &p.cfg.Processors[i]
+		if !c.Response || !c.Match.matches(ex.inbound) {
+			continue
+		}
+
+		call := newProcessorCall(ex, "response")
+		call.Request = newProcessorMessage(ex.reqBody)
+		call.Request.Method, call.Request.URL, call.Request.Header = req.Method, req.URL.String(), req.Header
+
+		response := newProcessorMessage(body)
+		response.Status, response.Header = res.StatusCode, res.Header
+		call.Response = &response
+
+		reply, err := c.call(call)
+		if err != nil {
+			if c.FailOpen {
+				continue
+			}
+
+			return nil, fmt.Errorf("%w: %v", errProcessorFailed, err)
+		}
+
+		if reply.Response == nil {
+			continue
+		}
+
+		if status := reply.Response.Status; status != 0 {
+			res.StatusCode, res.Status = status, fmt.Sprintf("%d %s", status, http.StatusText(status))
+		}
+
+		if reply.Response.Header != nil {
+			res.Header = reply.Response.Header
+		}
+
+		if reply.Response.Body != nil {
+			if body, err = reply.Response.body(); err != nil {
+				return nil, fmt.Errorf("%w: %s: invalid body: %v", errProcessorFailed, c.URL, err)
+			}
+		}
+
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	return body, nil
+}
+
+// writeProcessorAnswer gives the client the response of a processor
+// instead of the upstream's.
+func (p *Proxy) writeProcessorAnswer(w http.ResponseWriter, ex *exchange, answer *processorAnswer) {
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Message: newRawHTTPResponse(answer.res, answer.body)})
+
+	copyHeader(w.Header(), answer.res.Header)
+	ex.rewrites.headers.applyResponse(ex.inbound, w.Header())
+
+	w.WriteHeader(answer.res.StatusCode)
+
+	_, _ = w.Write(answer.body)
+}
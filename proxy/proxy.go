@@ -0,0 +1,1199 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Proxy forwards the requests it receives to the configured upstream servers,
+// logging every exchange.
+type Proxy struct {
+	lastID atomic.Uint64
+	conns  connStats
+	stats  proxyStats
+
+	cfg         *Config
+	routesMu    sync.RWMutex
+	routes      *routeTable
+	rewrites    *rewriteRules
+	config      *Config
+	cache       *responseCache
+	limiter     *rateLimiter
+	concurrency *concurrencyLimiter
+	acl         *acl
+	recorder    *recorder
+	replay      *replayStore
+	openAPI     *openAPISpec
+	graphQL     *graphQL
+	security    *securityHeaders
+	collapser   *collapser
+	duplicates  *duplicateTracker
+	errorPages  *errorPages
+	certs       *certReloader
+	acme        *acmeManager
+	interceptor *interceptor
+	traffic     *trafficStore
+	mitm        *mitm
+	health      *healthChecker
+	tracer      *tracer
+	client      *http.Client
+	handler     http.Handler
+	logger      Logger
+	server      *http.Server
+	admin       *http.Server
+	challenges  *http.Server
+	mirrors     chan struct{}
+
+	// loggingPaused is set to 1 when the logging is paused at the admin API.
+	loggingPaused atomic.Uint32
+
+	maintenanceMu sync.RWMutex
+	maintenance   MaintenanceConfig
+}
+
+type exchange struct {
+	id        uint64
+	inbound   *http.Request
+	reqBody   []byte
+	route     *route
+	upstream  string
+	requestID string
+	started   time.Time
+	span      *span
+	mock      *MockResponse
+	answer    *processorAnswer
+	budgets   *timeoutBudgets
+	operation *openAPIOperation
+	graphQL   []GraphQLOperation
+	trace     *upstreamTrace
+
+	// rewrites are the rewrite rules when the exchange started, which it
+	// keeps through a reload.
+	rewrites *rewriteRules
+
+	// stale is the cached response served if the upstream fails.
+	stale *cachedResponse
+
+	comparison *comparison
+}
+
+var replayRoute = &route{name: "replay"}
+
+// forwardProxyRoute is the route of the requests to arbitrary hosts in
+// forward proxy mode, logged by host.
+var forwardProxyRoute = &route{}
+
+// New validates the configuration and creates a proxy for it. Unless
+// cfg.Logger is set, the exchanges are logged to files in cfg.Log.Dir.
+func New(cfg Config) (*Proxy, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Admin.Token == "" {
+		cfg.Admin.Token = newAdminToken()
+
+		if cfg.Admin.Port > 0 {
+			log.Printf("Generated the admin token %s, which the admin requests must carry", cfg.Admin.Token)
+		}
+	}
+
+	p := &Proxy{
+		cfg:      &cfg,
+		config:   &cfg,
+		routes:   newRouteTable(cfg.routeConfigs(), cfg.Weights),
+		rewrites: newRewriteRules(&cfg),
+		logger:   cfg.Logger,
+		stats:    proxyStats{started: time.Now()},
+
+		maintenance: cfg.Maintenance,
+	}
+
+	transport, err := newTransport(&cfg, &p.conns)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CookieJar != "" {
+		transport = newCookieJarTransport(transport, cfg.CookieJar)
+	}
+
+	p.client = &http.Client{
+		Transport: chainUpstreamMiddleware(transport, cfg.UpstreamMiddleware),
+		Timeout:   cfg.Timeouts.Request,
+	}
+
+	if cfg.HealthCheck.Path != "" {
+		p.health = newHealthChecker(cfg.HealthCheck, p.client.Transport)
+
+		for _, rt := range p.routes.routes {
+			rt.upstreams.watchHealth(p.health)
+		}
+
+		p.health.start()
+	}
+
+	p.handler = chainMiddleware(http.HandlerFunc(p.serveHTTP), cfg.Middleware)
+
+	if cfg.RateLimit.Rate > 0 {
+		p.limiter = newRateLimiter(cfg.RateLimit)
+	}
+
+	if cfg.Concurrency.PerClient > 0 || cfg.Concurrency.Total > 0 {
+		p.concurrency = newConcurrencyLimiter(cfg.Concurrency)
+	}
+
+	p.security = newSecurityHeaders(cfg.SecurityHeaders)
+	p.collapser = newCollapser()
+
+	if cfg.Log.DuplicateWindow > 0 {
+		p.duplicates = newDuplicateTracker(cfg.Log.DuplicateWindow)
+	}
+
+	if len(cfg.GraphQL.Paths) > 0 {
+		p.graphQL = newGraphQL(cfg.GraphQL)
+	}
+
+	if cfg.Tracing.Endpoint != "" {
+		p.tracer = newTracer(cfg.Tracing)
+	}
+
+	if cfg.Mirror.Upstream != "" {
+		p.mirrors = make(chan struct{}, maxMirroredRequests)
+	}
+
+	acl, err := newACL(cfg.ACL)
+	if err != nil {
+		return nil, err
+	}
+
+	p.acl = acl
+
+	if cfg.Cache.Size > 0 && !cfg.Stream {
+		cache, err := newResponseCache(cfg.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the cache directory: %w", err)
+		}
+
+		p.cache = cache
+	}
+
+	if cfg.Admin.Port > 0 && cfg.Admin.History > 0 {
+		p.traffic = newTrafficStore(cfg.Admin.History, cfg.Log.Decode)
+	}
+
+	if len(cfg.Intercept) > 0 {
+		p.interceptor = newInterceptor(cfg.Intercept, cfg.Timeouts.Intercept)
+	}
+
+	if cfg.MITM.Enabled {
+		m, err := loadMITM(cfg.MITM)
+		if err != nil {
+			return nil, err
+		}
+
+		p.mitm = m
+	}
+
+	if files := cfg.TLS.certificates(); len(files) > 0 {
+		certs, err := newCertReloader(files)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the TLS certificate: %w", err)
+		}
+
+		p.certs = certs
+	}
+
+	if len(cfg.TLS.ACME.Hosts) > 0 {
+		acme, err := newACMEManager(cfg.TLS.ACME)
+		if err != nil {
+			return nil, err
+		}
+
+		p.acme = acme
+	}
+
+	if cfg.Replay != "" {
+		replay, err := loadReplayStore(cfg.Replay, cfg.ReplayMatchBody)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the recorded exchanges: %w", err)
+		}
+
+		p.replay = replay
+	}
+
+	errorPages, err := loadErrorPages(cfg.ErrorPages)
+	if err != nil {
+		return nil, fmt.Errorf("can't load the error pages: %w", err)
+	}
+
+	p.errorPages = errorPages
+
+	if cfg.OpenAPI.Spec != "" {
+		spec, err := loadOpenAPISpec(cfg.OpenAPI.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the OpenAPI spec: %w", err)
+		}
+
+		p.openAPI = spec
+	}
+
+	if cfg.Record != "" {
+		recorder, err := newRecorder(cfg.Record)
+		if err != nil {
+			return nil, fmt.Errorf("can't open the record file: %w", err)
+		}
+
+		p.recorder = recorder
+	}
+
+	if p.logger == nil {
+		p.logger = NewFileLogger(cfg.Log)
+	}
+
+	return p, nil
+}
+
+// Handler returns the proxy as an http.Handler, to be served by a server
+// other than the one started by ListenAndServe.
+func (p *Proxy) Handler() http.Handler {
+	return p.handler
+}
+
+// ListenAndServe serves the proxy on the configured port, or the Listen
+// addresses, with TLS if a certificate or ACME hosts were configured, and
+// the admin API if its port is set. Without TLS, HTTP/2 clients are served over h2c. It
+// returns http.ErrServerClosed after Shutdown.
+func (p *Proxy) ListenAndServe() error {
+	if p.cfg.Admin.Port > 0 {
+		if err := p.listenAdmin(); err != nil {
+			return err
+		}
+	}
+
+	listeners, err := p.cfg.listen()
+	if err != nil {
+		return err
+	}
+
+	timeouts := p.cfg.Timeouts
+
+	p.server = &http.Server{
+		Handler:           p.handler,
+		MaxHeaderBytes:    int(p.cfg.Limits.Header),
+		ReadHeaderTimeout: timeouts.ClientReadHeader,
+		ReadTimeout:       timeouts.ClientRead,
+		WriteTimeout:      timeouts.ClientWrite,
+		IdleTimeout:       timeouts.ClientIdle,
+	}
+
+	on := fmt.Sprintf("port %d", p.cfg.Port)
+	if len(p.cfg.Listen) > 0 {
+		on = strings.Join(p.cfg.Listen, ", ")
+	}
+
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	if p.certs != nil {
+		getCertificate = p.certs.getCertificate
+	}
+
+	if p.acme != nil {
+		if err := p.listenChallenges(listeners[0]); err != nil {
+			closeListeners(listeners)
+
+			return err
+		}
+
+		getCertificate = p.acme.getCertificate
+	}
+
+	if getCertificate != nil {
+		p.server.TLSConfig = &tls.Config{GetCertificate: getCertificate}
+
+		log.Printf("Starting TLS server on %s\n\n", on)
+
+		return serveListeners(listeners, func(ln net.Listener) error {
+			return p.server.ServeTLS(ln, "", "")
+		})
+	}
+
+	p.server.Handler = h2c.NewHandler(p.handler, &http2.Server{IdleTimeout: timeouts.ClientIdle})
+
+	log.Printf("Starting server on %s\n\n", on)
+
+	return serveListeners(listeners, p.server.Serve)
+}
+
+// ReloadTLS reads the certificate and key files again, keeping the current
+// pairs if one is invalid. Active connections are not affected.
+func (p *Proxy) ReloadTLS() error {
+	if p.certs == nil {
+		return errors.New("the proxy is not serving TLS")
+	}
+
+	return p.certs.reload()
+}
+
+// Reload replaces the routes, upstreams, rewrite rules of the headers,
+// query and bodies, and scripts with those of cfg, the other settings
+// being kept. The requests in flight finish with the old ones. If cfg is
+// invalid, the current ones are kept.
+func (p *Proxy) Reload(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	routes := newRouteTable(cfg.routeConfigs(), cfg.Weights)
+	rewrites := newRewriteRules(&cfg)
+
+	if p.health != nil {
+		for _, rt := range routes.routes {
+			rt.upstreams.watchHealth(p.health)
+		}
+	}
+
+	p.routesMu.Lock()
+	old := p.routes
+	p.routes, p.rewrites = routes, rewrites
+
+	config := *p.config
+	config.Upstreams, config.Routes, config.Balance, config.Weights = cfg.Upstreams, cfg.Routes, cfg.Balance, cfg.Weights
+	config.Headers, config.Query, config.BodyRules = cfg.Headers, cfg.Query, cfg.BodyRules
+	config.Scripts, config.scripts = cfg.Scripts, cfg.scripts
+	p.config = &config
+	p.routesMu.Unlock()
+
+	if p.health != nil {
+		for _, rt := range old.routes {
+			for _, u := range rt.upstreams.list() {
+				if !routes.hasUpstream(u.addr) {
+					p.health.unwatch(u.addr)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxy) routeTable() *routeTable {
+	p.routesMu.RLock()
+	defer p.routesMu.RUnlock()
+
+	return p.routes
+}
+
+// rewriteRules are the rules of the config that Reload replaces along with
+// the routes.
+type rewriteRules struct {
+	headers HeaderRewrites
+	query   QueryRewrites
+	body    []BodyRule
+	scripts scripts
+}
+
+func newRewriteRules(cfg *Config) *rewriteRules {
+	return &rewriteRules{headers: cfg.Headers, query: cfg.Query, body: cfg.BodyRules, scripts: cfg.scripts}
+}
+
+// currentConfig is the configuration of the proxy, with the settings
+// replaced by Reload.
+func (p *Proxy) currentConfig() *Config {
+	p.routesMu.RLock()
+	defer p.routesMu.RUnlock()
+
+	return p.config
+}
+
+func (p *Proxy) rewriteRules() *rewriteRules {
+	p.routesMu.RLock()
+	defer p.routesMu.RUnlock()
+
+	return p.rewrites
+}
+
+// Shutdown stops the server started by ListenAndServe, waiting for the
+// in-flight requests until ctx is done, and then closes the proxy.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	var err error
+
+	if p.interceptor != nil {
+		p.interceptor.releaseAll()
+	}
+
+	if p.server != nil {
+		err = p.server.Shutdown(ctx)
+	}
+
+	if p.admin != nil {
+		_ = p.admin.Close()
+	}
+
+	if p.challenges != nil {
+		_ = p.challenges.Close()
+	}
+
+	p.Close()
+
+	return err
+}
+
+// Close flushes and closes the logger and the record file. The proxy must
+// not serve requests afterwards.
+func (p *Proxy) Close() {
+	if p.health != nil {
+		p.health.close()
+	}
+
+	if p.tracer != nil {
+		p.tracer.close()
+	}
+
+	if p.cache != nil {
+		p.cache.close()
+	}
+
+	if p.recorder != nil {
+		if err := p.recorder.close(); err != nil {
+			log.Printf("Can't close the record file: %v", err)
+		}
+	}
+
+	p.logger.Close()
+}
+
+func (p *Proxy) log(entry LogEntry) {
+	if p.duplicates != nil && entry.Message != nil && entry.Message.IsRequest {
+		entry.Message.Duplicate = p.duplicates.check(entry)
+	}
+
+	entry.Message = truncatedMessage(redactedMessage(entry.Message, p.cfg.Log), int(p.cfg.Log.MaxBody))
+
+	p.stats.count(entry)
+
+	if p.traffic != nil {
+		p.traffic.add(entry)
+	}
+
+	if p.loggingEnabled() {
+		p.logger.Log(entry)
+	}
+}
+
+func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.stats.requests.Add(1)
+	p.stats.active.Add(1)
+	defer p.stats.active.Add(-1)
+
+	if p.cfg.RequestID != "" {
+		id := requestID(r, p.cfg.RequestID)
+		r.Header.Set(p.cfg.RequestID, id)
+		w = &requestIDWriter{ResponseWriter: w, header: p.cfg.RequestID, id: id}
+	}
+
+	if p.cfg.Compress.Enabled {
+		if cw := newCompressWriter(w, r, &p.cfg.Compress); cw != nil {
+			defer cw.close()
+			w = cw
+		}
+	}
+
+	if p.cfg.CORS.Enabled {
+		if isCORSPreflight(r) {
+			p.serveCORSPreflight(w, r)
+
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" && p.cfg.CORS.allows(origin) {
+			w = &corsWriter{ResponseWriter: w, cfg: &p.cfg.CORS, origin: origin}
+		}
+	}
+
+	ex := p.newExchange(r)
+	if ex == nil {
+		log.Printf("No route for %s %s", r.Method, r.URL.Path)
+
+		p.writeError(w, r, http.StatusNotFound, nil)
+
+		return
+	}
+
+	p.cfg.Hooks.request(ex)
+
+	security := ex.route.security
+	if security == nil {
+		security = p.security
+	}
+
+	if !security.empty() {
+		w = &securityHeadersWriter{ResponseWriter: w, headers: security}
+	}
+
+	if p.tracer != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		ex.span = p.tracer.start(ex)
+
+		defer func() { p.tracer.finish(ex.span, sw.status) }()
+	}
+
+	if !p.checkMaintenance(w, ex) || !p.checkACLs(w, ex) || !p.checkAuth(w, ex) {
+		return
+	}
+
+	limiter := ex.route.limiter
+	if limiter == nil {
+		limiter = p.limiter
+	}
+
+	if limiter != nil {
+		if ok, retryAfter := limiter.allow(r); !ok {
+			p.writeRateLimited(w, ex, limiter.key(r), retryAfter)
+
+			return
+		}
+	}
+
+	if p.concurrency != nil {
+		release, err := p.concurrency.acquire(r.Context(), clientIP(r))
+		if err != nil {
+			if r.Context().Err() != nil {
+				p.logClientCanceled(ex, err)
+			} else {
+				p.writeProxyError(w, ex, http.StatusServiceUnavailable, err)
+			}
+
+			return
+		}
+		defer release()
+	}
+
+	if status, err := p.checkLimits(w, r); err != nil {
+		p.writeProxyError(w, ex, status, err)
+
+		return
+	}
+
+	if ex.route == replayRoute {
+		p.serveReplay(w, ex)
+
+		return
+	}
+
+	if p.cfg.DecompressRequests {
+		if err := decodeRequestBody(w, r, p.cfg.Limits.DecodedRequestBody); err != nil {
+			p.writeProxyError(w, ex, http.StatusBadRequest, err)
+
+			return
+		}
+	}
+
+	if p.graphQL != nil && p.graphQL.matches(r) && !p.checkGraphQL(w, ex) {
+		return
+	}
+
+	if ex.mock != nil {
+		p.serveMock(w, ex, ex.mock)
+
+		return
+	}
+
+	if ex.route.upstreams != nil {
+		defer ex.route.upstreams.acquire(ex.upstream)()
+	}
+
+	if r.Method == http.MethodConnect && ex.route == forwardProxyRoute {
+		p.serveConnect(w, ex)
+
+		return
+	}
+
+	fault := ex.route.fault
+	if fault == nil {
+		fault = &p.cfg.Fault
+	}
+
+	w, ok := p.injectFault(w, ex, *fault)
+	if !ok {
+		return
+	}
+
+	if p.cfg.Throttle.Up > 0 && r.ContentLength != 0 {
+		r.Body = newThrottledReader(r.Body, p.cfg.Throttle.Up)
+	}
+
+	if p.cfg.Throttle.Down > 0 {
+		w = newThrottledWriter(w, p.cfg.Throttle.Down)
+	}
+
+	p.setStickyCookie(w, ex)
+
+	ex.budgets = newTimeoutBudgets(ex.inbound.Context(), p.exchangeTimeouts(ex))
+	defer ex.budgets.stop()
+
+	if p.cfg.Stream || isGRPC(r) {
+		p.streamExchange(w, r, ex)
+
+		return
+	}
+
+	if p.cache != nil {
+		cached, freshness := p.cache.lookup(r)
+
+		switch {
+		case cached == nil:
+		case freshness == cacheFresh:
+			p.serveCached(w, ex, cached, 0)
+
+			return
+		case freshness == cacheRevalidate:
+			p.serveCached(w, ex, cached, 110)
+			p.revalidate(ex, cached)
+
+			return
+		default:
+			ex.stale = cached
+		}
+	}
+
+	w, finishCollapse, ok := p.collapse(w, ex)
+	if !ok {
+		return
+	}
+	defer finishCollapse()
+
+	req, err := p.writeRequest(r, ex)
+	if err == nil && ex.answer != nil {
+		p.writeProcessorAnswer(w, ex, ex.answer)
+
+		return
+	}
+
+	if err == nil && p.cfg.Compare.Upstream != "" {
+		ex.comparison = p.startComparison(ex, req)
+		defer ex.comparison.setPrimary(nil)
+	}
+
+	if err == nil && p.mirrors != nil {
+		p.mirror(ex, req)
+	}
+
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errInterceptDropped) || errors.Is(err, errProcessorFailed) || errors.Is(err, errScriptFailed) {
+			status = http.StatusBadGateway
+		} else if isBodyTooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		p.writeProxyError(w, ex, status, err)
+
+		return
+	}
+
+	res, err := p.do(req, ex)
+	if err != nil {
+		p.writeUpstreamError(w, ex, err)
+
+		return
+	}
+	defer res.Body.Close()
+
+	p.cfg.Hooks.response(ex, res)
+
+	p.writeResponse(w, res, ex)
+}
+
+// newExchange picks the upstream for r, returning nil if no route matches.
+func (p *Proxy) newExchange(r *http.Request) *exchange {
+	ex := &exchange{inbound: r, requestID: p.inboundRequestID(r), started: time.Now(), trace: &upstreamTrace{}, rewrites: p.rewriteRules()}
+
+	mock := p.findMock(r)
+
+	switch {
+	case p.replay != nil:
+		ex.route = replayRoute
+	case mock != nil:
+		ex.route, ex.mock = mock.route, mock
+	case p.cfg.ForwardProxy && r.Method == http.MethodConnect:
+		ex.route, ex.upstream = forwardProxyRoute, "tcp://"+r.Host
+	case p.cfg.ForwardProxy && r.URL.IsAbs():
+		ex.route, ex.upstream = forwardProxyRoute, r.URL.Scheme+"://"+r.URL.Host
+	default:
+		rt := p.routeTable().match(r)
+		if rt == nil {
+			return nil
+		}
+
+		ex.route, ex.upstream = rt, p.pickUpstream(rt.upstreams, r)
+	}
+
+	ex.id = p.lastID.Add(1)
+
+	return ex
+}
+
+// inboundRequestID is the request ID set by serveHTTP.
+func (p *Proxy) inboundRequestID(r *http.Request) string {
+	if p.cfg.RequestID == "" {
+		return ""
+	}
+
+	return r.Header.Get(p.cfg.RequestID)
+}
+
+func (p *Proxy) writeRequest(r *http.Request, ex *exchange) (*http.Request, error) {
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.openAPI != nil {
+		if err := p.checkOpenAPIRequest(ex, r, reqBody); err != nil {
+			return nil, err
+		}
+	}
+
+	if reqBody, err = ex.rewrites.transformRequestBody(r, reqBody); err != nil {
+		return nil, err
+	}
+
+	req, err := p.newForwardRequest(r, ex, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	if p.interceptor != nil && p.interceptor.matches(r) {
+		req, reqBody, err = p.interceptor.hold(ex, req, reqBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.cfg.Processors) > 0 {
+		if req, reqBody, ex.answer, err = p.processRequest(ex, req, reqBody); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ex.rewrites.scripts) > 0 && ex.answer == nil {
+		if req, reqBody, ex.answer, err = ex.rewrites.scripts.request(ex, req, reqBody); err != nil {
+			return nil, err
+		}
+	}
+
+	ex.reqBody = reqBody
+
+	p.cfg.Hooks.beforeForward(ex, req)
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Upstream: ex.upstream, Route: ex.route.name, Message: ex.withGraphQL(newRawHTTPRequest(req, reqBody))})
+
+	return req, nil
+}
+
+func (p *Proxy) writeResponse(w http.ResponseWriter, res *http.Response, ex *exchange) {
+	if ex.stale != nil && staleIfErrorStatuses[res.StatusCode] {
+		p.serveStale(w, ex, errors.New(res.Status))
+
+		return
+	}
+
+	if isEventStream(res) {
+		p.streamResponse(w, res, ex)
+
+		return
+	}
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		p.writeUpstreamError(w, ex, err)
+
+		return
+	}
+
+	if ex.comparison != nil {
+		ex.comparison.setPrimary(&comparedResponse{status: res.StatusCode, header: res.Header.Clone(), body: resBody})
+	}
+
+	if p.openAPI != nil {
+		if err := p.checkOpenAPIResponse(ex, res, resBody); err != nil {
+			p.writeProxyError(w, ex, http.StatusBadGateway, err)
+
+			return
+		}
+	}
+
+	if resBody, err = ex.rewrites.transformResponseBody(ex.inbound, res, resBody); err != nil {
+		p.writeProxyError(w, ex, http.StatusBadGateway, err)
+
+		return
+	}
+
+	if len(p.cfg.Processors) > 0 {
+		if resBody, err = p.processResponse(ex, res, resBody); err != nil {
+			p.writeProxyError(w, ex, http.StatusBadGateway, err)
+
+			return
+		}
+	}
+
+	if len(ex.rewrites.scripts) > 0 {
+		if resBody, err = ex.rewrites.scripts.response(ex, res, resBody); err != nil {
+			p.writeProxyError(w, ex, http.StatusBadGateway, err)
+
+			return
+		}
+	}
+
+	resBody = p.cfg.Hooks.beforeWrite(ex, res, resBody)
+
+	now := time.Now()
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: now, Elapsed: now.Sub(ex.started), Upstream: ex.upstream, Route: ex.route.name, Message: newRawHTTPResponse(res, resBody), Timings: ex.trace.timings(now)})
+
+	if p.cache != nil {
+		p.cache.store(ex.inbound, res, resBody)
+	}
+
+	if p.recorder != nil {
+		recorded := newRecordedExchange(ex.inbound, ex.reqBody, res, resBody, time.Since(ex.started))
+		recorded.Route, recorded.Upstream = ex.route.displayName(), ex.upstream
+
+		if err := p.recorder.record(recorded); err != nil {
+			log.Printf("Can't record exchange #%d: %v", ex.id, err)
+		}
+	}
+
+	copyHeader(w.Header(), res.Header)
+	ex.rewrites.headers.applyResponse(ex.inbound, w.Header())
+
+	if p.cache != nil {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	announced := announceTrailers(w.Header(), res.Trailer)
+
+	w.WriteHeader(res.StatusCode)
+
+	_, err = w.Write(resBody)
+	if err != nil {
+		log.Printf("Writing response from %s: %v", ex.upstream, err)
+	}
+
+	copyTrailers(w.Header(), res.Trailer, announced)
+}
+
+func (p *Proxy) serveCached(w http.ResponseWriter, ex *exchange, cached *cachedResponse, warning int) {
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Upstream: ex.upstream, Route: ex.route.name, Message: ex.withGraphQL(newRawHTTPRequest(ex.inbound, nil))})
+
+	p.writeCached(w, ex, cached, warning)
+}
+
+// serveStale answers ex with its stale cached response, the upstream having
+// failed with err.
+func (p *Proxy) serveStale(w http.ResponseWriter, ex *exchange, err error) {
+	log.Printf("Serving the stale cached response of #%d, forwarding it to %s failed: %v", ex.id, ex.upstream, err)
+
+	p.writeCached(w, ex, ex.stale, 111)
+}
+
+// revalidate refreshes cached in the background with the request of ex,
+// unless it's already being refreshed. The response replaces it if it can
+// be cached, the stale one being kept otherwise.
+func (p *Proxy) revalidate(ex *exchange, cached *cachedResponse) {
+	if !p.cache.startRevalidation(cached) {
+		return
+	}
+
+	req, err := p.newForwardRequest(ex.inbound, ex, http.NoBody)
+	if err != nil {
+		p.cache.finishRevalidation(cached)
+		log.Printf("Can't revalidate the cached response of %s: %v", cached.url, err)
+
+		return
+	}
+
+	// The whole response is needed, whatever the client has.
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	shadow, budgets := p.shadowRequest(ex, req, ex.upstream)
+
+	go func() {
+		defer p.cache.finishRevalidation(cached)
+		defer budgets.stop()
+
+		res, err := p.client.Do(budgets.attempt(shadow))
+		if err != nil {
+			log.Printf("Revalidating the cached response of %s with %s failed: %v", cached.url, ex.upstream, err)
+
+			return
+		}
+		defer res.Body.Close()
+
+		resBody, err := io.ReadAll(res.Body)
+		if err != nil {
+			log.Printf("Revalidating the cached response of %s with %s failed: %v", cached.url, ex.upstream, err)
+
+			return
+		}
+
+		if resBody, err = ex.rewrites.transformResponseBody(ex.inbound, res, resBody); err != nil {
+			log.Printf("Revalidating the cached response of %s with %s failed: %v", cached.url, ex.upstream, err)
+
+			return
+		}
+
+		p.cache.store(ex.inbound, res, resBody)
+	}()
+}
+
+func (p *Proxy) writeCached(w http.ResponseWriter, ex *exchange, cached *cachedResponse, warning int) {
+	p.stats.cacheHits.Add(1)
+
+	status := p.cache.serve(w, ex.inbound, cached, warning)
+
+	res := &http.Response{
+		Proto:      ex.inbound.Proto,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Header:     w.Header().Clone(),
+	}
+
+	resBody := cached.body
+	if status == http.StatusNotModified {
+		resBody = nil
+	}
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Message: newRawHTTPResponse(res, resBody)})
+}
+
+func (p *Proxy) serveReplay(w http.ResponseWriter, ex *exchange) {
+	r := ex.inbound
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		p.writeProxyError(w, ex, http.StatusBadRequest, err)
+
+		return
+	}
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Route: ex.route.name, Message: newRawHTTPRequest(r, reqBody)})
+
+	recorded := p.replay.lookup(r, reqBody)
+	if recorded == nil {
+		p.writeProxyError(w, ex, http.StatusNotFound, fmt.Errorf("no recorded exchange for %s %s", r.Method, r.URL.RequestURI()))
+
+		return
+	}
+
+	res := &http.Response{
+		Proto:      r.Proto,
+		Status:     fmt.Sprintf("%d %s", recorded.Response.Status, http.StatusText(recorded.Response.Status)),
+		StatusCode: recorded.Response.Status,
+		Header:     recorded.Response.Header,
+	}
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Route: ex.route.name, Message: newRawHTTPResponse(res, recorded.Response.Body)})
+
+	copyHeader(w.Header(), res.Header)
+	ex.rewrites.headers.applyResponse(r, w.Header())
+
+	w.WriteHeader(res.StatusCode)
+
+	_, _ = w.Write(recorded.Response.Body)
+}
+
+func (p *Proxy) writeRateLimited(w http.ResponseWriter, ex *exchange, key string, retryAfter time.Duration) {
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Err: fmt.Errorf("429 Too Many Requests: rate limit exceeded by %s", key), Status: http.StatusTooManyRequests})
+
+	p.cfg.Hooks.error(ex, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded by %s", key))
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	p.writeError(w, ex.inbound, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded by %s", key))
+}
+
+func (p *Proxy) writeUpstreamError(w http.ResponseWriter, ex *exchange, err error) {
+	if clientCanceled(ex, err) {
+		p.logClientCanceled(ex, err)
+
+		return
+	}
+
+	if ex.stale != nil {
+		p.serveStale(w, ex, err)
+
+		return
+	}
+
+	if budget := ex.budgets.exceeded(err); budget != "" {
+		p.writeProxyError(w, ex, http.StatusGatewayTimeout, fmt.Errorf("%s timeout exceeded: %w", budget, err))
+
+		return
+	}
+
+	status := http.StatusBadGateway
+	if isTimeout(err) {
+		status = http.StatusGatewayTimeout
+	} else if isBodyTooLarge(err) {
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	p.writeProxyError(w, ex, status, err)
+}
+
+func (p *Proxy) writeProxyError(w http.ResponseWriter, ex *exchange, status int, err error) {
+	if ex.upstream != "" {
+		log.Printf("Forwarding #%d to %s failed with %d: %v", ex.id, ex.upstream, status, err)
+	} else {
+		log.Printf("Request #%d failed with %d: %v", ex.id, status, err)
+	}
+
+	now := time.Now()
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: now, Elapsed: now.Sub(ex.started), Upstream: ex.upstream, Route: ex.route.name, Err: fmt.Errorf("%d %s: %w", status, http.StatusText(status), err), Status: status, Timings: ex.trace.timings(now)})
+	p.cfg.Hooks.error(ex, status, err)
+
+	p.writeError(w, ex.inbound, status, err)
+}
+
+// logClientCanceled records that the client went away before the response
+// was written, which aborts the upstream request. There's no one left to
+// answer, so it only ends up in the logs, with the 499 status of nginx.
+func (p *Proxy) logClientCanceled(ex *exchange, err error) {
+	log.Printf("Client canceled request #%d to %s: %v", ex.id, ex.upstream, err)
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: time.Now(), Elapsed: time.Since(ex.started), Upstream: ex.upstream, Route: ex.route.name, Err: fmt.Errorf("499 Client Closed Request: client canceled: %w", err), Status: 499})
+	p.cfg.Hooks.error(ex, 499, err)
+}
+
+// clientCanceled tells if err comes from the client of ex disconnecting,
+// rather than from the upstream.
+func clientCanceled(ex *exchange, err error) bool {
+	return errors.Is(err, context.Canceled) && ex.inbound.Context().Err() != nil
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (p *Proxy) newForwardRequest(r *http.Request, ex *exchange, body io.Reader) (*http.Request, error) {
+	urlPath := r.URL.EscapedPath()
+	if ex.route.rewrite != nil {
+		urlPath = ex.route.rewrite.apply(urlPath)
+	}
+
+	urlPath = strings.TrimPrefix(urlPath, "/")
+
+	reqURL, err := url.Parse(fmt.Sprintf("%s/%s?%s#%s", forwardBaseURL(ex.upstream), urlPath, r.URL.RawQuery, r.URL.EscapedFragment()))
+	if err != nil {
+		return nil, err
+	}
+
+	ex.rewrites.query.apply(r, reqURL)
+
+	ctx := r.Context()
+	if ex.budgets != nil {
+		ctx = ex.budgets.ctx
+	}
+
+	ctx = context.WithValue(ctx, inboundRequestKey{}, r)
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, reqURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if isUnixUpstream(ex.upstream) {
+		req.Host = "localhost"
+	}
+
+	copyHeader(req.Header, r.Header)
+
+	setForwardedHeaders(p.cfg.Forwarded, r, req)
+
+	if ex.span != nil {
+		req.Header.Set("Traceparent", ex.span.traceparent())
+	}
+
+	ex.rewrites.headers.applyRequest(r, req)
+
+	return req, nil
+}
+
+// hopHeaders only apply to a single connection, so they are never
+// forwarded (RFC 7230, section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeader copies the end-to-end headers of src to dst, leaving out the
+// hop-by-hop ones and those listed in Connection.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		if isHopHeader(key, src) {
+			continue
+		}
+
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+
+	// gRPC needs the upstream to know the client accepts trailers.
+	for _, te := range src.Values("TE") {
+		if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+			dst.Set("TE", "trailers")
+		}
+	}
+}
+
+func isHopHeader(key string, header http.Header) bool {
+	for _, hop := range hopHeaders {
+		if strings.EqualFold(key, hop) {
+			return true
+		}
+	}
+
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
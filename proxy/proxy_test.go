@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestProxyConcurrent sends parallel requests through the proxy with most
+// of its shared state in use, for `go test -race` to check.
+func TestProxyConcurrent(t *testing.T) {
+	const clients, requests = 20, 15
+
+	var served atomic.Int64
+
+	body := strings.Repeat(`{"hello": "world"}`, 200)
+
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				return
+			}
+
+			served.Add(1)
+			time.Sleep(time.Millisecond)
+
+			if strings.HasPrefix(r.URL.Path, "/cached") {
+				w.Header().Set("Cache-Control", "max-age=60")
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Upstream", name)
+			_, _ = io.WriteString(w, body)
+		}))
+	}
+
+	first, second := newUpstream("first"), newUpstream("second")
+	defer first.Close()
+	defer second.Close()
+
+	cfg := DefaultConfig()
+	cfg.Upstreams = []string{first.URL, second.URL}
+	cfg.Balance = "least-conn"
+	cfg.Log.Format = "har"
+	cfg.Log.Bodies = true
+	cfg.Cache.Size = 1 << 20
+	cfg.Cache.TTL = time.Minute
+	cfg.Collapse.Enabled = true
+	cfg.Compress.Enabled = true
+	cfg.HealthCheck = HealthCheckConfig{Path: "/healthz", Interval: 10 * time.Millisecond, Timeout: time.Second, Threshold: 3}
+	cfg.Admin.Token = "s3cret"
+
+	p := newTestProxy(t, cfg)
+
+	server := httptest.NewServer(p.Handler())
+	defer server.Close()
+
+	admin := p.AdminHandler()
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, clients*requests)
+
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+
+		go func(c int) {
+			defer wg.Done()
+
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+			defer client.CloseIdleConnections()
+
+			for i := 0; i < requests; i++ {
+				path := fmt.Sprintf("/uncached/%d/%d", c, i)
+				if i%3 == 0 {
+					path = fmt.Sprintf("/cached/%d", i%5)
+				}
+
+				errs <- checkGet(client, server.URL+path, c%2 == 0, body)
+			}
+		}(c)
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < requests; i++ {
+			r := httptest.NewRequest("GET", "/stats", nil)
+			r.Header.Set("Authorization", "Bearer s3cret")
+			admin.ServeHTTP(httptest.NewRecorder(), r)
+
+			reloaded := cfg
+			reloaded.Upstreams = []string{second.URL, first.URL}
+
+			if err := p.Reload(reloaded); err != nil {
+				errs <- err
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if n := served.Load(); n >= clients*requests {
+		t.Errorf("the upstreams served %d requests, want fewer than %d with the cache", n, clients*requests)
+	}
+}
+
+func checkGet(client *http.Client, url string, gzipped bool, want string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if gzipped {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	reader := io.Reader(res.Body)
+
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return fmt.Errorf("GET %s: %w", url, err)
+		}
+
+		reader = gz
+	} else if gzipped {
+		return fmt.Errorf("GET %s wasn't compressed", url)
+	}
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+
+	if res.StatusCode != http.StatusOK || string(got) != want {
+		return fmt.Errorf("GET %s = %s, %d bytes, want 200 and %d bytes", url, res.Status, len(got), len(want))
+	}
+
+	return nil
+}
@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolSignature starts the headers of the PROXY protocol v2.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolV1MaxLength is the longest header of the PROXY protocol v1,
+// CRLF included.
+const proxyProtocolV1MaxLength = 107
+
+func validateProxyProtocolVersion(version string) error {
+	switch version {
+	case "", "v1", "v2":
+		return nil
+	default:
+		return fmt.Errorf("invalid upstream PROXY protocol version %q, which must be v1 or v2", version)
+	}
+}
+
+// proxyProtocolSources are the peers whose PROXY protocol headers are
+// trusted, nil meaning all of them.
+func (c *Config) proxyProtocolSources() ([]*net.IPNet, error) {
+	if len(c.ProxyProtocolFrom) > 0 && !c.ProxyProtocol {
+		return nil, errors.New("the PROXY protocol sources are only used with the PROXY protocol")
+	}
+
+	sources, err := parseIPNets(c.ProxyProtocolFrom)
+	if err != nil {
+		return nil, fmt.Errorf("%w in the PROXY protocol sources", err)
+	}
+
+	return sources, nil
+}
+
+// proxyProtocolListener reads the PROXY protocol header that the load
+// balancers in front of the proxy send first on every connection, the
+// connections it accepts having the client and proxy addresses of the
+// header. The connections without a valid header are closed. The headers
+// are read apart from Accept, so that a slow client doesn't hold the
+// others, within timeout. With sources, only the peers in them are trusted
+// to send a header, the others keeping their own address.
+type proxyProtocolListener struct {
+	net.Listener
+	timeout time.Duration
+	sources []*net.IPNet
+
+	accepted  chan acceptedConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptedConn struct {
+	conn net.Conn
+	err  error
+}
+
+func newProxyProtocolListener(ln net.Listener, timeout time.Duration, sources []*net.IPNet) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener: ln,
+		timeout:  timeout,
+		sources:  sources,
+		accepted: make(chan acceptedConn),
+		done:     make(chan struct{}),
+	}
+
+	go l.acceptConns()
+
+	return l
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+
+	return l.Listener.Close()
+}
+
+func (l *proxyProtocolListener) acceptConns() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepted <- acceptedConn{err: err}:
+			case <-l.done:
+				return
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			continue
+		}
+
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyProtocolListener) readHeader(conn net.Conn) {
+	accepted := conn
+
+	if l.trusts(conn.RemoteAddr()) {
+		if l.timeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(l.timeout))
+		}
+
+		reader := bufio.NewReader(conn)
+
+		remote, local, err := readProxyProtocolHeader(reader)
+		if err != nil {
+			log.Printf("Closed a connection from %s without a valid PROXY protocol header: %v", conn.RemoteAddr(), err)
+
+			_ = conn.Close()
+
+			return
+		}
+
+		_ = conn.SetReadDeadline(time.Time{})
+
+		accepted = &proxyProtocolConn{Conn: conn, reader: reader, remote: remote, local: local}
+	}
+
+	select {
+	case l.accepted <- acceptedConn{conn: accepted}:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+// trusts tells if the peer at addr may send a PROXY protocol header. The
+// peers of the Unix sockets, which have no IP address, are local and
+// trusted; a header sent by the others is left to be an invalid request.
+func (l *proxyProtocolListener) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if len(l.sources) == 0 || !ok {
+		return true
+	}
+
+	for _, ipNet := range l.sources {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyProtocolConn is a connection whose addresses were given by a PROXY
+// protocol header, nil ones being those of the connection itself.
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	remote, local net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header of either version,
+// returning the source and destination addresses it gives, which are nil
+// for the UNKNOWN and LOCAL ones.
+func readProxyProtocolHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	start, err := r.Peek(len(proxyProtocolSignature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(start, proxyProtocolSignature) {
+		return readProxyProtocolV2(r)
+	}
+
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+
+	return nil, nil, errors.New("no PROXY protocol signature")
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return nil, nil, errors.New("the v1 header is too long")
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	srcAddr, err := parseProxyProtocolAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dstAddr, err := parseProxyProtocolAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyProtocolAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid address %q in the v1 header", ip)
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in the v1 header", port)
+	}
+
+	addr.Port = int(n)
+
+	return addr, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyProtocolSignature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	versionCommand, family := header[12], header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d in the v2 header", versionCommand>>4)
+	}
+
+	switch versionCommand & 0xf {
+	case 0:
+		// LOCAL, like the health checks of the load balancer itself.
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d in the v2 header", versionCommand&0xf)
+	}
+
+	var ipLength int
+
+	// The TLVs following the addresses are skipped.
+	switch family >> 4 {
+	case 1:
+		ipLength = net.IPv4len
+	case 2:
+		ipLength = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLength+4 {
+		return nil, nil, errors.New("the v2 header is too short for its addresses")
+	}
+
+	srcAddr := &net.TCPAddr{IP: net.IP(payload[:ipLength]), Port: int(binary.BigEndian.Uint16(payload[2*ipLength:]))}
+	dstAddr := &net.TCPAddr{IP: net.IP(payload[ipLength : 2*ipLength]), Port: int(binary.BigEndian.Uint16(payload[2*ipLength+2:]))}
+
+	return srcAddr, dstAddr, nil
+}
+
+// proxyProtocolHeader is the PROXY protocol header of version telling that
+// a connection to dst was made for src. It's an UNKNOWN or LOCAL one when
+// either isn't a TCP address.
+func proxyProtocolHeader(version string, src, dst net.Addr) []byte {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+
+	if !srcOK || !dstOK {
+		if version == "v1" {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+
+		return append(append([]byte(nil), proxyProtocolSignature...), 0x20, 0x00, 0, 0)
+	}
+
+	// Both addresses must be of the same family, the IPv4 ones being mapped
+	// to IPv6 when the other is an IPv6 one.
+	srcIP, dstIP := srcAddr.IP.To16(), dstAddr.IP.To16()
+	ipv4 := srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	if ipv4 {
+		srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+	}
+
+	if version == "v1" {
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcAddr.Port, dstAddr.Port))
+		}
+
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), srcAddr.Port, dstAddr.Port))
+	}
+
+	family := byte(0x21)
+	if ipv4 {
+		family = 0x11
+	}
+
+	addrs := append(append([]byte(nil), srcIP...), dstIP...)
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcAddr.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstAddr.Port))
+
+	header := append(append([]byte(nil), proxyProtocolSignature...), 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+
+	return append(header, addrs...)
+}
+
+// ipv6String formats ip in the IPv6 form even if it's a mapped IPv4 one,
+// which net.IP formats in the IPv4 one.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+
+	return ip.String()
+}
+
+// inboundClientAddr is the address of the client whose request or, in the
+// tcp mode, connection ctx belongs to, or nil.
+func inboundClientAddr(ctx context.Context) net.Addr {
+	if addr, ok := ctx.Value(clientAddrKey{}).(net.Addr); ok {
+		return addr
+	}
+
+	r := InboundRequest(ctx)
+	if r == nil {
+		return nil
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return addr
+}
+
+// sendProxyProtocolHeader writes the PROXY protocol header of version on
+// conn, for the client whose request ctx belongs to.
+func sendProxyProtocolHeader(ctx context.Context, conn net.Conn, version string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+		defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+	}
+
+	if _, err := conn.Write(proxyProtocolHeader(version, inboundClientAddr(ctx), conn.RemoteAddr())); err != nil {
+		return fmt.Errorf("can't send the PROXY protocol header: %w", err)
+	}
+
+	return nil
+}
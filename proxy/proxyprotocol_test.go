@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		want    string
+	}{
+		{name: "any peer", want: "192.0.2.1"},
+		{name: "trusted peer", sources: []string{"127.0.0.0/8"}, want: "192.0.2.1"},
+		{name: "other peer", sources: []string{"10.0.0.0/8"}, want: "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{ProxyProtocol: true, ProxyProtocolFrom: tt.sources}
+
+			sources, err := cfg.proxyProtocolSources()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pln := newProxyProtocolListener(ln, time.Second, sources)
+			defer pln.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if _, err := io.WriteString(client, "PROXY TCP4 192.0.2.1 192.0.2.2 40000 80\r\n"); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := pln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != tt.want {
+				t.Errorf("got the client %s, want %s", host, tt.want)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		cfg := Config{ProxyProtocol: true, ProxyProtocolFrom: []string{"10.0.0.0/33"}}
+
+		if _, err := cfg.proxyProtocolSources(); err == nil {
+			t.Error("got no error for an invalid range")
+		}
+	})
+}
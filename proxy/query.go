@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CaptureQuery selects the exchanges of a record file. All the conditions
+// that are set must match:
+//
+//   - Since and Until, the time range of the exchanges.
+//   - Match, the request, like the rules of the other features.
+//   - Status, a status like 404 or a class like 5xx.
+//   - MinDuration and MinSize, the slow or large exchanges, the size being
+//     that of the response body.
+//
+// Limit keeps the first exchanges that match, 0 meaning all of them.
+type CaptureQuery struct {
+	Since       time.Time
+	Until       time.Time
+	Match       RequestMatch
+	Status      string
+	MinDuration time.Duration
+	MinSize     ByteSize
+	Limit       int
+
+	// id only selects the exchange at that position.
+	id int
+}
+
+func (q *CaptureQuery) compile() (minStatus, maxStatus int, err error) {
+	if err := q.Match.compile(); err != nil {
+		return 0, 0, err
+	}
+
+	if q.Status == "" {
+		return 0, 999, nil
+	}
+
+	return parseStatusRange(q.Status)
+}
+
+// parseStatusRange reads a status like 404 or a class like 5xx, returning
+// the range of statuses it covers.
+func parseStatusRange(s string) (minStatus, maxStatus int, err error) {
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil || class < 1 || class > 5 {
+			return 0, 0, fmt.Errorf("invalid status class %q", s)
+		}
+
+		return class * 100, class*100 + 99, nil
+	}
+
+	status, err := strconv.Atoi(s)
+	if err != nil || status < 100 || status > 999 {
+		return 0, 0, fmt.Errorf("invalid status %q", s)
+	}
+
+	return status, status, nil
+}
+
+// QueryCaptures writes the exchanges of the record file that match q to w,
+// either as a table or, with the jsonl format, as record lines that can be
+// replayed. It returns how many exchanges matched.
+func QueryCaptures(fileName string, q CaptureQuery, format string, w io.Writer) (int, error) {
+	if format != "table" && format != "jsonl" {
+		return 0, fmt.Errorf("invalid format %q, which must be table or jsonl", format)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if format == "table" {
+		fmt.Fprintln(table, "#\tTIME\tMETHOD\tPATH\tSTATUS\tDURATION\tSIZE")
+	}
+
+	matched, err := readCaptures(fileName, q, func(n int, exchange *recordedExchange, line []byte) error {
+		if format == "jsonl" {
+			_, err := fmt.Fprintf(w, "%s\n", line)
+
+			return err
+		}
+
+		req := exchange.Request
+		target := req.Path
+		if req.Query != "" {
+			target += "?" + req.Query
+		}
+
+		_, err := fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%d\t%s\t%d\n", n, exchange.Timestamp.Local().Format("2006-01-02 15:04:05"), req.Method, target,
+			exchange.Response.Status, exchange.duration().Round(time.Microsecond), len(exchange.Response.Body))
+
+		return err
+	})
+	if err != nil {
+		return matched, err
+	}
+
+	return matched, table.Flush()
+}
+
+// readCaptures calls fn with the exchanges of the record file that match q,
+// along with their position in the file and their line. It returns how many
+// exchanges matched.
+func readCaptures(fileName string, q CaptureQuery, fn func(n int, exchange *recordedExchange, line []byte) error) (int, error) {
+	minStatus, maxStatus, err := q.compile()
+	if err != nil {
+		return 0, err
+	}
+
+	if isCaptureDB(fileName) {
+		return readCaptureDB(fileName, q, minStatus, maxStatus, fn)
+	}
+
+	if isCaptureHAR(fileName) {
+		return readCaptureHAR(fileName, q, minStatus, maxStatus, fn)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+
+	matched := 0
+
+	for line := 1; scanner.Scan() && (q.Limit == 0 || matched < q.Limit); line++ {
+		if q.id != 0 && line != q.id {
+			continue
+		}
+
+		var exchange recordedExchange
+
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return matched, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		status := exchange.Response.Status
+		if status < minStatus || status > maxStatus || !q.matches(&exchange) {
+			continue
+		}
+
+		matched++
+
+		if err := fn(line, &exchange, scanner.Bytes()); err != nil {
+			return matched, err
+		}
+	}
+
+	return matched, scanner.Err()
+}
+
+func (q *CaptureQuery) matches(exchange *recordedExchange) bool {
+	if !q.Since.IsZero() && exchange.Timestamp.Before(q.Since) {
+		return false
+	}
+
+	if !q.Until.IsZero() && exchange.Timestamp.After(q.Until) {
+		return false
+	}
+
+	if exchange.duration() < q.MinDuration || ByteSize(len(exchange.Response.Body)) < q.MinSize {
+		return false
+	}
+
+	req := exchange.Request
+
+	return q.Match.matches(&http.Request{Method: req.Method, URL: &url.URL{Path: req.Path, RawQuery: req.Query}, Header: req.Header})
+}
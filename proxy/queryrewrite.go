@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// QueryRewrites changes the query parameters of the requests before they
+// are forwarded, first with its own rules and then with those of the Rules
+// matching the request.
+type QueryRewrites struct {
+	QueryRules `yaml:",inline"`
+
+	Rules []QueryRule `yaml:"rules"`
+}
+
+type QueryRule struct {
+	Match RequestMatch `yaml:"match"`
+
+	QueryRules `yaml:",inline"`
+}
+
+// QueryRules removes the parameters in Remove, which may be globs like
+// utm_*, replaces the value of the present parameters in Replace, and then
+// sets and adds those in Set and Add. The values may use the placeholders of
+// the header rewrites.
+type QueryRules struct {
+	Set     map[string]string `yaml:"set"`
+	Add     map[string]string `yaml:"add"`
+	Replace map[string]string `yaml:"replace"`
+	Remove  []string          `yaml:"remove"`
+}
+
+func (q QueryRules) isEmpty() bool {
+	return len(q.Set) == 0 && len(q.Add) == 0 && len(q.Replace) == 0 && len(q.Remove) == 0
+}
+
+func (q QueryRules) validate() error {
+	for _, pattern := range q.Remove {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid query parameter pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func (q QueryRules) apply(query url.Values, vars *strings.Replacer) {
+	for name := range query {
+		for _, pattern := range q.Remove {
+			if matched, _ := path.Match(pattern, name); matched {
+				query.Del(name)
+
+				break
+			}
+		}
+	}
+
+	for name, value := range q.Replace {
+		if query.Has(name) {
+			query.Set(name, vars.Replace(value))
+		}
+	}
+
+	for name, value := range q.Set {
+		query.Set(name, vars.Replace(value))
+	}
+
+	for name, value := range q.Add {
+		query.Add(name, vars.Replace(value))
+	}
+}
+
+func (q QueryRewrites) validate() error {
+	if err := q.QueryRules.validate(); err != nil {
+		return err
+	}
+
+	for i := range q.Rules {
+		if err := q.Rules[i].Match.compile(); err != nil {
+			return err
+		}
+
+		if err := q.Rules[i].QueryRules.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply rewrites the query of u, forwarded for r. The query is left as is,
+// down to the order of its parameters, unless the rules change it.
+func (q QueryRewrites) apply(r *http.Request, u *url.URL) {
+	rules := make([]QueryRules, 0, len(q.Rules)+1)
+
+	if !q.QueryRules.isEmpty() {
+		rules = append(rules, q.QueryRules)
+	}
+
+	for _, rule := range q.Rules {
+		if !rule.QueryRules.isEmpty() && rule.Match.matches(r) {
+			rules = append(rules, rule.QueryRules)
+		}
+	}
+
+	if len(rules) == 0 {
+		return
+	}
+
+	query := u.Query()
+	vars := headerVars(r)
+
+	for _, rule := range rules {
+		rule.apply(query, vars)
+	}
+
+	if !reflect.DeepEqual(query, u.Query()) {
+		u.RawQuery = query.Encode()
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitConfig limits the requests of each client to Rate per second, 0
+// not limiting them, with bursts of up to Burst requests, Rate rounded up
+// by default. The clients are told apart by their IP, or with a Key like
+// header:X-API-Key by that header, those without it by their IP.
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	Key   string  `yaml:"key"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	keyHeader string
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = int(math.Ceil(cfg.Rate))
+	}
+
+	return &rateLimiter{
+		rate:      cfg.Rate,
+		burst:     float64(burst),
+		keyHeader: strings.TrimPrefix(cfg.Key, "header:"),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *rateLimiter) key(r *http.Request) string {
+	if l.keyHeader != "" && l.keyHeader != "ip" {
+		if value := r.Header.Get(l.keyHeader); value != "" {
+			return l.keyHeader + ":" + value
+		}
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+func (l *rateLimiter) allow(r *http.Request) (bool, time.Duration) {
+	key := l.key(r)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
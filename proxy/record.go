@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+type recordedExchange struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Duration  float64          `json:"duration_ms,omitempty"`
+	Route     string           `json:"route,omitempty"`
+	Upstream  string           `json:"upstream,omitempty"`
+	Request   recordedRequest  `json:"request"`
+	Response  recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Query    string      `json:"query"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	BodyHash string      `json:"body_hash"`
+}
+
+type recordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+func newRecordedExchange(r *http.Request, reqBody []byte, res *http.Response, resBody []byte, elapsed time.Duration) *recordedExchange {
+	return &recordedExchange{
+		Timestamp: time.Now(),
+		Duration:  durationMillis(elapsed),
+		Request: recordedRequest{
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Query:    r.URL.Query().Encode(),
+			Header:   r.Header.Clone(),
+			Body:     reqBody,
+			BodyHash: bodyHash(reqBody),
+		},
+		Response: recordedResponse{
+			Status: res.StatusCode,
+			Header: res.Header.Clone(),
+			Body:   resBody,
+		},
+	}
+}
+
+// duration is zero for the exchanges recorded before it was.
+func (e *recordedExchange) duration() time.Duration {
+	return time.Duration(e.Duration * float64(time.Millisecond))
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
+
+const (
+	// recordQueueSize is how many exchanges wait to be inserted in the
+	// database at most, the next ones being dropped.
+	recordQueueSize = 4096
+
+	// recordBatchSize is how many exchanges are inserted in a transaction
+	// at most.
+	recordBatchSize = 100
+)
+
+var errRecordQueueFull = errors.New("too many exchanges waiting to be recorded")
+
+// recorder appends the exchanges to a record file of JSON lines, or inserts
+// them in an SQLite database, in batches from a goroutine of its own.
+type recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+
+	db     *sql.DB
+	queue  chan *recordedExchange
+	done   chan struct{}
+	closed bool
+}
+
+func newRecorder(fileName string) (*recorder, error) {
+	if isCaptureDB(fileName) {
+		db, err := openCaptureDB(fileName, true)
+		if err != nil {
+			return nil, err
+		}
+
+		rec := &recorder{db: db, queue: make(chan *recordedExchange, recordQueueSize), done: make(chan struct{})}
+
+		go rec.insert()
+
+		return rec, nil
+	}
+
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (rec *recorder) record(exchange *recordedExchange) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.db == nil {
+		return rec.encoder.Encode(exchange)
+	}
+
+	if rec.closed {
+		return os.ErrClosed
+	}
+
+	select {
+	case rec.queue <- exchange:
+		return nil
+	default:
+		return errRecordQueueFull
+	}
+}
+
+// insert inserts the queued exchanges in the database until the recorder
+// is closed, as many at a time as are waiting.
+func (rec *recorder) insert() {
+	defer close(rec.done)
+
+	for exchange := range rec.queue {
+		batch := []*recordedExchange{exchange}
+
+	collect:
+		for len(batch) < recordBatchSize {
+			select {
+			case exchange, ok := <-rec.queue:
+				if !ok {
+					break collect
+				}
+
+				batch = append(batch, exchange)
+			default:
+				break collect
+			}
+		}
+
+		if err := insertCaptures(rec.db, batch); err != nil {
+			log.Printf("Can't record %d exchanges: %v", len(batch), err)
+		}
+	}
+}
+
+// close records the exchanges still queued and closes the file.
+func (rec *recorder) close() error {
+	rec.mu.Lock()
+
+	if rec.db == nil {
+		defer rec.mu.Unlock()
+
+		return rec.file.Close()
+	}
+
+	rec.closed = true
+	close(rec.queue)
+	rec.mu.Unlock()
+
+	<-rec.done
+
+	return rec.db.Close()
+}
+
+type replayStore struct {
+	matchBody bool
+
+	mu        sync.Mutex
+	exchanges map[string][]*recordedExchange
+}
+
+func loadReplayStore(fileName string, matchBody bool) (*replayStore, error) {
+	store := &replayStore{matchBody: matchBody, exchanges: make(map[string][]*recordedExchange)}
+
+	_, err := readCaptures(fileName, CaptureQuery{}, func(_ int, exchange *recordedExchange, _ []byte) error {
+		req := exchange.Request
+		key := store.key(req.Method, req.Path, req.Query, req.BodyHash)
+		store.exchanges[key] = append(store.exchanges[key], exchange)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *replayStore) key(method, urlPath, query, hash string) string {
+	key := method + " " + urlPath + "?" + query
+	if s.matchBody {
+		key += " " + hash
+	}
+
+	return key
+}
+
+// lookup returns the recorded exchanges for a request in the order they were
+// recorded, repeating the last one once they run out.
+func (s *replayStore) lookup(r *http.Request, reqBody []byte) *recordedExchange {
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	key := s.key(r.Method, r.URL.Path, query.Encode(), bodyHash(reqBody))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exchanges := s.exchanges[key]
+	if len(exchanges) == 0 {
+		return nil
+	}
+
+	if len(exchanges) > 1 {
+		s.exchanges[key] = exchanges[1:]
+	}
+
+	return exchanges[0]
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// DefaultRedactedHeaders are the headers whose values are left out of the
+// logs by default.
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// redactedMessage returns a copy of msg with the values of the headers in
+// cfg.RedactHeaders and of the JSON fields in cfg.RedactFields, in the body
+// and the GraphQL variables, replaced with "[REDACTED]". The bodies are
+// decoded first, if enabled, so that their fields can be found.
+func redactedMessage(msg *Message, cfg LogConfig) *Message {
+	if msg == nil {
+		return nil
+	}
+
+	redactedMsg := *msg
+	redactedMsg.Header = redactedHeader(msg.Header, cfg.RedactHeaders)
+
+	if len(cfg.RedactFields) > 0 && len(msg.Body) > 0 {
+		if cfg.Decode {
+			redactedMsg.Body = decodedMessage(msg).Body
+		}
+
+		redactedMsg.Body = redactJSON(redactedMsg.Body, cfg.RedactFields)
+	}
+
+	if len(cfg.RedactFields) > 0 && len(msg.GraphQL) > 0 {
+		redactedMsg.GraphQL = make([]GraphQLOperation, len(msg.GraphQL))
+
+		for i, op := range msg.GraphQL {
+			if len(op.Variables) > 0 {
+				op.Variables = redactJSON(op.Variables, cfg.RedactFields)
+			}
+
+			redactedMsg.GraphQL[i] = op
+		}
+	}
+
+	return &redactedMsg
+}
+
+// redactedHeader returns header, or a copy of it with the values of the
+// headers named replaced with "[REDACTED]".
+func redactedHeader(header http.Header, names []string) http.Header {
+	cloned := false
+
+	for _, name := range names {
+		if len(header.Values(name)) == 0 {
+			continue
+		}
+
+		if !cloned {
+			header, cloned = header.Clone(), true
+		}
+
+		header.Set(name, redacted)
+	}
+
+	return header
+}
+
+// redactedBody returns body with the JSON fields redacted, unless it's
+// encoded, updating the Content-Length of header if it changed.
+func redactedBody(header http.Header, body []byte, fields []string) (http.Header, []byte) {
+	if len(fields) == 0 || len(body) == 0 || header.Get("Content-Encoding") != "" {
+		return header, body
+	}
+
+	redactedBody := redactJSON(body, fields)
+	if len(redactedBody) != len(body) && header.Get("Content-Length") != "" {
+		header = header.Clone()
+		header.Set("Content-Length", strconv.Itoa(len(redactedBody)))
+	}
+
+	return header, redactedBody
+}
+
+// redacted returns a copy of the exchange with the headers and JSON fields
+// of cfg redacted like in the logs. The hash of the request body is kept,
+// so that the redacted requests are still replayed.
+func (e *recordedExchange) redacted(cfg LogConfig) *recordedExchange {
+	redactedExchange := *e
+
+	req, res := &redactedExchange.Request, &redactedExchange.Response
+
+	req.Header, req.Body = redactedBody(redactedHeader(req.Header, cfg.RedactHeaders), req.Body, cfg.RedactFields)
+	res.Header, res.Body = redactedBody(redactedHeader(res.Header, cfg.RedactHeaders), res.Body, cfg.RedactFields)
+
+	return &redactedExchange
+}
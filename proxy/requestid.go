@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const maxRequestIDLength = 200
+
+// requestID returns the ID of the request in header, generating one unless
+// it came with a usable one.
+func requestID(r *http.Request, header string) string {
+	id := r.Header.Get(header)
+	if id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+
+	return newUUID()
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	id := randomHex(16)
+
+	return fmt.Sprintf("%s-%s-4%s-%x%s-%s", id[:8], id[8:12], id[13:16], 8|hexValue(id[16])&3, id[17:20], id[20:])
+}
+
+func hexValue(c byte) byte {
+	if c >= 'a' {
+		return c - 'a' + 10
+	}
+
+	return c - '0'
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestIDWriter returns the request ID to the client, replacing the one
+// the upstream may have echoed.
+type requestIDWriter struct {
+	http.ResponseWriter
+	header      string
+	id          string
+	wroteHeader bool
+}
+
+func (rw *requestIDWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.Header().Set(rw.header, rw.id)
+	}
+
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *requestIDWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *requestIDWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	_ = http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+func (rw *requestIDWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
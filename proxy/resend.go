@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ResendOptions are where ResendCaptures sends the requests and how fast:
+// Concurrency requests at a time, at most Rate a second (0 for no limit),
+// each one failing after Timeout.
+type ResendOptions struct {
+	Target      string
+	Concurrency int
+	Rate        float64
+	Timeout     time.Duration
+}
+
+func (o *ResendOptions) validate() error {
+	o.Target = strings.TrimSuffix(o.Target, "/")
+
+	u, err := url.Parse(o.Target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid target %q, which must be like http://host:port", o.Target)
+	}
+
+	if o.Concurrency < 1 {
+		return errors.New("the concurrency must be at least 1")
+	}
+
+	if o.Rate < 0 {
+		return errors.New("the rate can't be negative")
+	}
+
+	return nil
+}
+
+type resentExchange struct {
+	n        int
+	recorded *recordedExchange
+	status   int
+	duration time.Duration
+	err      error
+}
+
+// ResendCaptures sends the requests of the record file that match q to the
+// target of opts again, then writes to w how their statuses and durations
+// compare with the recorded ones. It returns how many requests were sent.
+func ResendCaptures(fileName string, q CaptureQuery, opts ResendOptions, w io.Writer) (int, error) {
+	if err := opts.validate(); err != nil {
+		return 0, err
+	}
+
+	var exchanges []*resentExchange
+
+	if _, err := readCaptures(fileName, q, func(n int, exchange *recordedExchange, _ []byte) error {
+		exchanges = append(exchanges, &resentExchange{n: n, recorded: exchange})
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var pace <-chan time.Time
+
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+
+		pace = ticker.C
+	}
+
+	queue := make(chan *resentExchange)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for e := range queue {
+				e.resend(client, opts.Target)
+			}
+		}()
+	}
+
+	for i, e := range exchanges {
+		if pace != nil && i > 0 {
+			<-pace
+		}
+
+		queue <- e
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return len(exchanges), writeResendReport(w, exchanges)
+}
+
+func (e *resentExchange) resend(client *http.Client, target string) {
+	recorded := e.recorded.Request
+
+	reqURL := target + recorded.Path
+	if recorded.Query != "" {
+		reqURL += "?" + recorded.Query
+	}
+
+	req, err := http.NewRequest(recorded.Method, reqURL, bytes.NewReader(recorded.Body))
+	if err != nil {
+		e.err = err
+
+		return
+	}
+
+	copyHeader(req.Header, recorded.Header)
+	req.Header.Del("Content-Length")
+
+	start := time.Now()
+
+	res, err := client.Do(req)
+	if err != nil {
+		e.err = err
+
+		return
+	}
+
+	_, err = io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	e.status, e.duration, e.err = res.StatusCode, time.Since(start), err
+}
+
+func writeResendReport(w io.Writer, exchanges []*resentExchange) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tMETHOD\tPATH\tSTATUS\tRECORDED\tDURATION\tRECORDED\tCHANGE")
+
+	var durations, recordedDurations []time.Duration
+
+	changed, failed := 0, 0
+
+	for _, e := range exchanges {
+		recorded := e.recorded
+
+		if e.err != nil {
+			failed++
+
+			fmt.Fprintf(table, "%d\t%s\t%s\t-\t%d\t-\t%s\t%v\n", e.n, recorded.Request.Method, recorded.Request.Path, recorded.Response.Status,
+				recorded.duration().Round(time.Microsecond), e.err)
+
+			continue
+		}
+
+		durations = append(durations, e.duration)
+		recordedDurations = append(recordedDurations, recorded.duration())
+
+		change := fmt.Sprintf("%+.0f%%", 100*(e.duration.Seconds()/recorded.duration().Seconds()-1))
+		if recorded.Duration == 0 {
+			change = ""
+		}
+
+		if e.status != recorded.Response.Status {
+			changed++
+
+			change = strings.TrimSpace("status changed " + change)
+		}
+
+		fmt.Fprintf(table, "%d\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", e.n, recorded.Request.Method, recorded.Request.Path, e.status, recorded.Response.Status,
+			e.duration.Round(time.Microsecond), recorded.duration().Round(time.Microsecond), change)
+	}
+
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d requests resent, %d with another status, %d failed; median duration %s, recorded %s\n",
+		len(exchanges), changed, failed, medianDuration(durations).Round(time.Microsecond), medianDuration(recordedDurations).Round(time.Microsecond))
+
+	return err
+}
+
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	return durations[len(durations)/2]
+}
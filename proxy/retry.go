@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxRetryBackoff = 10 * time.Second
+
+// RetryConfig retries the requests with one of Methods that failed to reach
+// the upstream or got one of Statuses back, waiting Backoff before the first
+// retry and twice as long before each of the next ones.
+type RetryConfig struct {
+	Attempts int           `yaml:"attempts"`
+	Statuses []int         `yaml:"statuses"`
+	Methods  []string      `yaml:"methods"`
+	Backoff  time.Duration `yaml:"backoff"`
+}
+
+func (rc RetryConfig) validate() error {
+	if rc.Attempts < 0 || rc.Backoff < 0 {
+		return errors.New("the retry attempts and backoff can't be negative")
+	}
+
+	for _, status := range rc.Statuses {
+		if status < 100 || status > 599 {
+			return errors.New("the retry statuses must be valid HTTP status codes")
+		}
+	}
+
+	return nil
+}
+
+func (rc RetryConfig) retriesMethod(method string) bool {
+	for _, m := range rc.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rc RetryConfig) retriesStatus(status int) bool {
+	for _, s := range rc.Statuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rc RetryConfig) backoff(attempt int) time.Duration {
+	d := rc.Backoff << (attempt - 1)
+	if d <= 0 || d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+
+	// Jitter keeps the clients that failed together from retrying together.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do sends req to the upstream, retrying it as configured. Requests whose
+// body can't be read again are sent only once.
+func (p *Proxy) do(req *http.Request, ex *exchange) (*http.Response, error) {
+	rc := p.cfg.Retry
+
+	canRetry := rc.Attempts > 0 && rc.retriesMethod(req.Method) &&
+		(req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 1; ; attempt++ {
+		res, err := p.client.Do(ex.trace.trace(ex.budgets.attempt(req)))
+		if !canRetry || attempt > rc.Attempts || ex.inbound.Context().Err() != nil {
+			return res, err
+		}
+
+		if err == nil && !rc.retriesStatus(res.StatusCode) {
+			return res, nil
+		}
+
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = res.Status
+
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		backoff := rc.backoff(attempt)
+
+		log.Printf("Request #%d to %s failed (%s), retrying in %s (%d/%d)", ex.id, ex.upstream, reason, backoff.Round(time.Millisecond), attempt, rc.Attempts)
+
+		select {
+		case <-time.After(backoff):
+		case <-ex.inbound.Context().Done():
+			return nil, ex.inbound.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PathRewrite changes the path of the requests of a route before they are
+// forwarded: StripPrefix is removed from its start, then the matches of
+// Regex are replaced with Replacement, which can refer to the groups as $1
+// or ${name}, and finally AddPrefix is put in front.
+type PathRewrite struct {
+	StripPrefix string `yaml:"strip_prefix"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	AddPrefix   string `yaml:"add_prefix"`
+
+	regex *regexp.Regexp
+}
+
+func (pr *PathRewrite) compile() error {
+	if pr.AddPrefix != "" && !strings.HasPrefix(pr.AddPrefix, "/") {
+		return fmt.Errorf("the added path prefix %q must start with /", pr.AddPrefix)
+	}
+
+	if pr.Regex == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(pr.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid path rewrite regex %q: %w", pr.Regex, err)
+	}
+
+	pr.regex = re
+
+	return nil
+}
+
+// apply returns the rewritten path, which always starts with /.
+func (pr *PathRewrite) apply(urlPath string) string {
+	urlPath = strings.TrimPrefix(urlPath, pr.StripPrefix)
+
+	if pr.regex != nil {
+		urlPath = pr.regex.ReplaceAllString(urlPath, pr.Replacement)
+	}
+
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = "/" + urlPath
+	}
+
+	if pr.AddPrefix != "" {
+		urlPath = strings.TrimSuffix(pr.AddPrefix, "/") + urlPath
+	}
+
+	return urlPath
+}
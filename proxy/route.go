@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RouteConfig sends the requests whose path starts with Path to other
+// upstreams. With Host, only those for that host are, which may be a
+// wildcard like *.example.com, the path then defaulting to /.
+type RouteConfig struct {
+	Name      string           `yaml:"name"`
+	Host      string           `yaml:"host"`
+	Path      string           `yaml:"path"`
+	Upstreams []string         `yaml:"upstreams"`
+	Balance   string           `yaml:"balance"`
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	Fault     *FaultConfig     `yaml:"fault"`
+	Rewrite   *PathRewrite     `yaml:"rewrite"`
+	ACL       *ACLConfig       `yaml:"acl"`
+	Timeouts  *RouteTimeouts   `yaml:"timeouts"`
+
+	// SecurityHeaders replaces the security headers of the config for the
+	// route.
+	SecurityHeaders *SecurityHeadersConfig `yaml:"security_headers"`
+
+	// Collapse replaces the collapsing of the config for the route, the
+	// headers defaulting to DefaultCollapseHeaders.
+	Collapse *CollapseConfig `yaml:"collapse"`
+
+	// Match restricts the route to the requests it matches, on top of
+	// the path prefix.
+	Match *RequestMatch `yaml:"match"`
+}
+
+type route struct {
+	name      string
+	host      string
+	prefix    string
+	upstreams *upstreamPool
+	limiter   *rateLimiter
+	fault     *FaultConfig
+	match     *RequestMatch
+	rewrite   *PathRewrite
+	acl       *acl
+	timeouts  *RouteTimeouts
+	security  *securityHeaders
+	collapse  *CollapseConfig
+}
+
+type routeTable struct {
+	routes []*route
+}
+
+func newRouteTable(configs []RouteConfig, weights map[string]int) *routeTable {
+	t := &routeTable{}
+
+	for _, rc := range configs {
+		rt := &route{
+			name:      rc.Name,
+			host:      strings.ToLower(rc.Host),
+			prefix:    strings.TrimSuffix(rc.Path, "*"),
+			upstreams: newUpstreamPool(rc.Upstreams, rc.Balance, weights),
+			fault:     rc.Fault,
+			match:     rc.Match,
+			rewrite:   rc.Rewrite,
+			timeouts:  rc.Timeouts,
+		}
+
+		if rt.prefix == "" {
+			rt.prefix = "/"
+		}
+
+		if rc.ACL != nil {
+			// The access lists were checked by validate.
+			rt.acl, _ = newACL(*rc.ACL)
+		}
+
+		if rc.RateLimit != nil && rc.RateLimit.Rate > 0 {
+			rt.limiter = newRateLimiter(*rc.RateLimit)
+		}
+
+		if rc.SecurityHeaders != nil {
+			rt.security = newSecurityHeaders(*rc.SecurityHeaders)
+		}
+
+		if rc.Collapse != nil {
+			collapse := *rc.Collapse
+			if len(collapse.Headers) == 0 {
+				collapse.Headers = DefaultCollapseHeaders
+			}
+
+			rt.collapse = &collapse
+		}
+
+		t.routes = append(t.routes, rt)
+	}
+
+	// The routes of a host win over those of a wildcard host, and those over
+	// the routes of any host. Then the longest prefix wins, and then the
+	// routes with a match over those without one.
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		if t.routes[i].hostRank() != t.routes[j].hostRank() {
+			return t.routes[i].hostRank() > t.routes[j].hostRank()
+		}
+
+		if len(t.routes[i].prefix) != len(t.routes[j].prefix) {
+			return len(t.routes[i].prefix) > len(t.routes[j].prefix)
+		}
+
+		return t.routes[i].match != nil && t.routes[j].match == nil
+	})
+
+	return t
+}
+
+// displayName is the name of the route, or its host and path if it has
+// none.
+func (rt *route) displayName() string {
+	if rt.name != "" {
+		return rt.name
+	}
+
+	return rt.host + rt.prefix + "*"
+}
+
+func (rt *route) hostRank() int {
+	switch {
+	case rt.host == "":
+		return 0
+	case strings.HasPrefix(rt.host, "*."):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// matchesHost tells if r is for the host of the route, any one if it has
+// none.
+func (rt *route) matchesHost(r *http.Request) bool {
+	if rt.host == "" {
+		return true
+	}
+
+	host := requestHost(r)
+
+	if strings.HasPrefix(rt.host, "*.") {
+		return strings.HasSuffix(host, rt.host[1:])
+	}
+
+	return host == rt.host
+}
+
+// requestHost is the host r is for, without the port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// byName finds a route by its name or host and path, with or without a
+// trailing *.
+func (t *routeTable) byName(name string) *route {
+	for _, rt := range t.routes {
+		if rt.hasName(name) {
+			return rt
+		}
+	}
+
+	return nil
+}
+
+func (rt *route) hasName(name string) bool {
+	return rt.name == name || rt.host+rt.prefix == strings.TrimSuffix(name, "*")
+}
+
+func (t *routeTable) hasUpstream(addr string) bool {
+	for _, rt := range t.routes {
+		for _, u := range rt.upstreams.list() {
+			if u.addr == addr {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *routeTable) match(r *http.Request) *route {
+	for _, rt := range t.routes {
+		if rt.matchesHost(r) && strings.HasPrefix(r.URL.Path, rt.prefix) && (rt.match == nil || rt.match.matches(r)) {
+			return rt
+		}
+	}
+
+	return nil
+}
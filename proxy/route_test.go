@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		match  RequestMatch
+		method string
+		target string
+		header http.Header
+		want   bool
+	}{
+		{name: "empty matches everything", target: "/anything", want: true},
+		{name: "method", match: RequestMatch{Methods: []string{"POST", "PUT"}}, method: "PUT", target: "/", want: true},
+		{name: "method case insensitive", match: RequestMatch{Methods: []string{"post"}}, method: "POST", target: "/", want: true},
+		{name: "other method", match: RequestMatch{Methods: []string{"POST"}}, method: "GET", target: "/", want: false},
+
+		{name: "prefix", match: RequestMatch{Path: "/api"}, target: "/api/users", want: true},
+		{name: "prefix with trailing star", match: RequestMatch{Path: "/api/*"}, target: "/api/users/1", want: true},
+		{name: "other prefix", match: RequestMatch{Path: "/api/*"}, target: "/apix", want: false},
+		{name: "glob", match: RequestMatch{Path: "/users/*/orders"}, target: "/users/42/orders", want: true},
+		{name: "glob is not a prefix", match: RequestMatch{Path: "/users/*/orders"}, target: "/users/42/orders/7", want: false},
+		{name: "glob star stops at slashes", match: RequestMatch{Path: "/users/*/orders"}, target: "/users/1/2/orders", want: false},
+		{name: "glob with trailing star", match: RequestMatch{Path: "/users/?/*"}, target: "/users/1/orders", want: true},
+
+		{name: "regex", match: RequestMatch{PathRegex: `^/v[0-9]+/`}, target: "/v2/items", want: true},
+		{name: "regex mismatch", match: RequestMatch{PathRegex: `^/v[0-9]+/`}, target: "/vx/items", want: false},
+		{name: "regex and path both apply", match: RequestMatch{Path: "/api/*", PathRegex: `/items$`}, target: "/v2/items", want: false},
+
+		{name: "header present", match: RequestMatch{Headers: map[string]string{"X-Debug": ""}}, target: "/", header: http.Header{"X-Debug": {"0"}}, want: true},
+		{name: "header absent", match: RequestMatch{Headers: map[string]string{"X-Debug": ""}}, target: "/", want: false},
+		{name: "header value", match: RequestMatch{Headers: map[string]string{"X-Tenant": "b"}}, target: "/", header: http.Header{"X-Tenant": {"a", "b"}}, want: true},
+		{name: "other header value", match: RequestMatch{Headers: map[string]string{"X-Tenant": "b"}}, target: "/", header: http.Header{"X-Tenant": {"a"}}, want: false},
+		{name: "header name case insensitive", match: RequestMatch{Headers: map[string]string{"x-tenant": "a"}}, target: "/", header: http.Header{"X-Tenant": {"a"}}, want: true},
+
+		{name: "query present", match: RequestMatch{Query: map[string]string{"debug": ""}}, target: "/?debug", want: true},
+		{name: "query value", match: RequestMatch{Query: map[string]string{"v": "2"}}, target: "/?v=1&v=2", want: true},
+		{name: "other query value", match: RequestMatch{Query: map[string]string{"v": "2"}}, target: "/?v=1", want: false},
+
+		{
+			name:   "all conditions",
+			match:  RequestMatch{Methods: []string{"POST"}, Path: "/api/*", Headers: map[string]string{"X-Tenant": "a"}, Query: map[string]string{"dry": "1"}},
+			method: "POST",
+			target: "/api/orders?dry=1",
+			header: http.Header{"X-Tenant": {"a"}},
+			want:   true,
+		},
+		{
+			name:   "all conditions but one",
+			match:  RequestMatch{Methods: []string{"POST"}, Path: "/api/*", Headers: map[string]string{"X-Tenant": "a"}, Query: map[string]string{"dry": "1"}},
+			method: "POST",
+			target: "/api/orders?dry=0",
+			header: http.Header{"X-Tenant": {"a"}},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match := tt.match
+			if err := match.compile(); err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, tt.target, nil)
+			for name, values := range tt.header {
+				for _, value := range values {
+					r.Header.Add(name, value)
+				}
+			}
+
+			if got := match.matches(r); got != tt.want {
+				t.Errorf("matches(%s %s) = %v, want %v", method, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestMatchCompileErrors(t *testing.T) {
+	for _, match := range []RequestMatch{
+		{Path: "api/*"},
+		{Path: "/users/[/orders"},
+		{PathRegex: "("},
+	} {
+		if err := match.compile(); err == nil {
+			t.Errorf("compile(%+v) succeeded, want an error", match)
+		}
+	}
+}
+
+func TestRouteTablePrecedence(t *testing.T) {
+	post := &RequestMatch{Methods: []string{"POST"}}
+	if err := post.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := []RouteConfig{
+		{Name: "default", Path: "/"},
+		{Name: "api", Path: "/api/*"},
+		{Name: "api-v1", Path: "/api/v1/*"},
+		{Name: "api-v1-post", Path: "/api/v1/*", Match: post},
+		{Name: "wildcard-host", Host: "*.example.com", Path: "/api/*"},
+		{Name: "host", Host: "shop.example.com"},
+		{Name: "host-users", Host: "shop.example.com", Path: "/users/*"},
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		path   string
+		want   string
+	}{
+		{name: "host over wildcard host and longer prefix", host: "shop.example.com", path: "/api/v1/x", want: "host"},
+		{name: "longest prefix of the host", host: "shop.example.com", path: "/users/1", want: "host-users"},
+		{name: "host with a port", host: "shop.example.com:8443", path: "/users/1", want: "host-users"},
+		{name: "wildcard host over longer prefix", host: "a.example.com", path: "/api/v1/x", want: "wildcard-host"},
+		{name: "wildcard host needs its prefix", host: "a.example.com", path: "/other", want: "default"},
+		{name: "longest prefix", host: "other.test", path: "/api/v1/x", want: "api-v1"},
+		{name: "match over no match with the same prefix", method: "POST", host: "other.test", path: "/api/v1/x", want: "api-v1-post"},
+		{name: "shorter prefix", host: "other.test", path: "/api/v2", want: "api"},
+		{name: "fallback", host: "other.test", path: "/", want: "default"},
+	}
+
+	// The order of the routes in the config doesn't matter.
+	reversed := make([]RouteConfig, len(configs))
+	for i, rc := range configs {
+		reversed[len(configs)-1-i] = rc
+	}
+
+	for order, configs := range map[string][]RouteConfig{"in order": configs, "reversed": reversed} {
+		table := newRouteTable(configs, nil)
+
+		for _, tt := range tests {
+			t.Run(order+"/"+tt.name, func(t *testing.T) {
+				method := tt.method
+				if method == "" {
+					method = http.MethodGet
+				}
+
+				r := httptest.NewRequest(method, tt.path, nil)
+				r.Host = tt.host
+
+				rt := table.match(r)
+				if rt == nil {
+					t.Fatalf("no route for %s %s%s, want %s", method, tt.host, tt.path, tt.want)
+				}
+
+				if rt.name != tt.want {
+					t.Errorf("route for %s %s%s = %s, want %s", method, tt.host, tt.path, rt.name, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var errScriptFailed = errors.New("script failed")
+
+// scriptCheckInterval is how often the scripts are checked for changes.
+const scriptCheckInterval = time.Second
+
+// scripts are the Lua scripts of Config.Scripts, which filter the
+// exchanges in the proxy itself like the addons of mitmproxy: a script
+// defines the functions request(flow) and response(flow) it needs, which
+// are called with the exchange and change it in place. A script is
+// reloaded when its file changes, a script that no longer loads keeping
+// the last version that did.
+type scripts []*script
+
+// script is a loaded script. A Lua state can't be shared, so the calls to
+// a script are serialized.
+type script struct {
+	path string
+
+	mu      sync.Mutex
+	state   *lua.LState
+	modTime time.Time
+	checked time.Time
+}
+
+func loadScripts(paths []string) (scripts, error) {
+	var loaded scripts
+
+	for _, path := range paths {
+		s := &script{path: path}
+
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+
+		loaded = append(loaded, s)
+	}
+
+	return loaded, nil
+}
+
+// load (re)loads the script from its file. It's called with s.mu held
+// once the script is shared.
+func (s *script) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("can't load the script %s: %w", s.path, err)
+	}
+
+	state := newScriptState(s.path)
+
+	if err := state.DoFile(s.path); err != nil {
+		state.Close()
+
+		return fmt.Errorf("can't load the script %s: %w", s.path, err)
+	}
+
+	if s.state != nil {
+		s.state.Close()
+	}
+
+	s.state, s.modTime, s.checked = state, info.ModTime(), time.Now()
+
+	return nil
+}
+
+// newScriptState is a Lua state with the libraries that don't reach the
+// system, and log(message), which logs for the script.
+func newScriptState(path string) *lua.LState {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		state.Push(state.NewFunction(open))
+		state.Push(lua.LString(name))
+		state.Call(1, 0)
+	}
+
+	for _, unsafe := range []string{"dofile", "loadfile"} {
+		state.SetGlobal(unsafe, lua.LNil)
+	}
+
+	state.SetGlobal("log", state.NewFunction(func(l *lua.LState) int {
+		log.Printf("Script %s: %s", path, l.CheckString(1))
+
+		return 0
+	}))
+
+	return state
+}
+
+// reloadIfChanged reloads the script if its file changed since it was
+// loaded, checking at most every scriptCheckInterval.
+func (s *script) reloadIfChanged() {
+	if time.Since(s.checked) < scriptCheckInterval {
+		return
+	}
+
+	s.checked = time.Now()
+
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+
+	if err := s.load(); err != nil {
+		s.modTime = info.ModTime()
+		log.Printf("Keeping the last version of the script %s: %v", s.path, err)
+
+		return
+	}
+
+	log.Printf("Reloaded the script %s", s.path)
+}
+
+// call calls the function of the script named fn with flow, if the script
+// defines it.
+func (s *script) call(r *http.Request, fn string, flow *lua.LTable) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloadIfChanged()
+
+	f := s.state.GetGlobal(fn)
+	if f.Type() != lua.LTFunction {
+		return nil
+	}
+
+	s.state.SetContext(r.Context())
+	defer s.state.RemoveContext()
+
+	if err := s.state.CallByParam(lua.P{Fn: f, Protect: true}, flow); err != nil {
+		return fmt.Errorf("%w: %s: %v", errScriptFailed, s.path, err)
+	}
+
+	return nil
+}
+
+// newScriptFlow is the flow table the script functions get: the id, route
+// and upstream of the exchange, and its request.
+func newScriptFlow(ex *exchange, req *http.Request, body []byte) *lua.LTable {
+	flow := &lua.LTable{}
+	flow.RawSetString("id", lua.LNumber(ex.id))
+	flow.RawSetString("request_id", lua.LString(ex.requestID))
+	flow.RawSetString("route", lua.LString(ex.route.displayName()))
+	flow.RawSetString("upstream", lua.LString(ex.upstream))
+
+	request := &lua.LTable{}
+	request.RawSetString("method", lua.LString(req.Method))
+	request.RawSetString("url", lua.LString(req.URL.String()))
+	request.RawSetString("headers", newScriptHeaders(req.Header))
+	request.RawSetString("body", lua.LString(body))
+	flow.RawSetString("request", request)
+
+	return flow
+}
+
+func newScriptResponse(res *http.Response, body []byte) *lua.LTable {
+	response := &lua.LTable{}
+	response.RawSetString("status", lua.LNumber(res.StatusCode))
+	response.RawSetString("headers", newScriptHeaders(res.Header))
+	response.RawSetString("body", lua.LString(body))
+
+	return response
+}
+
+// newScriptHeaders are the headers as a table of names to values, a
+// header with several values having a list of them.
+func newScriptHeaders(header http.Header) *lua.LTable {
+	headers := &lua.LTable{}
+
+	for name, values := range header {
+		if len(values) == 1 {
+			headers.RawSetString(name, lua.LString(values[0]))
+
+			continue
+		}
+
+		list := &lua.LTable{}
+		for _, value := range values {
+			list.Append(lua.LString(value))
+		}
+
+		headers.RawSetString(name, list)
+	}
+
+	return headers
+}
+
+// scriptMessage is a request or response table as the script left it, as
+// a processor message.
+func scriptMessage(value lua.LValue) (*processorMessage, error) {
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("the message is a %s, not a table", value.Type())
+	}
+
+	m := &processorMessage{}
+
+	m.Method = lua.LVAsString(table.RawGetString("method"))
+	m.URL = lua.LVAsString(table.RawGetString("url"))
+
+	if status := table.RawGetString("status"); status != lua.LNil {
+		n, ok := status.(lua.LNumber)
+		if !ok {
+			return nil, fmt.Errorf("invalid status %s", status)
+		}
+
+		m.Status = int(n)
+	}
+
+	if body := table.RawGetString("body"); body != lua.LNil {
+		text := lua.LVAsString(body)
+		m.Body = &text
+	}
+
+	headers, ok := table.RawGetString("headers").(*lua.LTable)
+	if !ok {
+		return m, nil
+	}
+
+	var err error
+
+	m.Header = http.Header{}
+	headers.ForEach(func(name, value lua.LValue) {
+		switch value := value.(type) {
+		case lua.LString, lua.LNumber:
+			m.Header.Add(lua.LVAsString(name), lua.LVAsString(value))
+		case *lua.LTable:
+			value.ForEach(func(_, v lua.LValue) {
+				m.Header.Add(lua.LVAsString(name), lua.LVAsString(v))
+			})
+		default:
+			err = fmt.Errorf("invalid value of the header %s", name)
+		}
+	})
+
+	return m, err
+}
+
+// request runs the request through the scripts, returning it as it must
+// be forwarded, or the response a script gave instead.
+func (s scripts) request(ex *exchange, req *http.Request, body []byte) (*http.Request, []byte, *processorAnswer, error) {
+	for _, script := range s {
+		flow := newScriptFlow(ex, req, body)
+
+		if err := script.call(ex.inbound, "request", flow); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if response := flow.RawGetString("response"); response != lua.LNil {
+			m, err := scriptMessage(response)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%w: %s: %v", errScriptFailed, script.path, err)
+			}
+
+			answer, err := newProcessorAnswer(ex.inbound, m)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%w: %s: %v", errScriptFailed, script.path, err)
+			}
+
+			return req, body, answer, nil
+		}
+
+		m, err := scriptMessage(flow.RawGetString("request"))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %s: %v", errScriptFailed, script.path, err)
+		}
+
+		edit := interceptEdit{Header: m.Header, Body: m.Body}
+
+		if m.Method != req.Method {
+			edit.Method = m.Method
+		}
+
+		if m.URL != req.URL.String() {
+			edit.URL = m.URL
+		}
+
+		if req, body, err = edit.apply(req, body); err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %s: %v", errScriptFailed, script.path, err)
+		}
+	}
+
+	return req, body, nil, nil
+}
+
+// response runs the response through the scripts, returning its body as
+// it must be written.
+func (s scripts) response(ex *exchange, res *http.Response, body []byte) ([]byte, error) {
+	req := res.Request
+	if req == nil {
+		req = ex.inbound
+	}
+
+	for _, script := range s {
+		flow := newScriptFlow(ex, req, ex.reqBody)
+		flow.RawSetString("response", newScriptResponse(res, body))
+
+		if err := script.call(ex.inbound, "response", flow); err != nil {
+			return nil, err
+		}
+
+		m, err := scriptMessage(flow.RawGetString("response"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errScriptFailed, script.path, err)
+		}
+
+		if m.Status != 0 && m.Status != res.StatusCode {
+			if m.Status < 100 || m.Status > 999 {
+				return nil, fmt.Errorf("%w: %s: invalid status %d", errScriptFailed, script.path, m.Status)
+			}
+
+			res.StatusCode, res.Status = m.Status, fmt.Sprintf("%d %s", m.Status, http.StatusText(m.Status))
+		}
+
+		if m.Header != nil {
+			res.Header = m.Header
+		}
+
+		if m.Body != nil {
+			body = []byte(*m.Body)
+		}
+
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	return body, nil
+}
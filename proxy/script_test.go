@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScripts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("X-Upstream-Saw", r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Script")+" "+string(body))
+		w.Header().Set("Server", "upstream")
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		script     string
+		path       string
+		wantStatus int
+		wantHeader map[string]string
+		wantBody   string
+	}{
+		{
+			name:       "no functions",
+			script:     `x = 1`,
+			path:       "/a",
+			wantStatus: http.StatusOK,
+			wantHeader: map[string]string{"X-Upstream-Saw": "POST /a  ping", "Server": "upstream"},
+			wantBody:   "hello",
+		},
+		{
+			name: "request edited",
+			script: `function request(flow)
+				flow.request.method = "PUT"
+				flow.request.url = string.gsub(flow.request.url, "/a", "/b")
+				flow.request.headers["X-Script"] = flow.route
+				flow.request.body = string.upper(flow.request.body)
+			end`,
+			path:       "/a",
+			wantStatus: http.StatusOK,
+			wantHeader: map[string]string{"X-Upstream-Saw": "PUT /b /* PING"},
+			wantBody:   "hello",
+		},
+		{
+			name: "answered",
+			script: `function request(flow)
+				flow.response = {status = 403, headers = {["Content-Type"] = "text/plain"}, body = "no " .. flow.request.method}
+			end`,
+			path:       "/a",
+			wantStatus: http.StatusForbidden,
+			wantHeader: map[string]string{"Content-Type": "text/plain", "X-Upstream-Saw": ""},
+			wantBody:   "no POST",
+		},
+		{
+			name: "response edited",
+			script: `function response(flow)
+				flow.response.status = 201
+				flow.response.headers["Server"] = nil
+				flow.response.headers["X-Values"] = {"a", "b"}
+				flow.response.body = flow.response.body .. " " .. flow.request.body
+			end`,
+			path:       "/a",
+			wantStatus: http.StatusCreated,
+			wantHeader: map[string]string{"Server": "", "X-Values": "a"},
+			wantBody:   "hello ping",
+		},
+		{
+			name:       "failing",
+			script:     `function request(flow) error("boom") end`,
+			path:       "/a",
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "script.lua")
+			if err := os.WriteFile(path, []byte(tt.script), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := DefaultConfig()
+			cfg.Upstreams = []string{upstream.URL}
+			cfg.Scripts = []string{path}
+
+			handler := newTestProxy(t, cfg).Handler()
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("POST", tt.path, strings.NewReader("ping")))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			for name, want := range tt.wantHeader {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestScriptsReloaded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "script.lua")
+	write := func(script string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version := func(n string) string {
+		return `function response(flow) flow.response.headers["X-Version"] = "` + n + `" end`
+	}
+
+	write(version("1"), time.Now().Add(-time.Hour))
+
+	cfg := DefaultConfig()
+	cfg.Upstreams = []string{upstream.URL}
+	cfg.Scripts = []string{path}
+
+	p := newTestProxy(t, cfg)
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		return w.Header().Get("X-Version")
+	}
+
+	if got := get(); got != "1" {
+		t.Fatalf("X-Version = %q, want 1", got)
+	}
+
+	for _, tt := range []struct {
+		script string
+		want   string
+	}{
+		{script: version("2"), want: "2"},
+		{script: "function response(flow", want: "2"},
+		{script: version("3"), want: "3"},
+	} {
+		write(tt.script, time.Now().Add(-time.Minute))
+		p.cfg.scripts[0].checked = time.Time{}
+
+		if got := get(); got != tt.want {
+			t.Errorf("X-Version after writing %q = %q, want %q", tt.script, got, tt.want)
+		}
+	}
+}
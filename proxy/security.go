@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// securityPresets are the security headers of the presets, which the
+// upstreams can override.
+var securityPresets = map[string]map[string]string{
+	"basic": {
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "SAMEORIGIN",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
+	},
+	"strict": {
+		"X-Content-Type-Options":     "nosniff",
+		"X-Frame-Options":            "DENY",
+		"Referrer-Policy":            "no-referrer",
+		"Strict-Transport-Security":  "max-age=63072000; includeSubDomains",
+		"Content-Security-Policy":    "default-src 'self'; frame-ancestors 'none'",
+		"Cross-Origin-Opener-Policy": "same-origin",
+		"Permissions-Policy":         "camera=(), microphone=(), geolocation=()",
+	},
+}
+
+// SecurityHeadersConfig adds security headers to the responses: those of
+// Preset (basic, strict or none) when the upstream didn't set them, and
+// CSP as the Content-Security-Policy and Headers in place of the
+// upstream's, an empty value removing the header.
+type SecurityHeadersConfig struct {
+	Preset  string            `yaml:"preset"`
+	CSP     string            `yaml:"csp"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (c SecurityHeadersConfig) validate() error {
+	if _, ok := securityPresets[c.Preset]; !ok && c.Preset != "" && c.Preset != "none" {
+		return fmt.Errorf("invalid security headers preset %q, which must be basic, strict or none", c.Preset)
+	}
+
+	return nil
+}
+
+// securityHeaders are the headers of a SecurityHeadersConfig, by whether
+// they replace those of the upstream.
+type securityHeaders struct {
+	defaults  map[string]string
+	overrides map[string]string
+}
+
+func newSecurityHeaders(cfg SecurityHeadersConfig) *securityHeaders {
+	h := &securityHeaders{defaults: securityPresets[cfg.Preset], overrides: make(map[string]string)}
+
+	if cfg.CSP != "" {
+		h.overrides["Content-Security-Policy"] = cfg.CSP
+	}
+
+	for name, value := range cfg.Headers {
+		h.overrides[http.CanonicalHeaderKey(name)] = value
+	}
+
+	return h
+}
+
+func (h *securityHeaders) empty() bool {
+	return len(h.defaults) == 0 && len(h.overrides) == 0
+}
+
+func (h *securityHeaders) apply(header http.Header) {
+	for name, value := range h.defaults {
+		if _, ok := h.overrides[name]; !ok && header.Get(name) == "" {
+			header.Set(name, value)
+		}
+	}
+
+	for name, value := range h.overrides {
+		if value == "" {
+			header.Del(name)
+		} else {
+			header.Set(name, value)
+		}
+	}
+}
+
+// securityHeadersWriter adds the security headers to the response.
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	headers     *securityHeaders
+	wroteHeader bool
+}
+
+func (sw *securityHeadersWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		sw.headers.apply(sw.Header())
+	}
+
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *securityHeadersWriter) Write(p []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *securityHeadersWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	_ = http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *securityHeadersWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a number of bytes that can be written with a KB, MB or GB
+// suffix in flags and config files.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	factor := int64(1)
+
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			factor = unit.factor
+
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional KB, MB or GB suffix", value)
+	}
+
+	return ByteSize(n * factor), nil
+}
+
+func (s *ByteSize) String() string {
+	for _, unit := range byteSizeUnits {
+		if *s != 0 && int64(*s)%unit.factor == 0 {
+			return strconv.FormatInt(int64(*s)/unit.factor, 10) + unit.suffix
+		}
+	}
+
+	return "0"
+}
+
+func (s *ByteSize) Set(value string) error {
+	size, err := ParseByteSize(value)
+	if err != nil {
+		return err
+	}
+
+	*s = size
+
+	return nil
+}
+
+func (s *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	return s.Set(node.Value)
+}
+
+// Bandwidth is a number of bits per second that can be written with a
+// kbps, mbps or gbps suffix in flags and config files.
+type Bandwidth int64
+
+var bandwidthUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"gbps", 1e9},
+	{"mbps", 1e6},
+	{"kbps", 1e3},
+	{"bps", 1},
+}
+
+func ParseBandwidth(value string) (Bandwidth, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	factor := int64(1)
+
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			factor = unit.factor
+
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected a number with an optional kbps, mbps or gbps suffix", value)
+	}
+
+	return Bandwidth(n * factor), nil
+}
+
+// bytesPerSecond returns the bandwidth in bytes per second, at least 1.
+func (b Bandwidth) bytesPerSecond() int64 {
+	if b < 8 {
+		return 1
+	}
+
+	return int64(b) / 8
+}
+
+func (b *Bandwidth) String() string {
+	for _, unit := range bandwidthUnits {
+		if *b != 0 && int64(*b)%unit.factor == 0 {
+			return strconv.FormatInt(int64(*b)/unit.factor, 10) + unit.suffix
+		}
+	}
+
+	return "0"
+}
+
+func (b *Bandwidth) Set(value string) error {
+	bandwidth, err := ParseBandwidth(value)
+	if err != nil {
+		return err
+	}
+
+	*b = bandwidth
+
+	return nil
+}
+
+func (b *Bandwidth) UnmarshalYAML(node *yaml.Node) error {
+	return b.Set(node.Value)
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+const stickyCookieName = "go_proxy_upstream"
+
+// pickUpstream picks the upstream of the pool for r, keeping each client on
+// the same one when sticky sessions are enabled.
+func (p *Proxy) pickUpstream(pool *upstreamPool, r *http.Request) string {
+	if len(pool.list()) < 2 {
+		return pool.pick()
+	}
+
+	switch p.cfg.Sticky {
+	case "ip":
+		return pool.pickByKey(clientIP(r))
+	case "cookie":
+		if cookie, err := r.Cookie(stickyCookieName); err == nil {
+			if addr, ok := pool.byID(cookie.Value); ok {
+				return addr
+			}
+		}
+	}
+
+	return pool.pick()
+}
+
+// setStickyCookie tells the client which upstream to come back to, unless
+// it already knows.
+func (p *Proxy) setStickyCookie(w http.ResponseWriter, ex *exchange) {
+	if p.cfg.Sticky != "cookie" || len(ex.route.upstreams.list()) < 2 {
+		return
+	}
+
+	id := upstreamID(ex.upstream)
+
+	if cookie, err := ex.inbound.Cookie(stickyCookieName); err == nil && cookie.Value == id {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: stickyCookieName, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// upstreamID identifies an upstream in the sticky cookie without revealing
+// its address.
+func upstreamID(addr string) string {
+	return fmt.Sprintf("%08x", hashKey(addr))
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return h.Sum32()
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type prefixBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	limit int
+	total int
+}
+
+func newPrefixBuffer(limit int) *prefixBuffer {
+	return &prefixBuffer{limit: limit}
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.total += len(p)
+
+	if b.limit <= 0 {
+		b.buf.Write(p)
+	} else if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (b *prefixBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func (b *prefixBuffer) omitted() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.total - b.buf.Len()
+}
+
+func (p *Proxy) streamExchange(w http.ResponseWriter, r *http.Request, ex *exchange) {
+	reqTimestamp := time.Now()
+	reqPrefix := newPrefixBuffer(int(p.cfg.Log.MaxBody))
+
+	var reqBody io.Reader = http.NoBody
+	if r.ContentLength != 0 {
+		reqBody = io.TeeReader(r.Body, reqPrefix)
+	}
+
+	req, err := p.newForwardRequest(r, ex, reqBody)
+	if err != nil {
+		p.writeProxyError(w, ex, http.StatusBadRequest, err)
+
+		return
+	}
+
+	req.ContentLength = r.ContentLength
+
+	p.cfg.Hooks.beforeForward(ex, req)
+
+	res, err := p.do(req, ex)
+	if err != nil {
+		p.writeUpstreamError(w, ex, err)
+
+		return
+	}
+	defer res.Body.Close()
+
+	p.cfg.Hooks.response(ex, res)
+
+	reqMsg := ex.withGraphQL(newRawHTTPRequest(req, reqPrefix.Bytes()))
+	reqMsg.Omitted = reqPrefix.omitted()
+
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: reqTimestamp, Upstream: ex.upstream, Route: ex.route.name, Message: reqMsg})
+
+	p.streamResponse(w, res, ex)
+}
+
+// streamResponse copies the response to the client as it arrives, flushing
+// every chunk.
+func (p *Proxy) streamResponse(w http.ResponseWriter, res *http.Response, ex *exchange) {
+	copyHeader(w.Header(), res.Header)
+	ex.rewrites.headers.applyResponse(ex.inbound, w.Header())
+	announced := announceTrailers(w.Header(), res.Trailer)
+
+	w.WriteHeader(res.StatusCode)
+
+	resPrefix := newPrefixBuffer(int(p.cfg.Log.MaxBody))
+
+	_, err := io.Copy(newFlushWriter(w), io.TeeReader(res.Body, resPrefix))
+	if clientCanceled(ex, err) {
+		log.Printf("Client canceled request #%d while streaming from %s", ex.id, ex.upstream)
+	} else if err != nil {
+		log.Printf("Streaming response from %s: %v", ex.upstream, err)
+	}
+
+	copyTrailers(w.Header(), res.Trailer, announced)
+
+	resMsg := newRawHTTPResponse(res, resPrefix.Bytes())
+	resMsg.Omitted = resPrefix.omitted()
+
+	now := time.Now()
+	p.log(LogEntry{ID: ex.id, RequestID: ex.requestID, Timestamp: now, Elapsed: now.Sub(ex.started), Upstream: ex.upstream, Route: ex.route.name, Message: resMsg, Timings: ex.trace.timings(now)})
+}
+
+// isEventStream tells if res is a stream of server-sent events, which must
+// reach the client as they come even when not streaming.
+func isEventStream(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
+	return mediaType == "text/event-stream"
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+type flushWriter struct {
+	w          io.Writer
+	controller *http.ResponseController
+}
+
+func newFlushWriter(w http.ResponseWriter) io.Writer {
+	return &flushWriter{w: w, controller: http.NewResponseController(w)}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if n > 0 {
+		_ = fw.controller.Flush()
+	}
+
+	return n, err
+}
+
+func announceTrailers(header http.Header, trailer http.Header) int {
+	for k := range trailer {
+		header.Add("Trailer", k)
+	}
+
+	return len(trailer)
+}
+
+func copyTrailers(header http.Header, trailer http.Header, announced int) {
+	// Trailers the server added while sending the body weren't announced, so
+	// they need the prefix to be sent at all.
+	if len(trailer) != announced {
+		for k, vv := range trailer {
+			for _, v := range vv {
+				header.Add(http.TrailerPrefix+k, v)
+			}
+		}
+
+		return
+	}
+
+	copyHeader(header, trailer)
+}
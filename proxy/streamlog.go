@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamLogs writes the connections of the tcp mode and the sessions of
+// the udp one to a file per upstream.
+type streamLogs struct {
+	cfg LogConfig
+
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+func newStreamLogs(cfg LogConfig) *streamLogs {
+	return &streamLogs{cfg: cfg, files: make(map[string]*os.File)}
+}
+
+func (l *streamLogs) printf(upstream string, id uint64, format string, args ...interface{}) {
+	l.write(upstream, fmt.Sprintf("==> #%d %s %s\n", id, l.cfg.formatTime(time.Now()), fmt.Sprintf(format, args...)))
+}
+
+// dump logs a hex dump of data, going the way of direction.
+func (l *streamLogs) dump(upstream string, id uint64, direction string, data []byte) {
+	l.printf(upstream, id, "%s %d bytes\n%s", direction, len(data), hex.Dump(data))
+}
+
+func (l *streamLogs) write(upstream, text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, ok := l.files[upstream]
+	if !ok {
+		fileName := strings.NewReplacer(":", ".", "/", "_").Replace(upstream)
+
+		var err error
+
+		if file, err = openLogFile(l.cfg.Dir, fileName); err != nil {
+			log.Printf("Can't open the log file %s, its entries are dropped: %v", fileName, err)
+		}
+
+		l.files[upstream] = file
+	}
+
+	if file != nil {
+		_, _ = file.WriteString(text)
+	}
+}
+
+func (l *streamLogs) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, file := range l.files {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+// streamDumpWriter logs a hex dump of the data going one way, > being from
+// the client and < from the upstream.
+type streamDumpWriter struct {
+	logs      *streamLogs
+	upstream  string
+	id        uint64
+	direction string
+}
+
+func (w *streamDumpWriter) Write(data []byte) (int, error) {
+	w.logs.dump(w.upstream, w.id, w.direction, data)
+
+	return len(data), nil
+}
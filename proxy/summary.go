@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// CaptureSummary are the figures of a group of recorded exchanges: the
+// latency percentiles, the share of 5xx responses and the requests a
+// second over the time they span.
+type CaptureSummary struct {
+	Group      string  `json:"group"`
+	Requests   int     `json:"requests"`
+	ErrorRate  float64 `json:"error_rate"`
+	Throughput float64 `json:"requests_per_second"`
+	P50        float64 `json:"p50_ms"`
+	P95        float64 `json:"p95_ms"`
+	P99        float64 `json:"p99_ms"`
+	Max        float64 `json:"max_ms"`
+
+	durations   []time.Duration
+	errors      int
+	first, last time.Time
+}
+
+// SummarizeCaptures writes the figures of the exchanges of the record file
+// that match q to w, grouped by route, upstream or path (the method and
+// path), and for all of them, as a table or, with the json format, as a
+// JSON array. It returns how many exchanges matched.
+func SummarizeCaptures(fileName string, q CaptureQuery, by, format string, w io.Writer) (int, error) {
+	if by != "route" && by != "upstream" && by != "path" {
+		return 0, fmt.Errorf("invalid grouping %q, which must be route, upstream or path", by)
+	}
+
+	if format != "table" && format != "json" {
+		return 0, fmt.Errorf("invalid format %q, which must be table or json", format)
+	}
+
+	groups := make(map[string]*CaptureSummary)
+	total := &CaptureSummary{Group: "all"}
+
+	matched, err := readCaptures(fileName, q, func(_ int, exchange *recordedExchange, _ []byte) error {
+		var name string
+
+		switch by {
+		case "route":
+			name = exchange.Route
+		case "upstream":
+			name = exchange.Upstream
+		case "path":
+			name = exchange.Request.Method + " " + exchange.Request.Path
+		}
+
+		if name == "" {
+			name = "-"
+		}
+
+		group, ok := groups[name]
+		if !ok {
+			group = &CaptureSummary{Group: name}
+			groups[name] = group
+		}
+
+		group.add(exchange)
+		total.add(exchange)
+
+		return nil
+	})
+	if err != nil {
+		return matched, err
+	}
+
+	summaries := make([]*CaptureSummary, 0, len(groups)+1)
+	for _, group := range groups {
+		summaries = append(summaries, group.compute())
+	}
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Group < summaries[j].Group })
+
+	if matched > 0 {
+		summaries = append(summaries, total.compute())
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return matched, encoder.Encode(summaries)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "%s\tREQUESTS\tERRORS\tREQ/S\tP50\tP95\tP99\tMAX\n", map[string]string{"route": "ROUTE", "upstream": "UPSTREAM", "path": "PATH"}[by])
+
+	for _, s := range summaries {
+		fmt.Fprintf(table, "%s\t%d\t%.1f%%\t%.2f\t%s\t%s\t%s\t%s\n", s.Group, s.Requests, 100*s.ErrorRate, s.Throughput,
+			millisDuration(s.P50), millisDuration(s.P95), millisDuration(s.P99), millisDuration(s.Max))
+	}
+
+	return matched, table.Flush()
+}
+
+func (s *CaptureSummary) add(exchange *recordedExchange) {
+	s.Requests++
+	s.durations = append(s.durations, exchange.duration())
+
+	if exchange.Response.Status >= 500 {
+		s.errors++
+	}
+
+	start := exchange.Timestamp.Add(-exchange.duration())
+	if s.first.IsZero() || start.Before(s.first) {
+		s.first = start
+	}
+
+	if exchange.Timestamp.After(s.last) {
+		s.last = exchange.Timestamp
+	}
+}
+
+func (s *CaptureSummary) compute() *CaptureSummary {
+	sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+
+	s.ErrorRate = float64(s.errors) / float64(s.Requests)
+	s.P50 = durationMillis(percentile(s.durations, 50))
+	s.P95 = durationMillis(percentile(s.durations, 95))
+	s.P99 = durationMillis(percentile(s.durations, 99))
+	s.Max = durationMillis(s.durations[len(s.durations)-1])
+
+	if elapsed := s.last.Sub(s.first); elapsed > 0 {
+		s.Throughput = float64(s.Requests) / elapsed.Seconds()
+	}
+
+	return s
+}
+
+// percentile is the nearest-rank percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+func millisDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Microsecond)
+}
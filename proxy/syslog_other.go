@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package proxy
+
+import "errors"
+
+func newSyslogLogSink(LogSinkConfig, LogConfig) (logSink, error) {
+	return nil, errors.New("syslog isn't available on this system")
+}
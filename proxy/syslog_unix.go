@@ -0,0 +1,71 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"bytes"
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+// syslogLogSink sends every entry to syslog as a single message, the
+// errors with the err severity and the others with info.
+type syslogLogSink struct {
+	writer *syslog.Writer
+	buf    bytes.Buffer
+	sink   logSink
+}
+
+func newSyslogLogSink(c LogSinkConfig, cfg LogConfig) (logSink, error) {
+	var network, addr string
+
+	if c.Address != "" {
+		u, err := url.Parse(c.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		network, addr = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "go-proxy")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &syslogLogSink{writer: writer}
+
+	if c.Format == "raw" {
+		s.sink = newRawLogSink(nopWriteCloser{&s.buf}, cfg)
+	} else {
+		s.sink = newJSONLogSink(nopWriteCloser{&s.buf}, cfg)
+	}
+
+	return s, nil
+}
+
+func (s *syslogLogSink) write(entry LogEntry, req *LogEntry) {
+	// The sinks buffer their output, which is sent as a message per entry.
+	s.sink.write(entry, req)
+	s.sink.flush()
+
+	if s.buf.Len() == 0 {
+		return
+	}
+
+	msg := strings.TrimRight(s.buf.String(), "\n")
+	s.buf.Reset()
+
+	if entry.Err != nil {
+		_ = s.writer.Err(msg)
+	} else {
+		_ = s.writer.Info(msg)
+	}
+}
+
+func (s *syslogLogSink) flush() {}
+
+func (s *syslogLogSink) close() {
+	_ = s.writer.Close()
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TailOptions tell Tail which admin API to follow: its base URL, like
+// http://localhost:8090, and its token, if any. Filter is an expression
+// like status >= 500 && path ~ "/api" selecting the exchanges, and History
+// the number of latest ones printed first.
+type TailOptions struct {
+	Admin   string
+	Token   string
+	Filter  string
+	History int
+}
+
+// Tail prints a line per exchange of the proxy whose admin API is at
+// opts.Admin as they complete, until the proxy stops or the connection is
+// lost.
+func Tail(opts TailOptions, w io.Writer) error {
+	// The filter is checked here for a clearer error than that of the API.
+	if _, err := compileFilter(opts.Filter); err != nil {
+		return err
+	}
+
+	query := "?filter=" + url.QueryEscape(opts.Filter)
+	base := strings.TrimSuffix(opts.Admin, "/")
+
+	if opts.History > 0 {
+		res, err := tailRequest(base+"/exchanges"+query, opts.Token)
+		if err != nil {
+			return err
+		}
+
+		var summaries []exchangeSummary
+
+		err = json.NewDecoder(res.Body).Decode(&summaries)
+		res.Body.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if len(summaries) > opts.History {
+			summaries = summaries[len(summaries)-opts.History:]
+		}
+
+		for i := range summaries {
+			printTailLine(w, &summaries[i])
+		}
+	}
+
+	res, err := tailRequest(base+"/events"+query, opts.Token)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, 1<<20)
+
+	// Only the completed exchanges are printed, not the remove events of
+	// those that stopped matching.
+	event := ""
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "":
+			var summary exchangeSummary
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &summary); err != nil || summary.Pending {
+				continue
+			}
+
+			printTailLine(w, &summary)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return io.ErrUnexpectedEOF
+}
+
+func tailRequest(target, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		res.Body.Close()
+
+		if res.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s isn't served, the proxy may run with -admin-history 0", target)
+		}
+
+		if text := strings.TrimSpace(string(body)); text != "" && text != http.StatusText(res.StatusCode) {
+			return nil, fmt.Errorf("%s: %s", res.Status, text)
+		}
+
+		return nil, errors.New(res.Status)
+	}
+
+	return res, nil
+}
+
+func printTailLine(w io.Writer, ex *exchangeSummary) {
+	at := ex.Time
+	if t, err := time.Parse(time.RFC3339Nano, ex.Time); err == nil {
+		at = t.Local().Format("15:04:05")
+	}
+
+	elapsed := formatElapsed(time.Duration(ex.Duration * float64(time.Millisecond)))
+
+	if ex.Error != "" {
+		fmt.Fprintf(w, "%s #%d %-7s %s ERR %s %s\n", at, ex.ID, ex.Method, ex.Path, elapsed, ex.Error)
+
+		return
+	}
+
+	fmt.Fprintf(w, "%s #%d %-7s %s %d %s %s\n", at, ex.ID, ex.Method, ex.Path, ex.Status, elapsed, formatSize(ex.Size))
+}
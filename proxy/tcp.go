@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func validateMode(mode string) error {
+	switch mode {
+	case "", "http", "tcp", "udp":
+		return nil
+	default:
+		return fmt.Errorf("invalid mode %q, which must be http, tcp or udp", mode)
+	}
+}
+
+// validateStream checks the settings used by the tcp and udp modes, whose
+// upstreams are of type host:port.
+func (c *Config) validateStream() error {
+	if len(c.Upstreams) == 0 {
+		return errors.New("at least one server address must be given")
+	}
+
+	for _, upstream := range c.Upstreams {
+		_, port, err := net.SplitHostPort(upstream)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+
+		if err != nil {
+			return fmt.Errorf("the address %s must be of type host:port in the %s mode", upstream, c.Mode)
+		}
+	}
+
+	for _, addr := range c.Listen {
+		if err := validateListenAddr(addr); err != nil {
+			return err
+		}
+
+		if c.Mode == "udp" && isUnixUpstream(addr) {
+			return fmt.Errorf("the udp mode can't listen on %s", addr)
+		}
+	}
+
+	if err := validateListenFamily(c.ListenFamily); err != nil {
+		return err
+	}
+
+	if err := c.Timeouts.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Log.compileTime(); err != nil {
+		return err
+	}
+
+	if err := validateProxyProtocolVersion(c.UpstreamProxyProtocol); err != nil {
+		return err
+	}
+
+	if _, err := c.proxyProtocolSources(); err != nil {
+		return err
+	}
+
+	if c.Mode == "udp" && (c.ProxyProtocol || c.UpstreamProxyProtocol != "") {
+		return errors.New("the PROXY protocol isn't spoken in the udp mode")
+	}
+
+	return c.DNS.compile()
+}
+
+type clientAddrKey struct{}
+
+// TCPProxy forwards raw TCP streams to the upstreams, taken in turn, for
+// the protocols other than HTTP like those of the databases. It logs every
+// connection with the bytes sent each way to a file per upstream in the
+// log directory, along with a hex dump of them with Log.HexDump.
+type TCPProxy struct {
+	next   atomic.Uint64
+	lastID atomic.Uint64
+
+	cfg    *Config
+	dialer *upstreamDialer
+	logs   *streamLogs
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewTCP(cfg Config) (*TCPProxy, error) {
+	if err := cfg.validateStream(); err != nil {
+		return nil, err
+	}
+
+	p := &TCPProxy{
+		cfg:    &cfg,
+		dialer: newDialer(&cfg),
+		logs:   newStreamLogs(cfg.Log),
+		conns:  make(map[net.Conn]struct{}),
+	}
+
+	p.dialer.proxyProtocol = cfg.UpstreamProxyProtocol
+
+	return p, nil
+}
+
+// ListenAndServe forwards the connections to the proxy until Shutdown,
+// after which it returns net.ErrClosed.
+func (p *TCPProxy) ListenAndServe() error {
+	listeners, err := p.cfg.listen()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.listeners = listeners
+	p.mu.Unlock()
+
+	on := fmt.Sprintf("port %d", p.cfg.Port)
+	if len(p.cfg.Listen) > 0 {
+		on = strings.Join(p.cfg.Listen, ", ")
+	}
+
+	log.Printf("Starting TCP proxy on %s to %s\n\n", on, strings.Join(p.cfg.Upstreams, ", "))
+
+	return serveListeners(listeners, p.serve)
+}
+
+func (p *TCPProxy) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		if !p.track(conn) {
+			_ = conn.Close()
+
+			return net.ErrClosed
+		}
+
+		go func() {
+			defer p.untrack(conn)
+
+			p.forward(conn)
+		}()
+	}
+}
+
+func (p *TCPProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	p.conns[conn] = struct{}{}
+	p.wg.Add(1)
+
+	return true
+}
+
+func (p *TCPProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+
+	p.wg.Done()
+}
+
+// Shutdown stops accepting connections and waits for the open ones to be
+// closed until ctx is done, closing them then.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	closeListeners(p.listeners)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+
+		p.mu.Lock()
+		for conn := range p.conns {
+			_ = conn.Close()
+		}
+		p.mu.Unlock()
+
+		<-done
+	}
+
+	p.logs.close()
+
+	return err
+}
+
+func (p *TCPProxy) upstream() string {
+	n := p.next.Add(1)
+
+	return p.cfg.Upstreams[(n-1)%uint64(len(p.cfg.Upstreams))]
+}
+
+// forward relays conn to an upstream until both sides are done.
+func (p *TCPProxy) forward(conn net.Conn) {
+	defer conn.Close()
+
+	id := p.lastID.Add(1)
+	upstream := p.upstream()
+	started := time.Now()
+
+	ctx := context.WithValue(context.Background(), clientAddrKey{}, conn.RemoteAddr())
+
+	up, err := p.dialer.DialContext(ctx, "tcp", upstream)
+	if err != nil {
+		log.Printf("Can't connect %s to %s: %v", conn.RemoteAddr(), upstream, err)
+		p.logs.printf(upstream, id, "Error: can't connect %s: %v", conn.RemoteAddr(), err)
+
+		return
+	}
+
+	defer up.Close()
+
+	p.logs.printf(upstream, id, "Connected %s to %s", conn.RemoteAddr(), upstream)
+
+	var received int64
+
+	done := make(chan struct{})
+
+	go func() {
+		received = p.relay(upstream, id, "<", conn, up)
+		close(done)
+	}()
+
+	sent := p.relay(upstream, id, ">", up, conn)
+
+	<-done
+
+	p.logs.printf(upstream, id, "Closed after %s, %d bytes sent and %d bytes received", time.Since(started).Round(time.Millisecond), sent, received)
+}
+
+// relay copies src to dst, dumping the data if enabled, and then closes
+// dst for writing. It returns the bytes copied.
+func (p *TCPProxy) relay(upstream string, id uint64, direction string, dst, src net.Conn) int64 {
+	var reader io.Reader = src
+	if p.cfg.Log.HexDump {
+		reader = io.TeeReader(src, &streamDumpWriter{logs: p.logs, upstream: upstream, id: id, direction: direction})
+	}
+
+	n, _ := io.Copy(dst, reader)
+
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+
+	return n
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// ThrottleConfig limits the bandwidth of each exchange, Up for the request
+// body and Down for the response body, to simulate slow networks. 0 means
+// no limit.
+type ThrottleConfig struct {
+	Down Bandwidth `yaml:"down"`
+	Up   Bandwidth `yaml:"up"`
+}
+
+// throttle paces the bytes going through it to a rate, in chunks of a
+// tenth of a second worth of bytes.
+type throttle struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func newThrottle(bandwidth Bandwidth) *throttle {
+	return &throttle{rate: bandwidth.bytesPerSecond(), start: time.Now()}
+}
+
+func (t *throttle) chunk() int {
+	if t.rate < 10 {
+		return 1
+	}
+
+	return int(t.rate / 10)
+}
+
+// wait blocks until n more bytes can go through.
+func (t *throttle) wait(n int) {
+	t.sent += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.sent) / float64(t.rate) * float64(time.Second)))
+	if delay := time.Until(due); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	throttle *throttle
+}
+
+func newThrottledWriter(w http.ResponseWriter, bandwidth Bandwidth) *throttledWriter {
+	return &throttledWriter{ResponseWriter: w, throttle: newThrottle(bandwidth)}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > tw.throttle.chunk() {
+			chunk = chunk[:tw.throttle.chunk()]
+		}
+
+		tw.throttle.wait(len(chunk))
+
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		tw.Flush()
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	_ = http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	throttle *throttle
+}
+
+func newThrottledReader(body io.ReadCloser, bandwidth Bandwidth) *throttledReader {
+	return &throttledReader{ReadCloser: body, throttle: newThrottle(bandwidth)}
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > tr.throttle.chunk() {
+		p = p[:tr.throttle.chunk()]
+	}
+
+	n, err := tr.ReadCloser.Read(p)
+	tr.throttle.wait(n)
+
+	return n, err
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings are the phases of the request to the upstream: resolving its
+// name, connecting to it and the TLS handshake, which only happen on new
+// connections, then sending the request, waiting for the first byte of the
+// response and receiving the rest of it.
+type Timings struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	Send    time.Duration
+	Wait    time.Duration
+	Receive time.Duration
+}
+
+// upstreamTrace records the phases of the last attempt of an exchange, the
+// events of the previous ones being ignored.
+type upstreamTrace struct {
+	mu      sync.Mutex
+	attempt int
+	events  traceEvents
+}
+
+type traceEvents struct {
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn, wroteRequest     time.Time
+	firstByte                 time.Time
+}
+
+// trace gives req a context recording the phases of a new attempt.
+func (t *upstreamTrace) trace(req *http.Request) *http.Request {
+	if t == nil {
+		return req
+	}
+
+	t.mu.Lock()
+	t.attempt++
+	t.events = traceEvents{}
+	attempt, e := t.attempt, &t.events
+	t.mu.Unlock()
+
+	// The starts keep their first time and the ends their last one, as
+	// several addresses may be tried.
+	mark := func(at *time.Time, first bool) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.attempt == attempt && (!first || at.IsZero()) {
+			*at = time.Now()
+		}
+	}
+
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&e.dnsStart, true) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&e.dnsDone, false) },
+		ConnectStart:         func(string, string) { mark(&e.connectStart, true) },
+		ConnectDone:          func(string, string, error) { mark(&e.connectDone, false) },
+		TLSHandshakeStart:    func() { mark(&e.tlsStart, true) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { mark(&e.tlsDone, false) },
+		GotConn:              func(httptrace.GotConnInfo) { mark(&e.gotConn, false) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&e.wroteRequest, false) },
+		GotFirstResponseByte: func() { mark(&e.firstByte, true) },
+	})
+
+	return req.WithContext(ctx)
+}
+
+// timings returns the phases of the last attempt, the response having been
+// received at finished, or nil if none was traced.
+func (t *upstreamTrace) timings(finished time.Time) *Timings {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.events
+	if e.dnsStart.IsZero() && e.connectStart.IsZero() && e.gotConn.IsZero() {
+		return nil
+	}
+
+	return &Timings{
+		DNS:     between(e.dnsStart, e.dnsDone),
+		Connect: between(e.connectStart, e.connectDone),
+		TLS:     between(e.tlsStart, e.tlsDone),
+		Send:    between(e.gotConn, e.wroteRequest),
+		Wait:    between(e.wroteRequest, e.firstByte),
+		Receive: between(e.firstByte, finished),
+	}
+}
+
+// between is the time from start to end, 0 unless both happened in that
+// order.
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.Before(start) {
+		return 0
+	}
+
+	return end.Sub(start)
+}
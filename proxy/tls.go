@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+)
+
+// certReloader serves the certificates of files, picking the one for the
+// server name the client asks for (SNI), or else the first one.
+type certReloader struct {
+	files []TLSCertificate
+
+	mu    sync.RWMutex
+	certs []tls.Certificate
+}
+
+func newCertReloader(files []TLSCertificate) (*certReloader, error) {
+	reloader := &certReloader{files: files}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (c *certReloader) reload() error {
+	certs := make([]tls.Certificate, len(c.files))
+
+	for i, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Cert, err)
+		}
+
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("%s: %w", f.Cert, err)
+		}
+
+		certs[i] = cert
+	}
+
+	c.mu.Lock()
+	c.certs = certs
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for i := range c.certs {
+			if c.certs[i].Leaf.VerifyHostname(hello.ServerName) == nil {
+				return &c.certs[i], nil
+			}
+		}
+	}
+
+	return &c.certs[0], nil
+}
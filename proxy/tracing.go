@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxSpanBatch       = 512
+	spanExportInterval = 5 * time.Second
+	spanKindServer     = 2
+	spanStatusError    = 2
+)
+
+// TracingConfig exports a span for every exchange to an OpenTelemetry
+// collector at Endpoint, like http://localhost:4318, with OTLP over HTTP.
+// The W3C traceparent of the requests is continued, and passed on to the
+// upstreams with the proxy's span as the parent.
+type TracingConfig struct {
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+}
+
+func (tc TracingConfig) validate() error {
+	if tc.Endpoint == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(tc.Endpoint, "http://") && !strings.HasPrefix(tc.Endpoint, "https://") {
+		return errors.New("the tracing endpoint must be an http or https URL")
+	}
+
+	return nil
+}
+
+type span struct {
+	traceID  string
+	spanID   string
+	parentID string
+	sampled  bool
+	name     string
+	start    time.Time
+	attrs    []otlpAttribute
+}
+
+// traceparent is the header passing the span on to the upstream.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+
+	return "00-" + s.traceID + "-" + s.spanID + "-" + flags
+}
+
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mu    sync.Mutex
+	spans []otlpSpan
+	flush chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newTracer(cfg TracingConfig) *tracer {
+	service := cfg.ServiceName
+	if service == "" {
+		service = "go-proxy"
+	}
+
+	t := &tracer{
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// start opens the span of the exchange, continuing the trace of the
+// request if it has a valid traceparent.
+func (t *tracer) start(ex *exchange) *span {
+	r := ex.inbound
+	s := &span{traceID: randomHex(16), spanID: randomHex(8), sampled: true, start: time.Now()}
+
+	if traceID, parentID, flags, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, flags&1 == 1
+	}
+
+	host := ex.upstream
+	if ex.route != forwardProxyRoute {
+		host = ex.route.displayName()
+	}
+
+	s.name = r.Method + " " + host
+	s.attrs = []otlpAttribute{
+		stringAttribute("http.request.method", r.Method),
+		stringAttribute("url.path", r.URL.Path),
+		stringAttribute("client.address", clientIP(r)),
+		stringAttribute("server.address", ex.upstream),
+		intAttribute("go_proxy.exchange_id", int64(ex.id)),
+	}
+
+	if ex.route.name != "" {
+		s.attrs = append(s.attrs, stringAttribute("http.route", ex.route.name))
+	}
+
+	return s
+}
+
+// finish closes the span with the status answered to the client, queuing
+// it for export if it's sampled.
+func (t *tracer) finish(s *span, status int) {
+	if !s.sampled {
+		return
+	}
+
+	otlp := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              spanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+
+	if status != 0 {
+		otlp.Attributes = append(otlp.Attributes, intAttribute("http.response.status_code", int64(status)))
+	}
+
+	if status >= 500 {
+		otlp.Status = &otlpStatus{Code: spanStatusError, Message: http.StatusText(status)}
+	}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, otlp)
+	full := len(t.spans) >= maxSpanBatch
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		case <-t.stop:
+			t.export()
+
+			return
+		}
+
+		t.export()
+	}
+}
+
+func (t *tracer) export() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "go-proxy"}, Spans: spans}},
+	}}})
+	if err != nil {
+		log.Printf("Can't encode the trace spans: %v", err)
+
+		return
+	}
+
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Can't export %d trace spans: %v", len(spans), err)
+
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		log.Printf("Can't export %d trace spans: the collector answered %s", len(spans), res.Status)
+	}
+}
+
+// close exports the remaining spans.
+func (t *tracer) close() {
+	close(t.stop)
+	<-t.done
+}
+
+func parseTraceparent(value string) (traceID, parentID string, flags byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", 0, false
+	}
+
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", 0, false
+	}
+
+	flagBytes, err := hex.DecodeString(parts[3])
+	if err != nil || !isLowerHex(parts[1]) || !isLowerHex(parts[2]) {
+		return "", "", 0, false
+	}
+
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", 0, false
+	}
+
+	return parts[1], parts[2], flagBytes[0], true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// statusWriter remembers the status of the response, for the trace span.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficStore keeps the latest exchanges in memory for the web UI, and
+// notifies the UI of every one that completes.
+type trafficStore struct {
+	limit  int
+	decode bool
+
+	mu          sync.Mutex
+	exchanges   map[uint64]*capturedExchange
+	order       []uint64
+	subscribers map[chan exchangeSummary]struct{}
+}
+
+type capturedExchange struct {
+	id       uint64
+	route    string
+	upstream string
+	request  *LogEntry
+	response *LogEntry
+}
+
+type exchangeSummary struct {
+	ID       uint64  `json:"id"`
+	Time     string  `json:"time"`
+	Route    string  `json:"route,omitempty"`
+	Upstream string  `json:"upstream,omitempty"`
+	Method   string  `json:"method"`
+	Path     string  `json:"path"`
+	Status   int     `json:"status,omitempty"`
+	Duration float64 `json:"duration_ms,omitempty"`
+	Size     int     `json:"size"`
+	Error    string  `json:"error,omitempty"`
+	Pending  bool    `json:"pending,omitempty"`
+}
+
+type exchangeDetail struct {
+	exchangeSummary
+	Request  *messageView `json:"request,omitempty"`
+	Response *messageView `json:"response,omitempty"`
+}
+
+type messageView struct {
+	URL          string      `json:"url,omitempty"`
+	Proto        string      `json:"proto"`
+	Status       string      `json:"status,omitempty"`
+	Header       http.Header `json:"headers"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	Omitted      int         `json:"body_omitted,omitempty"`
+	Truncated    bool        `json:"body_truncated,omitempty"`
+	Trailer      http.Header `json:"trailers,omitempty"`
+}
+
+func newTrafficStore(limit int, decode bool) *trafficStore {
+	return &trafficStore{
+		limit:       limit,
+		decode:      decode,
+		exchanges:   make(map[uint64]*capturedExchange),
+		subscribers: make(map[chan exchangeSummary]struct{}),
+	}
+}
+
+func (t *trafficStore) add(entry LogEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ex, ok := t.exchanges[entry.ID]
+	if !ok {
+		ex = &capturedExchange{id: entry.ID, route: entry.Route, upstream: entry.Upstream}
+		t.exchanges[entry.ID] = ex
+		t.order = append(t.order, entry.ID)
+
+		if len(t.order) > t.limit {
+			delete(t.exchanges, t.order[0])
+			t.order = t.order[1:]
+		}
+	}
+
+	if entry.Err == nil && entry.Message.IsRequest {
+		ex.request = &entry
+	} else {
+		ex.response = &entry
+	}
+
+	summary := ex.summary()
+
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- summary:
+		default:
+		}
+	}
+}
+
+func (t *trafficStore) list(filter exchangeFilter) []exchangeSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summaries := make([]exchangeSummary, 0, len(t.order))
+
+	for _, id := range t.order {
+		if summary := t.exchanges[id].summary(); filter(&summary) {
+			summaries = append(summaries, summary)
+		}
+	}
+
+	return summaries
+}
+
+func (t *trafficStore) get(id uint64) (exchangeDetail, bool) {
+	t.mu.Lock()
+	ex, ok := t.exchanges[id]
+	if !ok {
+		t.mu.Unlock()
+
+		return exchangeDetail{}, false
+	}
+
+	detail := exchangeDetail{exchangeSummary: ex.summary()}
+	request, response := ex.request, ex.response
+	t.mu.Unlock()
+
+	if request != nil {
+		detail.Request = t.messageView(request.Message)
+	}
+
+	if response != nil && response.Err == nil {
+		detail.Response = t.messageView(response.Message)
+	}
+
+	return detail, true
+}
+
+func (t *trafficStore) messageView(msg *Message) *messageView {
+	if t.decode {
+		msg = decodedMessage(msg)
+	}
+
+	body, encoding := harBody(msg.Body)
+
+	return &messageView{
+		URL:          msg.URL,
+		Proto:        msg.Proto,
+		Status:       msg.Status,
+		Header:       msg.Header,
+		Body:         body,
+		BodyEncoding: encoding,
+		Omitted:      msg.Omitted,
+		Truncated:    msg.Truncated,
+		Trailer:      msg.Trailer,
+	}
+}
+
+func (t *trafficStore) subscribe() chan exchangeSummary {
+	subscriber := make(chan exchangeSummary, 64)
+
+	t.mu.Lock()
+	t.subscribers[subscriber] = struct{}{}
+	t.mu.Unlock()
+
+	return subscriber
+}
+
+func (t *trafficStore) unsubscribe(subscriber chan exchangeSummary) {
+	t.mu.Lock()
+	delete(t.subscribers, subscriber)
+	t.mu.Unlock()
+}
+
+func (ex *capturedExchange) summary() exchangeSummary {
+	summary := exchangeSummary{ID: ex.id, Route: ex.route, Upstream: ex.upstream, Pending: ex.response == nil}
+
+	if ex.request != nil {
+		summary.Time = ex.request.Timestamp.UTC().Format(time.RFC3339Nano)
+		summary.Method = ex.request.Message.Method
+		summary.Path = ex.request.Message.Path
+	}
+
+	if ex.response == nil {
+		return summary
+	}
+
+	if ex.request != nil {
+		summary.Duration = durationMillis(ex.response.elapsed(*ex.request))
+	}
+
+	if ex.response.Err != nil {
+		summary.Error = ex.response.Err.Error()
+	} else {
+		summary.Status = ex.response.Message.StatusCode
+		summary.Size = ex.response.Message.BodySize()
+	}
+
+	return summary
+}
+
+func (t *trafficStore) serveExchanges(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/exchanges"), "/")
+	if idStr == "" {
+		filter, err := compileFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, t.list(filter))
+
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	detail, ok := t.get(id)
+	if !ok {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+func (t *trafficStore) serveEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := compileFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	subscriber := t.subscribe()
+	defer t.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	// The exchanges sent while pending that no longer match once completed
+	// are removed with a remove event, as their rows would stay pending.
+	pending := map[uint64]bool{}
+
+	for {
+		select {
+		case summary := <-subscriber:
+			event := ""
+
+			if !filter(&summary) {
+				if !pending[summary.ID] {
+					continue
+				}
+
+				event = "event: remove\n"
+			}
+
+			if summary.Pending {
+				pending[summary.ID] = true
+			} else {
+				delete(pending, summary.ID)
+			}
+
+			data, err := json.Marshal(summary)
+			if err != nil {
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "%sdata: %s\n\n", event, data); err != nil {
+				return
+			}
+
+			_ = controller.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
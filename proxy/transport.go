@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/http2"
+)
+
+func newTransport(cfg *Config, stats *connStats) (http.RoundTripper, error) {
+	dialer := newDialer(cfg)
+	dialer.stats = stats
+	dialer.proxyProtocol = cfg.UpstreamProxyProtocol
+
+	tlsConfig, err := cfg.UpstreamTLS.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = upstreamProxyFunc(cfg)
+	transport.TLSHandshakeTimeout = cfg.Timeouts.TLSHandshake
+	transport.IdleConnTimeout = cfg.Timeouts.IdleConn
+	transport.MaxIdleConns = cfg.Connections.MaxIdle
+	transport.MaxIdleConnsPerHost = cfg.Connections.MaxIdlePerHost
+	transport.MaxConnsPerHost = cfg.Connections.MaxPerHost
+	// The connections carrying the PROXY protocol header of a client can't
+	// be reused for the others.
+	transport.DisableKeepAlives = cfg.Connections.KeepAlive < 0 || cfg.UpstreamProxyProtocol != ""
+	transport.TLSClientConfig = tlsConfig
+
+	var next http.RoundTripper = transport
+
+	if http3Supported {
+		next = &http3Transport{next: transport, http3: newHTTP3RoundTripper(tlsConfig)}
+	}
+
+	if !cfg.H2C {
+		return &connStatsTransport{next: next, stats: stats}, nil
+	}
+
+	h2cTransport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		IdleConnTimeout: cfg.Timeouts.IdleConn,
+	}
+
+	return &connStatsTransport{next: &schemeTransport{http: h2cTransport, https: next}, stats: stats}, nil
+}
+
+func (c UpstreamTLSConfig) clientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the upstream CA bundle: %w", err)
+		}
+
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in the upstream CA bundle")
+		}
+
+		tlsConfig.RootCAs = roots
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the upstream client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// schemeTransport speaks h2c to the http:// upstreams, which a regular
+// http.Transport can only reach with HTTP/1.1.
+type schemeTransport struct {
+	http  http.RoundTripper
+	https http.RoundTripper
+}
+
+func (t *schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.http.RoundTrip(req)
+	}
+
+	return t.https.RoundTrip(req)
+}
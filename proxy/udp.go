@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 64 << 10
+
+var errUDPSessionLimit = errors.New("too many UDP sessions")
+
+// listenUDPFamilies are the UDP networks of the ListenFamily values.
+var listenUDPFamilies = map[string]string{
+	"":     "udp",
+	"dual": "udp",
+	"ipv4": "udp4",
+	"ipv6": "udp6",
+}
+
+// UDPProxy relays the UDP datagrams to the upstreams, for DNS or game
+// traffic. Each client address gets a session with an upstream, taken in
+// turn, whose replies are sent back to it; the sessions expire after
+// Timeouts.UDPIdle without datagrams either way, and there are at most
+// Limits.UDPSessions. The sessions are logged like the connections of the
+// TCPProxy.
+type UDPProxy struct {
+	cfg    *Config
+	dialer *upstreamDialer
+	logs   *streamLogs
+
+	mu       sync.Mutex
+	conns    []net.PacketConn
+	sessions map[string]*udpSession
+	next     uint64
+	lastID   uint64
+	closed   bool
+	wg       sync.WaitGroup
+
+	// dialing counts the sessions being started, and full is set once the
+	// limit is reached, until a session starts again.
+	dialing int
+	full    bool
+}
+
+// udpSession relays the datagrams of a client from the proxy address
+// they were sent to.
+type udpSession struct {
+	// lastActive is the Unix time in nanoseconds of the last datagram.
+	lastActive    atomic.Int64
+	sent          atomic.Uint64
+	sentBytes     atomic.Uint64
+	received      atomic.Uint64
+	receivedBytes atomic.Uint64
+
+	key      string
+	id       uint64
+	client   net.Addr
+	ln       net.PacketConn
+	upstream string
+	conn     net.Conn
+	started  time.Time
+}
+
+func NewUDP(cfg Config) (*UDPProxy, error) {
+	if err := cfg.validateStream(); err != nil {
+		return nil, err
+	}
+
+	return &UDPProxy{
+		cfg:      &cfg,
+		dialer:   newDialer(&cfg),
+		logs:     newStreamLogs(cfg.Log),
+		sessions: make(map[string]*udpSession),
+	}, nil
+}
+
+// ListenAndServe relays the datagrams sent to the proxy until Shutdown,
+// after which it returns net.ErrClosed.
+func (p *UDPProxy) ListenAndServe() error {
+	for _, addr := range p.cfg.listenAddrs() {
+		conn, err := net.ListenPacket(listenUDPFamilies[p.cfg.ListenFamily], addr)
+		if err != nil {
+			p.closeConns()
+
+			return err
+		}
+
+		p.mu.Lock()
+		p.conns = append(p.conns, conn)
+		p.mu.Unlock()
+	}
+
+	on := fmt.Sprintf("port %d", p.cfg.Port)
+	if len(p.cfg.Listen) > 0 {
+		on = strings.Join(p.cfg.Listen, ", ")
+	}
+
+	log.Printf("Starting UDP proxy on %s to %s\n\n", on, strings.Join(p.cfg.Upstreams, ", "))
+
+	errs := make(chan error, len(p.conns))
+
+	for _, conn := range p.conns {
+		go func(conn net.PacketConn) {
+			errs <- p.serve(conn)
+		}(conn)
+	}
+
+	err := <-errs
+
+	p.closeConns()
+
+	return err
+}
+
+func (p *UDPProxy) closeConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+}
+
+func (p *UDPProxy) serve(ln net.PacketConn) error {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, client, err := ln.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		s, err := p.session(ln, client)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			if errors.Is(err, errUDPSessionLimit) {
+				continue
+			}
+
+			log.Printf("Can't relay the datagrams of %s: %v", client, err)
+
+			continue
+		}
+
+		s.lastActive.Store(time.Now().UnixNano())
+
+		if p.cfg.Log.HexDump {
+			p.logs.dump(s.upstream, s.id, ">", buf[:n])
+		}
+
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			p.logs.printf(s.upstream, s.id, "Error: can't send a datagram: %v", err)
+
+			continue
+		}
+
+		s.sent.Add(1)
+		s.sentBytes.Add(uint64(n))
+	}
+}
+
+// session returns the session of client on ln, starting it if needed. The
+// upstream is dialed without holding p.mu, since resolving its name can
+// take a while. Only the goroutine serving ln starts the sessions of its
+// clients.
+func (p *UDPProxy) session(ln net.PacketConn, client net.Addr) (*udpSession, error) {
+	key := ln.LocalAddr().String() + " " + client.String()
+
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+
+		return nil, net.ErrClosed
+	}
+
+	if s, ok := p.sessions[key]; ok {
+		p.mu.Unlock()
+
+		return s, nil
+	}
+
+	if limit := p.cfg.Limits.UDPSessions; limit > 0 && len(p.sessions)+p.dialing >= limit {
+		if !p.full {
+			p.full = true
+			log.Printf("Reached the limit of %d UDP sessions, dropping the datagrams of the new clients", limit)
+		}
+
+		p.mu.Unlock()
+
+		return nil, errUDPSessionLimit
+	}
+
+	upstream := p.cfg.Upstreams[p.next%uint64(len(p.cfg.Upstreams))]
+	p.next++
+	p.lastID++
+	p.dialing++
+
+	s := &udpSession{key: key, id: p.lastID, client: client, ln: ln, upstream: upstream, started: time.Now()}
+	s.lastActive.Store(s.started.UnixNano())
+
+	p.mu.Unlock()
+
+	conn, err := p.dialer.DialContext(context.Background(), "udp", upstream)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dialing--
+
+	if err != nil {
+		p.logs.printf(upstream, s.id, "Error: can't reach %s from %s: %v", upstream, client, err)
+
+		return nil, err
+	}
+
+	if p.closed {
+		_ = conn.Close()
+
+		return nil, net.ErrClosed
+	}
+
+	s.conn = conn
+	p.sessions[key] = s
+	p.full = false
+	p.wg.Add(1)
+
+	p.logs.printf(upstream, s.id, "Started a session of %s with %s", client, upstream)
+
+	go p.relayReplies(s)
+
+	return s, nil
+}
+
+// relayReplies sends the datagrams of the upstream back to the client
+// until the session expires or the proxy is shut down.
+func (p *UDPProxy) relayReplies(s *udpSession) {
+	defer p.wg.Done()
+
+	buf := make([]byte, maxDatagramSize)
+	idle := p.cfg.Timeouts.UDPIdle
+
+	for {
+		if idle > 0 {
+			_ = s.conn.SetReadDeadline(time.Unix(0, s.lastActive.Load()).Add(idle))
+		}
+
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, s.lastActive.Load())) < idle {
+				// The client sent datagrams since the deadline was set.
+				continue
+			}
+
+			p.endSession(s, err)
+
+			return
+		}
+
+		s.lastActive.Store(time.Now().UnixNano())
+
+		if p.cfg.Log.HexDump {
+			p.logs.dump(s.upstream, s.id, "<", buf[:n])
+		}
+
+		if _, err := s.ln.WriteTo(buf[:n], s.client); err != nil {
+			p.endSession(s, err)
+
+			return
+		}
+
+		s.received.Add(1)
+		s.receivedBytes.Add(uint64(n))
+	}
+}
+
+func (p *UDPProxy) endSession(s *udpSession, err error) {
+	p.mu.Lock()
+	delete(p.sessions, s.key)
+	p.mu.Unlock()
+
+	_ = s.conn.Close()
+
+	reason := "Expired"
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		reason = "Ended"
+	}
+
+	p.logs.printf(s.upstream, s.id, "%s after %s, %d datagrams (%d bytes) sent and %d datagrams (%d bytes) received", reason,
+		time.Since(s.started).Round(time.Millisecond), s.sent.Load(), s.sentBytes.Load(),
+		s.received.Load(), s.receivedBytes.Load())
+}
+
+// Shutdown stops relaying the datagrams and ends the sessions.
+func (p *UDPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+
+	for _, s := range p.sessions {
+		_ = s.conn.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.logs.close()
+
+	return err
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPSessionLimit(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cfg := DefaultConfig()
+	cfg.Mode = "udp"
+	cfg.Upstreams = []string{upstream.LocalAddr().String()}
+	cfg.Limits.UDPSessions = 2
+	cfg.Log.Dir = t.TempDir()
+
+	p, err := NewUDP(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	p.conns = append(p.conns, ln)
+	p.mu.Unlock()
+
+	go func() {
+		_ = p.serve(ln)
+	}()
+
+	defer func() {
+		_ = p.Shutdown(context.Background())
+	}()
+
+	for i, wantReply := range []bool{true, true, false} {
+		client, err := net.Dial("udp", ln.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+
+		buf := make([]byte, 16)
+		n, err := client.Read(buf)
+
+		if gotReply := err == nil && string(buf[:n]) == "ping"; gotReply != wantReply {
+			t.Errorf("client %d got a reply: %v, want %v (%v)", i, gotReply, wantReply, err)
+		}
+	}
+}
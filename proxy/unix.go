@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// unixSocketSuffix ends the hosts standing for the Unix sockets of the
+// unix:// upstreams, which are reached over plain HTTP.
+const unixSocketSuffix = ".unix-socket"
+
+// unixSockets maps the hosts made by forwardBaseURL to their socket path.
+// Only these are dialed, so that the clients of the forward proxy can't
+// reach other sockets by making up such a host.
+var unixSockets sync.Map
+
+// forwardBaseURL returns the URL the requests to upstream are sent to. The
+// unix:///path/to/app.sock upstreams get a host encoding their socket path,
+// so that the transport keeps a separate pool of connections per socket.
+// The h3:// ones are kept as they are, for http3Transport.
+func forwardBaseURL(upstream string) string {
+	if !isUnixUpstream(upstream) {
+		return upstream
+	}
+
+	socket := strings.TrimPrefix(upstream, "unix://")
+	host := hex.EncodeToString([]byte(socket)) + unixSocketSuffix
+
+	unixSockets.Store(host, socket)
+
+	return "http://" + host
+}
+
+// unixSocketPath returns the socket path of a host made by forwardBaseURL.
+func unixSocketPath(host string) (string, bool) {
+	socket, ok := unixSockets.Load(host)
+	if !ok {
+		return "", false
+	}
+
+	return socket.(string), true
+}
+
+func isUnixUpstream(upstream string) bool {
+	return strings.HasPrefix(upstream, "unix://")
+}
@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var balanceStrategies = []string{"round-robin", "weighted", "least-conn", "p2c"}
+
+type upstream struct {
+	active   atomic.Int64
+	requests atomic.Uint64
+
+	addr   string
+	weight int
+	health *upstreamHealth
+
+	// current is the weighted round-robin state, guarded by the pool's
+	// weightedMu.
+	current int
+}
+
+// upstreamPool holds the upstreams of a route. The list is replaced, never
+// modified, when upstreams are added or removed at runtime, so a list
+// returned by list can be used without locking.
+type upstreamPool struct {
+	strategy string
+	weights  map[string]int
+	next     atomic.Uint32
+
+	mu         sync.RWMutex
+	upstreams  []*upstream
+	weightedMu sync.Mutex
+}
+
+type upstreamStats struct {
+	Addr     string `json:"addr"`
+	Weight   int    `json:"weight"`
+	Active   int64  `json:"active"`
+	Requests uint64 `json:"requests"`
+	Healthy  bool   `json:"healthy"`
+}
+
+func newUpstreamPool(addrs []string, strategy string, weights map[string]int) *upstreamPool {
+	p := &upstreamPool{strategy: strategy, weights: weights}
+
+	for _, addr := range addrs {
+		p.upstreams = append(p.upstreams, p.newUpstream(addr))
+	}
+
+	return p
+}
+
+func (p *upstreamPool) newUpstream(addr string) *upstream {
+	u := &upstream{addr: addr, weight: 1}
+	if weight, ok := p.weights[addr]; ok {
+		u.weight = weight
+	}
+
+	return u
+}
+
+func (p *upstreamPool) list() []*upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.upstreams
+}
+
+func (p *upstreamPool) addrs() []string {
+	upstreams := p.list()
+
+	addrs := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		addrs[i] = u.addr
+	}
+
+	return addrs
+}
+
+// add puts a new upstream in rotation, returning false if it's already in
+// the pool.
+func (p *upstreamPool) add(addr string, health *healthChecker) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, u := range p.upstreams {
+		if u.addr == addr {
+			return false
+		}
+	}
+
+	u := p.newUpstream(addr)
+	if health != nil {
+		u.health = health.watch(addr)
+	}
+
+	p.upstreams = append(append([]*upstream(nil), p.upstreams...), u)
+
+	return true
+}
+
+var errLastUpstream = errors.New("the last upstream of a route can't be removed")
+
+// remove takes an upstream out of the pool, returning false if it isn't in
+// it. The requests in flight to it are left to finish.
+func (p *upstreamPool) remove(addr string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upstreams := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.addr != addr {
+			upstreams = append(upstreams, u)
+		}
+	}
+
+	if len(upstreams) == len(p.upstreams) {
+		return false, nil
+	}
+
+	if len(upstreams) == 0 {
+		return false, errLastUpstream
+	}
+
+	p.upstreams = upstreams
+
+	return true, nil
+}
+
+func (p *upstreamPool) watchHealth(health *healthChecker) {
+	for _, u := range p.list() {
+		u.health = health.watch(u.addr)
+	}
+}
+
+func (u *upstream) isHealthy() bool {
+	return u.health == nil || u.health.isHealthy()
+}
+
+// pick returns the next upstream by the pool's strategy, skipping the
+// unhealthy ones unless none is left.
+func (p *upstreamPool) pick() string {
+	upstreams := p.list()
+
+	switch p.strategy {
+	case "weighted":
+		return p.pickWeighted(upstreams).addr
+	case "least-conn":
+		return p.pickLeastConn(upstreams).addr
+	case "p2c":
+		return pickTwoChoices(upstreams).addr
+	}
+
+	n := p.next.Add(1) - 1
+
+	for i := uint32(0); i < uint32(len(upstreams)); i++ {
+		u := upstreams[(n+i)%uint32(len(upstreams))]
+		if u.isHealthy() {
+			return u.addr
+		}
+	}
+
+	return upstreams[n%uint32(len(upstreams))].addr
+}
+
+// pickWeighted is nginx's smooth weighted round-robin, which spreads the
+// picks of the heavier upstreams instead of sending them in bursts.
+func (p *upstreamPool) pickWeighted(upstreams []*upstream) *upstream {
+	p.weightedMu.Lock()
+	defer p.weightedMu.Unlock()
+
+	var best *upstream
+
+	total := 0
+
+	for _, u := range upstreams {
+		if !u.isHealthy() {
+			continue
+		}
+
+		u.current += u.weight
+		total += u.weight
+
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+
+	if best == nil {
+		return upstreams[int(p.next.Add(1)-1)%len(upstreams)]
+	}
+
+	best.current -= total
+
+	return best
+}
+
+func (p *upstreamPool) pickLeastConn(upstreams []*upstream) *upstream {
+	start := int(p.next.Add(1)-1) % len(upstreams)
+
+	var best *upstream
+
+	// Starting at a rotating offset spreads the ties.
+	for i := range upstreams {
+		u := upstreams[(start+i)%len(upstreams)]
+		if !u.isHealthy() {
+			continue
+		}
+
+		if best == nil || u.active.Load() < best.active.Load() {
+			best = u
+		}
+	}
+
+	if best == nil {
+		return upstreams[start]
+	}
+
+	return best
+}
+
+// pickTwoChoices picks two healthy upstreams at random and returns the one
+// with fewer active requests.
+func pickTwoChoices(upstreams []*upstream) *upstream {
+	healthy := make([]*upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return upstreams[rand.Intn(len(upstreams))]
+	}
+
+	a := healthy[rand.Intn(len(healthy))]
+	b := healthy[rand.Intn(len(healthy))]
+
+	if b.active.Load() < a.active.Load() {
+		return b
+	}
+
+	return a
+}
+
+// pickByKey always returns the same upstream for key while it's healthy.
+func (p *upstreamPool) pickByKey(key string) string {
+	upstreams := p.list()
+	n := hashKey(key)
+
+	for i := uint32(0); i < uint32(len(upstreams)); i++ {
+		u := upstreams[(n+i)%uint32(len(upstreams))]
+		if u.isHealthy() {
+			return u.addr
+		}
+	}
+
+	return upstreams[n%uint32(len(upstreams))].addr
+}
+
+// byID returns the healthy upstream with the given upstreamID.
+func (p *upstreamPool) byID(id string) (string, bool) {
+	for _, u := range p.list() {
+		if upstreamID(u.addr) == id && u.isHealthy() {
+			return u.addr, true
+		}
+	}
+
+	return "", false
+}
+
+// acquire counts a request to addr as active until the returned function is
+// called.
+func (p *upstreamPool) acquire(addr string) func() {
+	for _, u := range p.list() {
+		if u.addr != addr {
+			continue
+		}
+
+		u.requests.Add(1)
+		u.active.Add(1)
+
+		return func() { u.active.Add(-1) }
+	}
+
+	return func() {}
+}
+
+func (p *upstreamPool) stats() []upstreamStats {
+	upstreams := p.list()
+	stats := make([]upstreamStats, len(upstreams))
+
+	for i, u := range upstreams {
+		stats[i] = upstreamStats{
+			Addr:     u.addr,
+			Weight:   u.weight,
+			Active:   u.active.Load(),
+			Requests: u.requests.Load(),
+			Healthy:  u.isHealthy(),
+		}
+	}
+
+	return stats
+}
+
+func (p *upstreamPool) hasHealthy() bool {
+	for _, u := range p.list() {
+		if u.isHealthy() {
+			return true
+		}
+	}
+
+	return false
+}
+
+type routeStats struct {
+	Route     string          `json:"route"`
+	Balance   string          `json:"balance"`
+	Upstreams []upstreamStats `json:"upstreams"`
+}
+
+// serveUpstreams reports how the requests of each route were spread over
+// its upstreams.
+func (p *Proxy) serveUpstreams(w http.ResponseWriter, r *http.Request) {
+	table := p.routeTable()
+	routes := make([]routeStats, 0, len(table.routes))
+
+	for _, rt := range table.routes {
+		balance := rt.upstreams.strategy
+		if balance == "" {
+			balance = "round-robin"
+		}
+
+		routes = append(routes, routeStats{Route: rt.displayName(), Balance: balance, Upstreams: rt.upstreams.stats()})
+	}
+
+	writeJSON(w, http.StatusOK, routes)
+}
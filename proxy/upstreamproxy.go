@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+func validateUpstreamProxy(addr string) error {
+	proxyURL, err := url.Parse(addr)
+	if err != nil || proxyURL.Host == "" {
+		return fmt.Errorf("the upstream proxy %s must be a URL of type scheme://host:port", addr)
+	}
+
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5" {
+		return fmt.Errorf("the scheme of the upstream proxy %s must be http, https or socks5", addr)
+	}
+
+	return nil
+}
+
+// upstreamProxyFunc picks the proxy of the requests to the upstreams: the
+// one of cfg, or else those of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables. The Unix sockets are always reached directly.
+func upstreamProxyFunc(cfg *Config) func(*http.Request) (*url.URL, error) {
+	proxyFunc := http.ProxyFromEnvironment
+
+	if cfg.UpstreamProxy != "" {
+		proxyURL, _ := url.Parse(cfg.UpstreamProxy)
+		proxyFunc = http.ProxyURL(proxyURL)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if _, ok := unixSocketPath(req.URL.Hostname()); ok {
+			return nil, nil
+		}
+
+		return proxyFunc(req)
+	}
+}
+
+// dialTunnel connects to addr for a CONNECT tunnel, through the upstream
+// proxy if there's one: with a SOCKS5 handshake, or a CONNECT request of
+// its own to an HTTP proxy.
+func (p *Proxy) dialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := newDialer(p.cfg)
+
+	if p.cfg.UpstreamProxy == "" {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyURL, _ := url.Parse(p.cfg.UpstreamProxy)
+
+	if proxyURL.Scheme == "socks5" {
+		socks, err := netproxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+
+		return socks.(netproxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	return dialHTTPTunnel(ctx, dialer, proxyURL, addr)
+}
+
+func dialHTTPTunnel(ctx context.Context, dialer *upstreamDialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), map[string]string{"http": "80", "https": "443"}[proxyURL.Scheme])
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+
+		return nil, fmt.Errorf("the upstream proxy answered the CONNECT with %s", res.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		conn.Close()
+
+		return nil, errors.New("the upstream proxy sent data before the tunnel was established")
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go-proxy/proxy"
+)
+
+// runQuery searches the exchanges recorded with -record:
+//
+//	go-proxy query -record captures.jsonl -status 5xx -since 1h
+func runQuery(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+
+	recordFile := flags.String("record", "captures.jsonl", "The file recorded with -record to search")
+	format := flags.String("format", "table", "How to show the exchanges: table or jsonl (record lines, which can be replayed with -replay)")
+	query := captureQueryFlags(flags)
+
+	_ = flags.Parse(args)
+
+	matched, err := proxy.QueryCaptures(*recordFile, query(), *format, os.Stdout)
+	if err != nil {
+		log.Fatalf("Can't query %s: %v", *recordFile, err)
+	}
+
+	if *format == "table" {
+		fmt.Fprintf(os.Stderr, "%d exchanges\n", matched)
+	}
+}
+
+// captureQueryFlags defines the filters of the record files in flags,
+// returning the query they make once parsed.
+func captureQueryFlags(flags *flag.FlagSet) func() proxy.CaptureQuery {
+	since := flags.String("since", "", "Only the exchanges after this time, either RFC 3339 like 2024-05-01T12:00:00Z or a duration ago like 1h")
+	until := flags.String("until", "", "Only the exchanges before this time, like -since")
+	method := flags.String("method", "", "Only the requests with this method")
+	urlPath := flags.String("path", "", "Only the requests with this path prefix, like /api, or glob, like /users/*/orders")
+	status := flags.String("status", "", "Only the responses with this status, like 404, or class, like 5xx")
+	minDuration := flags.Duration("min-duration", 0, "Only the exchanges that took at least this long")
+	limit := flags.Int("limit", 0, "The maximum number of exchanges (0 means no limit)")
+
+	minSize := new(proxy.ByteSize)
+
+	flags.Var(minSize, "min-size", "Only the responses with a body of at least this size, like 1MB")
+
+	return func() proxy.CaptureQuery {
+		q := proxy.CaptureQuery{Status: *status, MinDuration: *minDuration, MinSize: *minSize, Limit: *limit}
+		q.Match.Path = *urlPath
+
+		if *method != "" {
+			q.Match.Methods = []string{strings.ToUpper(*method)}
+		}
+
+		var err error
+
+		if q.Since, err = parseQueryTime(*since); err != nil {
+			log.Fatalf("Invalid -since: %v", err)
+		}
+
+		if q.Until, err = parseQueryTime(*until); err != nil {
+			log.Fatalf("Invalid -until: %v", err)
+		}
+
+		return q
+	}
+}
+
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}